@@ -2,11 +2,18 @@ package client
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/tahaontech/crypto_exchange/orderbook"
 	"github.com/tahaontech/crypto_exchange/server"
 )
 
@@ -18,10 +25,19 @@ type PlaceOrderParams struct {
 	// Price only needed for placing LIMIT orders.
 	Price float64
 	Size  float64
+	// Signed is only needed when the exchange settles in escrow.
+	Signed *server.SignedOrder
+	// ClientOrderID optionally names the order. Placing an order again
+	// with the same ClientOrderID, like after a timeout, returns the
+	// order placed first instead of placing another.
+	ClientOrderID string
 }
 
 type Client struct {
 	*http.Client
+	// APIKey and APISecret sign the requests when set.
+	APIKey    string
+	APISecret string
 }
 
 func NewClient() *Client {
@@ -30,9 +46,67 @@ func NewClient() *Client {
 	}
 }
 
-func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
-	e := fmt.Sprintf("%s/trades/%s", Endpoint, market)
-	req, err := http.NewRequest(http.MethodGet, e, nil)
+// NewClientWithKey returns a client signing its requests with the given
+// API key.
+func NewClientWithKey(key, secret string) *Client {
+	return &Client{
+		Client:    http.DefaultClient,
+		APIKey:    key,
+		APISecret: secret,
+	}
+}
+
+// Do signs the request with the API key of the client, if any, and sends
+// it.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if c.APIKey == "" {
+		return c.Client.Do(req)
+	}
+
+	var body []byte
+	if req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		if body, err = io.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.sign(req, body); err != nil {
+		return nil, err
+	}
+	return c.Client.Do(req)
+}
+
+// sign sets the API key headers of the request.
+func (c *Client) sign(req *http.Request, body []byte) error {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+
+	req.Header.Set(server.HeaderAPIKey, c.APIKey)
+	req.Header.Set(server.HeaderAPITimestamp, timestamp)
+	req.Header.Set(server.HeaderAPINonce, nonceHex)
+	req.Header.Set(server.HeaderAPISignature,
+		server.SignRequest(c.APISecret, req.Method, req.URL.RequestURI(), timestamp, nonceHex, body))
+
+	return nil
+}
+
+func (c *Client) RegisterUser(p *server.RegisterUserRequest) (*server.RegisterUserResponse, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Endpoint + "/users"
+	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
@@ -41,13 +115,183 @@ func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := server.APIError{}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+			return nil, fmt.Errorf("registering user: %s", resp.Status)
+		}
+		return nil, fmt.Errorf("registering user: %s", apiErr.Error)
+	}
 
-	trades := []*orderbook.Trade{}
-	if err := json.NewDecoder(resp.Body).Decode(&trades); err != nil {
+	user := &server.RegisterUserResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(user); err != nil {
 		return nil, err
 	}
 
-	return trades, nil
+	return user, nil
+}
+
+// GetTrades returns every trade of q.Market selected by q, oldest first,
+// reading them page by page.
+func (c *Client) GetTrades(q server.TradeQuery) ([]server.Trade, error) {
+	trades := []server.Trade{}
+	for {
+		page, err := c.GetTradesPage(q)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, page.Trades...)
+
+		if page.NextCursor == "" {
+			return trades, nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+// GetTradesPage returns a page of the trades of q.Market.
+func (c *Client) GetTradesPage(q server.TradeQuery) (*server.TradesResponse, error) {
+	e := fmt.Sprintf("%s/trades/%s?%s", Endpoint, q.Market, tradeQueryValues(q, false).Encode())
+	page := &server.TradesResponse{}
+	if err := c.get(e, page); err != nil {
+		return nil, fmt.Errorf("getting trades: %w", err)
+	}
+	return page, nil
+}
+
+// GetFills returns every fill of the user of the client selected by q,
+// oldest first, reading them page by page.
+func (c *Client) GetFills(q server.TradeQuery) ([]server.Fill, error) {
+	fills := []server.Fill{}
+	for {
+		page, err := c.GetFillsPage(q)
+		if err != nil {
+			return nil, err
+		}
+		fills = append(fills, page.Fills...)
+
+		if page.NextCursor == "" {
+			return fills, nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+// GetFillsPage returns a page of the fills of the user of the client.
+func (c *Client) GetFillsPage(q server.TradeQuery) (*server.FillsResponse, error) {
+	e := fmt.Sprintf("%s/fills?%s", Endpoint, tradeQueryValues(q, true).Encode())
+	page := &server.FillsResponse{}
+	if err := c.get(e, page); err != nil {
+		return nil, fmt.Errorf("getting fills: %w", err)
+	}
+	return page, nil
+}
+
+// GetOrder returns the state of an order of the user of the client.
+func (c *Client) GetOrder(id int64) (*server.OrderState, error) {
+	e := fmt.Sprintf("%s/orders/%d", Endpoint, id)
+	order := &server.OrderState{}
+	if err := c.get(e, order); err != nil {
+		return nil, fmt.Errorf("getting order %d: %w", id, err)
+	}
+	return order, nil
+}
+
+// GetClientOrder returns the state of the order of the user of the client
+// named by a client order ID.
+func (c *Client) GetClientOrder(clientOrderID string) (*server.OrderState, error) {
+	e := fmt.Sprintf("%s/orders/client/%s", Endpoint, url.PathEscape(clientOrderID))
+	order := &server.OrderState{}
+	if err := c.get(e, order); err != nil {
+		return nil, fmt.Errorf("getting order %q: %w", clientOrderID, err)
+	}
+	return order, nil
+}
+
+// GetOrderHistoryPage returns a page of the orders of the user of the
+// client.
+func (c *Client) GetOrderHistoryPage(q server.OrderQuery) (*server.OrdersResponse, error) {
+	values := url.Values{}
+	if q.Market != "" {
+		values.Set("market", string(q.Market))
+	}
+	if len(q.Statuses) > 0 {
+		statuses := make([]string, len(q.Statuses))
+		for i, status := range q.Statuses {
+			statuses[i] = string(status)
+		}
+		values.Set("status", strings.Join(statuses, ","))
+	}
+	if q.Cursor != "" {
+		values.Set("cursor", q.Cursor)
+	}
+	if q.Limit != 0 {
+		values.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	e := fmt.Sprintf("%s/orders?%s", Endpoint, values.Encode())
+	page := &server.OrdersResponse{}
+	if err := c.get(e, page); err != nil {
+		return nil, fmt.Errorf("getting order history: %w", err)
+	}
+	return page, nil
+}
+
+// tradeQueryValues returns the query parameters of q, with the market if
+// it is not in the path.
+func tradeQueryValues(q server.TradeQuery, market bool) url.Values {
+	values := url.Values{}
+	if market && q.Market != "" {
+		values.Set("market", string(q.Market))
+	}
+	if q.Cursor != "" {
+		values.Set("cursor", q.Cursor)
+	}
+	if q.From != 0 {
+		values.Set("from", strconv.FormatInt(q.From, 10))
+	}
+	if q.To != 0 {
+		values.Set("to", strconv.FormatInt(q.To, 10))
+	}
+	if q.Limit != 0 {
+		values.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return values
+}
+
+// get decodes the response to a GET request into v, or returns the
+// APIError of the response.
+func (c *Client) get(e string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// checkResponse returns the APIError of a response that failed.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	apiErr := server.APIError{}
+	if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+		return errors.New(resp.Status)
+	}
+	return errors.New(apiErr.Error)
 }
 
 func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
@@ -72,11 +316,13 @@ func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
 
 func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
 	params := &server.PlaceOrderRequest{
-		UserID: p.UserID,
-		Type:   server.MarketOrder,
-		Bid:    p.Bid,
-		Size:   p.Size,
-		Market: server.MarketETH,
+		UserID:        p.UserID,
+		Type:          server.MarketOrder,
+		Bid:           p.Bid,
+		Size:          p.Size,
+		Market:        server.MarketETH,
+		Signed:        p.Signed,
+		ClientOrderID: p.ClientOrderID,
 	}
 
 	body, err := json.Marshal(params)
@@ -143,6 +389,25 @@ func (c *Client) GetBestBid() (*server.Order, error) {
 	return order, err
 }
 
+// GetDepth returns at most levels price levels of each side of a market,
+// grouped by multiples of group when it is not zero.
+func (c *Client) GetDepth(market server.Market, levels int, group float64) (*server.Depth, error) {
+	values := url.Values{}
+	if levels != 0 {
+		values.Set("levels", strconv.Itoa(levels))
+	}
+	if group != 0 {
+		values.Set("group", strconv.FormatFloat(group, 'f', -1, 64))
+	}
+
+	e := fmt.Sprintf("%s/depth/%s?%s", Endpoint, market, values.Encode())
+	depth := &server.Depth{}
+	if err := c.get(e, depth); err != nil {
+		return nil, fmt.Errorf("getting depth: %w", err)
+	}
+	return depth, nil
+}
+
 func (c *Client) CancelOrder(orderID int64) error {
 	e := fmt.Sprintf("%s/order/%d", Endpoint, orderID)
 	req, err := http.NewRequest(http.MethodDelete, e, nil)
@@ -158,18 +423,114 @@ func (c *Client) CancelOrder(orderID int64) error {
 	return nil
 }
 
+// CancelClientOrder cancels the order named by a client order ID.
+func (c *Client) CancelClientOrder(clientOrderID string) error {
+	e := fmt.Sprintf("%s/order/client/%s", Endpoint, url.PathEscape(clientOrderID))
+	req, err := http.NewRequest(http.MethodDelete, e, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkResponse(resp)
+}
+
+// AmendOrder changes the price and size of an open limit order.
+func (c *Client) AmendOrder(orderID int64, price, size float64) error {
+	return c.amend(fmt.Sprintf("%s/order/%d", Endpoint, orderID), price, size)
+}
+
+// AmendClientOrder changes the price and size of the open limit order
+// named by a client order ID.
+func (c *Client) AmendClientOrder(clientOrderID string, price, size float64) error {
+	return c.amend(fmt.Sprintf("%s/order/client/%s", Endpoint, url.PathEscape(clientOrderID)), price, size)
+}
+
+func (c *Client) amend(e string, price, size float64) error {
+	body, err := json.Marshal(server.AmendOrderRequest{Price: price, Size: size})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, e, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return fmt.Errorf("amending order: %w", err)
+	}
+	return nil
+}
+
+// CancelAll cancels the open orders of the user of the client selected by
+// f, and returns their IDs.
+func (c *Client) CancelAll(f server.CancelFilter) ([]int64, error) {
+	values := url.Values{}
+	if f.Market != "" {
+		values.Set("market", string(f.Market))
+	}
+	if f.Bid != nil {
+		side := "ask"
+		if *f.Bid {
+			side = "bid"
+		}
+		values.Set("side", side)
+	}
+	if f.MinPrice != 0 {
+		values.Set("minPrice", strconv.FormatFloat(f.MinPrice, 'f', -1, 64))
+	}
+	if f.MaxPrice != 0 {
+		values.Set("maxPrice", strconv.FormatFloat(f.MaxPrice, 'f', -1, 64))
+	}
+
+	e := fmt.Sprintf("%s/orders?%s", Endpoint, values.Encode())
+	req, err := http.NewRequest(http.MethodDelete, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, fmt.Errorf("cancelling orders: %w", err)
+	}
+	cancelled := &server.CancelAllResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(cancelled); err != nil {
+		return nil, err
+	}
+	return cancelled.OrderIDs, nil
+}
+
 func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
 	if p.Size == 0.0 {
 		return nil, fmt.Errorf("size cannot be 0 when placing a limit order")
 	}
 
 	params := &server.PlaceOrderRequest{
-		UserID: p.UserID,
-		Type:   server.LimitOrder,
-		Bid:    p.Bid,
-		Size:   p.Size,
-		Price:  p.Price,
-		Market: server.MarketETH,
+		UserID:        p.UserID,
+		Type:          server.LimitOrder,
+		Bid:           p.Bid,
+		Size:          p.Size,
+		Price:         p.Price,
+		Market:        server.MarketETH,
+		Signed:        p.Signed,
+		ClientOrderID: p.ClientOrderID,
 	}
 
 	body, err := json.Marshal(params)
@@ -0,0 +1,372 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/server"
+)
+
+const (
+	StreamEndpoint = "ws://localhost:3000/ws"
+
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+)
+
+var (
+	// ErrStreamClosed is returned by the requests of a closed stream.
+	ErrStreamClosed = errors.New("stream closed")
+	// ErrDisconnected fails the requests in flight when the connection of
+	// a stream drops.
+	ErrDisconnected = errors.New("stream disconnected")
+)
+
+// Message is a message of the exchange with its data left undecoded.
+type Message struct {
+	server.WSMessage
+	Data json.RawMessage
+}
+
+// Decode unmarshals the data of the message into v.
+func (m Message) Decode(v any) error {
+	return json.Unmarshal(m.Data, v)
+}
+
+type subscription struct {
+	channel server.Channel
+	market  server.Market
+}
+
+type response struct {
+	msg Message
+	err error
+}
+
+// Stream is a websocket connection to the exchange that multiplexes order
+// entry requests and market data subscriptions. When the connection drops
+// it reconnects and subscribes again.
+type Stream struct {
+	// Timeout is how long requests wait for their response.
+	Timeout time.Duration
+
+	client *Client
+	url    string
+	done   chan struct{}
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	ws      *websocket.Conn
+	nextID  int64
+	pending map[string]chan response
+	subs    map[subscription]func(Message)
+	closed  bool
+}
+
+// Stream connects to the websocket of the exchange, authenticated with the
+// API key of the client if it has one.
+func (c *Client) Stream() (*Stream, error) {
+	return c.DialStream(StreamEndpoint)
+}
+
+// DialStream connects to the websocket at url.
+func (c *Client) DialStream(url string) (*Stream, error) {
+	s := &Stream{
+		Timeout: 10 * time.Second,
+		client:  c,
+		url:     url,
+		done:    make(chan struct{}),
+		pending: make(map[string]chan response),
+		subs:    make(map[subscription]func(Message)),
+	}
+
+	ws, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	s.ws = ws
+	go s.run(ws)
+
+	return s, nil
+}
+
+func (s *Stream) dial() (*websocket.Conn, error) {
+	header := http.Header{}
+	if s.client.APIKey != "" {
+		req, err := http.NewRequest(http.MethodGet, s.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.client.sign(req, nil); err != nil {
+			return nil, err
+		}
+		header = req.Header
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(s.url, header)
+	return ws, err
+}
+
+// Close closes the connection of the stream for good.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	ws := s.ws
+	s.mu.Unlock()
+
+	if ws == nil {
+		return nil
+	}
+	return ws.Close()
+}
+
+// Subscribe calls handler with the messages of channel on market, which is
+// empty for the orders channel. Handlers are called by the reader of the
+// stream, so they must not wait for requests of the stream.
+func (s *Stream) Subscribe(channel server.Channel, market server.Market, handler func(Message)) error {
+	sub := subscription{channel: channel, market: market}
+
+	s.mu.Lock()
+	s.subs[sub] = handler
+	s.mu.Unlock()
+
+	if _, err := s.request(server.WSRequest{Op: server.WSSubscribe, Channel: channel, Market: market}); err != nil {
+		s.mu.Lock()
+		delete(s.subs, sub)
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *Stream) Unsubscribe(channel server.Channel, market server.Market) error {
+	s.mu.Lock()
+	delete(s.subs, subscription{channel: channel, market: market})
+	s.mu.Unlock()
+
+	_, err := s.request(server.WSRequest{Op: server.WSUnsubscribe, Channel: channel, Market: market})
+	return err
+}
+
+func (s *Stream) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	if p.Size == 0.0 {
+		return nil, fmt.Errorf("size cannot be 0 when placing a limit order")
+	}
+
+	return s.placeOrder(&server.PlaceOrderRequest{
+		UserID: p.UserID,
+		Type:   server.LimitOrder,
+		Bid:    p.Bid,
+		Size:   p.Size,
+		Price:  p.Price,
+		Market: server.MarketETH,
+		Signed: p.Signed,
+	})
+}
+
+func (s *Stream) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	return s.placeOrder(&server.PlaceOrderRequest{
+		UserID: p.UserID,
+		Type:   server.MarketOrder,
+		Bid:    p.Bid,
+		Size:   p.Size,
+		Market: server.MarketETH,
+		Signed: p.Signed,
+	})
+}
+
+func (s *Stream) placeOrder(order *server.PlaceOrderRequest) (*server.PlaceOrderResponse, error) {
+	msg, err := s.request(server.WSRequest{Op: server.WSPlace, Order: order})
+	if err != nil {
+		return nil, err
+	}
+
+	placeOrderResponse := &server.PlaceOrderResponse{}
+	if err := msg.Decode(placeOrderResponse); err != nil {
+		return nil, err
+	}
+
+	return placeOrderResponse, nil
+}
+
+func (s *Stream) CancelOrder(orderID int64) error {
+	_, err := s.request(server.WSRequest{Op: server.WSCancel, OrderID: orderID})
+	return err
+}
+
+// AmendOrder changes the price and size of a resting order.
+func (s *Stream) AmendOrder(orderID int64, price, size float64) error {
+	_, err := s.request(server.WSRequest{Op: server.WSAmend, OrderID: orderID, Price: price, Size: size})
+	return err
+}
+
+// request sends req with a new ID and waits for the response with the
+// same ID.
+func (s *Stream) request(req server.WSRequest) (Message, error) {
+	ch := make(chan response, 1)
+
+	s.mu.Lock()
+	switch {
+	case s.closed:
+		s.mu.Unlock()
+		return Message{}, ErrStreamClosed
+	case s.ws == nil:
+		s.mu.Unlock()
+		return Message{}, ErrDisconnected
+	}
+	s.nextID++
+	req.ID = strconv.FormatInt(s.nextID, 10)
+	s.pending[req.ID] = ch
+	ws := s.ws
+	s.mu.Unlock()
+
+	s.writeMu.Lock()
+	ws.SetWriteDeadline(time.Now().Add(s.Timeout))
+	err := ws.WriteJSON(req)
+	s.writeMu.Unlock()
+	if err != nil {
+		s.forget(req.ID)
+		return Message{}, err
+	}
+
+	timer := time.NewTimer(s.Timeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-ch:
+		if resp.err != nil {
+			return Message{}, resp.err
+		}
+		if resp.msg.Type == server.WSError {
+			return resp.msg, errors.New(resp.msg.Error)
+		}
+		return resp.msg, nil
+	case <-timer.C:
+		s.forget(req.ID)
+		return Message{}, fmt.Errorf("%s request timed out", req.Op)
+	}
+}
+
+func (s *Stream) forget(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pending, id)
+}
+
+// run reads the connection and every connection after it until the stream
+// is closed.
+func (s *Stream) run(ws *websocket.Conn) {
+	for ws != nil {
+		for {
+			var msg Message
+			if err := ws.ReadJSON(&msg); err != nil {
+				break
+			}
+			s.dispatch(msg)
+		}
+		ws.Close()
+
+		ws = s.reconnect()
+	}
+}
+
+// dispatch hands responses to their request and everything else to the
+// handler of its subscription.
+func (s *Stream) dispatch(msg Message) {
+	s.mu.Lock()
+	if msg.ID != "" {
+		ch, ok := s.pending[msg.ID]
+		delete(s.pending, msg.ID)
+		s.mu.Unlock()
+
+		if ok {
+			ch <- response{msg: msg}
+		}
+		return
+	}
+	handler := s.subs[subscription{channel: msg.Channel, market: msg.Market}]
+	s.mu.Unlock()
+
+	if handler != nil {
+		handler(msg)
+	}
+}
+
+// reconnect fails the requests in flight and dials again, backing off,
+// until it succeeds or the stream is closed.
+func (s *Stream) reconnect() *websocket.Conn {
+	s.mu.Lock()
+	s.ws = nil
+	for id, ch := range s.pending {
+		ch <- response{err: ErrDisconnected}
+		delete(s.pending, id)
+	}
+	s.mu.Unlock()
+
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-s.done:
+			return nil
+		default:
+		}
+
+		ws, err := s.dial()
+		if err == nil {
+			s.mu.Lock()
+			if s.closed {
+				s.mu.Unlock()
+				ws.Close()
+				return nil
+			}
+			s.ws = ws
+			s.mu.Unlock()
+
+			go s.resubscribe()
+			return ws
+		}
+
+		logrus.WithError(err).WithField("retryIn", delay).Warn("stream disconnected")
+
+		select {
+		case <-s.done:
+			return nil
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+func (s *Stream) resubscribe() {
+	s.mu.Lock()
+	subs := make([]subscription, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.mu.Unlock()
+
+	for _, sub := range subs {
+		if _, err := s.request(server.WSRequest{Op: server.WSSubscribe, Channel: sub.channel, Market: sub.market}); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"channel": sub.channel,
+				"market":  sub.market,
+			}).Error(err)
+		}
+	}
+}
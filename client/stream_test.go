@@ -0,0 +1,107 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tahaontech/crypto_exchange/server"
+)
+
+// fakeExchange answers the requests of a stream. It drops the first
+// connection after an order is placed on it.
+func fakeExchange(t *testing.T) string {
+	upgrader := websocket.Upgrader{}
+	conns := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+		conns++
+		first := conns == 1
+
+		for {
+			var req server.WSRequest
+			if err := ws.ReadJSON(&req); err != nil {
+				return
+			}
+
+			switch req.Op {
+			case server.WSSubscribe:
+				ws.WriteJSON(server.WSMessage{Type: server.WSSubscribed, ID: req.ID, Channel: req.Channel, Market: req.Market})
+				ws.WriteJSON(server.WSMessage{Type: server.WSBBO, Channel: req.Channel, Market: req.Market, Data: server.BBO{BidPrice: 90}})
+			case server.WSPlace:
+				ws.WriteJSON(server.WSMessage{Type: server.WSResponse, ID: req.ID, Data: server.PlaceOrderResponse{OrderID: 1}})
+				if first {
+					return
+				}
+			default:
+				ws.WriteJSON(server.WSMessage{Type: server.WSError, ID: req.ID, Error: "order not found"})
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestStream(t *testing.T) {
+	s, err := NewClient().DialStream(fakeExchange(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	bbos := make(chan server.BBO, 2)
+	err = s.Subscribe(server.ChannelBBO, server.MarketETH, func(msg Message) {
+		var bbo server.BBO
+		if err := msg.Decode(&bbo); err != nil {
+			t.Error(err)
+		}
+		bbos <- bbo
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForBBO(t, bbos)
+
+	resp, err := s.PlaceLimitOrder(&PlaceOrderParams{Bid: true, Price: 90, Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.OrderID != 1 {
+		t.Fatalf("order id %d", resp.OrderID)
+	}
+
+	// The stream reconnects and subscribes again.
+	waitForBBO(t, bbos)
+
+	if err := s.CancelOrder(2); err == nil || err.Error() != "order not found" {
+		t.Fatalf("cancel error %v", err)
+	}
+
+	s.Close()
+	if err := s.CancelOrder(1); err != ErrStreamClosed {
+		t.Fatalf("cancel error %v", err)
+	}
+}
+
+func waitForBBO(t *testing.T, bbos chan server.BBO) {
+	t.Helper()
+
+	select {
+	case bbo := <-bbos:
+		if bbo.BidPrice != 90 {
+			t.Fatalf("bbo %+v", bbo)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no bbo received")
+	}
+}
@@ -0,0 +1,369 @@
+// Command replay runs a recorded command stream through the orderbook and
+// prints the trades and books at a sequence number, or compares two
+// streams to find where they diverge.
+//
+// Usage:
+//
+//	replay [-at seq] [-trades n] [-snapshot] stream
+//	replay [-at seq] [-trades n] -diff other stream
+//
+// A stream is the journal directory of the exchange, or a file of journal
+// entries in JSON, one per line, numbered from 1. Only the commands of a
+// stream are run: the events follow from them. Commands run at their Time,
+// and placed orders without an OrderID get the IDs after the largest ID
+// seen so far, so every run of a stream is the same.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/journal"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+	"github.com/tahaontech/crypto_exchange/server"
+)
+
+var (
+	at       = flag.Uint64("at", 0, "sequence number of the last record to replay, all records when 0")
+	trades   = flag.Int("trades", 20, "number of the last trades of every market to print")
+	diff     = flag.String("diff", "", "stream to compare with the stream, command by command")
+	snapshot = flag.Bool("snapshot", false, "start from the last snapshot in the journal directory, for journals that were compacted")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: replay [-at seq] [-trades n] [-snapshot] [-diff other] stream")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// The books log every order, which would drown the output.
+	logrus.SetLevel(logrus.WarnLevel)
+	log.SetFlags(0)
+
+	r, commands, err := load(flag.Arg(0), *snapshot)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *at != 0 && *at < r.seq {
+		log.Fatalf("record %d is before the snapshot after record %d", *at, r.seq)
+	}
+
+	if *diff == "" {
+		for _, c := range upTo(commands, *at) {
+			r.run(c)
+		}
+		printLines(os.Stdout, append([]string{fmt.Sprintf("after record %d", r.seq)}, r.render(*trades)...))
+		return
+	}
+
+	other, otherCommands, err := load(*diff, *snapshot)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !diffRuns(os.Stdout, r, other, upTo(commands, *at), upTo(otherCommands, *at), *trades) {
+		os.Exit(1)
+	}
+}
+
+// command is a command of a stream with the sequence number of its record.
+type command struct {
+	seq    uint64
+	market server.Market
+	cmd    *server.Command
+}
+
+func upTo(commands []command, at uint64) []command {
+	if at == 0 {
+		return commands
+	}
+
+	n := sort.Search(len(commands), func(i int) bool { return commands[i].seq > at })
+	return commands[:n]
+}
+
+// load reads a stream and returns a replay to run it, starting from the
+// last snapshot of a journal directory if fromSnapshot is set.
+func load(path string, fromSnapshot bool) (*replay, []command, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := newReplay(path)
+	if !info.IsDir() {
+		commands, err := readFile(path)
+		return r, commands, err
+	}
+
+	from := uint64(1)
+	if fromSnapshot {
+		s, err := server.LoadSnapshot(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if s == nil {
+			return nil, nil, fmt.Errorf("%s: no snapshot", path)
+		}
+		r.restore(s)
+		from = s.Seq + 1
+	}
+
+	var commands []command
+	err = journal.Read(path, from, func(seq uint64, data []byte) error {
+		return decode(&commands, seq, data)
+	})
+	if errors.Is(err, journal.ErrCompacted) {
+		err = fmt.Errorf("%w, replay it with -snapshot", err)
+	}
+	return r, commands, err
+}
+
+func readFile(path string) ([]command, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		commands []command
+		seq      uint64
+	)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		seq++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := decode(&commands, seq, []byte(line)); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return commands, scanner.Err()
+}
+
+func decode(commands *[]command, seq uint64, data []byte) error {
+	var entry server.JournalEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return fmt.Errorf("record %d: %w", seq, err)
+	}
+	if entry.Command != nil {
+		*commands = append(*commands, command{seq: seq, market: entry.Market, cmd: entry.Command})
+	}
+	return nil
+}
+
+// replay runs the commands of a stream on a book per market. The books
+// share an ID generator, like the books of the exchange.
+type replay struct {
+	name   string
+	books  map[server.Market]*orderbook.Orderbook
+	lastID int64
+	// seq is the sequence number of the last command run.
+	seq uint64
+}
+
+func newReplay(name string) *replay {
+	return &replay{
+		name:  name,
+		books: make(map[server.Market]*orderbook.Orderbook),
+	}
+}
+
+func (r *replay) book(market server.Market) *orderbook.Orderbook {
+	ob, ok := r.books[market]
+	if !ok {
+		ob = orderbook.NewOrderbook()
+		ob.SetIDGenerator(r.nextID)
+		r.books[market] = ob
+	}
+	return ob
+}
+
+func (r *replay) nextID() int64 {
+	r.lastID++
+	return r.lastID
+}
+
+func (r *replay) restore(s *server.Snapshot) {
+	for market, book := range s.Books {
+		r.book(market).Restore(book)
+	}
+	r.lastID = s.LastOrderID
+	r.seq = s.Seq
+}
+
+// run runs a command. Commands that fail are reported and skipped, as the
+// exchange would have rejected them.
+func (r *replay) run(c command) {
+	if c.cmd.Type == server.CommandPlace && c.cmd.OrderID > r.lastID {
+		r.lastID = c.cmd.OrderID
+	}
+
+	if _, _, err := server.ApplyCommand(r.book(c.market), c.cmd); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: record %d: %s %d: %v\n", r.name, c.seq, c.cmd.Type, c.cmd.OrderID, err)
+	}
+	r.seq = c.seq
+}
+
+// render returns the last trades and the orders of every book, as lines of
+// tab separated columns. Asks are listed from the highest price down,
+// followed by the bids, so the book reads like a ladder.
+func (r *replay) render(trades int) []string {
+	markets := make([]string, 0, len(r.books))
+	for market := range r.books {
+		markets = append(markets, string(market))
+	}
+	sort.Strings(markets)
+
+	var lines []string
+	for _, market := range markets {
+		s := r.books[server.Market(market)].Snapshot(trades)
+
+		lines = append(lines, "", market+" trades", "TIME\tSIDE\tPRICE\tSIZE")
+		for _, trade := range s.Trades {
+			side := "SELL"
+			if trade.Bid {
+				side = "BUY"
+			}
+			lines = append(lines, strings.Join([]string{formatTime(trade.Timestamp), side, formatFloat(trade.Price), formatFloat(trade.Size)}, "\t"))
+		}
+
+		lines = append(lines, "", market+" book", "SIDE\tPRICE\tLEVEL\tORDER\tUSER\tSIZE\tTIME")
+		for i := len(s.Asks) - 1; i >= 0; i-- {
+			lines = append(lines, renderLimit("ASK", s.Asks[i])...)
+		}
+		for _, limit := range s.Bids {
+			lines = append(lines, renderLimit("BID", limit)...)
+		}
+	}
+	return lines
+}
+
+func renderLimit(side string, limit orderbook.LimitSnapshot) []string {
+	lines := make([]string, len(limit.Orders))
+	for i, o := range limit.Orders {
+		lines[i] = strings.Join([]string{
+			side,
+			formatFloat(limit.Price),
+			formatFloat(limit.TotalVolume),
+			strconv.FormatInt(o.ID, 10),
+			strconv.FormatInt(o.UserID, 10),
+			formatFloat(o.Size),
+			formatTime(o.Timestamp),
+		}, "\t")
+	}
+	return lines
+}
+
+// formatFloat prints the shortest representation of f, so runs that
+// differ in the last bit differ in their output.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatTime(ns int64) string {
+	return time.Unix(0, ns).UTC().Format(time.RFC3339Nano)
+}
+
+func printLines(w io.Writer, lines []string) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, line := range lines {
+		fmt.Fprintln(tw, line)
+	}
+	tw.Flush()
+}
+
+// diffRuns runs two streams command by command and prints the difference
+// of their trades and books after the first command at which they differ.
+// It reports whether the runs ended the same.
+func diffRuns(w io.Writer, a, b *replay, as, bs []command, trades int) bool {
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		if i < len(as) {
+			a.run(as[i])
+		}
+		if i < len(bs) {
+			b.run(bs[i])
+		}
+
+		linesA, linesB := a.render(trades), b.render(trades)
+		if strings.Join(linesA, "\n") == strings.Join(linesB, "\n") {
+			continue
+		}
+
+		printLines(w, append([]string{
+			fmt.Sprintf("runs differ after command %d: record %d of %s, record %d of %s", i+1, a.seq, a.name, b.seq, b.name),
+			"--- " + a.name,
+			"+++ " + b.name,
+		}, diffLines(linesA, linesB)...))
+		return false
+	}
+
+	n := len(as)
+	if len(bs) > n {
+		n = len(bs)
+	}
+	fmt.Fprintf(w, "runs match after %d commands\n", n)
+	return true
+}
+
+// diffLines returns the lines of a and b, prefixed with "-" when they are
+// only in a, "+" when they are only in b, and " " when they are in both.
+func diffLines(a, b []string) []string {
+	// common[i][k] is the length of the longest common subsequence of
+	// a[i:] and b[k:].
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for k := len(b) - 1; k >= 0; k-- {
+			switch {
+			case a[i] == b[k]:
+				common[i][k] = common[i+1][k+1] + 1
+			case common[i+1][k] >= common[i][k+1]:
+				common[i][k] = common[i+1][k]
+			default:
+				common[i][k] = common[i][k+1]
+			}
+		}
+	}
+
+	var lines []string
+	i, k := 0, 0
+	for i < len(a) || k < len(b) {
+		switch {
+		case i < len(a) && k < len(b) && a[i] == b[k]:
+			lines = append(lines, " "+a[i])
+			i++
+			k++
+		case k == len(b) || i < len(a) && common[i+1][k] >= common[i][k+1]:
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[k])
+			k++
+		}
+	}
+	return lines
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const stream = `{"Market":"ETH","Command":{"Type":"PLACE","Time":1000,"OrderID":1,"UserID":1,"OrderType":"LIMIT","Price":110,"Size":2}}
+{"Market":"ETH","Event":{"Type":"ACCEPTED","OrderID":1,"UserID":1,"Bid":false,"Price":110,"Size":2}}
+{"Market":"ETH","Command":{"Type":"PLACE","Time":2000,"UserID":2,"OrderType":"LIMIT","Bid":true,"Price":100,"Size":1}}
+{"Market":"ETH","Command":{"Type":"PLACE","Time":3000,"UserID":3,"OrderType":"MARKET","Bid":true,"Size":0.5}}
+{"Market":"ETH","Command":{"Type":"CANCEL","Time":4000,"OrderID":2}}
+`
+
+func writeStream(t *testing.T, name, s string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReplay(t *testing.T) {
+	r, commands, err := load(writeStream(t, "a.jsonl", stream), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 4 || commands[1].seq != 3 {
+		t.Fatalf("expected the 4 commands, got %+v", commands)
+	}
+
+	for _, c := range upTo(commands, 4) {
+		r.run(c)
+	}
+	want := strings.Join([]string{
+		"",
+		"ETH trades",
+		"TIME\tSIDE\tPRICE\tSIZE",
+		"1970-01-01T00:00:00.000003Z\tBUY\t110\t0.5",
+		"",
+		"ETH book",
+		"SIDE\tPRICE\tLEVEL\tORDER\tUSER\tSIZE\tTIME",
+		"ASK\t110\t1.5\t1\t1\t1.5\t1970-01-01T00:00:00.000001Z",
+		"BID\t100\t1\t2\t2\t1\t1970-01-01T00:00:00.000002Z",
+	}, "\n")
+	if got := strings.Join(r.render(20), "\n"); got != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestDiffRuns(t *testing.T) {
+	a, as, err := load(writeStream(t, "a.jsonl", stream), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, bs, err := load(writeStream(t, "b.jsonl", stream), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if !diffRuns(&out, a, b, as, bs, 20) {
+		t.Fatalf("expected the runs to match, got\n%s", &out)
+	}
+
+	// The market order fills at 0.6 instead.
+	a, as, _ = load(writeStream(t, "a.jsonl", stream), false)
+	b, bs, _ = load(writeStream(t, "c.jsonl", strings.Replace(stream, `"Size":0.5`, `"Size":0.6`, 1)), false)
+	out.Reset()
+	if diffRuns(&out, a, b, as, bs, 20) {
+		t.Fatal("expected the runs to differ")
+	}
+	if !strings.Contains(out.String(), "runs differ after command 3: record 4 of") {
+		t.Fatalf("expected the runs to differ after command 3, got\n%s", &out)
+	}
+	if !strings.Contains(out.String(), "-1970-01-01T00:00:00.000003Z  BUY") || !strings.Contains(out.String(), "+ASK") {
+		t.Fatalf("expected the differing lines, got\n%s", &out)
+	}
+}
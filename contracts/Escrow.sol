@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: MIT
+pragma solidity ^0.8.19;
+
+import "./IERC20.sol";
+
+// Escrow holds the funds of the exchange users. The exchange matches orders
+// off chain and settles the resulting trades in batches, but it can only
+// move funds along orders the users signed with their own keys (EIP-712).
+// Users deposit and withdraw themselves, so they keep custody.
+contract Escrow {
+    struct Order {
+        address user;
+        // baseToken and quoteToken are address(0) for ETH.
+        address baseToken;
+        address quoteToken;
+        bool bid;
+        // price is the amount of quote base units per 1e18 base units of
+        // the base token.
+        uint256 price;
+        uint256 size;
+        uint256 nonce;
+        uint256 expiry;
+        uint8 v;
+        bytes32 r;
+        bytes32 s;
+    }
+
+    bytes32 constant DOMAIN_TYPEHASH =
+        keccak256("EIP712Domain(string name,string version,uint256 chainId,address verifyingContract)");
+    bytes32 constant ORDER_TYPEHASH = keccak256(
+        "Order(address user,address baseToken,address quoteToken,bool bid,uint256 price,uint256 size,uint256 nonce,uint256 expiry)"
+    );
+
+    address public operator;
+    // balanceOf maps token => user => amount.
+    mapping(address => mapping(address => uint256)) public balanceOf;
+    // filled maps an order hash to the size settled so far.
+    mapping(bytes32 => uint256) public filled;
+
+    event Deposit(address indexed token, address indexed user, uint256 amount);
+    event Withdraw(address indexed token, address indexed user, uint256 amount);
+    event Settled(bytes32 indexed makerHash, bytes32 indexed takerHash, uint256 size, uint256 price);
+
+    constructor() {
+        operator = msg.sender;
+    }
+
+    function deposit() external payable {
+        balanceOf[address(0)][msg.sender] += msg.value;
+        emit Deposit(address(0), msg.sender, msg.value);
+    }
+
+    function depositToken(address token, uint256 amount) external {
+        require(IERC20(token).transferFrom(msg.sender, address(this), amount));
+        balanceOf[token][msg.sender] += amount;
+        emit Deposit(token, msg.sender, amount);
+    }
+
+    function withdraw(address token, uint256 amount) external {
+        require(balanceOf[token][msg.sender] >= amount);
+        balanceOf[token][msg.sender] -= amount;
+
+        if (token == address(0)) {
+            (bool ok,) = msg.sender.call{value: amount}("");
+            require(ok);
+        } else {
+            require(IERC20(token).transfer(msg.sender, amount));
+        }
+
+        emit Withdraw(token, msg.sender, amount);
+    }
+
+    function hashOrder(Order calldata order) public view returns (bytes32) {
+        bytes32 domainSeparator = keccak256(
+            abi.encode(DOMAIN_TYPEHASH, keccak256("CryptoExchange"), keccak256("1"), block.chainid, address(this))
+        );
+        bytes32 structHash = keccak256(
+            abi.encode(
+                ORDER_TYPEHASH,
+                order.user,
+                order.baseToken,
+                order.quoteToken,
+                order.bid,
+                order.price,
+                order.size,
+                order.nonce,
+                order.expiry
+            )
+        );
+        return keccak256(abi.encodePacked("\x19\x01", domainSeparator, structHash));
+    }
+
+    // settle executes sizes[i] of makers[i] against takers[i] at the maker
+    // price. Only the operator can settle.
+    function settle(Order[] calldata makers, Order[] calldata takers, uint256[] calldata sizes) external {
+        require(msg.sender == operator);
+        require(makers.length == takers.length && makers.length == sizes.length);
+
+        for (uint256 i = 0; i < sizes.length; i++) {
+            _settle(makers[i], takers[i], sizes[i]);
+        }
+    }
+
+    function _settle(Order calldata maker, Order calldata taker, uint256 size) internal {
+        require(size > 0);
+        require(maker.bid != taker.bid);
+        require(maker.baseToken == taker.baseToken && maker.quoteToken == taker.quoteToken);
+        require(block.timestamp <= maker.expiry && block.timestamp <= taker.expiry);
+        if (taker.bid) {
+            require(taker.price >= maker.price);
+        } else {
+            require(taker.price <= maker.price);
+        }
+
+        bytes32 makerHash = _verify(maker);
+        bytes32 takerHash = _verify(taker);
+
+        filled[makerHash] += size;
+        require(filled[makerHash] <= maker.size);
+        filled[takerHash] += size;
+        require(filled[takerHash] <= taker.size);
+
+        uint256 quote = size * maker.price / 1e18;
+        (address buyer, address seller) = maker.bid ? (maker.user, taker.user) : (taker.user, maker.user);
+
+        _move(maker.baseToken, seller, buyer, size);
+        _move(maker.quoteToken, buyer, seller, quote);
+
+        emit Settled(makerHash, takerHash, size, maker.price);
+    }
+
+    function _verify(Order calldata order) internal view returns (bytes32 hash) {
+        hash = hashOrder(order);
+        address signer = ecrecover(hash, order.v, order.r, order.s);
+        require(signer != address(0) && signer == order.user);
+    }
+
+    function _move(address token, address from, address to, uint256 amount) internal {
+        require(balanceOf[token][from] >= amount);
+        balanceOf[token][from] -= amount;
+        balanceOf[token][to] += amount;
+    }
+}
@@ -0,0 +1,889 @@
+// Code generated - DO NOT EDIT.
+// This file is a generated binding and any manual changes will be lost.
+
+package escrow
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var (
+	_ = errors.New
+	_ = big.NewInt
+	_ = strings.NewReader
+	_ = ethereum.NotFound
+	_ = bind.Bind
+	_ = common.Big1
+	_ = types.BloomLookup
+	_ = event.NewSubscription
+	_ = abi.ConvertType
+)
+
+// EscrowOrder is an auto generated low-level Go binding around an user-defined struct.
+type EscrowOrder struct {
+	User       common.Address
+	BaseToken  common.Address
+	QuoteToken common.Address
+	Bid        bool
+	Price      *big.Int
+	Size       *big.Int
+	Nonce      *big.Int
+	Expiry     *big.Int
+	V          uint8
+	R          [32]byte
+	S          [32]byte
+}
+
+// EscrowMetaData contains all meta data concerning the Escrow contract.
+var EscrowMetaData = &bind.MetaData{
+	ABI: "[{\"inputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"constructor\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"internalType\":\"address\",\"name\":\"token\",\"type\":\"address\"},{\"indexed\":true,\"internalType\":\"address\",\"name\":\"user\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"amount\",\"type\":\"uint256\"}],\"name\":\"Deposit\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"internalType\":\"bytes32\",\"name\":\"makerHash\",\"type\":\"bytes32\"},{\"indexed\":true,\"internalType\":\"bytes32\",\"name\":\"takerHash\",\"type\":\"bytes32\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"size\",\"type\":\"uint256\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"price\",\"type\":\"uint256\"}],\"name\":\"Settled\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"internalType\":\"address\",\"name\":\"token\",\"type\":\"address\"},{\"indexed\":true,\"internalType\":\"address\",\"name\":\"user\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"amount\",\"type\":\"uint256\"}],\"name\":\"Withdraw\",\"type\":\"event\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"}],\"name\":\"balanceOf\",\"outputs\":[{\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"deposit\",\"outputs\":[],\"stateMutability\":\"payable\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"token\",\"type\":\"address\"},{\"internalType\":\"uint256\",\"name\":\"amount\",\"type\":\"uint256\"}],\"name\":\"depositToken\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"bytes32\",\"name\":\"\",\"type\":\"bytes32\"}],\"name\":\"filled\",\"outputs\":[{\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"components\":[{\"internalType\":\"address\",\"name\":\"user\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"baseToken\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"quoteToken\",\"type\":\"address\"},{\"internalType\":\"bool\",\"name\":\"bid\",\"type\":\"bool\"},{\"internalType\":\"uint256\",\"name\":\"price\",\"type\":\"uint256\"},{\"internalType\":\"uint256\",\"name\":\"size\",\"type\":\"uint256\"},{\"internalType\":\"uint256\",\"name\":\"nonce\",\"type\":\"uint256\"},{\"internalType\":\"uint256\",\"name\":\"expiry\",\"type\":\"uint256\"},{\"internalType\":\"uint8\",\"name\":\"v\",\"type\":\"uint8\"},{\"internalType\":\"bytes32\",\"name\":\"r\",\"type\":\"bytes32\"},{\"internalType\":\"bytes32\",\"name\":\"s\",\"type\":\"bytes32\"}],\"internalType\":\"structEscrow.Order\",\"name\":\"order\",\"type\":\"tuple\"}],\"name\":\"hashOrder\",\"outputs\":[{\"internalType\":\"bytes32\",\"name\":\"\",\"type\":\"bytes32\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"operator\",\"outputs\":[{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"components\":[{\"internalType\":\"address\",\"name\":\"user\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"baseToken\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"quoteToken\",\"type\":\"address\"},{\"internalType\":\"bool\",\"name\":\"bid\",\"type\":\"bool\"},{\"internalType\":\"uint256\",\"name\":\"price\",\"type\":\"uint256\"},{\"internalType\":\"uint256\",\"name\":\"size\",\"type\":\"uint256\"},{\"internalType\":\"uint256\",\"name\":\"nonce\",\"type\":\"uint256\"},{\"internalType\":\"uint256\",\"name\":\"expiry\",\"type\":\"uint256\"},{\"internalType\":\"uint8\",\"name\":\"v\",\"type\":\"uint8\"},{\"internalType\":\"bytes32\",\"name\":\"r\",\"type\":\"bytes32\"},{\"internalType\":\"bytes32\",\"name\":\"s\",\"type\":\"bytes32\"}],\"internalType\":\"structEscrow.Order[]\",\"name\":\"makers\",\"type\":\"tuple[]\"},{\"components\":[{\"internalType\":\"address\",\"name\":\"user\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"baseToken\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"quoteToken\",\"type\":\"address\"},{\"internalType\":\"bool\",\"name\":\"bid\",\"type\":\"bool\"},{\"internalType\":\"uint256\",\"name\":\"price\",\"type\":\"uint256\"},{\"internalType\":\"uint256\",\"name\":\"size\",\"type\":\"uint256\"},{\"internalType\":\"uint256\",\"name\":\"nonce\",\"type\":\"uint256\"},{\"internalType\":\"uint256\",\"name\":\"expiry\",\"type\":\"uint256\"},{\"internalType\":\"uint8\",\"name\":\"v\",\"type\":\"uint8\"},{\"internalType\":\"bytes32\",\"name\":\"r\",\"type\":\"bytes32\"},{\"internalType\":\"bytes32\",\"name\":\"s\",\"type\":\"bytes32\"}],\"internalType\":\"structEscrow.Order[]\",\"name\":\"takers\",\"type\":\"tuple[]\"},{\"internalType\":\"uint256[]\",\"name\":\"sizes\",\"type\":\"uint256[]\"}],\"name\":\"settle\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"token\",\"type\":\"address\"},{\"internalType\":\"uint256\",\"name\":\"amount\",\"type\":\"uint256\"}],\"name\":\"withdraw\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"}]",
+	Bin: "0x3461001657336000556107de8061001b6000396000f35b600080fd600436106100665760003560e01c8063570ca73514610076578063f7888aec14610087578063288cdc91146100cd578063d0e30db0146100f4578063338b5dea1461014c578063f3fef3a3146102065780632396e00d146102d65780633566e216146102f7575b600080fd5b3d600060003e3d6000fd5b346100665760005460005260206000f35b346100665760443610610066576004358060a01c610066576024358060a01c61006657906000526001602052604060002060205260005260406000205460005260206000f35b34610066576024361061006657600435600052600260205260406000205460005260206000f35b6000339060005260016020526040600020602052600052604060002080543401803411610066579055346000523360007f5548c837ab068cf56a2c2479df0882a4922fd203edb7517321831d95078c5f6260206000a3005b346100665760443610610066576004358060a01c610066576323b872dd60e01b610300523361030452306103245260243561034452602061040060646103006000855af11561006b573d6020116100665761040051806001106100665715610066576024358133906000526001602052604060002060205260005260406000208054820180831161006657905560005233907f5548c837ab068cf56a2c2479df0882a4922fd203edb7517321831d95078c5f6260206000a3005b346100665760443610610066576004358060a01c6100665760243581339060005260016020526040600020602052600052604060002080548281106100665782900390558161026557600060006000600084335af115610066576102a9565b63a9059cbb60e01b6103005233610304528061032452602061040060446103006000865af11561006b573d6020116100665761040051806001106100665715610066575b60005233907f9b1bfa7fa9ee420a16e124f794c35ac9f90472acc99140eb2f6447c714cad8eb60206000a3005b34610066576101643610610066576102ee6004610678565b60005260206000f35b34610066576064361061006657600054331415610066576004356004018063ffffffff106100665780358063ffffffff10610066578061016002820160200136106100665760e0526020016080526024356004018063ffffffff106100665780358063ffffffff10610066578061016002820160200136106100665760e05114156100665760200160a0526044356004018063ffffffff106100665780358063ffffffff106100665780602002820160200136106100665760e05114156100665760200160c0526000610100525b6101005160e051111561061f57610100516101600280608051016101205260a05101610140526101005160200260c05101356101605261016051156100665761012051606001356101405160600135146100665761012051602001356101405160200135141561006657610120516040013561014051604001351415610066576101205160e001354211610066576101405160e0013542116100665761014051606001356104875761012051608001356101405160800135116100665761049d565b6101205160800135610140516080013510610066575b6104a961012051610782565b610180526104b961014051610782565b6101a05261018051600052600260205260406000208054610160510180610160511161006657806101205160a00135106100665790556101a051600052600260205260406000208054610160510180610160511161006657806101405160a001351061006657905561016051610120516080013502806101605190046101205160800135141561006657670de0b6b3a764000090046101c052610120516060013561057b5761012051600001356102005261014051600001356101e052610594565b61012051600001356101e0526101405160000135610200525b6105b06101205160200135610200516101e05161016051610621565b6105cc61012051604001356101e051610200516101c051610621565b61016051610800526101205160800135610820526101a051610180517f3d366a4e7a8f55c96fdefb618ae465b00ea521df10c8287a3c1de2305e4aeddd6040610800a361010051600101610100526103c5565b005b83839060005260016020526040600020602052600052604060002080548281106100665782900390558382906000526001602052604060002060205260005260406000208054820180831161006657905550505050565b803560a01c61006657806020013560a01c61006657806040013560a01c6100665780606001356001106100665780610100013560ff10610066577fe4a6580bb3341b017082b8eedd9ed974fc0212659cbb651040e56d595341d048610300526101008161032037610120610300207f8b73c3c69bb8fe3d512ecc4cf759cc79239f7b179b0ffacaa9a75d522b39400f610400527fb1626a39eefc2abbe0aa5e515b2bc2fac6a61880c7eb28bb61c9b3f8e8c84338610420527fc89efdaa54c0f20c7adf612882df0950f5a951637e0307cdcb4c672f298b8bc6610440524661046052306104805260a06104002061190160f01b610500526105025261052252604261050020905090565b61078b81610678565b80610600528161010001356106205281610120013561064052816101400135610660526000610700526020610700608061060060015afa156100665761070051801561006657823514156100665790509056",
+}
+
+// EscrowABI is the input ABI used to generate the binding from.
+// Deprecated: Use EscrowMetaData.ABI instead.
+var EscrowABI = EscrowMetaData.ABI
+
+// EscrowBin is the compiled bytecode used for deploying new contracts.
+// Deprecated: Use EscrowMetaData.Bin instead.
+var EscrowBin = EscrowMetaData.Bin
+
+// DeployEscrow deploys a new Ethereum contract, binding an instance of Escrow to it.
+func DeployEscrow(auth *bind.TransactOpts, backend bind.ContractBackend) (common.Address, *types.Transaction, *Escrow, error) {
+	parsed, err := EscrowMetaData.GetAbi()
+	if err != nil {
+		return common.Address{}, nil, nil, err
+	}
+	if parsed == nil {
+		return common.Address{}, nil, nil, errors.New("GetABI returned nil")
+	}
+
+	address, tx, contract, err := bind.DeployContract(auth, *parsed, common.FromHex(EscrowBin), backend)
+	if err != nil {
+		return common.Address{}, nil, nil, err
+	}
+	return address, tx, &Escrow{EscrowCaller: EscrowCaller{contract: contract}, EscrowTransactor: EscrowTransactor{contract: contract}, EscrowFilterer: EscrowFilterer{contract: contract}}, nil
+}
+
+// Escrow is an auto generated Go binding around an Ethereum contract.
+type Escrow struct {
+	EscrowCaller     // Read-only binding to the contract
+	EscrowTransactor // Write-only binding to the contract
+	EscrowFilterer   // Log filterer for contract events
+}
+
+// EscrowCaller is an auto generated read-only Go binding around an Ethereum contract.
+type EscrowCaller struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// EscrowTransactor is an auto generated write-only Go binding around an Ethereum contract.
+type EscrowTransactor struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// EscrowFilterer is an auto generated log filtering Go binding around an Ethereum contract events.
+type EscrowFilterer struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// EscrowSession is an auto generated Go binding around an Ethereum contract,
+// with pre-set call and transact options.
+type EscrowSession struct {
+	Contract     *Escrow           // Generic contract binding to set the session for
+	CallOpts     bind.CallOpts     // Call options to use throughout this session
+	TransactOpts bind.TransactOpts // Transaction auth options to use throughout this session
+}
+
+// EscrowCallerSession is an auto generated read-only Go binding around an Ethereum contract,
+// with pre-set call options.
+type EscrowCallerSession struct {
+	Contract *EscrowCaller // Generic contract caller binding to set the session for
+	CallOpts bind.CallOpts // Call options to use throughout this session
+}
+
+// EscrowTransactorSession is an auto generated write-only Go binding around an Ethereum contract,
+// with pre-set transact options.
+type EscrowTransactorSession struct {
+	Contract     *EscrowTransactor // Generic contract transactor binding to set the session for
+	TransactOpts bind.TransactOpts // Transaction auth options to use throughout this session
+}
+
+// EscrowRaw is an auto generated low-level Go binding around an Ethereum contract.
+type EscrowRaw struct {
+	Contract *Escrow // Generic contract binding to access the raw methods on
+}
+
+// EscrowCallerRaw is an auto generated low-level read-only Go binding around an Ethereum contract.
+type EscrowCallerRaw struct {
+	Contract *EscrowCaller // Generic read-only contract binding to access the raw methods on
+}
+
+// EscrowTransactorRaw is an auto generated low-level write-only Go binding around an Ethereum contract.
+type EscrowTransactorRaw struct {
+	Contract *EscrowTransactor // Generic write-only contract binding to access the raw methods on
+}
+
+// NewEscrow creates a new instance of Escrow, bound to a specific deployed contract.
+func NewEscrow(address common.Address, backend bind.ContractBackend) (*Escrow, error) {
+	contract, err := bindEscrow(address, backend, backend, backend)
+	if err != nil {
+		return nil, err
+	}
+	return &Escrow{EscrowCaller: EscrowCaller{contract: contract}, EscrowTransactor: EscrowTransactor{contract: contract}, EscrowFilterer: EscrowFilterer{contract: contract}}, nil
+}
+
+// NewEscrowCaller creates a new read-only instance of Escrow, bound to a specific deployed contract.
+func NewEscrowCaller(address common.Address, caller bind.ContractCaller) (*EscrowCaller, error) {
+	contract, err := bindEscrow(address, caller, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &EscrowCaller{contract: contract}, nil
+}
+
+// NewEscrowTransactor creates a new write-only instance of Escrow, bound to a specific deployed contract.
+func NewEscrowTransactor(address common.Address, transactor bind.ContractTransactor) (*EscrowTransactor, error) {
+	contract, err := bindEscrow(address, nil, transactor, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &EscrowTransactor{contract: contract}, nil
+}
+
+// NewEscrowFilterer creates a new log filterer instance of Escrow, bound to a specific deployed contract.
+func NewEscrowFilterer(address common.Address, filterer bind.ContractFilterer) (*EscrowFilterer, error) {
+	contract, err := bindEscrow(address, nil, nil, filterer)
+	if err != nil {
+		return nil, err
+	}
+	return &EscrowFilterer{contract: contract}, nil
+}
+
+// bindEscrow binds a generic wrapper to an already deployed contract.
+func bindEscrow(address common.Address, caller bind.ContractCaller, transactor bind.ContractTransactor, filterer bind.ContractFilterer) (*bind.BoundContract, error) {
+	parsed, err := EscrowMetaData.GetAbi()
+	if err != nil {
+		return nil, err
+	}
+	return bind.NewBoundContract(address, *parsed, caller, transactor, filterer), nil
+}
+
+// Call invokes the (constant) contract method with params as input values and
+// sets the output to result. The result type might be a single field for simple
+// returns, a slice of interfaces for anonymous returns and a struct for named
+// returns.
+func (_Escrow *EscrowRaw) Call(opts *bind.CallOpts, result *[]interface{}, method string, params ...interface{}) error {
+	return _Escrow.Contract.EscrowCaller.contract.Call(opts, result, method, params...)
+}
+
+// Transfer initiates a plain transaction to move funds to the contract, calling
+// its default method if one is available.
+func (_Escrow *EscrowRaw) Transfer(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _Escrow.Contract.EscrowTransactor.contract.Transfer(opts)
+}
+
+// Transact invokes the (paid) contract method with params as input values.
+func (_Escrow *EscrowRaw) Transact(opts *bind.TransactOpts, method string, params ...interface{}) (*types.Transaction, error) {
+	return _Escrow.Contract.EscrowTransactor.contract.Transact(opts, method, params...)
+}
+
+// Call invokes the (constant) contract method with params as input values and
+// sets the output to result. The result type might be a single field for simple
+// returns, a slice of interfaces for anonymous returns and a struct for named
+// returns.
+func (_Escrow *EscrowCallerRaw) Call(opts *bind.CallOpts, result *[]interface{}, method string, params ...interface{}) error {
+	return _Escrow.Contract.contract.Call(opts, result, method, params...)
+}
+
+// Transfer initiates a plain transaction to move funds to the contract, calling
+// its default method if one is available.
+func (_Escrow *EscrowTransactorRaw) Transfer(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _Escrow.Contract.contract.Transfer(opts)
+}
+
+// Transact invokes the (paid) contract method with params as input values.
+func (_Escrow *EscrowTransactorRaw) Transact(opts *bind.TransactOpts, method string, params ...interface{}) (*types.Transaction, error) {
+	return _Escrow.Contract.contract.Transact(opts, method, params...)
+}
+
+// BalanceOf is a free data retrieval call binding the contract method 0xf7888aec.
+//
+// Solidity: function balanceOf(address , address ) view returns(uint256)
+func (_Escrow *EscrowCaller) BalanceOf(opts *bind.CallOpts, arg0 common.Address, arg1 common.Address) (*big.Int, error) {
+	var out []interface{}
+	err := _Escrow.contract.Call(opts, &out, "balanceOf", arg0, arg1)
+
+	if err != nil {
+		return *new(*big.Int), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(*big.Int)).(**big.Int)
+
+	return out0, err
+
+}
+
+// BalanceOf is a free data retrieval call binding the contract method 0xf7888aec.
+//
+// Solidity: function balanceOf(address , address ) view returns(uint256)
+func (_Escrow *EscrowSession) BalanceOf(arg0 common.Address, arg1 common.Address) (*big.Int, error) {
+	return _Escrow.Contract.BalanceOf(&_Escrow.CallOpts, arg0, arg1)
+}
+
+// BalanceOf is a free data retrieval call binding the contract method 0xf7888aec.
+//
+// Solidity: function balanceOf(address , address ) view returns(uint256)
+func (_Escrow *EscrowCallerSession) BalanceOf(arg0 common.Address, arg1 common.Address) (*big.Int, error) {
+	return _Escrow.Contract.BalanceOf(&_Escrow.CallOpts, arg0, arg1)
+}
+
+// Filled is a free data retrieval call binding the contract method 0x288cdc91.
+//
+// Solidity: function filled(bytes32 ) view returns(uint256)
+func (_Escrow *EscrowCaller) Filled(opts *bind.CallOpts, arg0 [32]byte) (*big.Int, error) {
+	var out []interface{}
+	err := _Escrow.contract.Call(opts, &out, "filled", arg0)
+
+	if err != nil {
+		return *new(*big.Int), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(*big.Int)).(**big.Int)
+
+	return out0, err
+
+}
+
+// Filled is a free data retrieval call binding the contract method 0x288cdc91.
+//
+// Solidity: function filled(bytes32 ) view returns(uint256)
+func (_Escrow *EscrowSession) Filled(arg0 [32]byte) (*big.Int, error) {
+	return _Escrow.Contract.Filled(&_Escrow.CallOpts, arg0)
+}
+
+// Filled is a free data retrieval call binding the contract method 0x288cdc91.
+//
+// Solidity: function filled(bytes32 ) view returns(uint256)
+func (_Escrow *EscrowCallerSession) Filled(arg0 [32]byte) (*big.Int, error) {
+	return _Escrow.Contract.Filled(&_Escrow.CallOpts, arg0)
+}
+
+// HashOrder is a free data retrieval call binding the contract method 0x2396e00d.
+//
+// Solidity: function hashOrder((address,address,address,bool,uint256,uint256,uint256,uint256,uint8,bytes32,bytes32) order) view returns(bytes32)
+func (_Escrow *EscrowCaller) HashOrder(opts *bind.CallOpts, order EscrowOrder) ([32]byte, error) {
+	var out []interface{}
+	err := _Escrow.contract.Call(opts, &out, "hashOrder", order)
+
+	if err != nil {
+		return *new([32]byte), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new([32]byte)).(*[32]byte)
+
+	return out0, err
+
+}
+
+// HashOrder is a free data retrieval call binding the contract method 0x2396e00d.
+//
+// Solidity: function hashOrder((address,address,address,bool,uint256,uint256,uint256,uint256,uint8,bytes32,bytes32) order) view returns(bytes32)
+func (_Escrow *EscrowSession) HashOrder(order EscrowOrder) ([32]byte, error) {
+	return _Escrow.Contract.HashOrder(&_Escrow.CallOpts, order)
+}
+
+// HashOrder is a free data retrieval call binding the contract method 0x2396e00d.
+//
+// Solidity: function hashOrder((address,address,address,bool,uint256,uint256,uint256,uint256,uint8,bytes32,bytes32) order) view returns(bytes32)
+func (_Escrow *EscrowCallerSession) HashOrder(order EscrowOrder) ([32]byte, error) {
+	return _Escrow.Contract.HashOrder(&_Escrow.CallOpts, order)
+}
+
+// Operator is a free data retrieval call binding the contract method 0x570ca735.
+//
+// Solidity: function operator() view returns(address)
+func (_Escrow *EscrowCaller) Operator(opts *bind.CallOpts) (common.Address, error) {
+	var out []interface{}
+	err := _Escrow.contract.Call(opts, &out, "operator")
+
+	if err != nil {
+		return *new(common.Address), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(common.Address)).(*common.Address)
+
+	return out0, err
+
+}
+
+// Operator is a free data retrieval call binding the contract method 0x570ca735.
+//
+// Solidity: function operator() view returns(address)
+func (_Escrow *EscrowSession) Operator() (common.Address, error) {
+	return _Escrow.Contract.Operator(&_Escrow.CallOpts)
+}
+
+// Operator is a free data retrieval call binding the contract method 0x570ca735.
+//
+// Solidity: function operator() view returns(address)
+func (_Escrow *EscrowCallerSession) Operator() (common.Address, error) {
+	return _Escrow.Contract.Operator(&_Escrow.CallOpts)
+}
+
+// Deposit is a paid mutator transaction binding the contract method 0xd0e30db0.
+//
+// Solidity: function deposit() payable returns()
+func (_Escrow *EscrowTransactor) Deposit(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _Escrow.contract.Transact(opts, "deposit")
+}
+
+// Deposit is a paid mutator transaction binding the contract method 0xd0e30db0.
+//
+// Solidity: function deposit() payable returns()
+func (_Escrow *EscrowSession) Deposit() (*types.Transaction, error) {
+	return _Escrow.Contract.Deposit(&_Escrow.TransactOpts)
+}
+
+// Deposit is a paid mutator transaction binding the contract method 0xd0e30db0.
+//
+// Solidity: function deposit() payable returns()
+func (_Escrow *EscrowTransactorSession) Deposit() (*types.Transaction, error) {
+	return _Escrow.Contract.Deposit(&_Escrow.TransactOpts)
+}
+
+// DepositToken is a paid mutator transaction binding the contract method 0x338b5dea.
+//
+// Solidity: function depositToken(address token, uint256 amount) returns()
+func (_Escrow *EscrowTransactor) DepositToken(opts *bind.TransactOpts, token common.Address, amount *big.Int) (*types.Transaction, error) {
+	return _Escrow.contract.Transact(opts, "depositToken", token, amount)
+}
+
+// DepositToken is a paid mutator transaction binding the contract method 0x338b5dea.
+//
+// Solidity: function depositToken(address token, uint256 amount) returns()
+func (_Escrow *EscrowSession) DepositToken(token common.Address, amount *big.Int) (*types.Transaction, error) {
+	return _Escrow.Contract.DepositToken(&_Escrow.TransactOpts, token, amount)
+}
+
+// DepositToken is a paid mutator transaction binding the contract method 0x338b5dea.
+//
+// Solidity: function depositToken(address token, uint256 amount) returns()
+func (_Escrow *EscrowTransactorSession) DepositToken(token common.Address, amount *big.Int) (*types.Transaction, error) {
+	return _Escrow.Contract.DepositToken(&_Escrow.TransactOpts, token, amount)
+}
+
+// Settle is a paid mutator transaction binding the contract method 0x3566e216.
+//
+// Solidity: function settle((address,address,address,bool,uint256,uint256,uint256,uint256,uint8,bytes32,bytes32)[] makers, (address,address,address,bool,uint256,uint256,uint256,uint256,uint8,bytes32,bytes32)[] takers, uint256[] sizes) returns()
+func (_Escrow *EscrowTransactor) Settle(opts *bind.TransactOpts, makers []EscrowOrder, takers []EscrowOrder, sizes []*big.Int) (*types.Transaction, error) {
+	return _Escrow.contract.Transact(opts, "settle", makers, takers, sizes)
+}
+
+// Settle is a paid mutator transaction binding the contract method 0x3566e216.
+//
+// Solidity: function settle((address,address,address,bool,uint256,uint256,uint256,uint256,uint8,bytes32,bytes32)[] makers, (address,address,address,bool,uint256,uint256,uint256,uint256,uint8,bytes32,bytes32)[] takers, uint256[] sizes) returns()
+func (_Escrow *EscrowSession) Settle(makers []EscrowOrder, takers []EscrowOrder, sizes []*big.Int) (*types.Transaction, error) {
+	return _Escrow.Contract.Settle(&_Escrow.TransactOpts, makers, takers, sizes)
+}
+
+// Settle is a paid mutator transaction binding the contract method 0x3566e216.
+//
+// Solidity: function settle((address,address,address,bool,uint256,uint256,uint256,uint256,uint8,bytes32,bytes32)[] makers, (address,address,address,bool,uint256,uint256,uint256,uint256,uint8,bytes32,bytes32)[] takers, uint256[] sizes) returns()
+func (_Escrow *EscrowTransactorSession) Settle(makers []EscrowOrder, takers []EscrowOrder, sizes []*big.Int) (*types.Transaction, error) {
+	return _Escrow.Contract.Settle(&_Escrow.TransactOpts, makers, takers, sizes)
+}
+
+// Withdraw is a paid mutator transaction binding the contract method 0xf3fef3a3.
+//
+// Solidity: function withdraw(address token, uint256 amount) returns()
+func (_Escrow *EscrowTransactor) Withdraw(opts *bind.TransactOpts, token common.Address, amount *big.Int) (*types.Transaction, error) {
+	return _Escrow.contract.Transact(opts, "withdraw", token, amount)
+}
+
+// Withdraw is a paid mutator transaction binding the contract method 0xf3fef3a3.
+//
+// Solidity: function withdraw(address token, uint256 amount) returns()
+func (_Escrow *EscrowSession) Withdraw(token common.Address, amount *big.Int) (*types.Transaction, error) {
+	return _Escrow.Contract.Withdraw(&_Escrow.TransactOpts, token, amount)
+}
+
+// Withdraw is a paid mutator transaction binding the contract method 0xf3fef3a3.
+//
+// Solidity: function withdraw(address token, uint256 amount) returns()
+func (_Escrow *EscrowTransactorSession) Withdraw(token common.Address, amount *big.Int) (*types.Transaction, error) {
+	return _Escrow.Contract.Withdraw(&_Escrow.TransactOpts, token, amount)
+}
+
+// EscrowDepositIterator is returned from FilterDeposit and is used to iterate over the raw logs and unpacked data for Deposit events raised by the Escrow contract.
+type EscrowDepositIterator struct {
+	Event *EscrowDeposit // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *EscrowDepositIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(EscrowDeposit)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(EscrowDeposit)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *EscrowDepositIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *EscrowDepositIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// EscrowDeposit represents a Deposit event raised by the Escrow contract.
+type EscrowDeposit struct {
+	Token  common.Address
+	User   common.Address
+	Amount *big.Int
+	Raw    types.Log // Blockchain specific contextual infos
+}
+
+// FilterDeposit is a free log retrieval operation binding the contract event 0x5548c837ab068cf56a2c2479df0882a4922fd203edb7517321831d95078c5f62.
+//
+// Solidity: event Deposit(address indexed token, address indexed user, uint256 amount)
+func (_Escrow *EscrowFilterer) FilterDeposit(opts *bind.FilterOpts, token []common.Address, user []common.Address) (*EscrowDepositIterator, error) {
+
+	var tokenRule []interface{}
+	for _, tokenItem := range token {
+		tokenRule = append(tokenRule, tokenItem)
+	}
+	var userRule []interface{}
+	for _, userItem := range user {
+		userRule = append(userRule, userItem)
+	}
+
+	logs, sub, err := _Escrow.contract.FilterLogs(opts, "Deposit", tokenRule, userRule)
+	if err != nil {
+		return nil, err
+	}
+	return &EscrowDepositIterator{contract: _Escrow.contract, event: "Deposit", logs: logs, sub: sub}, nil
+}
+
+// WatchDeposit is a free log subscription operation binding the contract event 0x5548c837ab068cf56a2c2479df0882a4922fd203edb7517321831d95078c5f62.
+//
+// Solidity: event Deposit(address indexed token, address indexed user, uint256 amount)
+func (_Escrow *EscrowFilterer) WatchDeposit(opts *bind.WatchOpts, sink chan<- *EscrowDeposit, token []common.Address, user []common.Address) (event.Subscription, error) {
+
+	var tokenRule []interface{}
+	for _, tokenItem := range token {
+		tokenRule = append(tokenRule, tokenItem)
+	}
+	var userRule []interface{}
+	for _, userItem := range user {
+		userRule = append(userRule, userItem)
+	}
+
+	logs, sub, err := _Escrow.contract.WatchLogs(opts, "Deposit", tokenRule, userRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(EscrowDeposit)
+				if err := _Escrow.contract.UnpackLog(event, "Deposit", log); err != nil {
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseDeposit is a log parse operation binding the contract event 0x5548c837ab068cf56a2c2479df0882a4922fd203edb7517321831d95078c5f62.
+//
+// Solidity: event Deposit(address indexed token, address indexed user, uint256 amount)
+func (_Escrow *EscrowFilterer) ParseDeposit(log types.Log) (*EscrowDeposit, error) {
+	event := new(EscrowDeposit)
+	if err := _Escrow.contract.UnpackLog(event, "Deposit", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
+
+// EscrowSettledIterator is returned from FilterSettled and is used to iterate over the raw logs and unpacked data for Settled events raised by the Escrow contract.
+type EscrowSettledIterator struct {
+	Event *EscrowSettled // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *EscrowSettledIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(EscrowSettled)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(EscrowSettled)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *EscrowSettledIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *EscrowSettledIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// EscrowSettled represents a Settled event raised by the Escrow contract.
+type EscrowSettled struct {
+	MakerHash [32]byte
+	TakerHash [32]byte
+	Size      *big.Int
+	Price     *big.Int
+	Raw       types.Log // Blockchain specific contextual infos
+}
+
+// FilterSettled is a free log retrieval operation binding the contract event 0x3d366a4e7a8f55c96fdefb618ae465b00ea521df10c8287a3c1de2305e4aeddd.
+//
+// Solidity: event Settled(bytes32 indexed makerHash, bytes32 indexed takerHash, uint256 size, uint256 price)
+func (_Escrow *EscrowFilterer) FilterSettled(opts *bind.FilterOpts, makerHash [][32]byte, takerHash [][32]byte) (*EscrowSettledIterator, error) {
+
+	var makerHashRule []interface{}
+	for _, makerHashItem := range makerHash {
+		makerHashRule = append(makerHashRule, makerHashItem)
+	}
+	var takerHashRule []interface{}
+	for _, takerHashItem := range takerHash {
+		takerHashRule = append(takerHashRule, takerHashItem)
+	}
+
+	logs, sub, err := _Escrow.contract.FilterLogs(opts, "Settled", makerHashRule, takerHashRule)
+	if err != nil {
+		return nil, err
+	}
+	return &EscrowSettledIterator{contract: _Escrow.contract, event: "Settled", logs: logs, sub: sub}, nil
+}
+
+// WatchSettled is a free log subscription operation binding the contract event 0x3d366a4e7a8f55c96fdefb618ae465b00ea521df10c8287a3c1de2305e4aeddd.
+//
+// Solidity: event Settled(bytes32 indexed makerHash, bytes32 indexed takerHash, uint256 size, uint256 price)
+func (_Escrow *EscrowFilterer) WatchSettled(opts *bind.WatchOpts, sink chan<- *EscrowSettled, makerHash [][32]byte, takerHash [][32]byte) (event.Subscription, error) {
+
+	var makerHashRule []interface{}
+	for _, makerHashItem := range makerHash {
+		makerHashRule = append(makerHashRule, makerHashItem)
+	}
+	var takerHashRule []interface{}
+	for _, takerHashItem := range takerHash {
+		takerHashRule = append(takerHashRule, takerHashItem)
+	}
+
+	logs, sub, err := _Escrow.contract.WatchLogs(opts, "Settled", makerHashRule, takerHashRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(EscrowSettled)
+				if err := _Escrow.contract.UnpackLog(event, "Settled", log); err != nil {
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseSettled is a log parse operation binding the contract event 0x3d366a4e7a8f55c96fdefb618ae465b00ea521df10c8287a3c1de2305e4aeddd.
+//
+// Solidity: event Settled(bytes32 indexed makerHash, bytes32 indexed takerHash, uint256 size, uint256 price)
+func (_Escrow *EscrowFilterer) ParseSettled(log types.Log) (*EscrowSettled, error) {
+	event := new(EscrowSettled)
+	if err := _Escrow.contract.UnpackLog(event, "Settled", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
+
+// EscrowWithdrawIterator is returned from FilterWithdraw and is used to iterate over the raw logs and unpacked data for Withdraw events raised by the Escrow contract.
+type EscrowWithdrawIterator struct {
+	Event *EscrowWithdraw // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *EscrowWithdrawIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(EscrowWithdraw)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(EscrowWithdraw)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *EscrowWithdrawIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *EscrowWithdrawIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// EscrowWithdraw represents a Withdraw event raised by the Escrow contract.
+type EscrowWithdraw struct {
+	Token  common.Address
+	User   common.Address
+	Amount *big.Int
+	Raw    types.Log // Blockchain specific contextual infos
+}
+
+// FilterWithdraw is a free log retrieval operation binding the contract event 0x9b1bfa7fa9ee420a16e124f794c35ac9f90472acc99140eb2f6447c714cad8eb.
+//
+// Solidity: event Withdraw(address indexed token, address indexed user, uint256 amount)
+func (_Escrow *EscrowFilterer) FilterWithdraw(opts *bind.FilterOpts, token []common.Address, user []common.Address) (*EscrowWithdrawIterator, error) {
+
+	var tokenRule []interface{}
+	for _, tokenItem := range token {
+		tokenRule = append(tokenRule, tokenItem)
+	}
+	var userRule []interface{}
+	for _, userItem := range user {
+		userRule = append(userRule, userItem)
+	}
+
+	logs, sub, err := _Escrow.contract.FilterLogs(opts, "Withdraw", tokenRule, userRule)
+	if err != nil {
+		return nil, err
+	}
+	return &EscrowWithdrawIterator{contract: _Escrow.contract, event: "Withdraw", logs: logs, sub: sub}, nil
+}
+
+// WatchWithdraw is a free log subscription operation binding the contract event 0x9b1bfa7fa9ee420a16e124f794c35ac9f90472acc99140eb2f6447c714cad8eb.
+//
+// Solidity: event Withdraw(address indexed token, address indexed user, uint256 amount)
+func (_Escrow *EscrowFilterer) WatchWithdraw(opts *bind.WatchOpts, sink chan<- *EscrowWithdraw, token []common.Address, user []common.Address) (event.Subscription, error) {
+
+	var tokenRule []interface{}
+	for _, tokenItem := range token {
+		tokenRule = append(tokenRule, tokenItem)
+	}
+	var userRule []interface{}
+	for _, userItem := range user {
+		userRule = append(userRule, userItem)
+	}
+
+	logs, sub, err := _Escrow.contract.WatchLogs(opts, "Withdraw", tokenRule, userRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(EscrowWithdraw)
+				if err := _Escrow.contract.UnpackLog(event, "Withdraw", log); err != nil {
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseWithdraw is a log parse operation binding the contract event 0x9b1bfa7fa9ee420a16e124f794c35ac9f90472acc99140eb2f6447c714cad8eb.
+//
+// Solidity: event Withdraw(address indexed token, address indexed user, uint256 amount)
+func (_Escrow *EscrowFilterer) ParseWithdraw(log types.Log) (*EscrowWithdraw, error) {
+	event := new(EscrowWithdraw)
+	if err := _Escrow.contract.UnpackLog(event, "Withdraw", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
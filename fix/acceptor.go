@@ -0,0 +1,334 @@
+// Package fix is a FIX 4.4 acceptor for order entry and market data. A
+// counterparty logs on with an API key of its user: Username is the key and
+// Password is SignLogon of its secret. Orders are placed, cancelled and
+// amended on the exchange with NewOrderSingle, OrderCancelRequest and
+// OrderCancelReplaceRequest, and reported with ExecutionReports. A
+// MarketDataRequest is answered with a snapshot of the book.
+package fix
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/server"
+)
+
+// logonMethod is signed in place of the HTTP method by SignLogon.
+const logonMethod = "LOGON"
+
+var (
+	ErrNotLogon       = errors.New("first message is not a logon")
+	ErrLoggedOn       = errors.New("session already logged on")
+	ErrInvalidCompID  = errors.New("invalid CompID")
+	ErrCompIDOwner    = errors.New("CompID belongs to another user")
+	ErrInvalidHeartBt = errors.New("invalid HeartBtInt")
+)
+
+type Config struct {
+	// CompID is the SenderCompID of the exchange.
+	CompID string
+	// StoreDir holds the sequence numbers and the sent messages of every
+	// session.
+	StoreDir string
+	// LogonTimeout is how long a connection may take to log on.
+	LogonTimeout time.Duration
+	WriteTimeout time.Duration
+	// SendBuffer is the number of messages queued for a session before it
+	// is disconnected as a slow consumer.
+	SendBuffer int
+}
+
+var defaultConfig = Config{
+	CompID:       "EXCHANGE",
+	StoreDir:     "fix",
+	LogonTimeout: 10 * time.Second,
+	WriteTimeout: 10 * time.Second,
+	SendBuffer:   1024,
+}
+
+// Acceptor accepts FIX sessions for the users of an exchange.
+type Acceptor struct {
+	ex  *server.Exchange
+	cfg Config
+
+	// execIDPrefix and execIDs make the ExecIDs unique across restarts.
+	execIDPrefix string
+	execIDs      int64
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	// sessions are the logged on sessions by SenderCompID of the
+	// counterparty.
+	sessions map[string]*session
+}
+
+// NewAcceptor returns an acceptor for ex. Zero fields of cfg are set to
+// their defaults.
+func NewAcceptor(ex *server.Exchange, cfg Config) *Acceptor {
+	if cfg.CompID == "" {
+		cfg.CompID = defaultConfig.CompID
+	}
+	if cfg.StoreDir == "" {
+		cfg.StoreDir = defaultConfig.StoreDir
+	}
+	if cfg.LogonTimeout == 0 {
+		cfg.LogonTimeout = defaultConfig.LogonTimeout
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = defaultConfig.WriteTimeout
+	}
+	if cfg.SendBuffer == 0 {
+		cfg.SendBuffer = defaultConfig.SendBuffer
+	}
+
+	return &Acceptor{
+		ex:           ex,
+		cfg:          cfg,
+		execIDPrefix: strconv.FormatInt(time.Now().UnixNano(), 36),
+		conns:        make(map[net.Conn]bool),
+		sessions:     make(map[string]*session),
+	}
+}
+
+func (a *Acceptor) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return a.Serve(l)
+}
+
+// Serve accepts connections on l until the acceptor is closed.
+func (a *Acceptor) Serve(l net.Listener) error {
+	a.mu.Lock()
+	a.listener = l
+	a.mu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"addr":   l.Addr(),
+		"compID": a.cfg.CompID,
+	}).Info("fix acceptor listening")
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		a.mu.Lock()
+		a.conns[conn] = true
+		a.mu.Unlock()
+
+		go a.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections and disconnects every session.
+func (a *Acceptor) Close() error {
+	a.mu.Lock()
+	l := a.listener
+	conns := make([]net.Conn, 0, len(a.conns))
+	for conn := range a.conns {
+		conns = append(conns, conn)
+	}
+	a.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if l == nil {
+		return nil
+	}
+	return l.Close()
+}
+
+func (a *Acceptor) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		a.mu.Lock()
+		delete(a.conns, conn)
+		a.mu.Unlock()
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(a.cfg.LogonTimeout))
+	r := bufio.NewReader(conn)
+	msg, err := ReadMessage(r)
+	if err != nil {
+		return
+	}
+
+	s, err := a.logon(conn, msg)
+	if err != nil {
+		logrus.WithField("remote", conn.RemoteAddr()).Warnf("fix logon: %v", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	s.run(r)
+}
+
+// logon authenticates a Logon, opens the store of its session and answers
+// it.
+func (a *Acceptor) logon(conn net.Conn, msg *Message) (*session, error) {
+	if msg.Type() != MsgLogon {
+		return nil, ErrNotLogon
+	}
+
+	sender, _ := msg.Get(TagSenderCompID)
+	target, _ := msg.Get(TagTargetCompID)
+	if target != a.cfg.CompID || !validSessionID(sender) {
+		return nil, ErrInvalidCompID
+	}
+
+	heartBtInt, err := msg.Int(TagHeartBtInt)
+	if err != nil || heartBtInt <= 0 {
+		return nil, ErrInvalidHeartBt
+	}
+	seq, err := msg.Int(TagMsgSeqNum)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey, err := a.authenticate(msg, sender)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		a:          a,
+		conn:       conn,
+		id:         sender,
+		userID:     apiKey.UserID,
+		scopes:     apiKey.Scopes,
+		authKey:    server.APIKeyAuth(apiKey.Key),
+		ip:         remoteIP(conn),
+		heartBtInt: time.Duration(heartBtInt) * time.Second,
+		out:        make(chan []byte, a.cfg.SendBuffer),
+		done:       make(chan struct{}),
+		lastSent:   time.Now(),
+		lastRecv:   time.Now(),
+		orders:     make(map[int64]*order),
+		clOrdIDs:   make(map[string]int64),
+	}
+
+	a.mu.Lock()
+	if _, ok := a.sessions[sender]; ok {
+		a.mu.Unlock()
+		return nil, ErrLoggedOn
+	}
+	a.sessions[sender] = s
+	a.mu.Unlock()
+
+	store, err := OpenFileStore(a.cfg.StoreDir, sender)
+	if err != nil {
+		a.removeSession(s)
+		return nil, err
+	}
+	// A CompID is owned by the first user who logs on with it, so no other
+	// user can reset its sequence numbers or have its messages resent.
+	switch owner := store.Owner(); {
+	case owner == 0:
+		err = store.SetOwner(s.userID)
+	case owner != s.userID:
+		err = fmt.Errorf("%w: %s", ErrCompIDOwner, sender)
+	}
+	if err == nil && msg.Bool(TagResetSeqNumFlag) {
+		err = store.Reset()
+	}
+	if err != nil {
+		store.Close()
+		a.removeSession(s)
+		return nil, err
+	}
+	s.store = store
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expected := store.NextTargetSeq()
+	if seq < expected {
+		store.Close()
+		a.removeSession(s)
+		return nil, fmt.Errorf("MsgSeqNum too low, expecting %d but received %d", expected, seq)
+	}
+
+	s.restoreOrdersLocked()
+	s.unsubscribe = a.ex.SubscribeUser(s.userID, s.onUserEvent)
+
+	reply := NewMessage(MsgLogon).
+		AddInt(TagEncryptMethod, 0).
+		AddInt(TagHeartBtInt, heartBtInt)
+	if msg.Bool(TagResetSeqNumFlag) {
+		reply.Add(TagResetSeqNumFlag, "Y")
+	}
+	s.sendLocked(reply)
+
+	if seq > expected {
+		s.sendLocked(NewMessage(MsgResendRequest).AddInt(TagBeginSeqNo, expected).AddInt(TagEndSeqNo, 0))
+		s.resendEnd = seq
+	} else {
+		s.setNextTargetLocked(seq + 1)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"session": sender,
+		"user":    s.userID,
+		"remote":  conn.RemoteAddr(),
+	}).Info("fix session logged on")
+
+	return s, nil
+}
+
+// authenticate checks the API key signature of a Logon.
+func (a *Acceptor) authenticate(msg *Message, sender string) (*server.APIKey, error) {
+	key, _ := msg.Get(TagUsername)
+	password, _ := msg.Get(TagPassword)
+	sendingTime, _ := msg.Get(TagSendingTime)
+
+	t, err := time.Parse(TimeFormat, sendingTime)
+	if err != nil {
+		return nil, server.ErrInvalidRequestTS
+	}
+
+	return a.ex.VerifyAPIKey(key, strconv.FormatInt(t.UnixMilli(), 10), sendingTime, password, logonMethod, sender, nil)
+}
+
+// SignLogon returns the Password of a Logon with an API key. It signs the
+// SenderCompID and the SendingTime of the Logon with the secret of the key.
+func SignLogon(secret, senderCompID, sendingTime string) (string, error) {
+	t, err := time.Parse(TimeFormat, sendingTime)
+	if err != nil {
+		return "", err
+	}
+	return server.SignRequest(secret, logonMethod, senderCompID, strconv.FormatInt(t.UnixMilli(), 10), sendingTime, nil), nil
+}
+
+// remoteIP is the IP of the counterparty of conn.
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+func (a *Acceptor) removeSession(s *session) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.sessions[s.id] == s {
+		delete(a.sessions, s.id)
+	}
+}
+
+func (a *Acceptor) nextExecID() string {
+	return a.execIDPrefix + "-" + strconv.FormatInt(atomic.AddInt64(&a.execIDs, 1), 10)
+}
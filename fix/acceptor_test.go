@@ -0,0 +1,424 @@
+package fix
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tahaontech/crypto_exchange/server"
+)
+
+// initiator is the counterparty side of a session in tests.
+type initiator struct {
+	t      *testing.T
+	conn   net.Conn
+	r      *bufio.Reader
+	compID string
+	seq    int
+}
+
+func dial(t *testing.T, addr, compID string, seq int) *initiator {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &initiator{t: t, conn: conn, r: bufio.NewReader(conn), compID: compID, seq: seq}
+}
+
+func (i *initiator) send(msg *Message) {
+	i.t.Helper()
+
+	msg.Set(TagSenderCompID, i.compID).
+		Set(TagTargetCompID, defaultConfig.CompID).
+		Set(TagMsgSeqNum, strconv.Itoa(i.seq))
+	if _, ok := msg.Get(TagSendingTime); !ok {
+		msg.AddTime(TagSendingTime, time.Now())
+	}
+	i.seq++
+
+	if _, err := i.conn.Write(msg.Bytes()); err != nil {
+		i.t.Fatal(err)
+	}
+}
+
+func (i *initiator) logon(apiKey *server.APIKey, heartBtInt int) {
+	i.t.Helper()
+
+	sendingTime := time.Now().UTC().Format(TimeFormat)
+	password, err := SignLogon(apiKey.Secret, i.compID, sendingTime)
+	if err != nil {
+		i.t.Fatal(err)
+	}
+
+	i.send(NewMessage(MsgLogon).
+		Add(TagSendingTime, sendingTime).
+		AddInt(TagEncryptMethod, 0).
+		AddInt(TagHeartBtInt, heartBtInt).
+		Add(TagUsername, apiKey.Key).
+		Add(TagPassword, password))
+}
+
+// read returns the next message, which has to be of the given type and
+// have the given fields.
+func (i *initiator) read(msgType string, fields map[int]string) *Message {
+	i.t.Helper()
+
+	i.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := ReadMessage(i.r)
+	if err != nil {
+		i.t.Fatal(err)
+	}
+
+	if msg.Type() != msgType {
+		i.t.Fatalf("expected message type %s, got %s", msgType, msg)
+	}
+	for tag, value := range fields {
+		if v, _ := msg.Get(tag); v != value {
+			i.t.Fatalf("expected %d=%s, got %s", tag, value, msg)
+		}
+	}
+	return msg
+}
+
+// newTestExchange returns an exchange on a simulated chain with a funded
+// account for every user, by ID starting at 1, and their API keys.
+func newTestExchange(t *testing.T, users int) (*server.Exchange, []*server.APIKey) {
+	t.Helper()
+
+	alloc := core.GenesisAlloc{}
+	keys := make([]*ecdsa.PrivateKey, users)
+	for i := range keys {
+		keys[i] = newKey(t)
+		balance, _ := new(big.Int).SetString("1000000000000000000000", 10)
+		alloc[crypto.PubkeyToAddress(keys[i].PublicKey)] = core.GenesisAccount{Balance: balance}
+	}
+	backend := backends.NewSimulatedBackend(alloc, 30_000_000)
+	t.Cleanup(func() { backend.Close() })
+
+	ex, err := server.NewExchange(newKey(t), backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apiKeys := make([]*server.APIKey, users)
+	for i, key := range keys {
+		apiKeys[i] = registerUser(t, ex, int64(i+1), key)
+	}
+	return ex, apiKeys
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func registerUser(t *testing.T, ex *server.Exchange, id int64, key *ecdsa.PrivateKey) *server.APIKey {
+	t.Helper()
+
+	user, err := server.NewUser(hex.EncodeToString(crypto.FromECDSA(key)), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey, err := ex.RegisterUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apiKey
+}
+
+func startAcceptor(t *testing.T, ex *server.Exchange, dir string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAcceptor(ex, Config{StoreDir: dir})
+	go a.Serve(l)
+	t.Cleanup(func() { a.Close() })
+
+	return l.Addr().String()
+}
+
+func TestAcceptor(t *testing.T) {
+	ex, keys := newTestExchange(t, 2)
+	key, taker := keys[0], keys[1]
+	dir := t.TempDir()
+	addr := startAcceptor(t, ex, dir)
+
+	// A bad signature is disconnected without an answer.
+	bad := dial(t, addr, "CLIENT", 1)
+	bad.logon(&server.APIKey{Key: key.Key, Secret: "wrong"}, 30)
+	bad.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ReadMessage(bad.r); err == nil {
+		t.Fatal("logon with a bad signature was accepted")
+	}
+
+	i := dial(t, addr, "CLIENT", 1)
+	i.logon(key, 30)
+	i.read(MsgLogon, map[int]string{TagMsgSeqNum: "1", TagHeartBtInt: "30"})
+
+	i.send(NewMessage(MsgNewOrderSingle).
+		Add(TagClOrdID, "a1").
+		Add(TagSymbol, "ETH").
+		Add(TagSide, sideBuy).
+		Add(TagOrderQty, "2").
+		Add(TagOrdType, ordTypeLimit).
+		Add(TagPrice, "90"))
+	report := i.read(MsgExecutionReport, map[int]string{TagClOrdID: "a1", TagExecType: execNew, TagOrdStatus: statusNew, TagLeavesQty: "2"})
+	orderID, _ := report.Get(TagOrderID)
+
+	// Fills of matches with orders placed over other gateways are reported.
+	if _, err := ex.PlaceOrder(&server.PlaceOrderRequest{UserID: 2, Type: server.MarketOrder, Size: 0.5, Market: server.MarketETH}, server.APIKeyAuth(taker.Key)); err != nil {
+		t.Fatal(err)
+	}
+	i.read(MsgExecutionReport, map[int]string{
+		TagOrderID:   orderID,
+		TagExecType:  execTrade,
+		TagOrdStatus: statusPartiallyFilled,
+		TagLastQty:   "0.5",
+		TagLastPx:    "90",
+		TagCumQty:    "0.5",
+		TagLeavesQty: "1.5",
+	})
+
+	i.send(NewMessage(MsgOrderCancelReplaceRequest).
+		Add(TagClOrdID, "a2").
+		Add(TagOrigClOrdID, "a1").
+		Add(TagSymbol, "ETH").
+		Add(TagSide, sideBuy).
+		Add(TagOrderQty, "3").
+		Add(TagOrdType, ordTypeLimit).
+		Add(TagPrice, "95"))
+	i.read(MsgExecutionReport, map[int]string{
+		TagOrderID:     orderID,
+		TagClOrdID:     "a2",
+		TagOrigClOrdID: "a1",
+		TagExecType:    execReplaced,
+		TagOrdStatus:   statusPartiallyFilled,
+		TagPrice:       "95",
+		TagLeavesQty:   "2.5",
+	})
+
+	i.send(NewMessage(MsgMarketDataRequest).
+		Add(TagMDReqID, "md1").
+		Add(TagSubscriptionRequestType, "0").
+		AddInt(TagMarketDepth, 1).
+		AddInt(TagNoRelatedSym, 1).
+		Add(TagSymbol, "ETH"))
+	i.read(MsgMarketDataSnapshot, map[int]string{TagMDReqID: "md1", TagNoMDEntries: "1", TagMDEntryType: "0", TagMDEntryPx: "95", TagMDEntrySize: "2.5"})
+
+	i.send(NewMessage(MsgNewOrderSingle).
+		Add(TagClOrdID, "a1").
+		Add(TagSymbol, "ETH").
+		Add(TagSide, sideSell).
+		Add(TagOrderQty, "1").
+		Add(TagOrdType, ordTypeLimit).
+		Add(TagPrice, "100"))
+	i.read(MsgExecutionReport, map[int]string{TagOrderID: "NONE", TagExecType: execRejected, TagOrdRejReason: ordRejDuplicate})
+
+	i.send(NewMessage(MsgOrderCancelRequest).Add(TagClOrdID, "a3").Add(TagOrigClOrdID, "a2").Add(TagSymbol, "ETH").Add(TagSide, sideBuy))
+	i.read(MsgExecutionReport, map[int]string{TagClOrdID: "a3", TagOrigClOrdID: "a2", TagExecType: execCanceled, TagOrdStatus: statusCanceled, TagLeavesQty: "0"})
+
+	i.send(NewMessage(MsgOrderCancelRequest).Add(TagClOrdID, "a4").Add(TagOrigClOrdID, "unknown").Add(TagSymbol, "ETH").Add(TagSide, sideBuy))
+	i.read(MsgOrderCancelReject, map[int]string{TagClOrdID: "a4", TagCxlRejResponseTo: responseToCancel, TagCxlRejReason: cxlRejUnknownOrder})
+
+	i.send(NewMessage(MsgTestRequest).Add(TagTestReqID, "ping"))
+	i.read(MsgHeartbeat, map[int]string{TagTestReqID: "ping"})
+
+	// The Logon is gap filled, the application messages are sent again.
+	i.send(NewMessage(MsgResendRequest).AddInt(TagBeginSeqNo, 1).AddInt(TagEndSeqNo, 3))
+	i.read(MsgSequenceReset, map[int]string{TagMsgSeqNum: "1", TagGapFillFlag: "Y", TagNewSeqNo: "2"})
+	i.read(MsgExecutionReport, map[int]string{TagMsgSeqNum: "2", TagPossDupFlag: "Y", TagExecType: execNew})
+	i.read(MsgExecutionReport, map[int]string{TagMsgSeqNum: "3", TagPossDupFlag: "Y", TagExecType: execTrade})
+
+	// A gap in the sequence numbers of the counterparty is requested.
+	gap := i.seq
+	i.seq++
+	i.send(NewMessage(MsgHeartbeat))
+	i.read(MsgResendRequest, map[int]string{TagBeginSeqNo: strconv.Itoa(gap), TagEndSeqNo: "0"})
+	i.seq = gap
+	i.send(NewMessage(MsgSequenceReset).Set(TagPossDupFlag, "Y").Add(TagGapFillFlag, "Y").AddInt(TagNewSeqNo, gap+2))
+	i.seq = gap + 2
+
+	i.send(NewMessage(MsgLogout))
+	logout := i.read(MsgLogout, nil)
+	next, _ := logout.Int(TagMsgSeqNum)
+
+	// The sequence numbers survive a restart of the acceptor.
+	addr = startAcceptor(t, ex, dir)
+	i = dial(t, addr, "CLIENT", i.seq)
+	i.logon(key, 30)
+	i.read(MsgLogon, map[int]string{TagMsgSeqNum: strconv.Itoa(next + 1)})
+
+	// Sequence numbers lower than expected end the session.
+	i.seq--
+	i.send(NewMessage(MsgHeartbeat))
+	i.read(MsgLogout, nil)
+}
+
+func TestAcceptorCompIDOwner(t *testing.T) {
+	ex, keys := newTestExchange(t, 2)
+	dir := t.TempDir()
+	addr := startAcceptor(t, ex, dir)
+
+	i := dial(t, addr, "CLIENT", 1)
+	i.logon(keys[0], 30)
+	i.read(MsgLogon, map[int]string{TagMsgSeqNum: "1"})
+	i.send(NewMessage(MsgLogout))
+	i.read(MsgLogout, map[int]string{TagMsgSeqNum: "2"})
+
+	// Another user can neither log on to the session nor reset it.
+	other := dial(t, addr, "CLIENT", 1)
+	sendingTime := time.Now().UTC().Format(TimeFormat)
+	password, err := SignLogon(keys[1].Secret, "CLIENT", sendingTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.send(NewMessage(MsgLogon).
+		Add(TagSendingTime, sendingTime).
+		AddInt(TagEncryptMethod, 0).
+		AddInt(TagHeartBtInt, 30).
+		Add(TagResetSeqNumFlag, "Y").
+		Add(TagUsername, keys[1].Key).
+		Add(TagPassword, password))
+	other.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ReadMessage(other.r); err == nil {
+		t.Fatal("logon of another user was accepted")
+	}
+
+	// The owner resumes where the session stopped.
+	i = dial(t, addr, "CLIENT", i.seq)
+	i.logon(keys[0], 30)
+	i.read(MsgLogon, map[int]string{TagMsgSeqNum: "3"})
+}
+
+func TestAcceptorRestoresOrders(t *testing.T) {
+	ex, keys := newTestExchange(t, 2)
+	addr := startAcceptor(t, ex, t.TempDir())
+
+	i := dial(t, addr, "CLIENT", 1)
+	i.logon(keys[0], 30)
+	i.read(MsgLogon, nil)
+	i.send(NewMessage(MsgNewOrderSingle).
+		Add(TagClOrdID, "a1").
+		Add(TagSymbol, "ETH").
+		Add(TagSide, sideBuy).
+		Add(TagOrderQty, "1").
+		Add(TagOrdType, ordTypeLimit).
+		Add(TagPrice, "90"))
+	i.read(MsgExecutionReport, map[int]string{TagClOrdID: "a1", TagExecType: execNew})
+	i.send(NewMessage(MsgOrderCancelReplaceRequest).
+		Add(TagClOrdID, "a2").
+		Add(TagOrigClOrdID, "a1").
+		Add(TagSymbol, "ETH").
+		Add(TagSide, sideBuy).
+		Add(TagOrderQty, "2").
+		Add(TagOrdType, ordTypeLimit).
+		Add(TagPrice, "90"))
+	i.read(MsgExecutionReport, map[int]string{TagClOrdID: "a2", TagExecType: execReplaced})
+	i.send(NewMessage(MsgLogout))
+	i.read(MsgLogout, nil)
+
+	if _, err := ex.PlaceOrder(&server.PlaceOrderRequest{UserID: 2, Type: server.MarketOrder, Size: 0.5, Market: server.MarketETH}, server.APIKeyAuth(keys[1].Key)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The order is known after a reconnect, with the fill it had meanwhile.
+	i = dial(t, addr, "CLIENT", i.seq)
+	i.logon(keys[0], 30)
+	i.read(MsgLogon, nil)
+	i.send(NewMessage(MsgNewOrderSingle).
+		Add(TagClOrdID, "a1").
+		Add(TagSymbol, "ETH").
+		Add(TagSide, sideBuy).
+		Add(TagOrderQty, "1").
+		Add(TagOrdType, ordTypeLimit).
+		Add(TagPrice, "90"))
+	i.read(MsgExecutionReport, map[int]string{TagExecType: execRejected, TagOrdRejReason: ordRejDuplicate})
+	i.send(NewMessage(MsgOrderCancelRequest).Add(TagClOrdID, "a3").Add(TagOrigClOrdID, "a2").Add(TagSymbol, "ETH").Add(TagSide, sideBuy))
+	i.read(MsgExecutionReport, map[int]string{TagClOrdID: "a3", TagOrigClOrdID: "a2", TagExecType: execCanceled, TagCumQty: "0.5"})
+}
+
+func TestAcceptorRateLimits(t *testing.T) {
+	ex, keys := newTestExchange(t, 1)
+	ex.SetRateLimits(server.RateLimitConfig{
+		OrderRate: 0.001, OrderBurst: 1, OrderIPRate: 100, OrderIPBurst: 100,
+		MarketDataRate: 0.001, MarketDataBurst: 1,
+		MinOrders: 100, MaxOrderTradeRatio: 1, RatioWindow: time.Minute,
+	})
+	addr := startAcceptor(t, ex, t.TempDir())
+
+	i := dial(t, addr, "CLIENT", 1)
+	i.logon(keys[0], 30)
+	i.read(MsgLogon, nil)
+
+	newOrder := func(clOrdID string) *Message {
+		return NewMessage(MsgNewOrderSingle).
+			Add(TagClOrdID, clOrdID).
+			Add(TagSymbol, "ETH").
+			Add(TagSide, sideBuy).
+			Add(TagOrderQty, "1").
+			Add(TagOrdType, ordTypeLimit).
+			Add(TagPrice, "90")
+	}
+	i.send(newOrder("a1"))
+	i.read(MsgExecutionReport, map[int]string{TagClOrdID: "a1", TagExecType: execNew})
+	i.send(newOrder("a2"))
+	i.read(MsgExecutionReport, map[int]string{TagClOrdID: "a2", TagExecType: execRejected, TagOrdRejReason: ordRejOther})
+	i.send(NewMessage(MsgOrderCancelRequest).Add(TagClOrdID, "a3").Add(TagOrigClOrdID, "a1").Add(TagSymbol, "ETH").Add(TagSide, sideBuy))
+	i.read(MsgOrderCancelReject, map[int]string{TagClOrdID: "a3", TagCxlRejReason: cxlRejOther})
+
+	marketData := func(mdReqID string) *Message {
+		return NewMessage(MsgMarketDataRequest).
+			Add(TagMDReqID, mdReqID).
+			Add(TagSubscriptionRequestType, "0").
+			AddInt(TagNoRelatedSym, 1).
+			Add(TagSymbol, "ETH")
+	}
+	i.send(marketData("md1"))
+	i.read(MsgMarketDataSnapshot, map[int]string{TagMDReqID: "md1"})
+	i.send(marketData("md2"))
+	i.read(MsgMarketDataRequestReject, map[int]string{TagMDReqID: "md2", TagMDReqRejReason: mdRejInsufficientBandwidth})
+}
+
+func TestAcceptorHeartbeat(t *testing.T) {
+	ex, keys := newTestExchange(t, 1)
+	key := keys[0]
+	addr := startAcceptor(t, ex, t.TempDir())
+
+	i := dial(t, addr, "CLIENT", 1)
+	i.logon(key, 1)
+	i.read(MsgLogon, nil)
+
+	i.read(MsgHeartbeat, nil)
+	// A silent counterparty is sent a TestRequest, and disconnected when
+	// it does not answer.
+	for {
+		i.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msg, err := ReadMessage(i.r)
+		if err != nil {
+			return
+		}
+		if msg.Type() != MsgHeartbeat && msg.Type() != MsgTestRequest {
+			t.Fatalf("unexpected message %s", msg)
+		}
+	}
+}
@@ -0,0 +1,641 @@
+package fix
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/server"
+)
+
+// Values of ExecType, OrdStatus, Side and OrdType.
+const (
+	execNew      = "0"
+	execCanceled = "4"
+	execReplaced = "5"
+	execRejected = "8"
+	execExpired  = "C"
+	execTrade    = "F"
+
+	statusNew             = "0"
+	statusPartiallyFilled = "1"
+	statusFilled          = "2"
+	statusCanceled        = "4"
+	statusRejected        = "8"
+	statusExpired         = "C"
+
+	sideBuy  = "1"
+	sideSell = "2"
+
+	ordTypeMarket = "1"
+	ordTypeLimit  = "2"
+)
+
+// Values of OrdRejReason, CxlRejReason and MDReqRejReason.
+const (
+	ordRejUnknownSymbol = "1"
+	ordRejDuplicate     = "6"
+	ordRejOther         = "99"
+
+	cxlRejTooLate      = "0"
+	cxlRejUnknownOrder = "1"
+	cxlRejDuplicate    = "6"
+	cxlRejOther        = "99"
+
+	mdRejUnknownSymbol         = "0"
+	mdRejInsufficientBandwidth = "2"
+	mdRejUnsupportedType       = "4"
+	mdRejUnsupportedDepth      = "5"
+)
+
+// Values of CxlRejResponseTo.
+const (
+	responseToCancel  = "1"
+	responseToReplace = "2"
+)
+
+// order is an open order placed in a session.
+type order struct {
+	id      int64
+	clOrdID string
+	market  server.Market
+	bid     bool
+	ordType string
+	price   float64
+	qty     float64
+	cumQty  float64
+	// notional is the sum of the fills, for AvgPx.
+	notional float64
+
+	// cancelClOrdID and replace are the requests waiting for the event of
+	// the exchange.
+	cancelClOrdID string
+	replace       *replaceRequest
+}
+
+type replaceRequest struct {
+	clOrdID string
+	qty     float64
+}
+
+func (o *order) avgPx() float64 {
+	if o.cumQty == 0 {
+		return 0
+	}
+	return o.notional / o.cumQty
+}
+
+func (o *order) status() string {
+	if o.cumQty > 0 {
+		return statusPartiallyFilled
+	}
+	return statusNew
+}
+
+func (s *session) handleApplication(msg *Message) {
+	switch msg.Type() {
+	case MsgNewOrderSingle:
+		s.handleNewOrderSingle(msg)
+	case MsgOrderCancelRequest:
+		s.handleOrderCancelRequest(msg)
+	case MsgOrderCancelReplaceRequest:
+		s.handleOrderCancelReplaceRequest(msg)
+	case MsgMarketDataRequest:
+		s.handleMarketDataRequest(msg)
+	}
+}
+
+func (s *session) canTrade() bool {
+	for _, scope := range s.scopes {
+		if scope == server.ScopeTrade {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *session) handleNewOrderSingle(msg *Message) {
+	clOrdID, err := msg.Required(TagClOrdID)
+	if err != nil {
+		s.reject(msg, rejectRequiredTagMissing, err.Error())
+		return
+	}
+
+	o := &order{clOrdID: clOrdID}
+	o.market, o.bid, o.ordType, o.qty, o.price, err = parseOrder(msg)
+	if err != nil {
+		s.rejectOrder(o, ordRejOther, err.Error())
+		return
+	}
+	if !s.canTrade() {
+		s.rejectOrder(o, ordRejOther, fmt.Sprintf("missing %s scope", server.ScopeTrade))
+		return
+	}
+	if err := s.a.ex.AllowOrderEntry(s.authKey, s.userID, s.ip); err != nil {
+		s.rejectOrder(o, ordRejOther, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	if _, ok := s.clOrdIDs[clOrdID]; ok {
+		s.rejectOrderLocked(o, ordRejDuplicate, "duplicate ClOrdID")
+		s.mu.Unlock()
+		return
+	}
+	s.placing = true
+	s.mu.Unlock()
+
+	req := &server.PlaceOrderRequest{
+		UserID: s.userID,
+		Type:   server.LimitOrder,
+		Bid:    o.bid,
+		Size:   o.qty,
+		Price:  o.price,
+		Market: o.market,
+	}
+	if o.ordType == ordTypeMarket {
+		req.Type = server.MarketOrder
+	}
+	resp, err := s.a.ex.PlaceOrder(req, s.authKey)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buffered := s.buffered
+	s.placing, s.buffered = false, nil
+
+	if err != nil {
+		reason := ordRejOther
+		if errors.Is(err, server.ErrMarketNotFound) {
+			reason = ordRejUnknownSymbol
+		}
+		s.rejectOrderLocked(o, reason, err.Error())
+		return
+	}
+
+	s.a.ex.RecordOrder(s.userID)
+	o.id = resp.OrderID
+	s.orders[o.id] = o
+	s.clOrdIDs[clOrdID] = o.id
+	s.saveOrderLocked(clOrdID, o.id)
+	for _, event := range buffered {
+		s.handleUserEventLocked(event)
+	}
+}
+
+func parseOrder(msg *Message) (market server.Market, bid bool, ordType string, qty, price float64, err error) {
+	symbol, err := msg.Required(TagSymbol)
+	if err != nil {
+		return
+	}
+	market = server.Market(symbol)
+
+	switch side, _ := msg.Get(TagSide); side {
+	case sideBuy:
+		bid = true
+	case sideSell:
+	default:
+		err = fmt.Errorf("unsupported Side %q", side)
+		return
+	}
+
+	if qty, err = msg.Float(TagOrderQty); err != nil {
+		return
+	}
+
+	switch ordType, _ = msg.Get(TagOrdType); ordType {
+	case ordTypeLimit:
+		price, err = msg.Float(TagPrice)
+	case ordTypeMarket:
+	default:
+		err = fmt.Errorf("unsupported OrdType %q", ordType)
+	}
+	return
+}
+
+func (s *session) handleOrderCancelRequest(msg *Message) {
+	clOrdID, origClOrdID, err := cancelIDs(msg)
+	if err != nil {
+		s.reject(msg, rejectRequiredTagMissing, err.Error())
+		return
+	}
+
+	o, ok := s.pendingRequest(clOrdID, origClOrdID, responseToCancel, func(o *order) { o.cancelClOrdID = clOrdID })
+	if !ok {
+		return
+	}
+
+	if err := s.a.ex.CancelOrder(s.userID, o.id); err != nil {
+		s.mu.Lock()
+		o.cancelClOrdID = ""
+		s.cancelRejectLocked(clOrdID, origClOrdID, o, responseToCancel, cxlRejectReason(err), err.Error())
+		s.mu.Unlock()
+		return
+	}
+	s.a.ex.RecordOrder(s.userID)
+}
+
+func (s *session) handleOrderCancelReplaceRequest(msg *Message) {
+	clOrdID, origClOrdID, err := cancelIDs(msg)
+	if err != nil {
+		s.reject(msg, rejectRequiredTagMissing, err.Error())
+		return
+	}
+	qty, err := msg.Float(TagOrderQty)
+	if err != nil {
+		s.reject(msg, rejectRequiredTagMissing, err.Error())
+		return
+	}
+	price, err := msg.Float(TagPrice)
+	if err != nil {
+		s.reject(msg, rejectRequiredTagMissing, err.Error())
+		return
+	}
+
+	var size float64
+	o, ok := s.pendingRequest(clOrdID, origClOrdID, responseToReplace, func(o *order) {
+		o.replace = &replaceRequest{clOrdID: clOrdID, qty: qty}
+		size = qty - o.cumQty
+	})
+	if !ok {
+		return
+	}
+
+	// The exchange amends the size left of the order, FIX the quantity
+	// of the whole order.
+	err = fmt.Errorf("%w: OrderQty must exceed CumQty", server.ErrInvalidOrder)
+	if size > 0 {
+		err = s.a.ex.AmendOrder(s.userID, o.id, price, size)
+	}
+	if err != nil {
+		s.mu.Lock()
+		o.replace = nil
+		s.cancelRejectLocked(clOrdID, origClOrdID, o, responseToReplace, cxlRejectReason(err), err.Error())
+		s.mu.Unlock()
+		return
+	}
+	s.a.ex.RecordOrder(s.userID)
+}
+
+func cancelIDs(msg *Message) (string, string, error) {
+	clOrdID, err := msg.Required(TagClOrdID)
+	if err != nil {
+		return "", "", err
+	}
+	origClOrdID, err := msg.Required(TagOrigClOrdID)
+	if err != nil {
+		return "", "", err
+	}
+	return clOrdID, origClOrdID, nil
+}
+
+// pendingRequest looks up the open order of a cancel or replace request
+// and records the request on it with set. Requests for unknown orders, and
+// over the order entry limits, are rejected.
+func (s *session) pendingRequest(clOrdID, origClOrdID, responseTo string, set func(*order)) (*order, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.canTrade() {
+		s.cancelRejectLocked(clOrdID, origClOrdID, nil, responseTo, cxlRejOther, fmt.Sprintf("missing %s scope", server.ScopeTrade))
+		return nil, false
+	}
+	if err := s.a.ex.AllowOrderEntry(s.authKey, s.userID, s.ip); err != nil {
+		s.cancelRejectLocked(clOrdID, origClOrdID, nil, responseTo, cxlRejOther, err.Error())
+		return nil, false
+	}
+
+	id, known := s.clOrdIDs[origClOrdID]
+	o, open := s.orders[id]
+	switch {
+	case !known:
+		s.cancelRejectLocked(clOrdID, origClOrdID, nil, responseTo, cxlRejUnknownOrder, "unknown order")
+		return nil, false
+	case !open:
+		s.cancelRejectLocked(clOrdID, origClOrdID, nil, responseTo, cxlRejTooLate, "order is not open")
+		return nil, false
+	case o.cancelClOrdID != "" || o.replace != nil:
+		s.cancelRejectLocked(clOrdID, origClOrdID, o, responseTo, cxlRejOther, "order has a pending request")
+		return nil, false
+	}
+	if _, ok := s.clOrdIDs[clOrdID]; ok {
+		s.cancelRejectLocked(clOrdID, origClOrdID, o, responseTo, cxlRejDuplicate, "duplicate ClOrdID")
+		return nil, false
+	}
+
+	s.clOrdIDs[clOrdID] = id
+	set(o)
+	return o, true
+}
+
+// saveOrderLocked records the ClOrdID of an order, so the order is known
+// to the session after a reconnect.
+func (s *session) saveOrderLocked(clOrdID string, id int64) {
+	if err := s.store.SaveOrder(clOrdID, id); err != nil {
+		logrus.WithField("session", s.id).Error(err)
+	}
+}
+
+// restoreOrdersLocked rebuilds the open orders of the session from the
+// ClOrdIDs in its store and their state on the exchange, so their events
+// are reported and they can be cancelled and replaced after a reconnect.
+// The ClOrdIDs of orders that are not open anymore are dropped.
+func (s *session) restoreOrdersLocked() {
+	var kept []StoredOrder
+	for _, stored := range s.store.Orders() {
+		if o, ok := s.orders[stored.OrderID]; ok {
+			o.clOrdID = stored.ClOrdID
+		} else {
+			state, err := s.a.ex.Order(s.userID, stored.OrderID)
+			if err != nil || !state.Status.Open() {
+				continue
+			}
+
+			o = &order{
+				id:       state.ID,
+				clOrdID:  stored.ClOrdID,
+				market:   state.Market,
+				bid:      state.Bid,
+				ordType:  ordTypeLimit,
+				price:    state.Price,
+				qty:      state.Size,
+				cumQty:   state.Filled,
+				notional: state.Filled * state.AvgPrice,
+			}
+			if state.Type == server.MarketOrder {
+				o.ordType = ordTypeMarket
+			}
+			s.orders[o.id] = o
+		}
+		s.clOrdIDs[stored.ClOrdID] = stored.OrderID
+		kept = append(kept, stored)
+	}
+
+	if len(kept) < len(s.store.Orders()) {
+		if err := s.store.SetOrders(kept); err != nil {
+			logrus.WithField("session", s.id).Error(err)
+		}
+	}
+}
+
+func cxlRejectReason(err error) string {
+	if errors.Is(err, server.ErrOrderNotFound) {
+		return cxlRejTooLate
+	}
+	return cxlRejOther
+}
+
+// onUserEvent is the handler of the events of the user on the exchange.
+func (s *session) onUserEvent(event server.UserEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	var id int64
+	switch data := event.Data.(type) {
+	case server.OrderUpdate:
+		id = data.OrderID
+	case server.Fill:
+		id = data.OrderID
+	default:
+		return
+	}
+
+	if _, ok := s.orders[id]; !ok {
+		if s.placing {
+			s.buffered = append(s.buffered, event)
+		}
+		return
+	}
+	s.handleUserEventLocked(event)
+}
+
+// handleUserEventLocked reports an event of an order of the session. The
+// events of other orders of the user are ignored.
+func (s *session) handleUserEventLocked(event server.UserEvent) {
+	switch data := event.Data.(type) {
+	case server.OrderUpdate:
+		o, ok := s.orders[data.OrderID]
+		if !ok {
+			return
+		}
+
+		switch data.Status {
+		case server.OrderAccepted:
+			s.sendLocked(s.executionReport(o, execNew, statusNew))
+		case server.OrderCancelled, server.OrderExpired:
+			execType, status := execCanceled, statusCanceled
+			if data.Status == server.OrderExpired {
+				execType, status = execExpired, statusExpired
+			}
+
+			report := s.executionReport(o, execType, status)
+			if o.cancelClOrdID != "" {
+				report.Set(TagClOrdID, o.cancelClOrdID).Add(TagOrigClOrdID, o.clOrdID)
+			}
+			s.sendLocked(report.Set(TagLeavesQty, "0"))
+			delete(s.orders, o.id)
+		case server.OrderAmended:
+			origClOrdID := o.clOrdID
+			if o.replace != nil {
+				o.clOrdID = o.replace.clOrdID
+				o.replace = nil
+				s.saveOrderLocked(o.clOrdID, o.id)
+			}
+			o.price = data.Price
+			o.qty = o.cumQty + data.Size
+
+			report := s.executionReport(o, execReplaced, o.status())
+			if origClOrdID != o.clOrdID {
+				report.Add(TagOrigClOrdID, origClOrdID)
+			}
+			s.sendLocked(report)
+		}
+	case server.Fill:
+		o, ok := s.orders[data.OrderID]
+		if !ok {
+			return
+		}
+
+		o.cumQty += data.Size
+		o.notional += data.Size * data.Price
+
+		status := statusPartiallyFilled
+		if o.cumQty >= o.qty-1e-9 {
+			status = statusFilled
+			delete(s.orders, o.id)
+		}
+		s.sendLocked(s.executionReport(o, execTrade, status).
+			AddFloat(TagLastQty, data.Size).
+			AddFloat(TagLastPx, data.Price))
+	}
+}
+
+func (s *session) executionReport(o *order, execType, status string) *Message {
+	report := NewMessage(MsgExecutionReport).
+		Add(TagOrderID, strconv.FormatInt(o.id, 10)).
+		Add(TagClOrdID, o.clOrdID).
+		Add(TagExecID, s.a.nextExecID()).
+		Add(TagExecType, execType).
+		Add(TagOrdStatus, status).
+		Add(TagSymbol, string(o.market)).
+		Add(TagSide, side(o.bid)).
+		Add(TagOrdType, o.ordType).
+		AddFloat(TagOrderQty, o.qty)
+	if o.ordType == ordTypeLimit {
+		report.AddFloat(TagPrice, o.price)
+	}
+
+	leaves := o.qty - o.cumQty
+	if status == statusFilled || status == statusRejected {
+		leaves = 0
+	}
+	return report.
+		AddFloat(TagLeavesQty, leaves).
+		AddFloat(TagCumQty, o.cumQty).
+		AddFloat(TagAvgPx, o.avgPx()).
+		AddTime(TagTransactTime, time.Now())
+}
+
+func side(bid bool) string {
+	if bid {
+		return sideBuy
+	}
+	return sideSell
+}
+
+func (s *session) reject(ref *Message, reason int, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rejectLocked(ref, reason, text)
+}
+
+func (s *session) rejectOrder(o *order, reason, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rejectOrderLocked(o, reason, text)
+}
+
+// rejectOrderLocked reports an order that was not placed.
+func (s *session) rejectOrderLocked(o *order, reason, text string) {
+	report := s.executionReport(o, execRejected, statusRejected).
+		Set(TagOrderID, "NONE").
+		Add(TagOrdRejReason, reason).
+		Add(TagText, text)
+	s.sendLocked(report)
+}
+
+// cancelRejectLocked reports a cancel or replace request that failed. o is
+// nil for unknown orders.
+func (s *session) cancelRejectLocked(clOrdID, origClOrdID string, o *order, responseTo, reason, text string) {
+	orderID, status := "NONE", statusRejected
+	if o != nil {
+		orderID, status = strconv.FormatInt(o.id, 10), o.status()
+	}
+
+	s.sendLocked(NewMessage(MsgOrderCancelReject).
+		Add(TagOrderID, orderID).
+		Add(TagClOrdID, clOrdID).
+		Add(TagOrigClOrdID, origClOrdID).
+		Add(TagOrdStatus, status).
+		Add(TagCxlRejResponseTo, responseTo).
+		Add(TagCxlRejReason, reason).
+		Add(TagText, text))
+}
+
+// handleMarketDataRequest answers with a snapshot of the book of every
+// requested symbol. Subscriptions to updates are not supported, they are
+// streamed over the websocket.
+func (s *session) handleMarketDataRequest(msg *Message) {
+	mdReqID, err := msg.Required(TagMDReqID)
+	if err != nil {
+		s.reject(msg, rejectRequiredTagMissing, err.Error())
+		return
+	}
+
+	if err := s.a.ex.AllowMarketData(s.ip); err != nil {
+		s.rejectMarketData(mdReqID, mdRejInsufficientBandwidth, err.Error())
+		return
+	}
+	if subType, _ := msg.Get(TagSubscriptionRequestType); subType != "0" {
+		s.rejectMarketData(mdReqID, mdRejUnsupportedType, "only snapshots are supported")
+		return
+	}
+	depth := 0
+	if _, ok := msg.Get(TagMarketDepth); ok {
+		if depth, err = msg.Int(TagMarketDepth); err != nil || depth < 0 {
+			s.rejectMarketData(mdReqID, mdRejUnsupportedDepth, "invalid MarketDepth")
+			return
+		}
+	}
+
+	bids, offers := true, true
+	if types := msg.GetAll(TagMDEntryType); len(types) > 0 {
+		bids, offers = false, false
+		for _, t := range types {
+			bids = bids || t == "0"
+			offers = offers || t == "1"
+		}
+	}
+
+	symbols := msg.GetAll(TagSymbol)
+	if len(symbols) == 0 {
+		s.rejectMarketData(mdReqID, mdRejUnknownSymbol, "no symbol")
+		return
+	}
+
+	snapshots := make([]*Message, 0, len(symbols))
+	for _, symbol := range symbols {
+		book, err := s.a.ex.Levels(server.Market(symbol))
+		if err != nil {
+			s.rejectMarketData(mdReqID, mdRejUnknownSymbol, err.Error())
+			return
+		}
+
+		if !bids {
+			book.Bids = nil
+		}
+		if !offers {
+			book.Asks = nil
+		}
+		if depth > 0 && len(book.Bids) > depth {
+			book.Bids = book.Bids[:depth]
+		}
+		if depth > 0 && len(book.Asks) > depth {
+			book.Asks = book.Asks[:depth]
+		}
+
+		snapshot := NewMessage(MsgMarketDataSnapshot).
+			Add(TagMDReqID, mdReqID).
+			Add(TagSymbol, symbol).
+			AddInt(TagNoMDEntries, len(book.Bids)+len(book.Asks))
+		for _, level := range book.Bids {
+			snapshot.Add(TagMDEntryType, "0").AddFloat(TagMDEntryPx, level.Price).AddFloat(TagMDEntrySize, level.Size)
+		}
+		for _, level := range book.Asks {
+			snapshot.Add(TagMDEntryType, "1").AddFloat(TagMDEntryPx, level.Price).AddFloat(TagMDEntrySize, level.Size)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, snapshot := range snapshots {
+		s.sendLocked(snapshot)
+	}
+}
+
+func (s *session) rejectMarketData(mdReqID, reason, text string) {
+	s.send(NewMessage(MsgMarketDataRequestReject).
+		Add(TagMDReqID, mdReqID).
+		Add(TagMDReqRejReason, reason).
+		Add(TagText, text))
+}
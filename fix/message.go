@@ -0,0 +1,362 @@
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	BeginString = "FIX.4.4"
+
+	// soh separates the fields of a message.
+	soh = '\x01'
+
+	// TimeFormat is the format of UTCTimestamp fields.
+	TimeFormat = "20060102-15:04:05.000"
+)
+
+// Tags of the fields used by the acceptor.
+const (
+	TagAvgPx                   = 6
+	TagBeginSeqNo              = 7
+	TagBeginString             = 8
+	TagBodyLength              = 9
+	TagCheckSum                = 10
+	TagClOrdID                 = 11
+	TagCumQty                  = 14
+	TagEndSeqNo                = 16
+	TagExecID                  = 17
+	TagLastPx                  = 31
+	TagLastQty                 = 32
+	TagMsgSeqNum               = 34
+	TagMsgType                 = 35
+	TagNewSeqNo                = 36
+	TagOrderID                 = 37
+	TagOrderQty                = 38
+	TagOrdStatus               = 39
+	TagOrdType                 = 40
+	TagOrigClOrdID             = 41
+	TagPossDupFlag             = 43
+	TagPrice                   = 44
+	TagRefSeqNum               = 45
+	TagSenderCompID            = 49
+	TagSendingTime             = 52
+	TagSide                    = 54
+	TagSymbol                  = 55
+	TagTargetCompID            = 56
+	TagText                    = 58
+	TagTransactTime            = 60
+	TagEncryptMethod           = 98
+	TagCxlRejReason            = 102
+	TagOrdRejReason            = 103
+	TagHeartBtInt              = 108
+	TagTestReqID               = 112
+	TagOrigSendingTime         = 122
+	TagGapFillFlag             = 123
+	TagResetSeqNumFlag         = 141
+	TagNoRelatedSym            = 146
+	TagExecType                = 150
+	TagLeavesQty               = 151
+	TagMDReqID                 = 262
+	TagSubscriptionRequestType = 263
+	TagMarketDepth             = 264
+	TagNoMDEntryTypes          = 267
+	TagNoMDEntries             = 268
+	TagMDEntryType             = 269
+	TagMDEntryPx               = 270
+	TagMDEntrySize             = 271
+	TagMDReqRejReason          = 281
+	TagRefMsgType              = 372
+	TagSessionRejectReason     = 373
+	TagCxlRejResponseTo        = 434
+	TagUsername                = 553
+	TagPassword                = 554
+)
+
+// MsgType values of the session and application messages.
+const (
+	MsgHeartbeat                 = "0"
+	MsgTestRequest               = "1"
+	MsgResendRequest             = "2"
+	MsgReject                    = "3"
+	MsgSequenceReset             = "4"
+	MsgLogout                    = "5"
+	MsgExecutionReport           = "8"
+	MsgOrderCancelReject         = "9"
+	MsgLogon                     = "A"
+	MsgNewOrderSingle            = "D"
+	MsgOrderCancelRequest        = "F"
+	MsgOrderCancelReplaceRequest = "G"
+	MsgMarketDataRequest         = "V"
+	MsgMarketDataSnapshot        = "W"
+	MsgMarketDataRequestReject   = "Y"
+)
+
+var (
+	// ErrGarbled is returned for messages with a wrong body length or
+	// checksum. They are ignored without consuming a sequence number.
+	ErrGarbled = errors.New("garbled message")
+	// ErrFieldMissing is returned when a required field is not set.
+	ErrFieldMissing = errors.New("required field missing")
+)
+
+type Field struct {
+	Tag   int
+	Value string
+}
+
+// Message is a FIX message. Fields holds the header and body in order,
+// without BeginString, BodyLength and CheckSum, which are added when the
+// message is encoded.
+type Message struct {
+	Fields []Field
+}
+
+// NewMessage returns a message of the given type.
+func NewMessage(msgType string) *Message {
+	return &Message{Fields: []Field{{Tag: TagMsgType, Value: msgType}}}
+}
+
+// Type returns the MsgType of the message.
+func (m *Message) Type() string {
+	t, _ := m.Get(TagMsgType)
+	return t
+}
+
+// Get returns the value of the first field with the tag.
+func (m *Message) Get(tag int) (string, bool) {
+	for _, f := range m.Fields {
+		if f.Tag == tag {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// GetAll returns the values of every field with the tag, in order. It is
+// used to read the entries of repeating groups.
+func (m *Message) GetAll(tag int) []string {
+	var values []string
+	for _, f := range m.Fields {
+		if f.Tag == tag {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// Required returns the value of the field, or ErrFieldMissing.
+func (m *Message) Required(tag int) (string, error) {
+	v, ok := m.Get(tag)
+	if !ok || v == "" {
+		return "", fmt.Errorf("%w: %d", ErrFieldMissing, tag)
+	}
+	return v, nil
+}
+
+// Int returns the value of an integer field.
+func (m *Message) Int(tag int) (int, error) {
+	v, err := m.Required(tag)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value of field %d: %q", tag, v)
+	}
+	return n, nil
+}
+
+// Float returns the value of a decimal field.
+func (m *Message) Float(tag int) (float64, error) {
+	v, err := m.Required(tag)
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value of field %d: %q", tag, v)
+	}
+	return f, nil
+}
+
+// Bool reports whether a boolean field is set to Y.
+func (m *Message) Bool(tag int) bool {
+	v, _ := m.Get(tag)
+	return v == "Y"
+}
+
+// Add appends a field.
+func (m *Message) Add(tag int, value string) *Message {
+	m.Fields = append(m.Fields, Field{Tag: tag, Value: value})
+	return m
+}
+
+func (m *Message) AddInt(tag int, value int) *Message {
+	return m.Add(tag, strconv.Itoa(value))
+}
+
+func (m *Message) AddFloat(tag int, value float64) *Message {
+	return m.Add(tag, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (m *Message) AddTime(tag int, t time.Time) *Message {
+	return m.Add(tag, t.UTC().Format(TimeFormat))
+}
+
+// Set replaces the value of the first field with the tag, or appends it.
+func (m *Message) Set(tag int, value string) *Message {
+	for i, f := range m.Fields {
+		if f.Tag == tag {
+			m.Fields[i].Value = value
+			return m
+		}
+	}
+	return m.Add(tag, value)
+}
+
+// Remove deletes every field with the tag.
+func (m *Message) Remove(tag int) *Message {
+	fields := m.Fields[:0]
+	for _, f := range m.Fields {
+		if f.Tag != tag {
+			fields = append(fields, f)
+		}
+	}
+	m.Fields = fields
+	return m
+}
+
+// headerTags are the fields of the standard header after MsgType, in the
+// order they are encoded.
+var headerTags = []int{TagSenderCompID, TagTargetCompID, TagMsgSeqNum, TagPossDupFlag, TagSendingTime, TagOrigSendingTime}
+
+// Bytes encodes the message with its BeginString, BodyLength and CheckSum.
+// The header fields are moved to the front of the body as the standard
+// requires.
+func (m *Message) Bytes() []byte {
+	var body bytes.Buffer
+	writeField(&body, TagMsgType, m.Type())
+	for _, tag := range headerTags {
+		if v, ok := m.Get(tag); ok {
+			writeField(&body, tag, v)
+		}
+	}
+	for _, f := range m.Fields {
+		if f.Tag != TagMsgType && !isHeaderTag(f.Tag) {
+			writeField(&body, f.Tag, f.Value)
+		}
+	}
+
+	var b bytes.Buffer
+	writeField(&b, TagBeginString, BeginString)
+	writeField(&b, TagBodyLength, strconv.Itoa(body.Len()))
+	b.Write(body.Bytes())
+	writeField(&b, TagCheckSum, fmt.Sprintf("%03d", checksum(b.Bytes())))
+
+	return b.Bytes()
+}
+
+// String shows the message with | instead of SOH, for logs.
+func (m *Message) String() string {
+	return string(bytes.ReplaceAll(m.Bytes(), []byte{soh}, []byte{'|'}))
+}
+
+func isHeaderTag(tag int) bool {
+	for _, t := range headerTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeField(b *bytes.Buffer, tag int, value string) {
+	b.WriteString(strconv.Itoa(tag))
+	b.WriteByte('=')
+	b.WriteString(value)
+	b.WriteByte(soh)
+}
+
+func checksum(b []byte) int {
+	sum := 0
+	for _, c := range b {
+		sum += int(c)
+	}
+	return sum % 256
+}
+
+// ReadMessage reads the next message from r. It returns ErrGarbled for
+// messages that were framed correctly but fail the checks, so the caller
+// can skip them. Any other error means the stream is broken.
+func ReadMessage(r *bufio.Reader) (*Message, error) {
+	prefix := fmt.Sprintf("%d=%s%c%d=", TagBeginString, BeginString, soh, TagBodyLength)
+	head := make([]byte, len(prefix))
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if string(head) != prefix {
+		return nil, fmt.Errorf("unexpected message start %q", head)
+	}
+
+	lengthField, err := r.ReadString(soh)
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(lengthField[:len(lengthField)-1])
+	if err != nil || length <= 0 {
+		return nil, fmt.Errorf("invalid body length %q", lengthField)
+	}
+
+	// The body is followed by the 7 bytes of the CheckSum field.
+	rest := make([]byte, length+7)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	body, trailer := rest[:length], rest[length:]
+	if !bytes.HasPrefix(trailer, []byte("10=")) || trailer[6] != soh {
+		return nil, fmt.Errorf("%w: body length", ErrGarbled)
+	}
+
+	sum, err := strconv.Atoi(string(trailer[3:6]))
+	if err != nil || sum != checksum(append([]byte(prefix+lengthField), body...)) {
+		return nil, fmt.Errorf("%w: checksum", ErrGarbled)
+	}
+
+	msg, err := parseFields(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrGarbled, err)
+	}
+	if len(msg.Fields) == 0 || msg.Fields[0].Tag != TagMsgType {
+		return nil, fmt.Errorf("%w: MsgType is not the first field", ErrGarbled)
+	}
+	return msg, nil
+}
+
+func parseFields(b []byte) (*Message, error) {
+	msg := &Message{}
+	for len(b) > 0 {
+		end := bytes.IndexByte(b, soh)
+		if end < 0 {
+			return nil, errors.New("field not terminated")
+		}
+		field := b[:end]
+		b = b[end+1:]
+
+		eq := bytes.IndexByte(field, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		tag, err := strconv.Atoi(string(field[:eq]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %q", field[:eq])
+		}
+		msg.Fields = append(msg.Fields, Field{Tag: tag, Value: string(field[eq+1:])})
+	}
+	return msg, nil
+}
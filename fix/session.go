@@ -0,0 +1,431 @@
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/server"
+)
+
+// Values of SessionRejectReason.
+const (
+	rejectRequiredTagMissing = 1
+	rejectCompIDProblem      = 9
+	rejectInvalidMsgType     = 11
+)
+
+// session is a logged on FIX session with a counterparty. Messages are
+// read by the goroutine of the connection and written by writeLoop.
+type session struct {
+	a    *Acceptor
+	conn net.Conn
+	// id is the SenderCompID of the counterparty.
+	id      string
+	userID  int64
+	scopes  []server.Scope
+	authKey string
+	// ip is the address of the counterparty, which order entry and market
+	// data are rate limited by.
+	ip         string
+	heartBtInt time.Duration
+
+	// out queues the encoded messages for writeLoop. A nil message closes
+	// the session after the messages before it were written.
+	out         chan []byte
+	done        chan struct{}
+	unsubscribe func()
+
+	mu       sync.Mutex
+	closed   bool
+	store    *FileStore
+	lastSent time.Time
+	lastRecv time.Time
+	// testReqSent is when a TestRequest was sent that was not answered
+	// yet.
+	testReqSent time.Time
+	// resendEnd is the highest sequence number seen while waiting for the
+	// messages requested with a ResendRequest, or zero.
+	resendEnd int
+
+	// orders are the open orders placed in the session by exchange ID,
+	// clOrdIDs maps every ClOrdID used in the session to its order.
+	orders   map[int64]*order
+	clOrdIDs map[string]int64
+	// placing is set while an order is placed. The events of orders that
+	// are not known yet are buffered meanwhile, since the exchange reports
+	// them before the order ID is returned.
+	placing  bool
+	buffered []server.UserEvent
+}
+
+// run handles the messages of the counterparty until the session ends.
+func (s *session) run(r *bufio.Reader) {
+	defer s.close()
+
+	go s.writeLoop()
+	go s.heartbeatLoop()
+
+	for {
+		msg, err := ReadMessage(r)
+		if errors.Is(err, ErrGarbled) {
+			logrus.WithField("session", s.id).Warn(err)
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		// Sessions end with a Logout, which closes the session once
+		// it is written.
+		if !s.handle(msg) {
+			<-s.done
+			return
+		}
+	}
+}
+
+// handle processes a message and reports whether the session goes on.
+func (s *session) handle(msg *Message) bool {
+	s.mu.Lock()
+	process, ok := s.checkSeqLocked(msg)
+	if !ok || !process {
+		s.mu.Unlock()
+		return ok
+	}
+
+	switch msg.Type() {
+	case MsgNewOrderSingle, MsgOrderCancelRequest, MsgOrderCancelReplaceRequest, MsgMarketDataRequest:
+		// Application messages call into the exchange, which publishes
+		// the events of the session with its own locks held.
+		s.mu.Unlock()
+		s.handleApplication(msg)
+		return true
+	}
+	defer s.mu.Unlock()
+
+	switch msg.Type() {
+	case MsgHeartbeat, MsgSequenceReset:
+	case MsgTestRequest:
+		heartbeat := NewMessage(MsgHeartbeat)
+		if id, ok := msg.Get(TagTestReqID); ok {
+			heartbeat.Add(TagTestReqID, id)
+		}
+		s.sendLocked(heartbeat)
+	case MsgResendRequest:
+		s.handleResendRequestLocked(msg)
+	case MsgReject:
+		text, _ := msg.Get(TagText)
+		logrus.WithFields(logrus.Fields{"session": s.id, "text": text}).Warn("message rejected by counterparty")
+	case MsgLogout:
+		s.logoutLocked("")
+		return false
+	case MsgLogon:
+		s.rejectLocked(msg, 0, "already logged on")
+	default:
+		s.rejectLocked(msg, rejectInvalidMsgType, "unsupported message type")
+	}
+	return true
+}
+
+// checkSeqLocked checks the header of a received message. It reports
+// whether the message is processed, and whether the session goes on.
+func (s *session) checkSeqLocked(msg *Message) (bool, bool) {
+	s.lastRecv = time.Now()
+	s.testReqSent = time.Time{}
+
+	sender, _ := msg.Get(TagSenderCompID)
+	target, _ := msg.Get(TagTargetCompID)
+	if sender != s.id || target != s.a.cfg.CompID {
+		s.rejectLocked(msg, rejectCompIDProblem, "CompID problem")
+		s.logoutLocked("CompID problem")
+		return false, false
+	}
+
+	seq, err := msg.Int(TagMsgSeqNum)
+	if err != nil {
+		s.logoutLocked("MsgSeqNum missing")
+		return false, false
+	}
+	expected := s.store.NextTargetSeq()
+
+	// A SequenceReset in reset mode sets the next sequence number whatever
+	// its own.
+	if msg.Type() == MsgSequenceReset && !msg.Bool(TagGapFillFlag) {
+		s.sequenceResetLocked(msg, expected)
+		return false, true
+	}
+
+	switch {
+	case seq > expected:
+		// Resend requests are answered right away, the gap is filled
+		// by the counterparty afterwards.
+		if msg.Type() == MsgResendRequest {
+			s.handleResendRequestLocked(msg)
+		}
+		if s.resendEnd == 0 {
+			s.sendLocked(NewMessage(MsgResendRequest).AddInt(TagBeginSeqNo, expected).AddInt(TagEndSeqNo, 0))
+		}
+		if seq > s.resendEnd {
+			s.resendEnd = seq
+		}
+		return false, true
+	case seq < expected:
+		if msg.Bool(TagPossDupFlag) {
+			return false, true
+		}
+		s.logoutLocked(fmt.Sprintf("MsgSeqNum too low, expecting %d but received %d", expected, seq))
+		return false, false
+	}
+
+	next := seq + 1
+	if msg.Type() == MsgSequenceReset {
+		if newSeq, err := msg.Int(TagNewSeqNo); err == nil && newSeq > next {
+			next = newSeq
+		}
+	}
+	s.setNextTargetLocked(next)
+
+	return true, true
+}
+
+func (s *session) sequenceResetLocked(msg *Message, expected int) {
+	newSeq, err := msg.Int(TagNewSeqNo)
+	if err != nil {
+		s.rejectLocked(msg, rejectRequiredTagMissing, err.Error())
+		return
+	}
+	if newSeq < expected {
+		s.rejectLocked(msg, 0, fmt.Sprintf("NewSeqNo %d lower than expected %d", newSeq, expected))
+		return
+	}
+	s.setNextTargetLocked(newSeq)
+}
+
+func (s *session) setNextTargetLocked(next int) {
+	if err := s.store.SetNextTargetSeq(next); err != nil {
+		logrus.WithField("session", s.id).Error(err)
+	}
+	if s.resendEnd != 0 && next > s.resendEnd {
+		s.resendEnd = 0
+	}
+}
+
+// handleResendRequestLocked sends the requested messages again. Session
+// messages are replaced by gap fills, which are not stored.
+func (s *session) handleResendRequestLocked(msg *Message) {
+	begin, err := msg.Int(TagBeginSeqNo)
+	if err != nil {
+		s.rejectLocked(msg, rejectRequiredTagMissing, err.Error())
+		return
+	}
+	end, err := msg.Int(TagEndSeqNo)
+	if err != nil {
+		s.rejectLocked(msg, rejectRequiredTagMissing, err.Error())
+		return
+	}
+
+	last := s.store.NextSenderSeq() - 1
+	if end == 0 || end > last {
+		end = last
+	}
+	if begin < 1 {
+		begin = 1
+	}
+
+	gapStart := 0
+	fillGap := func(next int) {
+		if gapStart == 0 {
+			return
+		}
+		s.queueLocked(s.headerLocked(NewMessage(MsgSequenceReset), gapStart).
+			Set(TagPossDupFlag, "Y").
+			Add(TagGapFillFlag, "Y").
+			AddInt(TagNewSeqNo, next).
+			Bytes())
+		gapStart = 0
+	}
+
+	for seq := begin; seq <= end; seq++ {
+		var sent *Message
+		if b, ok := s.store.Message(seq); ok {
+			sent, _ = ReadMessage(bufio.NewReader(bytes.NewReader(b)))
+		}
+		if sent == nil || isSessionMessage(sent.Type()) {
+			if gapStart == 0 {
+				gapStart = seq
+			}
+			continue
+		}
+
+		fillGap(seq)
+		origSendingTime, _ := sent.Get(TagSendingTime)
+		sent.Set(TagPossDupFlag, "Y").
+			Set(TagOrigSendingTime, origSendingTime).
+			Set(TagSendingTime, time.Now().UTC().Format(TimeFormat))
+		s.queueLocked(sent.Bytes())
+	}
+	fillGap(end + 1)
+}
+
+// isSessionMessage reports whether messages of the type are gap filled
+// instead of being sent again.
+func isSessionMessage(msgType string) bool {
+	switch msgType {
+	case MsgHeartbeat, MsgTestRequest, MsgResendRequest, MsgSequenceReset, MsgLogout, MsgLogon:
+		return true
+	}
+	return false
+}
+
+func (s *session) rejectLocked(ref *Message, reason int, text string) {
+	reject := NewMessage(MsgReject)
+	if seq, ok := ref.Get(TagMsgSeqNum); ok {
+		reject.Add(TagRefSeqNum, seq)
+	}
+	reject.Add(TagRefMsgType, ref.Type())
+	if reason != 0 {
+		reject.AddInt(TagSessionRejectReason, reason)
+	}
+	reject.Add(TagText, text)
+
+	s.sendLocked(reject)
+}
+
+// logoutLocked sends a Logout and closes the session once it is written.
+func (s *session) logoutLocked(text string) {
+	logout := NewMessage(MsgLogout)
+	if text != "" {
+		logout.Add(TagText, text)
+		logrus.WithFields(logrus.Fields{"session": s.id, "text": text}).Warn("logging out")
+	}
+	s.sendLocked(logout)
+	s.queueLocked(nil)
+}
+
+func (s *session) send(msg *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sendLocked(msg)
+}
+
+// sendLocked sends msg with the next sequence number and stores it for
+// resend requests.
+func (s *session) sendLocked(msg *Message) {
+	if s.closed {
+		return
+	}
+
+	seq := s.store.NextSenderSeq()
+	b := s.headerLocked(msg, seq).Bytes()
+	if err := s.store.SaveMessage(seq, b); err != nil {
+		logrus.WithField("session", s.id).Error(err)
+	}
+	if err := s.store.SetNextSenderSeq(seq + 1); err != nil {
+		logrus.WithField("session", s.id).Error(err)
+	}
+
+	s.queueLocked(b)
+}
+
+func (s *session) headerLocked(msg *Message, seq int) *Message {
+	return msg.Set(TagSenderCompID, s.a.cfg.CompID).
+		Set(TagTargetCompID, s.id).
+		Set(TagMsgSeqNum, strconv.Itoa(seq)).
+		Set(TagSendingTime, time.Now().UTC().Format(TimeFormat))
+}
+
+// queueLocked hands an encoded message to writeLoop. A counterparty that
+// does not keep up is disconnected.
+func (s *session) queueLocked(b []byte) {
+	if s.closed {
+		return
+	}
+	s.lastSent = time.Now()
+
+	select {
+	case s.out <- b:
+	default:
+		logrus.WithField("session", s.id).Warn("disconnecting slow session")
+		go s.close()
+	}
+}
+
+func (s *session) writeLoop() {
+	for {
+		select {
+		case b := <-s.out:
+			if b == nil {
+				s.close()
+				return
+			}
+			s.conn.SetWriteDeadline(time.Now().Add(s.a.cfg.WriteTimeout))
+			if _, err := s.conn.Write(b); err != nil {
+				s.close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// heartbeatLoop sends a Heartbeat when nothing was sent for the heartbeat
+// interval, and a TestRequest when nothing was received. A counterparty
+// that does not answer the TestRequest within the interval is
+// disconnected.
+func (s *session) heartbeatLoop() {
+	ticker := time.NewTicker(s.heartBtInt / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			if !s.testReqSent.IsZero() && now.Sub(s.testReqSent) > s.heartBtInt {
+				s.mu.Unlock()
+				logrus.WithField("session", s.id).Warn("heartbeat timeout")
+				s.close()
+				return
+			}
+			if s.testReqSent.IsZero() && now.Sub(s.lastRecv) > s.heartBtInt+s.heartBtInt/5 {
+				s.testReqSent = now
+				s.sendLocked(NewMessage(MsgTestRequest).Add(TagTestReqID, now.UTC().Format(TimeFormat)))
+			} else if now.Sub(s.lastSent) >= s.heartBtInt {
+				s.sendLocked(NewMessage(MsgHeartbeat))
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *session) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	if err := s.store.Close(); err != nil {
+		logrus.WithField("session", s.id).Error(err)
+	}
+	s.mu.Unlock()
+
+	close(s.done)
+	s.conn.Close()
+	if s.unsubscribe != nil {
+		s.unsubscribe()
+	}
+	s.a.removeSession(s)
+
+	logrus.WithField("session", s.id).Info("fix session closed")
+}
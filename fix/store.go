@@ -0,0 +1,327 @@
+package fix
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxStoredMessages is the number of sent messages a store keeps in memory
+// for resend requests. Older messages are gap filled.
+const maxStoredMessages = 10000
+
+// FileStore persists the sequence numbers and the sent messages of a
+// session, so that a session resumes where it stopped after a restart and
+// can answer resend requests, the user who owns the session, and the
+// ClOrdIDs of its orders. It is not safe for concurrent use; sessions
+// serialize their access to it.
+type FileStore struct {
+	seqPath    string
+	msgPath    string
+	ownerPath  string
+	ordersPath string
+	msgFile    *os.File
+	ordersFile *os.File
+
+	owner      int64
+	nextSender int
+	nextTarget int
+	// messages are the last maxStoredMessages sent messages by sequence
+	// number.
+	messages map[int][]byte
+	// orders are the ClOrdIDs of the orders of the session, in the order
+	// they were given.
+	orders []StoredOrder
+}
+
+// StoredOrder is a ClOrdID of an order placed in a session.
+type StoredOrder struct {
+	ClOrdID string
+	OrderID int64
+}
+
+// OpenFileStore opens the store of the session in dir, creating it for a
+// new session.
+func OpenFileStore(dir, sessionID string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{
+		seqPath:    filepath.Join(dir, sessionID+".seqnums"),
+		msgPath:    filepath.Join(dir, sessionID+".messages"),
+		ownerPath:  filepath.Join(dir, sessionID+".owner"),
+		ordersPath: filepath.Join(dir, sessionID+".orders"),
+		nextSender: 1,
+		nextTarget: 1,
+		messages:   make(map[int][]byte),
+	}
+
+	if err := s.loadOwner(); err != nil {
+		return nil, err
+	}
+	if err := s.loadSeqNums(); err != nil {
+		return nil, err
+	}
+	if err := s.loadMessages(); err != nil {
+		return nil, err
+	}
+	if err := s.loadOrders(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(s.msgPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	s.msgFile = f
+
+	if s.ordersFile, err = os.OpenFile(s.ordersPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600); err != nil {
+		s.msgFile.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) loadOwner() error {
+	b, err := os.ReadFile(s.ownerPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.owner, err = strconv.ParseInt(string(b), 10, 64); err != nil {
+		return fmt.Errorf("reading %s: %w", s.ownerPath, err)
+	}
+	return nil
+}
+
+func (s *FileStore) loadSeqNums() error {
+	b, err := os.ReadFile(s.seqPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Sscanf(string(b), "%d:%d", &s.nextSender, &s.nextTarget); err != nil {
+		return fmt.Errorf("reading %s: %w", s.seqPath, err)
+	}
+	return nil
+}
+
+func (s *FileStore) loadMessages() error {
+	f, err := os.Open(s.msgPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		header, err := r.ReadString('\n')
+		if err == io.EOF {
+			if header != "" {
+				return s.truncateMessages(offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var seq, length int
+		if _, err := fmt.Sscanf(header, "%d,%d\n", &seq, &length); err != nil {
+			return fmt.Errorf("reading %s: %w", s.msgPath, err)
+		}
+		msg := make([]byte, length)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			// A message cut short by a crash was never sent, and is cut
+			// off so the next message is appended after the last whole
+			// one.
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				return s.truncateMessages(offset)
+			}
+			return err
+		}
+		offset += int64(len(header) + length)
+		s.keepMessage(seq, msg)
+	}
+}
+
+func (s *FileStore) truncateMessages(size int64) error {
+	if err := os.Truncate(s.msgPath, size); err != nil {
+		return fmt.Errorf("truncating %s: %w", s.msgPath, err)
+	}
+	return nil
+}
+
+// keepMessage keeps a sent message in memory, dropping the oldest one
+// beyond maxStoredMessages.
+func (s *FileStore) keepMessage(seq int, msg []byte) {
+	s.messages[seq] = msg
+	delete(s.messages, seq-maxStoredMessages)
+}
+
+func (s *FileStore) loadOrders() error {
+	f, err := os.Open(s.ordersPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		clOrdID, id, ok := strings.Cut(scanner.Text(), ",")
+		orderID, err := strconv.ParseInt(id, 10, 64)
+		if !ok || err != nil {
+			// Only the last line can be cut short by a crash.
+			break
+		}
+		s.orders = append(s.orders, StoredOrder{ClOrdID: clOrdID, OrderID: orderID})
+	}
+	return scanner.Err()
+}
+
+// Owner is the ID of the user who owns the session, or 0 for a session
+// nobody logged on to yet.
+func (s *FileStore) Owner() int64 {
+	return s.owner
+}
+
+// SetOwner gives the session to a user. It is kept by Reset.
+func (s *FileStore) SetOwner(userID int64) error {
+	tmp := s.ownerPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(userID, 10)), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.ownerPath); err != nil {
+		return err
+	}
+	s.owner = userID
+	return nil
+}
+
+// NextSenderSeq is the sequence number of the next message sent.
+func (s *FileStore) NextSenderSeq() int {
+	return s.nextSender
+}
+
+// NextTargetSeq is the sequence number expected of the next message
+// received.
+func (s *FileStore) NextTargetSeq() int {
+	return s.nextTarget
+}
+
+func (s *FileStore) SetNextSenderSeq(seq int) error {
+	s.nextSender = seq
+	return s.saveSeqNums()
+}
+
+func (s *FileStore) SetNextTargetSeq(seq int) error {
+	s.nextTarget = seq
+	return s.saveSeqNums()
+}
+
+func (s *FileStore) saveSeqNums() error {
+	tmp := s.seqPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d:%d", s.nextSender, s.nextTarget)), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.seqPath)
+}
+
+// SaveMessage keeps a sent message for resend requests.
+func (s *FileStore) SaveMessage(seq int, msg []byte) error {
+	s.keepMessage(seq, msg)
+
+	record := strconv.Itoa(seq) + "," + strconv.Itoa(len(msg)) + "\n" + string(msg)
+	_, err := s.msgFile.WriteString(record)
+	return err
+}
+
+// Message returns the sent message with the sequence number.
+func (s *FileStore) Message(seq int) ([]byte, bool) {
+	msg, ok := s.messages[seq]
+	return msg, ok
+}
+
+// Orders returns the ClOrdIDs of the orders of the session, oldest first.
+func (s *FileStore) Orders() []StoredOrder {
+	return s.orders
+}
+
+// SaveOrder records the ClOrdID an order was placed or replaced with.
+func (s *FileStore) SaveOrder(clOrdID string, orderID int64) error {
+	s.orders = append(s.orders, StoredOrder{ClOrdID: clOrdID, OrderID: orderID})
+
+	_, err := s.ordersFile.WriteString(clOrdID + "," + strconv.FormatInt(orderID, 10) + "\n")
+	return err
+}
+
+// SetOrders replaces the recorded ClOrdIDs, to drop those of orders that
+// are not open anymore.
+func (s *FileStore) SetOrders(orders []StoredOrder) error {
+	var b strings.Builder
+	for _, o := range orders {
+		b.WriteString(o.ClOrdID + "," + strconv.FormatInt(o.OrderID, 10) + "\n")
+	}
+
+	tmp := s.ordersPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.ordersPath); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.ordersPath, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	s.ordersFile.Close()
+	s.ordersFile = f
+	s.orders = orders
+	return nil
+}
+
+// Reset starts the session over at sequence number 1. The orders of the
+// session are kept, as they stay open.
+func (s *FileStore) Reset() error {
+	s.messages = make(map[int][]byte)
+	if err := s.msgFile.Truncate(0); err != nil {
+		return err
+	}
+
+	s.nextSender, s.nextTarget = 1, 1
+	return s.saveSeqNums()
+}
+
+func (s *FileStore) Close() error {
+	s.ordersFile.Close()
+	return s.msgFile.Close()
+}
+
+// validSessionID reports whether id can name the files of a store.
+func validSessionID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	return strings.Trim(id, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._-") == "" &&
+		!strings.HasPrefix(id, ".")
+}
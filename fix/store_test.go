@@ -0,0 +1,61 @@
+package fix
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenFileStore(dir, "CLIENT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := 1; seq <= maxStoredMessages+2; seq++ {
+		if err := s.SaveMessage(seq, []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := s.Message(2); ok {
+		t.Fatal("message beyond the bound was kept")
+	}
+	if err := s.SaveOrder("a1", 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record cut short by a crash is cut off, and the next one is
+	// appended after the last whole record.
+	f, err := os.OpenFile(filepath.Join(dir, "CLIENT.messages"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("10003,10\nmsg")
+	f.Close()
+
+	for i := 0; i < 2; i++ {
+		if s, err = OpenFileStore(dir, "CLIENT"); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if err := s.SaveMessage(maxStoredMessages+3, []byte("last")); err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+		}
+	}
+	defer s.Close()
+
+	if msg, ok := s.Message(maxStoredMessages + 3); !ok || string(msg) != "last" {
+		t.Fatalf("expected the message after the cut off record, got %q", msg)
+	}
+	if _, ok := s.Message(1); ok {
+		t.Fatal("message beyond the bound was loaded")
+	}
+	if orders := s.Orders(); len(orders) != 1 || orders[0] != (StoredOrder{ClOrdID: "a1", OrderID: 7}) {
+		t.Fatalf("unexpected orders %v", orders)
+	}
+}
@@ -0,0 +1,549 @@
+// Package journal is a durable append-only log of records on local disk.
+// Records are numbered by sequence, starting at 1, and written to segment
+// files named after the sequence number of their first record. A new
+// segment is started when the current one reaches the segment size.
+//
+// Every record is framed by a header of its length, the CRC-32C of its
+// sequence number and data, and its sequence number. A record cut short or
+// damaged by a crash at the end of the last segment is truncated when the
+// journal is opened; damage anywhere else is reported as ErrCorrupt.
+//
+// A failed fsync can not be retried, as the kernel may have dropped the
+// pages it failed to write, so it fails the journal: every later Append
+// returns ErrFailed until the journal is opened again.
+package journal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SyncEvery fsyncs every record before Append returns.
+	SyncEvery SyncPolicy = "every"
+	// SyncBatch fsyncs after every BatchSize records.
+	SyncBatch SyncPolicy = "batch"
+	// SyncInterval fsyncs the records written in the last Interval in the
+	// background.
+	SyncInterval SyncPolicy = "interval"
+
+	segmentExt = ".journal"
+	// headerSize is the size of the length, checksum and sequence number
+	// in front of every record.
+	headerSize = 16
+	// maxRecordSize bounds the length read from a header, so a damaged
+	// length is not allocated.
+	maxRecordSize = 16 << 20
+)
+
+type SyncPolicy string
+
+var (
+	ErrCorrupt  = errors.New("journal corrupt")
+	ErrClosed   = errors.New("journal closed")
+	ErrTooLarge = errors.New("record too large")
+	ErrFailed   = errors.New("journal failed")
+	// ErrCompacted is returned by Read for records removed by Compact.
+	ErrCompacted = errors.New("records compacted")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type Config struct {
+	Sync SyncPolicy
+	// BatchSize is the number of records between fsyncs with SyncBatch.
+	BatchSize int
+	// Interval is the time between fsyncs with SyncInterval.
+	Interval time.Duration
+	// SegmentSize is the size in bytes at which a new segment is started.
+	SegmentSize int64
+}
+
+var defaultConfig = Config{
+	Sync:        SyncEvery,
+	BatchSize:   64,
+	Interval:    100 * time.Millisecond,
+	SegmentSize: 64 << 20,
+}
+
+// segment is the file of the segment written to. It is an interface so
+// tests can fail its writes and fsyncs.
+type segment interface {
+	io.WriteSeeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// Journal appends records to the segments in a directory. It is safe for
+// concurrent use.
+type Journal struct {
+	dir string
+	cfg Config
+
+	mu   sync.Mutex
+	file segment
+	size int64
+	next uint64
+	// unsynced is the number of records written since the last fsync.
+	unsynced int
+	// failed is the error that failed the journal.
+	failed error
+	closed bool
+	done   chan struct{}
+}
+
+// Open opens the journal in dir, creating it if it does not exist, to
+// append records after the last one. Zero fields of cfg are set to their
+// defaults.
+func Open(dir string, cfg Config) (*Journal, error) {
+	if cfg.Sync == "" {
+		cfg.Sync = defaultConfig.Sync
+	}
+	if cfg.Sync != SyncEvery && cfg.Sync != SyncBatch && cfg.Sync != SyncInterval {
+		return nil, fmt.Errorf("unknown sync policy %q", cfg.Sync)
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = defaultConfig.BatchSize
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultConfig.Interval
+	}
+	if cfg.SegmentSize == 0 {
+		cfg.SegmentSize = defaultConfig.SegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		dir:  dir,
+		cfg:  cfg,
+		next: 1,
+		done: make(chan struct{}),
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		if err := j.createSegment(); err != nil {
+			return nil, err
+		}
+	} else if err := j.openLast(segments[len(segments)-1]); err != nil {
+		return nil, err
+	}
+
+	if cfg.Sync == SyncInterval {
+		go j.syncLoop()
+	}
+
+	return j, nil
+}
+
+// openLast opens the last segment for appending, truncating a damaged
+// record at its end.
+func (j *Journal) openLast(first uint64) error {
+	path := segmentPath(j.dir, first)
+	f, err := os.OpenFile(path, os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+
+	j.next = first
+	end, err := scan(f, first, func(seq uint64, data []byte) error {
+		j.next = seq + 1
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrCorrupt) {
+		f.Close()
+		return err
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"segment": path,
+			"offset":  end,
+		}).Warnf("truncating damaged journal tail: %v", err)
+
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	j.file = f
+	j.size = end
+	return nil
+}
+
+// createSegment starts a segment with the next record. It must be called
+// with the lock held.
+func (j *Journal) createSegment() error {
+	f, err := os.OpenFile(segmentPath(j.dir, j.next), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(j.dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	j.file = f
+	j.size = 0
+	return nil
+}
+
+// Append writes a record and returns its sequence number. The record is
+// durable when Append returns with SyncEvery, and after the next fsync with
+// the other policies.
+func (j *Journal) Append(data []byte) (uint64, error) {
+	if len(data) > maxRecordSize {
+		return 0, ErrTooLarge
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return 0, ErrClosed
+	}
+	if j.failed != nil {
+		return 0, fmt.Errorf("%w: %v", ErrFailed, j.failed)
+	}
+
+	record := encode(j.next, data)
+	if j.size > 0 && j.size+int64(len(record)) > j.cfg.SegmentSize {
+		if err := j.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := j.file.Write(record); err != nil {
+		// A record written in part would end the journal when it is
+		// read, losing the records appended after it, so it is cut off.
+		j.cutLocked()
+		return 0, err
+	}
+	j.unsynced++
+
+	switch {
+	case j.cfg.Sync == SyncEvery,
+		j.cfg.Sync == SyncBatch && j.unsynced >= j.cfg.BatchSize:
+		if err := j.syncLocked(); err != nil {
+			// The record is not appended, and cut off in case its
+			// pages make it to disk anyway.
+			j.cutLocked()
+			return 0, err
+		}
+	}
+
+	seq := j.next
+	j.next++
+	j.size += int64(len(record))
+	return seq, nil
+}
+
+// cutLocked truncates the segment to the records appended, failing the
+// journal if it can not. It must be called with the lock held.
+func (j *Journal) cutLocked() {
+	if err := j.file.Truncate(j.size); err != nil {
+		j.failLocked(fmt.Errorf("truncating a partial record: %w", err))
+		return
+	}
+	if _, err := j.file.Seek(j.size, io.SeekStart); err != nil {
+		j.failLocked(fmt.Errorf("truncating a partial record: %w", err))
+	}
+}
+
+// failLocked fails the journal with err. It must be called with the lock
+// held.
+func (j *Journal) failLocked(err error) {
+	if j.failed != nil {
+		return
+	}
+	j.failed = err
+	logrus.Errorf("journal failed, no more records are appended: %v", err)
+}
+
+// rotate closes the current segment and starts the next one. It must be
+// called with the lock held.
+func (j *Journal) rotate() error {
+	if err := j.syncLocked(); err != nil {
+		return err
+	}
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	return j.createSegment()
+}
+
+// Sync fsyncs the records written so far.
+func (j *Journal) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return ErrClosed
+	}
+	return j.syncLocked()
+}
+
+func (j *Journal) syncLocked() error {
+	if j.failed != nil {
+		return fmt.Errorf("%w: %v", ErrFailed, j.failed)
+	}
+	if j.unsynced == 0 {
+		return nil
+	}
+	if err := j.file.Sync(); err != nil {
+		j.failLocked(fmt.Errorf("fsync: %w", err))
+		return fmt.Errorf("%w: %v", ErrFailed, j.failed)
+	}
+	j.unsynced = 0
+	return nil
+}
+
+func (j *Journal) syncLoop() {
+	ticker := time.NewTicker(j.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-ticker.C:
+			err := j.Sync()
+			if err != nil && !errors.Is(err, ErrClosed) && !errors.Is(err, ErrFailed) {
+				logrus.Errorf("journal sync: %v", err)
+			}
+		}
+	}
+}
+
+// NextSeq is the sequence number of the next record appended.
+func (j *Journal) NextSeq() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.next
+}
+
+// Compact removes the segments that only hold records before sequence
+// number before. The segment written to is kept.
+func (j *Journal) Compact(before uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return ErrClosed
+	}
+
+	segments, err := listSegments(j.dir)
+	if err != nil {
+		return err
+	}
+
+	removed := false
+	for i := 0; i+1 < len(segments) && segments[i+1] <= before; i++ {
+		if err := os.Remove(segmentPath(j.dir, segments[i])); err != nil {
+			return err
+		}
+		removed = true
+	}
+	if !removed {
+		return nil
+	}
+	return syncDir(j.dir)
+}
+
+// Close fsyncs and closes the journal.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	close(j.done)
+
+	if err := j.syncLocked(); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
+
+// Read calls fn with the records in dir from sequence number from on, in
+// order. A damaged record at the end of the last segment ends the journal,
+// as it was never durably written.
+func Read(dir string, from uint64, fn func(seq uint64, data []byte) error) error {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	if len(segments) > 0 && segments[0] > from {
+		return fmt.Errorf("%w: journal starts at record %d", ErrCompacted, segments[0])
+	}
+
+	for i, first := range segments {
+		last := i == len(segments)-1
+		// Skip the segments that end before from.
+		if !last && segments[i+1] <= from {
+			continue
+		}
+
+		if err := readSegment(dir, first, last, from, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSegment(dir string, first uint64, last bool, from uint64, fn func(uint64, []byte) error) error {
+	f, err := os.Open(segmentPath(dir, first))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = scan(f, first, func(seq uint64, data []byte) error {
+		if seq < from {
+			return nil
+		}
+		return fn(seq, data)
+	})
+	if errors.Is(err, ErrCorrupt) && last {
+		return nil
+	}
+	return err
+}
+
+// scan reads the records of a segment starting at sequence number first
+// and returns the offset after the last good record. It fails with
+// ErrCorrupt at the first record that is cut short or damaged.
+func scan(r io.Reader, first uint64, fn func(seq uint64, data []byte) error) (int64, error) {
+	var (
+		header [headerSize]byte
+		offset int64
+		next   = first
+	)
+
+	for {
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+			return offset, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return offset, fmt.Errorf("%w: record %d cut short", ErrCorrupt, next)
+		} else if err != nil {
+			return offset, err
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		seq := binary.BigEndian.Uint64(header[8:16])
+		if length > maxRecordSize {
+			return offset, fmt.Errorf("%w: record %d has length %d", ErrCorrupt, next, length)
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, fmt.Errorf("%w: record %d cut short", ErrCorrupt, next)
+		} else if err != nil {
+			return offset, err
+		}
+
+		if checksum != crc(seq, data) {
+			return offset, fmt.Errorf("%w: bad checksum of record %d", ErrCorrupt, next)
+		}
+		if seq != next {
+			return offset, fmt.Errorf("%w: expected record %d, found %d", ErrCorrupt, next, seq)
+		}
+
+		if err := fn(seq, data); err != nil {
+			return offset, err
+		}
+		offset += headerSize + int64(length)
+		next++
+	}
+}
+
+func encode(seq uint64, data []byte) []byte {
+	record := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc(seq, data))
+	binary.BigEndian.PutUint64(record[8:16], seq)
+	copy(record[headerSize:], data)
+	return record
+}
+
+func crc(seq uint64, data []byte) uint32 {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], seq)
+	return crc32.Update(crc32.Checksum(b[:], crcTable), crcTable, data)
+}
+
+// listSegments returns the first sequence numbers of the segments in dir,
+// in order.
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, first)
+	}
+
+	sort.Slice(segments, func(i, k int) bool { return segments[i] < segments[k] })
+	return segments, nil
+}
+
+func segmentPath(dir string, first uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", first, segmentExt))
+}
+
+// syncDir fsyncs a directory, so files created in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
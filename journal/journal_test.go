@@ -0,0 +1,249 @@
+package journal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func appendRecords(t *testing.T, j *Journal, from, to int) {
+	t.Helper()
+
+	for i := from; i <= to; i++ {
+		seq, err := j.Append([]byte(fmt.Sprintf("record %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != uint64(i) {
+			t.Fatalf("expected sequence number %d, got %d", i, seq)
+		}
+	}
+}
+
+func readRecords(t *testing.T, dir string, from uint64) []string {
+	t.Helper()
+
+	var records []string
+	err := Read(dir, from, func(seq uint64, data []byte) error {
+		if want := fmt.Sprintf("record %d", seq); string(data) != want {
+			t.Fatalf("expected %q, got %q", want, data)
+		}
+		records = append(records, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestJournal(t *testing.T) {
+	for _, sync := range []SyncPolicy{SyncEvery, SyncBatch, SyncInterval} {
+		t.Run(string(sync), func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := Config{Sync: sync, BatchSize: 3, SegmentSize: 100}
+
+			j, err := Open(dir, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendRecords(t, j, 1, 10)
+			if err := j.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Records of 24 or 25 bytes fill a segment of 100 bytes with 4.
+			segments, err := listSegments(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(segments) != "[1 5 9]" {
+				t.Fatalf("expected segments [1 5 9], got %v", segments)
+			}
+
+			j, err = Open(dir, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if j.NextSeq() != 11 {
+				t.Fatalf("expected next sequence number 11, got %d", j.NextSeq())
+			}
+			appendRecords(t, j, 11, 12)
+			if err := j.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if records := readRecords(t, dir, 1); len(records) != 12 {
+				t.Fatalf("expected 12 records, got %d", len(records))
+			}
+			if records := readRecords(t, dir, 6); len(records) != 7 || records[0] != "record 6" {
+				t.Fatalf("expected records 6 to 12, got %v", records)
+			}
+		})
+	}
+}
+
+func TestJournalDamagedTail(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := Open(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, j, 1, 3)
+	j.Close()
+
+	// A crash in the middle of writing record 4.
+	path := segmentPath(dir, 1)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encode(4, []byte("record 4"))[:headerSize+3])
+	f.Close()
+
+	if records := readRecords(t, dir, 1); len(records) != 3 {
+		t.Fatalf("expected the 3 complete records, got %v", records)
+	}
+
+	j, err = Open(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, j, 4, 5)
+	j.Close()
+
+	if records := readRecords(t, dir, 1); len(records) != 5 {
+		t.Fatalf("expected 5 records, got %v", records)
+	}
+}
+
+func TestJournalCorrupt(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := Open(dir, Config{SegmentSize: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, j, 1, 4)
+	j.Close()
+
+	// Damage the data of record 1, in a segment before the last.
+	path := segmentPath(dir, 1)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[headerSize] ^= 0xff
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = Read(dir, 1, func(uint64, []byte) error { return nil })
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := Open(dir, Config{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	appendRecords(t, j, 1, 10)
+
+	if err := j.Compact(7); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(segments) != "[5 9]" {
+		t.Fatalf("expected segments [5 9], got %v", segments)
+	}
+
+	if records := readRecords(t, dir, 7); len(records) != 4 {
+		t.Fatalf("expected records 7 to 10, got %v", records)
+	}
+	err = Read(dir, 3, func(uint64, []byte) error { return nil })
+	if !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected ErrCompacted, got %v", err)
+	}
+
+	// The segment written to is kept.
+	if err := j.Compact(100); err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, j, 11, 11)
+	if records := readRecords(t, dir, 9); len(records) != 3 {
+		t.Fatalf("expected records 9 to 11, got %v", records)
+	}
+}
+
+// faultySegment fails the writes, writing half the record, and the fsyncs
+// of a segment when told to.
+type faultySegment struct {
+	segment
+	failWrite bool
+	failSync  bool
+}
+
+func (f *faultySegment) Write(p []byte) (int, error) {
+	if f.failWrite {
+		n, _ := f.segment.Write(p[:len(p)/2])
+		return n, errors.New("write failed")
+	}
+	return f.segment.Write(p)
+}
+
+func (f *faultySegment) Sync() error {
+	if f.failSync {
+		return errors.New("fsync failed")
+	}
+	return f.segment.Sync()
+}
+
+func TestJournalFailures(t *testing.T) {
+	dir := t.TempDir()
+	j, err := Open(dir, Config{Sync: SyncEvery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	faulty := &faultySegment{segment: j.file}
+	j.file = faulty
+	appendRecords(t, j, 1, 2)
+
+	// A partly written record is cut off and the next one takes its place.
+	faulty.failWrite = true
+	if _, err := j.Append([]byte("record 3")); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	faulty.failWrite = false
+	appendRecords(t, j, 3, 4)
+
+	// A failed fsync fails the journal.
+	faulty.failSync = true
+	if _, err := j.Append([]byte("record 5")); !errors.Is(err, ErrFailed) {
+		t.Fatalf("expected %v, got %v", ErrFailed, err)
+	}
+	faulty.failSync = false
+	if _, err := j.Append([]byte("record 5")); !errors.Is(err, ErrFailed) {
+		t.Fatalf("expected %v, got %v", ErrFailed, err)
+	}
+	j.Close()
+
+	if records := readRecords(t, dir, 1); len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+	j, err = Open(dir, Config{Sync: SyncEvery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	appendRecords(t, j, 5, 5)
+}
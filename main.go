@@ -1,35 +1,117 @@
 package main
 
 import (
+	"flag"
 	"math/rand"
+	"os"
 	"time"
 
 	"github.com/tahaontech/crypto_exchange/client"
+	"github.com/tahaontech/crypto_exchange/fix"
+	"github.com/tahaontech/crypto_exchange/journal"
 	"github.com/tahaontech/crypto_exchange/mm"
+	"github.com/tahaontech/crypto_exchange/rpc"
 	"github.com/tahaontech/crypto_exchange/server"
 )
 
+var (
+	dev          = flag.Bool("dev", false, "allow well-known development keys and run the demo traders")
+	keystorePath = flag.String("keystore", "", "keystore file of the exchange key (default $EXCHANGE_KEYSTORE)")
+	passwordFile = flag.String("password-file", "", "file with the keystore passphrase (default $EXCHANGE_PASSWORD_FILE)")
+	fixAddr      = flag.String("fix", "", "listen address of the FIX acceptor, off when empty (default $EXCHANGE_FIX_ADDR)")
+	fixStore     = flag.String("fix-store", "fixstore", "directory of the sequence numbers and messages of the FIX sessions")
+	grpcAddr     = flag.String("grpc", "", "listen address of the gRPC API, off when empty (default $EXCHANGE_GRPC_ADDR)")
+	journalDir   = flag.String("journal", "", "directory of the journal of the books, off when empty (default $EXCHANGE_JOURNAL_DIR)")
+	journalSync  = flag.String("journal-sync", "", "fsync policy of the journal: every, batch or interval (default $EXCHANGE_JOURNAL_SYNC or every)")
+	snapshotInt  = flag.Duration("snapshot-interval", 0, "time between snapshots of the books in the journal directory (default $EXCHANGE_SNAPSHOT_INTERVAL or 1m)")
+	dbPath       = flag.String("db", "", "database of the users and the history of orders, trades and settlements, in memory when empty (default $EXCHANGE_DB)")
+)
+
+// devUsers are ganache -d accounts used by the demo traders.
+var devUsers = map[int64]string{
+	8:   "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4",
+	7:   "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3",
+	666: "e485d098507f54e7733a205420dfddbe58db035fa577fc294ebd14db90767a52",
+}
+
 func main() {
-	go server.StartServer()
+	flag.Parse()
+
+	cfg := server.ConfigFromEnv()
+	if *keystorePath != "" {
+		cfg.KeystorePath = *keystorePath
+	}
+	if *passwordFile != "" {
+		cfg.PasswordFile = *passwordFile
+	}
+	cfg.Dev = cfg.Dev || *dev
+	if *journalDir != "" {
+		cfg.JournalDir = *journalDir
+	}
+	if *journalSync != "" {
+		cfg.JournalSync = journal.SyncPolicy(*journalSync)
+	}
+	if *snapshotInt != 0 {
+		cfg.SnapshotInterval = *snapshotInt
+	}
+	if *dbPath != "" {
+		cfg.StorePath = *dbPath
+	}
+	if *fixAddr == "" {
+		*fixAddr = os.Getenv("EXCHANGE_FIX_ADDR")
+	}
+	if *fixAddr != "" {
+		cfg.Gateways = append(cfg.Gateways, func(ex *server.Exchange) error {
+			return fix.NewAcceptor(ex, fix.Config{StoreDir: *fixStore}).ListenAndServe(*fixAddr)
+		})
+	}
+	if *grpcAddr == "" {
+		*grpcAddr = os.Getenv("EXCHANGE_GRPC_ADDR")
+	}
+	if *grpcAddr != "" {
+		cfg.Gateways = append(cfg.Gateways, func(ex *server.Exchange) error {
+			return rpc.NewServer(ex, rpc.Config{}).ListenAndServe(*grpcAddr)
+		})
+	}
+
+	if !cfg.Dev {
+		server.StartServer(cfg)
+		return
+	}
+
+	go server.StartServer(cfg)
 	time.Sleep(1 * time.Second)
 
-	c := client.NewClient()
+	clients := make(map[int64]*client.Client)
+	for id, key := range devUsers {
+		user, err := client.NewClient().RegisterUser(&server.RegisterUserRequest{ID: id, PrivateKey: key})
+		if err != nil {
+			panic(err)
+		}
+		clients[id] = client.NewClientWithKey(user.APIKey, user.APISecret)
+	}
+
+	stream, err := clients[8].Stream()
+	if err != nil {
+		panic(err)
+	}
 
-	cfg := mm.Config{
+	makerCfg := mm.Config{
 		UserID:         8,
 		OrderSize:      10,
 		MinSpread:      20,
 		MakeInterval:   1 * time.Second,
 		SeedOffset:     40,
-		ExchangeClient: c,
+		ExchangeClient: clients[8],
+		Stream:         stream,
 		PriceOffset:    10,
 	}
-	maker := mm.NewMakerMaker(cfg)
+	maker := mm.NewMakerMaker(makerCfg)
 
 	maker.Start()
 
 	time.Sleep(2 * time.Second)
-	go marketOrderPlacer(c)
+	go marketOrderPlacer(clients[7])
 
 	select {}
 }
@@ -1,10 +1,12 @@
 package mm
 
 import (
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/tahaontech/crypto_exchange/client"
+	"github.com/tahaontech/crypto_exchange/server"
 )
 
 type Config struct {
@@ -13,8 +15,11 @@ type Config struct {
 	MinSpread      float64
 	SeedOffset     float64
 	ExchangeClient *client.Client
-	MakeInterval   time.Duration
-	PriceOffset    float64
+	// Stream, when set, is used for the best prices and to place orders
+	// instead of polling the REST API.
+	Stream       *client.Stream
+	MakeInterval time.Duration
+	PriceOffset  float64
 }
 
 type MarketMaker struct {
@@ -24,7 +29,11 @@ type MarketMaker struct {
 	seedOffset     float64
 	priceOffset    float64
 	exchangeClient *client.Client
+	stream         *client.Stream
 	makeInterval   time.Duration
+
+	mu  sync.Mutex
+	bbo server.BBO
 }
 
 func NewMakerMaker(cfg Config) *MarketMaker {
@@ -34,6 +43,7 @@ func NewMakerMaker(cfg Config) *MarketMaker {
 		minSpread:      cfg.MinSpread,
 		seedOffset:     cfg.SeedOffset,
 		exchangeClient: cfg.ExchangeClient,
+		stream:         cfg.Stream,
 		makeInterval:   cfg.MakeInterval,
 		priceOffset:    cfg.PriceOffset,
 	}
@@ -46,54 +56,97 @@ func (mm *MarketMaker) Start() {
 		"makeInterval": mm.makeInterval,
 		"minSpread":    mm.minSpread,
 		"priceOffset":  mm.priceOffset,
+		"stream":       mm.stream != nil,
 	}).Info("starting market maker")
 
+	if mm.stream != nil {
+		if err := mm.stream.Subscribe(server.ChannelBBO, server.MarketETH, mm.handleBBO); err != nil {
+			logrus.Error(err)
+			return
+		}
+	}
+
 	go mm.makerLoop()
 }
 
+func (mm *MarketMaker) handleBBO(msg client.Message) {
+	var bbo server.BBO
+	if err := msg.Decode(&bbo); err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	mm.mu.Lock()
+	mm.bbo = bbo
+	mm.mu.Unlock()
+}
+
+// bestPrices returns the best bid and ask, zero for an empty side.
+func (mm *MarketMaker) bestPrices() (float64, float64, error) {
+	if mm.stream != nil {
+		mm.mu.Lock()
+		defer mm.mu.Unlock()
+
+		return mm.bbo.BidPrice, mm.bbo.AskPrice, nil
+	}
+
+	bestBid, err := mm.exchangeClient.GetBestBid()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	bestAsk, err := mm.exchangeClient.GetBestAsk()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return bestBid.Price, bestAsk.Price, nil
+}
+
 func (mm *MarketMaker) makerLoop() {
 	ticker := time.NewTicker(mm.makeInterval)
 
 	for {
-		bestBid, err := mm.exchangeClient.GetBestBid()
+		bestBid, bestAsk, err := mm.bestPrices()
 		if err != nil {
 			logrus.Error(err)
 			break
 		}
 
-		bestAsk, err := mm.exchangeClient.GetBestAsk()
-		if err != nil {
-			logrus.Error(err)
-			break
-		}
-
-		if bestAsk.Price == 0 && bestBid.Price == 0 {
+		if bestAsk == 0 && bestBid == 0 {
 			if err := mm.seedMarket(); err != nil {
 				logrus.Error(err)
 				break
 			}
+			// The prices of the stream lag behind the orders placed.
+			if mm.stream != nil {
+				<-ticker.C
+			}
 			continue
 		}
 
-		if bestBid.Price == 0 {
-			bestBid.Price = bestAsk.Price - mm.priceOffset*2
+		if bestBid == 0 {
+			bestBid = bestAsk - mm.priceOffset*2
 		}
 
-		if bestAsk.Price == 0 {
-			bestAsk.Price = bestBid.Price + mm.priceOffset*2
+		if bestAsk == 0 {
+			bestAsk = bestBid + mm.priceOffset*2
 		}
 
-		spread := bestAsk.Price - bestBid.Price
+		spread := bestAsk - bestBid
 
 		if spread <= mm.minSpread {
+			if mm.stream != nil {
+				<-ticker.C
+			}
 			continue
 		}
 
-		if err := mm.placeOrder(true, bestBid.Price+mm.priceOffset); err != nil {
+		if err := mm.placeOrder(true, bestBid+mm.priceOffset); err != nil {
 			logrus.Error(err)
 			break
 		}
-		if err := mm.placeOrder(false, bestAsk.Price-mm.priceOffset); err != nil {
+		if err := mm.placeOrder(false, bestAsk-mm.priceOffset); err != nil {
 			logrus.Error(err)
 			break
 		}
@@ -109,6 +162,10 @@ func (mm *MarketMaker) placeOrder(bid bool, price float64) error {
 		Bid:    bid,
 		Price:  price,
 	}
+	if mm.stream != nil {
+		_, err := mm.stream.PlaceLimitOrder(bidOrder)
+		return err
+	}
 	_, err := mm.exchangeClient.PlaceLimitOrder(bidOrder)
 	return err
 }
@@ -121,26 +178,11 @@ func (mm *MarketMaker) seedMarket() error {
 		"seedOffset":      mm.seedOffset,
 	}).Info("orderbooks empty => seeding market!")
 
-	bidOrder := &client.PlaceOrderParams{
-		UserID: mm.userID,
-		Size:   mm.orderSize,
-		Bid:    true,
-		Price:  currentPrice - mm.seedOffset,
-	}
-	_, err := mm.exchangeClient.PlaceLimitOrder(bidOrder)
-	if err != nil {
+	if err := mm.placeOrder(true, currentPrice-mm.seedOffset); err != nil {
 		return err
 	}
 
-	askOrder := &client.PlaceOrderParams{
-		UserID: mm.userID,
-		Size:   mm.orderSize,
-		Bid:    false,
-		Price:  currentPrice + mm.seedOffset,
-	}
-	_, err = mm.exchangeClient.PlaceLimitOrder(askOrder)
-
-	return err
+	return mm.placeOrder(false, currentPrice+mm.seedOffset)
 }
 
 // this will simulate a call to an other exchange fetching
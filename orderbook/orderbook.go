@@ -2,7 +2,6 @@ package orderbook
 
 import (
 	"fmt"
-	"math/rand"
 	"sort"
 	"sync"
 	"time"
@@ -24,6 +23,49 @@ type Match struct {
 	Price      float64
 }
 
+const (
+	// EventAccepted is emitted when an order enters the book, before it
+	// is matched.
+	EventAccepted EventType = "ACCEPTED"
+	// EventMatch is emitted for every match of an order, after the sizes
+	// of both orders were reduced.
+	EventMatch EventType = "MATCH"
+	// EventCancelled and EventExpired are emitted when a resting order is
+	// removed from the book.
+	EventCancelled EventType = "CANCELLED"
+	EventExpired   EventType = "EXPIRED"
+	// EventAmended is emitted when the price or size of a resting order
+	// changed.
+	EventAmended EventType = "AMENDED"
+)
+
+type EventType string
+
+// Event is a change of the book. Order is the accepted or removed order,
+// or the taker of a match. Price is the limit price of the order, zero for
+// market orders, or the price of the match. Time is the time of the book
+// clock when the event happened.
+type Event struct {
+	Type  EventType
+	Order *Order
+	Match *Match
+	Price float64
+	Time  int64
+}
+
+// Level is the total size of the orders at a price.
+type Level struct {
+	Price float64
+	Size  float64
+}
+
+// DepthLevel is a price level with the number of its orders.
+type DepthLevel struct {
+	Price  float64
+	Size   float64
+	Orders int
+}
+
 type Order struct {
 	ID        int64
 	UserID    int64
@@ -39,14 +81,10 @@ func (o Orders) Len() int           { return len(o) }
 func (o Orders) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
 func (o Orders) Less(i, j int) bool { return o[i].Timestamp < o[j].Timestamp }
 
-func NewOrder(bid bool, size float64, userID int64) *Order {
-	return &Order{
-		UserID:    userID,
-		ID:        int64(rand.Intn(10000000)),
-		Size:      size,
-		Bid:       bid,
-		Timestamp: time.Now().UnixNano(),
-	}
+// SystemClock is the default clock of a book, the current time in Unix
+// nanoseconds.
+func SystemClock() int64 {
+	return time.Now().UnixNano()
 }
 
 func (o *Order) String() string {
@@ -97,18 +135,18 @@ func (l *Limit) AddOrder(o *Order) {
 	l.TotalVolume += o.Size
 }
 
+// DeleteOrder removes an order from the limit. The other orders keep their
+// place in the queue, also when they have the same timestamp.
 func (l *Limit) DeleteOrder(o *Order) {
 	for i := 0; i < len(l.Orders); i++ {
 		if l.Orders[i] == o {
-			l.Orders[i] = l.Orders[len(l.Orders)-1]
-			l.Orders = l.Orders[:len(l.Orders)-1]
+			l.Orders = append(l.Orders[:i], l.Orders[i+1:]...)
+			break
 		}
 	}
 
 	o.Limit = nil
 	l.TotalVolume -= o.Size
-
-	sort.Sort(l.Orders)
 }
 
 func (l *Limit) Fill(o *Order) []Match {
@@ -182,6 +220,15 @@ type Orderbook struct {
 	AskLimits map[float64]*Limit
 	BidLimits map[float64]*Limit
 	Orders    map[int64]*Order
+
+	onEvent func(Event)
+	// now is the time of new orders, trades and amended orders in Unix
+	// nanoseconds, and nextID the ID of new orders.
+	now    func() int64
+	nextID func() int64
+	lastID int64
+	// tradeLimit is the number of trades kept in Trades, all when zero.
+	tradeLimit int
 }
 
 func NewOrderbook() *Orderbook {
@@ -192,6 +239,81 @@ func NewOrderbook() *Orderbook {
 		AskLimits: make(map[float64]*Limit),
 		BidLimits: make(map[float64]*Limit),
 		Orders:    make(map[int64]*Order),
+		now:       SystemClock,
+	}
+}
+
+// SetClock sets the time of the new orders, trades and amended orders of
+// the book, which is SystemClock by default.
+func (ob *Orderbook) SetClock(now func() int64) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.now = now
+}
+
+// SetIDGenerator sets the generator of the IDs of new orders. By default
+// the book counts up from 1.
+func (ob *Orderbook) SetIDGenerator(nextID func() int64) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.nextID = nextID
+}
+
+// SetTradeLimit keeps only the last n trades in Trades, so the book does
+// not grow with its history. Zero keeps every trade.
+func (ob *Orderbook) SetTradeLimit(n int) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.tradeLimit = n
+	ob.trimTrades()
+}
+
+// trimTrades drops the trades over the limit. It must be called with the
+// lock held.
+func (ob *Orderbook) trimTrades() {
+	if ob.tradeLimit > 0 && len(ob.Trades) > ob.tradeLimit {
+		ob.Trades = ob.Trades[len(ob.Trades)-ob.tradeLimit:]
+	}
+}
+
+// NewOrder returns an order with the next ID of the book, at the time of
+// its clock.
+func (ob *Orderbook) NewOrder(bid bool, size float64, userID int64) *Order {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	id := ob.lastID + 1
+	if ob.nextID != nil {
+		id = ob.nextID()
+	}
+	ob.lastID = id
+
+	return &Order{
+		UserID:    userID,
+		ID:        id,
+		Size:      size,
+		Bid:       bid,
+		Timestamp: ob.now(),
+	}
+}
+
+// OnEvent sets the handler of the events of the book. It is called with
+// the book locked, so it must not call back into the book.
+func (ob *Orderbook) OnEvent(handler func(Event)) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.onEvent = handler
+}
+
+// emit must be called with the lock held.
+func (ob *Orderbook) emit(event Event) {
+	if ob.onEvent != nil {
+		event.Time = ob.now()
+		ob.onEvent(event)
 	}
 }
 
@@ -205,6 +327,7 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 		if o.Size > ob.AskTotalVolume() {
 			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.AskTotalVolume(), o.Size))
 		}
+		ob.emit(Event{Type: EventAccepted, Order: o})
 
 		for _, limit := range ob.Asks() {
 			limitMatches := limit.Fill(o)
@@ -218,6 +341,7 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 		if o.Size > ob.BidTotalVolume() {
 			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.BidTotalVolume(), o.Size))
 		}
+		ob.emit(Event{Type: EventAccepted, Order: o})
 
 		for _, limit := range ob.Bids() {
 			limitMatches := limit.Fill(o)
@@ -229,15 +353,27 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 		}
 	}
 
-	for _, match := range matches {
+	for i, match := range matches {
+		// Filled makers left the book, so they are forgotten.
+		maker := match.Bid
+		if o.Bid {
+			maker = match.Ask
+		}
+		if maker.IsFilled() {
+			delete(ob.Orders, maker.ID)
+		}
+
+		ob.emit(Event{Type: EventMatch, Order: o, Match: &matches[i], Price: match.Price})
+
 		trade := &Trade{
 			Price:     match.Price,
 			Size:      match.SizeFilled,
-			Timestamp: time.Now().UnixNano(),
+			Timestamp: ob.now(),
 			Bid:       o.Bid,
 		}
 		ob.Trades = append(ob.Trades, trade)
 	}
+	ob.trimTrades()
 
 	logrus.WithFields(logrus.Fields{
 		"currentPrice": ob.Trades[len(ob.Trades)-1].Price,
@@ -247,12 +383,61 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 }
 
 func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
-	var limit *Limit
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	limit := ob.limit(o.Bid, price)
+
+	logrus.WithFields(logrus.Fields{
+		"price":  limit.Price,
+		"type":   o.Type(),
+		"size":   o.Size,
+		"userID": o.UserID,
+	}).Info("new limit order")
 
+	ob.Orders[o.ID] = o
+	limit.AddOrder(o)
+
+	ob.emit(Event{Type: EventAccepted, Order: o, Price: price})
+}
+
+// AmendOrder changes the price and size of a resting order, reporting
+// whether it was still in the book. An order that only shrinks keeps its
+// time priority, any other change moves it to the back of its new price
+// level.
+func (ob *Orderbook) AmendOrder(o *Order, price, size float64) bool {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
-	if o.Bid {
+	limit := o.Limit
+	if limit == nil {
+		return false
+	}
+
+	if price == limit.Price && size <= o.Size {
+		limit.TotalVolume -= o.Size - size
+		o.Size = size
+	} else {
+		limit.DeleteOrder(o)
+		if len(limit.Orders) == 0 {
+			ob.clearLimit(o.Bid, limit)
+		}
+
+		o.Size = size
+		o.Timestamp = ob.now()
+		ob.limit(o.Bid, price).AddOrder(o)
+	}
+
+	ob.emit(Event{Type: EventAmended, Order: o, Price: price})
+	return true
+}
+
+// limit returns the limit of a price, adding it when it does not exist.
+// It must be called with the lock held.
+func (ob *Orderbook) limit(bid bool, price float64) *Limit {
+	var limit *Limit
+
+	if bid {
 		limit = ob.BidLimits[price]
 	} else {
 		limit = ob.AskLimits[price]
@@ -261,7 +446,7 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 	if limit == nil {
 		limit = NewLimit(price)
 
-		if o.Bid {
+		if bid {
 			ob.bids = append(ob.bids, limit)
 			ob.BidLimits[price] = limit
 		} else {
@@ -270,15 +455,7 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 		}
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"price":  limit.Price,
-		"type":   o.Type(),
-		"size":   o.Size,
-		"userID": o.UserID,
-	}).Info("new limit order")
-
-	ob.Orders[o.ID] = o
-	limit.AddOrder(o)
+	return limit
 }
 
 func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
@@ -300,17 +477,146 @@ func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
 		}
 	}
 
-	fmt.Printf("clearing limit price level [%.2f]\n", l.Price)
+	logrus.WithField("price", l.Price).Info("clearing limit price level")
+}
+
+// Order returns an order that was placed in the book. Filled and cancelled
+// orders have no limit.
+func (ob *Orderbook) Order(id int64) (*Order, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	o, ok := ob.Orders[id]
+	return o, ok
+}
+
+// UserOrders returns the orders of a user resting in the book, by ID.
+func (ob *Orderbook) UserOrders(userID int64) []*Order {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	orders := []*Order{}
+	for _, o := range ob.Orders {
+		if o.UserID == userID && o.Limit != nil {
+			orders = append(orders, o)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return orders
+}
+
+// OpenOrder is a copy of an order resting in the book at Price.
+type OpenOrder struct {
+	OrderSnapshot
+	Price float64
+}
+
+// OpenOrders returns copies of the orders of a user resting in the book,
+// by ID. Unlike the orders of UserOrders, they can be read without the
+// lock of the book.
+func (ob *Orderbook) OpenOrders(userID int64) []OpenOrder {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	orders := []OpenOrder{}
+	for _, o := range ob.Orders {
+		if o.UserID == userID && o.Limit != nil {
+			orders = append(orders, OpenOrder{OrderSnapshot: snapshotOrder(o), Price: o.Limit.Price})
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return orders
 }
 
 func (ob *Orderbook) CancelOrder(o *Order) {
+	ob.removeOrder(o, EventCancelled)
+}
+
+// ExpireOrder removes an order that expired from the book.
+func (ob *Orderbook) ExpireOrder(o *Order) {
+	ob.removeOrder(o, EventExpired)
+}
+
+func (ob *Orderbook) removeOrder(o *Order, eventType EventType) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
 	limit := o.Limit
+	if limit == nil {
+		return
+	}
+
 	limit.DeleteOrder(o)
 	delete(ob.Orders, o.ID)
 
 	if len(limit.Orders) == 0 {
 		ob.clearLimit(o.Bid, limit)
 	}
+
+	ob.emit(Event{Type: eventType, Order: o, Price: limit.Price})
+}
+
+// Levels returns the price levels of both sides of the book, best first.
+func (ob *Orderbook) Levels() (bids, asks []Level) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	bids = make([]Level, 0, len(ob.bids))
+	for _, limit := range ob.Bids() {
+		bids = append(bids, Level{Price: limit.Price, Size: limit.TotalVolume})
+	}
+
+	asks = make([]Level, 0, len(ob.asks))
+	for _, limit := range ob.Asks() {
+		asks = append(asks, Level{Price: limit.Price, Size: limit.TotalVolume})
+	}
+
+	return bids, asks
+}
+
+// Depth returns the price levels of the book with the number of their
+// orders, best first.
+func (ob *Orderbook) Depth() (bids, asks []DepthLevel) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	bids = make([]DepthLevel, 0, len(ob.bids))
+	for _, limit := range ob.Bids() {
+		bids = append(bids, DepthLevel{Price: limit.Price, Size: limit.TotalVolume, Orders: len(limit.Orders)})
+	}
+
+	asks = make([]DepthLevel, 0, len(ob.asks))
+	for _, limit := range ob.Asks() {
+		asks = append(asks, DepthLevel{Price: limit.Price, Size: limit.TotalVolume, Orders: len(limit.Orders)})
+	}
+
+	return bids, asks
+}
+
+// Book returns the price levels of the book, best first, with their orders
+// in queue order.
+func (ob *Orderbook) Book() (bids, asks []LimitSnapshot) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	return snapshotLimits(ob.Bids()), snapshotLimits(ob.Asks())
+}
+
+// BestOrder returns the first order at the best price of a side and that
+// price, or false when the side is empty.
+func (ob *Orderbook) BestOrder(bid bool) (OrderSnapshot, float64, bool) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	limits := ob.Asks()
+	if bid {
+		limits = ob.Bids()
+	}
+	if len(limits) == 0 {
+		return OrderSnapshot{}, 0, false
+	}
+
+	return snapshotOrder(limits[0].Orders[0]), limits[0].Price, true
 }
 
 func (ob *Orderbook) BidTotalVolume() float64 {
@@ -13,10 +13,11 @@ func assert(t *testing.T, a, b any) {
 }
 
 func TestLimit(t *testing.T) {
+	ob := NewOrderbook()
 	l := NewLimit(10_000)
-	buyOrderA := NewOrder(true, 5, 1)
-	buyOrderB := NewOrder(true, 8, 1)
-	buyOrderC := NewOrder(true, 10, 1)
+	buyOrderA := ob.NewOrder(true, 5, 1)
+	buyOrderB := ob.NewOrder(true, 8, 1)
+	buyOrderC := ob.NewOrder(true, 10, 1)
 
 	l.AddOrder(buyOrderA)
 	l.AddOrder(buyOrderB)
@@ -30,8 +31,8 @@ func TestLimit(t *testing.T) {
 func TestPlaceLimitOrder(t *testing.T) {
 	ob := NewOrderbook()
 
-	sellOrderA := NewOrder(false, 10, 1)
-	sellOrderB := NewOrder(false, 5, 1)
+	sellOrderA := ob.NewOrder(false, 10, 1)
+	sellOrderB := ob.NewOrder(false, 5, 1)
 	ob.PlaceLimitOrder(10_000, sellOrderA)
 	ob.PlaceLimitOrder(9_000, sellOrderB)
 
@@ -44,10 +45,10 @@ func TestPlaceLimitOrder(t *testing.T) {
 func TestPlaceMarketOrder(t *testing.T) {
 	ob := NewOrderbook()
 
-	sellOrder := NewOrder(false, 20, 1)
+	sellOrder := ob.NewOrder(false, 20, 1)
 	ob.PlaceLimitOrder(10_000, sellOrder)
 
-	buyOrder := NewOrder(true, 10, 1)
+	buyOrder := ob.NewOrder(true, 10, 1)
 	matches := ob.PlaceMarketOrder(buyOrder)
 
 	assert(t, len(matches), 1)
@@ -65,10 +66,10 @@ func TestPlaceMarketOrder(t *testing.T) {
 func TestPlaceMarketOrderMultiFill(t *testing.T) {
 	ob := NewOrderbook()
 
-	buyOrderA := NewOrder(true, 5, 1)
-	buyOrderB := NewOrder(true, 8, 1)
-	buyOrderC := NewOrder(true, 10, 1)
-	buyOrderD := NewOrder(true, 1, 1)
+	buyOrderA := ob.NewOrder(true, 5, 1)
+	buyOrderB := ob.NewOrder(true, 8, 1)
+	buyOrderC := ob.NewOrder(true, 10, 1)
+	buyOrderD := ob.NewOrder(true, 1, 1)
 
 	ob.PlaceLimitOrder(5_000, buyOrderC)
 	ob.PlaceLimitOrder(5_000, buyOrderD)
@@ -77,20 +78,39 @@ func TestPlaceMarketOrderMultiFill(t *testing.T) {
 
 	assert(t, ob.BidTotalVolume(), 24.00)
 
-	sellOrder := NewOrder(false, 20, 1)
+	sellOrder := ob.NewOrder(false, 20, 1)
 	matches := ob.PlaceMarketOrder(sellOrder)
 
 	assert(t, ob.BidTotalVolume(), 4.00)
 	assert(t, len(matches), 3)
 	assert(t, len(ob.bids), 1)
 
+	// The filled orders left the book.
+	assert(t, len(ob.Orders), 2)
+	_, ok := ob.Order(buyOrderA.ID)
+	assert(t, ok, false)
+
 	fmt.Printf("%+v", matches)
 }
 
+func TestTradeLimit(t *testing.T) {
+	ob := NewOrderbook()
+	ob.SetTradeLimit(2)
+
+	ob.PlaceLimitOrder(10_000, ob.NewOrder(false, 10, 1))
+	for _, size := range []float64{1, 2, 3} {
+		ob.PlaceMarketOrder(ob.NewOrder(true, size, 2))
+	}
+
+	assert(t, len(ob.Trades), 2)
+	assert(t, ob.Trades[0].Size, 2.0)
+	assert(t, ob.Trades[1].Size, 3.0)
+}
+
 func TestCancelOrder(t *testing.T) {
 	ob := NewOrderbook()
 
-	buyOrder := NewOrder(true, 4, 1)
+	buyOrder := ob.NewOrder(true, 4, 1)
 	ob.PlaceLimitOrder(10_000.0, buyOrder)
 
 	assert(t, ob.BidTotalVolume(), 4.0)
@@ -101,3 +121,133 @@ func TestCancelOrder(t *testing.T) {
 	_, ok := ob.Orders[buyOrder.ID]
 	assert(t, ok, false)
 }
+
+func TestUserOrders(t *testing.T) {
+	ob := NewOrderbook()
+
+	ask := ob.NewOrder(false, 2, 1)
+	ob.PlaceLimitOrder(10_000, ask)
+	bid := ob.NewOrder(true, 1, 1)
+	ob.PlaceLimitOrder(9_000, bid)
+	ob.PlaceLimitOrder(9_000, ob.NewOrder(true, 1, 2))
+	filled := ob.NewOrder(false, 1, 1)
+	ob.PlaceLimitOrder(9_500, filled)
+	ob.PlaceMarketOrder(ob.NewOrder(true, 1, 2))
+
+	assert(t, ob.UserOrders(1), []*Order{ask, bid})
+	assert(t, len(ob.UserOrders(3)), 0)
+
+	assert(t, ob.OpenOrders(1), []OpenOrder{
+		{OrderSnapshot: snapshotOrder(ask), Price: 10_000},
+		{OrderSnapshot: snapshotOrder(bid), Price: 9_000},
+	})
+}
+
+func TestLevels(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(9_000, ob.NewOrder(true, 2, 1))
+	ob.PlaceLimitOrder(9_500, ob.NewOrder(true, 1, 1))
+	ob.PlaceLimitOrder(9_500, ob.NewOrder(true, 3, 1))
+	ob.PlaceLimitOrder(10_000, ob.NewOrder(false, 5, 1))
+
+	bids, asks := ob.Levels()
+	assert(t, bids, []Level{{Price: 9_500, Size: 4}, {Price: 9_000, Size: 2}})
+	assert(t, asks, []Level{{Price: 10_000, Size: 5}})
+
+	depthBids, depthAsks := ob.Depth()
+	assert(t, depthBids, []DepthLevel{{Price: 9_500, Size: 4, Orders: 2}, {Price: 9_000, Size: 2, Orders: 1}})
+	assert(t, depthAsks, []DepthLevel{{Price: 10_000, Size: 5, Orders: 1}})
+
+	bookBids, bookAsks := ob.Book()
+	assert(t, len(bookBids), 2)
+	assert(t, bookBids[0].Price, 9_500.0)
+	assert(t, []float64{bookBids[0].Orders[0].Size, bookBids[0].Orders[1].Size}, []float64{1, 3})
+	assert(t, len(bookAsks), 1)
+
+	best, price, ok := ob.BestOrder(true)
+	assert(t, ok, true)
+	assert(t, price, 9_500.0)
+	assert(t, best, bookBids[0].Orders[0])
+	ob.CancelOrder(ob.Orders[bookAsks[0].Orders[0].ID])
+	_, _, ok = ob.BestOrder(false)
+	assert(t, ok, false)
+}
+
+func TestEvents(t *testing.T) {
+	ob := NewOrderbook()
+
+	var events []EventType
+	ob.OnEvent(func(e Event) {
+		events = append(events, e.Type)
+	})
+
+	sellOrderA := ob.NewOrder(false, 5, 1)
+	sellOrderB := ob.NewOrder(false, 5, 1)
+	ob.PlaceLimitOrder(10_000, sellOrderA)
+	ob.PlaceLimitOrder(10_000, sellOrderB)
+	ob.PlaceMarketOrder(ob.NewOrder(true, 6, 2))
+	ob.CancelOrder(sellOrderB)
+	ob.CancelOrder(sellOrderA)
+
+	assert(t, events, []EventType{
+		EventAccepted,
+		EventAccepted,
+		EventAccepted,
+		EventMatch,
+		EventMatch,
+		EventCancelled,
+	})
+}
+
+func TestAmendOrder(t *testing.T) {
+	ob := NewOrderbook()
+
+	buyOrderA := ob.NewOrder(true, 5, 1)
+	buyOrderB := ob.NewOrder(true, 5, 1)
+	ob.PlaceLimitOrder(100, buyOrderA)
+	ob.PlaceLimitOrder(100, buyOrderB)
+
+	// Shrinking keeps the priority of the order.
+	assert(t, ob.AmendOrder(buyOrderA, 100, 3), true)
+	assert(t, ob.BidLimits[100].Orders, Orders{buyOrderA, buyOrderB})
+	assert(t, ob.BidTotalVolume(), 8.0)
+
+	assert(t, ob.AmendOrder(buyOrderA, 100, 4), true)
+	assert(t, ob.BidLimits[100].Orders, Orders{buyOrderB, buyOrderA})
+	assert(t, ob.BidTotalVolume(), 9.0)
+
+	assert(t, ob.AmendOrder(buyOrderB, 110, 5), true)
+	bids, _ := ob.Levels()
+	assert(t, bids, []Level{{Price: 110, Size: 5}, {Price: 100, Size: 4}})
+
+	ob.CancelOrder(buyOrderB)
+	assert(t, ob.AmendOrder(buyOrderB, 100, 1), false)
+}
+
+func TestSnapshot(t *testing.T) {
+	ob := NewOrderbook()
+	ob.SetClock(func() int64 { return 42 })
+
+	ob.PlaceLimitOrder(100, ob.NewOrder(true, 0.1, 1))
+	ob.PlaceLimitOrder(100, ob.NewOrder(true, 0.2, 2))
+	ob.PlaceLimitOrder(90, ob.NewOrder(true, 1, 1))
+	ob.PlaceLimitOrder(110, ob.NewOrder(false, 3, 3))
+	ob.PlaceMarketOrder(ob.NewOrder(false, 0.15, 4))
+	ob.PlaceMarketOrder(ob.NewOrder(true, 1, 4))
+
+	s := ob.Snapshot(1)
+	assert(t, len(s.Trades), 1)
+	assert(t, *s.Trades[0], Trade{Price: 110, Size: 1, Bid: true, Timestamp: 42})
+
+	restored := NewOrderbook()
+	restored.Restore(s)
+	assert(t, restored.Snapshot(1), s)
+	assert(t, len(restored.Orders), 3)
+
+	// The restored book trades like the original.
+	ob.PlaceMarketOrder(ob.NewOrder(false, 1, 4))
+	restored.SetClock(func() int64 { return 42 })
+	restored.PlaceMarketOrder(restored.NewOrder(false, 1, 4))
+	assert(t, restored.Snapshot(2), ob.Snapshot(2))
+}
@@ -0,0 +1,116 @@
+package orderbook
+
+// Snapshot is the state of a book: its price levels, best first, with their
+// orders in queue order, and its last trades, oldest first.
+type Snapshot struct {
+	Bids   []LimitSnapshot
+	Asks   []LimitSnapshot
+	Trades []*Trade
+}
+
+// LimitSnapshot is a price level of a Snapshot. TotalVolume is kept as it
+// was in the book, as adding up the sizes of the orders again could round
+// differently.
+type LimitSnapshot struct {
+	Price       float64
+	TotalVolume float64
+	Orders      []OrderSnapshot
+}
+
+type OrderSnapshot struct {
+	ID        int64
+	UserID    int64
+	Size      float64
+	Bid       bool
+	Timestamp int64
+}
+
+// Snapshot returns the state of the book with at most trades of its last
+// trades.
+func (ob *Orderbook) Snapshot(trades int) *Snapshot {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if trades > len(ob.Trades) {
+		trades = len(ob.Trades)
+	}
+
+	s := &Snapshot{
+		Bids:   snapshotLimits(ob.Bids()),
+		Asks:   snapshotLimits(ob.Asks()),
+		Trades: make([]*Trade, trades),
+	}
+	for i, trade := range ob.Trades[len(ob.Trades)-trades:] {
+		t := *trade
+		s.Trades[i] = &t
+	}
+
+	return s
+}
+
+func snapshotLimits(limits []*Limit) []LimitSnapshot {
+	snapshots := make([]LimitSnapshot, len(limits))
+	for i, limit := range limits {
+		orders := make([]OrderSnapshot, len(limit.Orders))
+		for k, o := range limit.Orders {
+			orders[k] = snapshotOrder(o)
+		}
+		snapshots[i] = LimitSnapshot{
+			Price:       limit.Price,
+			TotalVolume: limit.TotalVolume,
+			Orders:      orders,
+		}
+	}
+	return snapshots
+}
+
+func snapshotOrder(o *Order) OrderSnapshot {
+	return OrderSnapshot{
+		ID:        o.ID,
+		UserID:    o.UserID,
+		Size:      o.Size,
+		Bid:       o.Bid,
+		Timestamp: o.Timestamp,
+	}
+}
+
+// Restore replaces the state of the book with a snapshot. No events are
+// emitted for the restored orders.
+func (ob *Orderbook) Restore(s *Snapshot) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.asks = []*Limit{}
+	ob.bids = []*Limit{}
+	ob.AskLimits = make(map[float64]*Limit)
+	ob.BidLimits = make(map[float64]*Limit)
+	ob.Orders = make(map[int64]*Order)
+
+	ob.restoreLimits(true, s.Bids)
+	ob.restoreLimits(false, s.Asks)
+
+	ob.Trades = make([]*Trade, len(s.Trades))
+	for i, trade := range s.Trades {
+		t := *trade
+		ob.Trades[i] = &t
+	}
+}
+
+// restoreLimits must be called with the lock held.
+func (ob *Orderbook) restoreLimits(bid bool, snapshots []LimitSnapshot) {
+	for _, snapshot := range snapshots {
+		limit := ob.limit(bid, snapshot.Price)
+		for _, o := range snapshot.Orders {
+			order := &Order{
+				ID:        o.ID,
+				UserID:    o.UserID,
+				Size:      o.Size,
+				Bid:       o.Bid,
+				Timestamp: o.Timestamp,
+			}
+			ob.Orders[order.ID] = order
+			limit.AddOrder(order)
+		}
+		limit.TotalVolume = snapshot.TotalVolume
+	}
+}
@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Endpoint is the default address of the gRPC API.
+const Endpoint = "localhost:3001"
+
+// Client is a gRPC client of the exchange. Calls are signed with its API
+// key, if it has one.
+type Client struct {
+	ExchangeClient
+
+	conn *grpc.ClientConn
+	// APIKey and APISecret sign the calls when set.
+	APIKey    string
+	APISecret string
+}
+
+// Dial connects to the gRPC API at target. Connections are not encrypted
+// unless opts set transport credentials.
+func Dial(target string, opts ...grpc.DialOption) (*Client, error) {
+	return DialWithKey(target, "", "", opts...)
+}
+
+// DialWithKey connects to the gRPC API at target, signing the calls with
+// the given API key.
+func DialWithKey(target, key, secret string, opts ...grpc.DialOption) (*Client, error) {
+	c := &Client{
+		APIKey:    key,
+		APISecret: secret,
+	}
+
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(c.sign),
+	}, opts...)
+
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	c.ExchangeClient = NewExchangeClient(conn)
+
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// sign adds the API key signature of a call to its metadata.
+func (c *Client) sign(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	msg, ok := req.(proto.Message)
+	if c.APIKey == "" || !ok {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+
+	signature, err := SignCall(c.APISecret, method, timestamp, nonceHex, msg)
+	if err != nil {
+		return err
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		mdAPIKey, c.APIKey,
+		mdAPITimestamp, timestamp,
+		mdAPINonce, nonceHex,
+		mdAPISignature, signature,
+	)
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
@@ -0,0 +1,539 @@
+// Package rpc is the gRPC API of the exchange, defined in exchange.proto.
+// Calls are authenticated like REST requests: with a session token in the
+// authorization metadata, or with an API key signature in the x-api-*
+// metadata, computed with SignCall over the deterministic encoding of the
+// request. Use Dial for a client that signs its calls.
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+	"github.com/tahaontech/crypto_exchange/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// signMethod is signed in place of the HTTP method by SignCall.
+const signMethod = "GRPC"
+
+// The metadata of API key signatures, the headers of REST requests in
+// lower case.
+var (
+	mdAPIKey       = strings.ToLower(server.HeaderAPIKey)
+	mdAPITimestamp = strings.ToLower(server.HeaderAPITimestamp)
+	mdAPINonce     = strings.ToLower(server.HeaderAPINonce)
+	mdAPISignature = strings.ToLower(server.HeaderAPISignature)
+)
+
+type Config struct {
+	// StreamBuffer is the number of messages queued for a stream before it
+	// is ended as a slow consumer.
+	StreamBuffer int
+}
+
+var defaultConfig = Config{
+	StreamBuffer: 256,
+}
+
+// Server serves the gRPC API of an exchange.
+type Server struct {
+	UnimplementedExchangeServer
+
+	ex   *server.Exchange
+	cfg  Config
+	grpc *grpc.Server
+}
+
+// NewServer returns a server for ex. Zero fields of cfg are set to their
+// defaults.
+func NewServer(ex *server.Exchange, cfg Config) *Server {
+	if cfg.StreamBuffer == 0 {
+		cfg.StreamBuffer = defaultConfig.StreamBuffer
+	}
+
+	s := &Server{
+		ex:   ex,
+		cfg:  cfg,
+		grpc: grpc.NewServer(),
+	}
+	RegisterExchangeServer(s.grpc, s)
+
+	return s
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	logrus.WithField("addr", l.Addr()).Info("grpc server listening")
+	return s.grpc.Serve(l)
+}
+
+// Close stops the server and ends every call.
+func (s *Server) Close() {
+	s.grpc.Stop()
+}
+
+func (s *Server) PlaceOrder(ctx context.Context, req *PlaceOrderRequest) (*PlaceOrderResponse, error) {
+	var placed *server.PlaceOrderResponse
+	err := s.orderEntry(ctx, req, func(caller *server.Caller) error {
+		signed, err := toSignedOrder(req.Signed)
+		if err != nil {
+			return err
+		}
+
+		resp, err := s.ex.PlaceOrder(&server.PlaceOrderRequest{
+			UserID:        caller.UserID,
+			Type:          toOrderType(req.Type),
+			Bid:           req.Bid,
+			Size:          req.Size,
+			Price:         req.Price,
+			Market:        server.Market(req.Market),
+			Signed:        signed,
+			ClientOrderID: req.ClientOrderId,
+		}, caller.AuthKey)
+		placed = resp
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PlaceOrderResponse{OrderId: placed.OrderID, ClientOrderId: placed.ClientOrderID}, nil
+}
+
+func (s *Server) CancelOrder(ctx context.Context, req *CancelOrderRequest) (*CancelOrderResponse, error) {
+	err := s.orderEntry(ctx, req, func(caller *server.Caller) error {
+		id, err := s.orderID(caller, req.OrderId, req.ClientOrderId)
+		if err != nil {
+			return err
+		}
+		return s.ex.CancelOrder(caller.UserID, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &CancelOrderResponse{}, nil
+}
+
+func (s *Server) AmendOrder(ctx context.Context, req *AmendOrderRequest) (*AmendOrderResponse, error) {
+	err := s.orderEntry(ctx, req, func(caller *server.Caller) error {
+		id, err := s.orderID(caller, req.OrderId, req.ClientOrderId)
+		if err != nil {
+			return err
+		}
+		return s.ex.AmendOrder(caller.UserID, id, req.Price, req.Size)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &AmendOrderResponse{}, nil
+}
+
+func (s *Server) CancelAllOrders(ctx context.Context, req *CancelAllOrdersRequest) (*CancelAllOrdersResponse, error) {
+	f := server.CancelFilter{
+		Market:   server.Market(req.Market),
+		MinPrice: req.MinPrice,
+		MaxPrice: req.MaxPrice,
+	}
+	if req.Side != Side_SIDE_UNSPECIFIED {
+		bid := req.Side == Side_SIDE_BID
+		f.Bid = &bid
+	}
+
+	var ids []int64
+	err := s.orderEntry(ctx, req, func(caller *server.Caller) error {
+		var err error
+		ids, err = s.ex.CancelAll(caller.UserID, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &CancelAllOrdersResponse{OrderIds: ids}, nil
+}
+
+// orderID is the ID of the order of the caller named by clientOrderID
+// when it is set, or id.
+func (s *Server) orderID(caller *server.Caller, id int64, clientOrderID string) (int64, error) {
+	if clientOrderID == "" {
+		return id, nil
+	}
+	return s.ex.OrderID(caller.UserID, clientOrderID)
+}
+
+// orderEntry authenticates a call with the trade scope and runs entry
+// with the limits of REST order entry.
+func (s *Server) orderEntry(ctx context.Context, req proto.Message, entry func(*server.Caller) error) error {
+	caller, err := s.authenticate(ctx, req, server.ScopeTrade)
+	if err != nil {
+		return err
+	}
+
+	if err := s.ex.AllowOrderEntry(caller.AuthKey, caller.UserID, peerIP(ctx)); err != nil {
+		return toStatus(err)
+	}
+	if err := entry(caller); err != nil {
+		return toStatus(err)
+	}
+
+	s.ex.RecordOrder(caller.UserID)
+	return nil
+}
+
+func (s *Server) GetOrders(ctx context.Context, req *GetOrdersRequest) (*GetOrdersResponse, error) {
+	caller, err := s.authenticate(ctx, req, server.ScopeRead)
+	if err != nil {
+		return nil, err
+	}
+
+	orders := s.ex.UserOrders(caller.UserID)
+	resp := &GetOrdersResponse{
+		Asks: make([]*Order, len(orders.Asks)),
+		Bids: make([]*Order, len(orders.Bids)),
+	}
+	for i := range orders.Asks {
+		resp.Asks[i] = fromOrder(&orders.Asks[i])
+	}
+	for i := range orders.Bids {
+		resp.Bids[i] = fromOrder(&orders.Bids[i])
+	}
+
+	return resp, nil
+}
+
+func (s *Server) GetBook(ctx context.Context, req *GetBookRequest) (*Book, error) {
+	if err := s.ex.AllowMarketData(peerIP(ctx)); err != nil {
+		return nil, toStatus(err)
+	}
+
+	book, err := s.ex.Book(server.Market(req.Market))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	resp := &Book{
+		TotalBidVolume: book.TotalBidVolume,
+		TotalAskVolume: book.TotalAskVolume,
+		Asks:           make([]*Order, len(book.Asks)),
+		Bids:           make([]*Order, len(book.Bids)),
+	}
+	for i, order := range book.Asks {
+		resp.Asks[i] = fromOrder(order)
+	}
+	for i, order := range book.Bids {
+		resp.Bids[i] = fromOrder(order)
+	}
+
+	return resp, nil
+}
+
+func (s *Server) GetDepth(ctx context.Context, req *GetDepthRequest) (*Depth, error) {
+	if err := s.ex.AllowMarketData(peerIP(ctx)); err != nil {
+		return nil, toStatus(err)
+	}
+
+	depth, err := s.ex.Depth(server.Market(req.Market), int(req.Levels), req.Group)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &Depth{
+		Market:   string(depth.Market),
+		Sequence: depth.Sequence,
+		Bids:     fromDepthLevels(depth.Bids),
+		Asks:     fromDepthLevels(depth.Asks),
+	}, nil
+}
+
+func (s *Server) GetTrades(ctx context.Context, req *GetTradesRequest) (*GetTradesResponse, error) {
+	if err := s.ex.AllowMarketData(peerIP(ctx)); err != nil {
+		return nil, toStatus(err)
+	}
+
+	trades, err := s.ex.Trades(server.Market(req.Market))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	resp := &GetTradesResponse{Trades: make([]*Trade, len(trades))}
+	for i, trade := range trades {
+		resp.Trades[i] = fromTrade(trade)
+	}
+
+	return resp, nil
+}
+
+func (s *Server) StreamTrades(req *StreamTradesRequest, stream Exchange_StreamTradesServer) error {
+	return s.stream(stream.Context(), server.Market(req.Market), server.ChannelTrades, func(msg server.WSMessage) error {
+		trade, ok := msg.Data.(*orderbook.Trade)
+		if !ok {
+			return nil
+		}
+		return stream.Send(fromTrade(trade))
+	})
+}
+
+func (s *Server) StreamBook(req *StreamBookRequest, stream Exchange_StreamBookServer) error {
+	return s.stream(stream.Context(), server.Market(req.Market), server.ChannelBook, func(msg server.WSMessage) error {
+		levels, ok := msg.Data.(server.BookLevels)
+		if !ok {
+			return nil
+		}
+		return stream.Send(&BookUpdate{
+			Snapshot: msg.Type == server.WSSnapshot,
+			Sequence: msg.Sequence,
+			Bids:     fromLevels(levels.Bids),
+			Asks:     fromLevels(levels.Asks),
+		})
+	})
+}
+
+// stream subscribes to a channel of a market and sends its messages until
+// the call ends. Messages are queued, a stream that falls too far behind
+// is ended as a slow consumer.
+func (s *Server) stream(ctx context.Context, market server.Market, channel server.Channel, send func(server.WSMessage) error) error {
+	if err := s.ex.AllowMarketData(peerIP(ctx)); err != nil {
+		return toStatus(err)
+	}
+
+	msgs := make(chan server.WSMessage, s.cfg.StreamBuffer)
+	full := false
+	// The handler is called with the feed locked, so it never runs
+	// concurrently with itself.
+	unsubscribe, err := s.ex.SubscribeMarket(market, channel, func(msg server.WSMessage) {
+		if full {
+			return
+		}
+		select {
+		case msgs <- msg:
+		default:
+			full = true
+			close(msgs)
+		}
+	})
+	if err != nil {
+		return toStatus(err)
+	}
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-msgs:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "slow consumer")
+			}
+			if err := send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// authenticate returns the caller of a call, who needs to have scope.
+func (s *Server) authenticate(ctx context.Context, req proto.Message, scope server.Scope) (*server.Caller, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	var caller *server.Caller
+	if auth := get("authorization"); strings.HasPrefix(auth, "Bearer ") {
+		c, err := s.ex.VerifySession(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		caller = c
+	} else {
+		body, err := signedBody(req)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		method, _ := grpc.Method(ctx)
+
+		apiKey, err := s.ex.VerifyAPIKey(get(mdAPIKey), get(mdAPITimestamp), get(mdAPINonce), get(mdAPISignature), signMethod, method, body)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		caller = &server.Caller{UserID: apiKey.UserID, Scopes: apiKey.Scopes, AuthKey: server.APIKeyAuth(apiKey.Key)}
+	}
+
+	if !caller.HasScope(scope) {
+		return nil, status.Errorf(codes.PermissionDenied, "missing %s scope", scope)
+	}
+	return caller, nil
+}
+
+// SignCall returns the API key signature of a call of method, the full
+// method name, with req.
+func SignCall(secret, method, timestamp, nonce string, req proto.Message) (string, error) {
+	body, err := signedBody(req)
+	if err != nil {
+		return "", err
+	}
+	return server.SignRequest(secret, signMethod, method, timestamp, nonce, body), nil
+}
+
+// signedBody is the encoding of a request that is signed. It is
+// deterministic so the client and the server encode it the same.
+func signedBody(req proto.Message) ([]byte, error) {
+	return proto.MarshalOptions{Deterministic: true}.Marshal(req)
+}
+
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// toStatus is the status of an error of the exchange, with the codes
+// matching the HTTP statuses of the REST API.
+func toStatus(err error) error {
+	var limited *server.RateLimitError
+
+	code := codes.InvalidArgument
+	switch {
+	case errors.As(err, &limited):
+		code = codes.ResourceExhausted
+	case errors.Is(err, server.ErrOrderNotFound):
+		code = codes.NotFound
+	case errors.Is(err, server.ErrNotOrderOwner):
+		code = codes.PermissionDenied
+	case errors.Is(err, server.ErrOrderNonceUsed):
+		code = codes.AlreadyExists
+	}
+
+	return status.Error(code, err.Error())
+}
+
+func toOrderType(t OrderType) server.OrderType {
+	switch t {
+	case OrderType_ORDER_TYPE_LIMIT:
+		return server.LimitOrder
+	case OrderType_ORDER_TYPE_MARKET:
+		return server.MarketOrder
+	default:
+		return ""
+	}
+}
+
+func toSignedOrder(o *SignedOrder) (*server.SignedOrder, error) {
+	if o == nil {
+		return nil, nil
+	}
+
+	for _, address := range []string{o.User, o.BaseToken, o.QuoteToken} {
+		if !common.IsHexAddress(address) {
+			return nil, fmt.Errorf("%w: invalid address %q", server.ErrInvalidOrder, address)
+		}
+	}
+
+	var amounts [4]*big.Int
+	for i, amount := range []string{o.Price, o.Size, o.Nonce, o.Expiry} {
+		n, ok := new(big.Int).SetString(amount, 10)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid amount %q", server.ErrInvalidOrder, amount)
+		}
+		amounts[i] = n
+	}
+
+	return &server.SignedOrder{
+		User:       common.HexToAddress(o.User),
+		BaseToken:  common.HexToAddress(o.BaseToken),
+		QuoteToken: common.HexToAddress(o.QuoteToken),
+		Bid:        o.Bid,
+		Price:      amounts[0],
+		Size:       amounts[1],
+		Nonce:      amounts[2],
+		Expiry:     amounts[3],
+		Signature:  o.Signature,
+	}, nil
+}
+
+func fromSignedOrder(o *server.SignedOrder) *SignedOrder {
+	if o == nil {
+		return nil
+	}
+
+	return &SignedOrder{
+		User:       o.User.Hex(),
+		BaseToken:  o.BaseToken.Hex(),
+		QuoteToken: o.QuoteToken.Hex(),
+		Bid:        o.Bid,
+		Price:      o.Price.String(),
+		Size:       o.Size.String(),
+		Nonce:      o.Nonce.String(),
+		Expiry:     o.Expiry.String(),
+		Signature:  o.Signature,
+	}
+}
+
+func fromOrder(o *server.Order) *Order {
+	return &Order{
+		UserId:        o.UserID,
+		Id:            o.ID,
+		Price:         o.Price,
+		Size:          o.Size,
+		Bid:           o.Bid,
+		Timestamp:     o.Timestamp,
+		Signed:        fromSignedOrder(o.Signed),
+		ClientOrderId: o.ClientOrderID,
+	}
+}
+
+func fromTrade(t *orderbook.Trade) *Trade {
+	return &Trade{
+		Price:     t.Price,
+		Size:      t.Size,
+		Bid:       t.Bid,
+		Timestamp: t.Timestamp,
+	}
+}
+
+func fromLevels(levels []orderbook.Level) []*Level {
+	resp := make([]*Level, len(levels))
+	for i, level := range levels {
+		resp[i] = &Level{Price: level.Price, Size: level.Size}
+	}
+	return resp
+}
+
+func fromDepthLevels(levels []orderbook.DepthLevel) []*DepthLevel {
+	resp := make([]*DepthLevel, len(levels))
+	for i, level := range levels {
+		resp[i] = &DepthLevel{Price: level.Price, Size: level.Size, Orders: int64(level.Orders)}
+	}
+	return resp
+}
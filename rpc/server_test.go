@@ -0,0 +1,236 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tahaontech/crypto_exchange/server"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// newTestExchange returns an exchange on a simulated chain with a funded
+// account for every user, by ID starting at 1, and their API keys.
+func newTestExchange(t *testing.T, users int) (*server.Exchange, []*server.APIKey) {
+	t.Helper()
+
+	alloc := core.GenesisAlloc{}
+	keys := make([]*ecdsa.PrivateKey, users)
+	for i := range keys {
+		keys[i] = newKey(t)
+		balance, _ := new(big.Int).SetString("1000000000000000000000", 10)
+		alloc[crypto.PubkeyToAddress(keys[i].PublicKey)] = core.GenesisAccount{Balance: balance}
+	}
+	backend := backends.NewSimulatedBackend(alloc, 30_000_000)
+	t.Cleanup(func() { backend.Close() })
+
+	ex, err := server.NewExchange(newKey(t), backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apiKeys := make([]*server.APIKey, users)
+	for i, key := range keys {
+		user, err := server.NewUser(hex.EncodeToString(crypto.FromECDSA(key)), int64(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if apiKeys[i], err = ex.RegisterUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ex, apiKeys
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func startServer(t *testing.T, ex *server.Exchange) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(ex, Config{})
+	go s.Serve(l)
+	t.Cleanup(s.Close)
+
+	return l.Addr().String()
+}
+
+func dial(t *testing.T, addr string, key *server.APIKey) *Client {
+	t.Helper()
+
+	c, err := DialWithKey(addr, key.Key, key.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func expectCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+
+	if status.Code(err) != code {
+		t.Fatalf("expected %s, got %v", code, err)
+	}
+}
+
+func TestServer(t *testing.T) {
+	ex, keys := newTestExchange(t, 2)
+	addr := startServer(t, ex)
+	maker, taker := dial(t, addr, keys[0]), dial(t, addr, keys[1])
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bad := dial(t, addr, &server.APIKey{Key: keys[0].Key, Secret: "wrong"})
+	_, err := bad.PlaceOrder(ctx, &PlaceOrderRequest{Type: OrderType_ORDER_TYPE_LIMIT, Size: 1, Price: 90, Market: "ETH"})
+	expectCode(t, err, codes.Unauthenticated)
+
+	book, err := maker.StreamBook(ctx, &StreamBookRequest{Market: "ETH"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, err := book.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !update.Snapshot || len(update.Bids) != 0 {
+		t.Fatalf("expected an empty snapshot, got %v", update)
+	}
+
+	trades, err := maker.StreamTrades(ctx, &StreamTradesRequest{Market: "ETH"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	placed, err := maker.PlaceOrder(ctx, &PlaceOrderRequest{Type: OrderType_ORDER_TYPE_LIMIT, Bid: true, Size: 2, Price: 90, Market: "ETH", ClientOrderId: "bid-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if placed.ClientOrderId != "bid-1" {
+		t.Fatalf("expected client order id bid-1, got %q", placed.ClientOrderId)
+	}
+
+	update, err = book.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.Snapshot || len(update.Bids) != 1 || update.Bids[0].Price != 90 || update.Bids[0].Size != 2 {
+		t.Fatalf("expected a bid of 2 at 90, got %v", update)
+	}
+
+	// Order entry behaves like the exchange does for every transport.
+	_, err = maker.PlaceOrder(ctx, &PlaceOrderRequest{Type: OrderType_ORDER_TYPE_UNSPECIFIED, Size: 1, Market: "ETH"})
+	expectCode(t, err, codes.InvalidArgument)
+	_, err = taker.CancelOrder(ctx, &CancelOrderRequest{OrderId: placed.OrderId})
+	expectCode(t, err, codes.PermissionDenied)
+	_, err = maker.CancelOrder(ctx, &CancelOrderRequest{OrderId: placed.OrderId + 1})
+	expectCode(t, err, codes.NotFound)
+
+	if _, err := taker.PlaceOrder(ctx, &PlaceOrderRequest{Type: OrderType_ORDER_TYPE_MARKET, Size: 0.5, Market: "ETH"}); err != nil {
+		t.Fatal(err)
+	}
+	trade, err := trades.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.Price != 90 || trade.Size != 0.5 || trade.Bid {
+		t.Fatalf("expected a sell of 0.5 at 90, got %v", trade)
+	}
+
+	_, err = maker.AmendOrder(ctx, &AmendOrderRequest{ClientOrderId: "bid-2", Price: 95, Size: 3})
+	expectCode(t, err, codes.NotFound)
+	if _, err := maker.AmendOrder(ctx, &AmendOrderRequest{ClientOrderId: "bid-1", Price: 95, Size: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	orders, err := maker.GetOrders(ctx, &GetOrdersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders.Bids) != 1 || orders.Bids[0].Id != placed.OrderId || orders.Bids[0].Price != 95 || orders.Bids[0].Size != 3 || orders.Bids[0].ClientOrderId != "bid-1" {
+		t.Fatalf("expected the amended order, got %v", orders)
+	}
+
+	// The book and the trades are the ones of the REST API.
+	got, err := maker.GetBook(ctx, &GetBookRequest{Market: "ETH"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ex.Book(server.MarketETH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TotalBidVolume != want.TotalBidVolume || len(got.Bids) != len(want.Bids) || !proto.Equal(got.Bids[0], fromOrder(want.Bids[0])) {
+		t.Fatalf("expected book %v, got %v", want, got)
+	}
+
+	depth, err := maker.GetDepth(ctx, &GetDepthRequest{Market: "ETH", Levels: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(depth.Bids) != 1 || depth.Bids[0].Price != 95 || depth.Bids[0].Size != 3 || depth.Bids[0].Orders != 1 || len(depth.Asks) != 0 {
+		t.Fatalf("expected a bid level of 3 at 95, got %v", depth)
+	}
+	_, err = maker.GetDepth(ctx, &GetDepthRequest{Market: "ETH", Group: -1})
+	expectCode(t, err, codes.InvalidArgument)
+
+	tradesResp, err := maker.GetTrades(ctx, &GetTradesRequest{Market: "ETH"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tradesResp.Trades) != 1 || tradesResp.Trades[0].Price != trade.Price || tradesResp.Trades[0].Size != trade.Size {
+		t.Fatalf("expected the streamed trade, got %v", tradesResp.Trades)
+	}
+
+	_, err = maker.GetBook(ctx, &GetBookRequest{Market: "BTC"})
+	expectCode(t, err, codes.InvalidArgument)
+
+	second, err := maker.PlaceOrder(ctx, &PlaceOrderRequest{Type: OrderType_ORDER_TYPE_LIMIT, Bid: true, Size: 1, Price: 80, Market: "ETH"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := maker.CancelOrder(ctx, &CancelOrderRequest{ClientOrderId: "bid-1"}); err != nil {
+		t.Fatal(err)
+	}
+	cancelled, err := maker.CancelAllOrders(ctx, &CancelAllOrdersRequest{Market: "ETH", Side: Side_SIDE_ASK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cancelled.OrderIds) != 0 {
+		t.Fatalf("expected no cancelled asks, got %v", cancelled.OrderIds)
+	}
+	cancelled, err = maker.CancelAllOrders(ctx, &CancelAllOrdersRequest{Side: Side_SIDE_BID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cancelled.OrderIds) != 1 || cancelled.OrderIds[0] != second.OrderId {
+		t.Fatalf("expected order %d cancelled, got %v", second.OrderId, cancelled.OrderIds)
+	}
+	orders, err = maker.GetOrders(ctx, &GetOrdersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders.Bids) != 0 {
+		t.Fatalf("expected no orders, got %v", orders)
+	}
+}
@@ -0,0 +1,430 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	HeaderAPIKey       = "X-Api-Key"
+	HeaderAPITimestamp = "X-Api-Timestamp"
+	HeaderAPINonce     = "X-Api-Nonce"
+	HeaderAPISignature = "X-Api-Signature"
+	// HeaderOperatorToken carries the operator token of the exchange,
+	// which approves and rejects withdrawals.
+	HeaderOperatorToken = "X-Operator-Token"
+
+	// minOperatorTokenLen is the length an operator token has at least.
+	minOperatorTokenLen = 32
+
+	// authWindow is how far the timestamp of a signed request may be off
+	// from the server clock. Nonces are remembered for as long.
+	authWindow = 30 * time.Second
+
+	// contextUserID, contextScopes and contextAuthKey are the keys of the
+	// authenticated user ID, their scopes and credentials in the echo
+	// context.
+	contextUserID  = "userID"
+	contextScopes  = "scopes"
+	contextAuthKey = "authKey"
+
+	// ScopeRead allows querying the orders, deposits and withdrawals of
+	// the user.
+	ScopeRead Scope = "READ"
+	// ScopeTrade allows placing and cancelling orders.
+	ScopeTrade Scope = "TRADE"
+	// ScopeWithdraw allows requesting withdrawals.
+	ScopeWithdraw Scope = "WITHDRAW"
+)
+
+// AllScopes are the scopes of wallet sessions and of the first key of a
+// user.
+var AllScopes = []Scope{ScopeRead, ScopeTrade, ScopeWithdraw}
+
+var (
+	ErrInvalidAPIKey    = errors.New("invalid api key")
+	ErrInvalidRequestTS = errors.New("request timestamp outside of the allowed window")
+	ErrReplayedNonce    = errors.New("nonce already used")
+	ErrBadSignature     = errors.New("invalid request signature")
+	ErrAPIKeyNotFound   = errors.New("api key not found")
+	ErrInvalidScope     = errors.New("invalid scope")
+	ErrOperatorToken    = errors.New("invalid operator token")
+)
+
+type Scope string
+
+type APIKey struct {
+	Key       string
+	Secret    string `json:",omitempty"`
+	UserID    int64
+	Scopes    []Scope
+	CreatedAt int64
+}
+
+type CreateAPIKeyRequest struct {
+	// Scopes default to the scopes of the caller, and can not exceed them.
+	Scopes []Scope
+}
+
+// APIKeys holds the API keys of the users and the nonces of the signed
+// requests of the last authWindow.
+type APIKeys struct {
+	mu     sync.Mutex
+	keys   map[string]*APIKey
+	nonces map[string]map[string]time.Time
+	now    func() time.Time
+	// save stores a new key, or a revoked key with the time it was
+	// revoked, if set.
+	save func(apiKey *APIKey, revokedAt int64) error
+}
+
+func NewAPIKeys() *APIKeys {
+	return &APIKeys{
+		keys:   make(map[string]*APIKey),
+		nonces: make(map[string]map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// Create generates a new key and secret for the user. The secret is only
+// returned here.
+func (k *APIKeys) Create(userID int64, scopes []Scope) (*APIKey, error) {
+	if len(scopes) == 0 {
+		return nil, ErrInvalidScope
+	}
+	for _, scope := range scopes {
+		if !hasScope(AllScopes, scope) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidScope, scope)
+		}
+	}
+
+	key, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey := &APIKey{
+		Key:       key,
+		Secret:    secret,
+		UserID:    userID,
+		Scopes:    append([]Scope{}, scopes...),
+		CreatedAt: k.now().UnixNano(),
+	}
+	if k.save != nil {
+		if err := k.save(apiKey, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	k.mu.Lock()
+	k.keys[key] = apiKey
+	k.mu.Unlock()
+
+	created := *apiKey
+	return &created, nil
+}
+
+// Revoke deletes a key of the user.
+func (k *APIKeys) Revoke(userID int64, key string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	apiKey, ok := k.keys[key]
+	if !ok || apiKey.UserID != userID {
+		return ErrAPIKeyNotFound
+	}
+	if k.save != nil {
+		if err := k.save(apiKey, k.now().UnixNano()); err != nil {
+			return err
+		}
+	}
+
+	delete(k.keys, key)
+	delete(k.nonces, key)
+	return nil
+}
+
+// load adds stored keys.
+func (k *APIKeys) load(keys []*APIKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, apiKey := range keys {
+		k.keys[apiKey.Key] = apiKey
+	}
+}
+
+// List returns the keys of the user without their secrets.
+func (k *APIKeys) List(userID int64) []*APIKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys := []*APIKey{}
+	for _, apiKey := range k.keys {
+		if apiKey.UserID == userID {
+			keys = append(keys, &APIKey{
+				Key:       apiKey.Key,
+				UserID:    apiKey.UserID,
+				Scopes:    apiKey.Scopes,
+				CreatedAt: apiKey.CreatedAt,
+			})
+		}
+	}
+	return keys
+}
+
+// Verify checks a signed request and returns the key it was signed with.
+// A nonce can only be used once per key within the auth window.
+func (k *APIKeys) Verify(key, timestamp, nonce, signature, method, path string, body []byte) (*APIKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	apiKey, ok := k.keys[key]
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+
+	ms, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidRequestTS
+	}
+	now := k.now()
+	if d := now.Sub(time.UnixMilli(ms)); d > authWindow || d < -authWindow {
+		return nil, ErrInvalidRequestTS
+	}
+
+	expected := SignRequest(apiKey.Secret, method, path, timestamp, nonce, body)
+	if nonce == "" || !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, ErrBadSignature
+	}
+
+	nonces, ok := k.nonces[key]
+	if !ok {
+		nonces = make(map[string]time.Time)
+		k.nonces[key] = nonces
+	}
+	for n, seen := range nonces {
+		if now.Sub(seen) > 2*authWindow {
+			delete(nonces, n)
+		}
+	}
+	if _, ok := nonces[nonce]; ok {
+		return nil, ErrReplayedNonce
+	}
+	nonces[nonce] = now
+
+	verified := *apiKey
+	return &verified, nil
+}
+
+// SignRequest returns the hex encoded HMAC-SHA256 of a request. path is
+// the request URI including the query, timestamp is in Unix milliseconds.
+func SignRequest(secret, method, path, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n" + nonce + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authenticate is a middleware that derives the user of a request from
+// its session token or API key signature.
+func (ex *Exchange) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+
+		if auth := req.Header.Get(echo.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+			userID, err := ex.sessions.Parse(strings.TrimPrefix(auth, "Bearer "))
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, APIError{Error: err.Error()})
+			}
+
+			c.Set(contextUserID, userID)
+			c.Set(contextScopes, AllScopes)
+			c.Set(contextAuthKey, sessionAuthKey(userID))
+			return next(c)
+		}
+
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request body"})
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		apiKey, err := ex.apiKeys.Verify(
+			req.Header.Get(HeaderAPIKey),
+			req.Header.Get(HeaderAPITimestamp),
+			req.Header.Get(HeaderAPINonce),
+			req.Header.Get(HeaderAPISignature),
+			req.Method,
+			req.URL.RequestURI(),
+			body,
+		)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, APIError{Error: err.Error()})
+		}
+
+		c.Set(contextUserID, apiKey.UserID)
+		c.Set(contextScopes, apiKey.Scopes)
+		c.Set(contextAuthKey, APIKeyAuth(apiKey.Key))
+		return next(c)
+	}
+}
+
+// SetOperatorToken sets the token of the operator of the exchange. Users
+// can not get it with their API keys or session tokens.
+func (ex *Exchange) SetOperatorToken(token string) error {
+	if len(token) < minOperatorTokenLen {
+		return fmt.Errorf("%w: shorter than %d characters", ErrOperatorToken, minOperatorTokenLen)
+	}
+	ex.operatorToken = token
+	return nil
+}
+
+// requireOperator is a middleware that lets only the operator of the
+// exchange through. Users are authenticated to tell them apart from
+// anonymous callers, and refused.
+func (ex *Exchange) requireOperator(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if token := c.Request().Header.Get(HeaderOperatorToken); token != "" {
+			if ex.operatorToken == "" || !hmac.Equal([]byte(token), []byte(ex.operatorToken)) {
+				return c.JSON(http.StatusUnauthorized, APIError{Error: ErrOperatorToken.Error()})
+			}
+			return next(c)
+		}
+
+		return ex.authenticate(func(c echo.Context) error {
+			return c.JSON(http.StatusForbidden, APIError{Error: "operator only"})
+		})(c)
+	}
+}
+
+// requireScope returns a middleware, to be used after authenticate, that
+// rejects callers without the given scope.
+func requireScope(scope Scope) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !hasScope(authScopes(c), scope) {
+				return c.JSON(http.StatusForbidden, APIError{Error: fmt.Sprintf("missing %s scope", scope)})
+			}
+			return next(c)
+		}
+	}
+}
+
+// authUserID returns the user authenticated by the middleware.
+func authUserID(c echo.Context) (int64, bool) {
+	userID, ok := c.Get(contextUserID).(int64)
+	return userID, ok
+}
+
+// isOwner reports whether the authenticated user is userID.
+func isOwner(c echo.Context, userID int64) bool {
+	authID, ok := authUserID(c)
+	return ok && authID == userID
+}
+
+// authKey identifies the credentials of the request: the API key, or the
+// user for session tokens.
+func authKey(c echo.Context) string {
+	key, _ := c.Get(contextAuthKey).(string)
+	return key
+}
+
+// APIKeyAuth is the auth key of an API key, which identifies the orders
+// placed with it for cancel-on-disconnect.
+func APIKeyAuth(key string) string {
+	return "key:" + key
+}
+
+// sessionAuthKey is the auth key of the session tokens of a user.
+func sessionAuthKey(userID int64) string {
+	return "session:" + strconv.FormatInt(userID, 10)
+}
+
+func authScopes(c echo.Context) []Scope {
+	scopes, _ := c.Get(contextScopes).([]Scope)
+	return scopes
+}
+
+func hasScope(scopes []Scope, scope Scope) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (ex *Exchange) handleCreateAPIKey(c echo.Context) error {
+	userID, _ := authUserID(c)
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil && err != io.EOF {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request body"})
+	}
+
+	callerScopes := authScopes(c)
+	if len(req.Scopes) == 0 {
+		req.Scopes = callerScopes
+	}
+	for _, scope := range req.Scopes {
+		if !hasScope(callerScopes, scope) {
+			return c.JSON(http.StatusForbidden, APIError{Error: fmt.Sprintf("can not grant %s scope", scope)})
+		}
+	}
+
+	apiKey, err := ex.apiKeys.Create(userID, req.Scopes)
+	if errors.Is(err, ErrInvalidScope) {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, apiKey)
+}
+
+func (ex *Exchange) handleGetAPIKeys(c echo.Context) error {
+	userID, _ := authUserID(c)
+	return c.JSON(http.StatusOK, ex.apiKeys.List(userID))
+}
+
+func (ex *Exchange) handleRevokeAPIKey(c echo.Context) error {
+	userID, _ := authUserID(c)
+
+	err := ex.apiKeys.Revoke(userID, c.Param("key"))
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return c.JSON(http.StatusNotFound, APIError{Error: err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "api key revoked"})
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func signedRequest(key *APIKey, method, path, body, nonce string, ts time.Time) *http.Request {
+	timestamp := strconv.FormatInt(ts.UnixMilli(), 10)
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(HeaderAPIKey, key.Key)
+	req.Header.Set(HeaderAPITimestamp, timestamp)
+	req.Header.Set(HeaderAPINonce, nonce)
+	req.Header.Set(HeaderAPISignature, SignRequest(key.Secret, method, path, timestamp, nonce, []byte(body)))
+	return req
+}
+
+func TestAuthenticate(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+
+	e := echo.New()
+	e.POST("/whoami", func(c echo.Context) error {
+		userID, _ := authUserID(c)
+		return c.String(http.StatusOK, strconv.FormatInt(userID, 10))
+	}, ex.authenticate)
+
+	key, err := ex.apiKeys.Create(42, AllScopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(signedRequest(key, http.MethodPost, "/whoami?a=1", `{"Size":1}`, "n1", time.Now()))
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, rec.Body.String(), "42")
+
+	// Replayed nonce.
+	rec = serve(signedRequest(key, http.MethodPost, "/whoami?a=1", `{"Size":1}`, "n1", time.Now()))
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	// Stale timestamp.
+	rec = serve(signedRequest(key, http.MethodPost, "/whoami", "", "n2", time.Now().Add(-time.Minute)))
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	// Tampered body.
+	req := signedRequest(key, http.MethodPost, "/whoami", `{"Size":1}`, "n3", time.Now())
+	req.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"Size":100}`)).Body
+	assert(t, serve(req).Code, http.StatusUnauthorized)
+
+	// Revoked key.
+	if err := ex.apiKeys.Revoke(42, key.Key); err != nil {
+		t.Fatal(err)
+	}
+	rec = serve(signedRequest(key, http.MethodPost, "/whoami", "", "n4", time.Now()))
+	assert(t, rec.Code, http.StatusUnauthorized)
+}
+
+func TestOrderOwnershipAndScopes(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	alice, err := ex.apiKeys.Create(1, AllScopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := ex.apiKeys.Create(2, AllScopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnly, err := ex.apiKeys.Create(1, []Scope{ScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tradeOnly, err := ex.apiKeys.Create(1, []Scope{ScopeTrade})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := 0
+	serve := func(key *APIKey, method, path, body string) *httptest.ResponseRecorder {
+		nonce++
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, signedRequest(key, method, path, body, strconv.Itoa(nonce), time.Now()))
+		return rec
+	}
+
+	rec := serve(alice, http.MethodPost, "/order", `{"Type":"LIMIT","Bid":true,"Size":1,"Price":100,"Market":"ETH"}`)
+	assert(t, rec.Code, http.StatusOK)
+	var placed PlaceOrderResponse
+	if err := json.NewDecoder(rec.Body).Decode(&placed); err != nil {
+		t.Fatal(err)
+	}
+	orderPath := "/order/" + strconv.FormatInt(placed.OrderID, 10)
+
+	assert(t, serve(bob, http.MethodPost, "/order", `{"UserID":1,"Type":"LIMIT","Bid":true,"Size":1,"Price":100,"Market":"ETH"}`).Code, http.StatusForbidden)
+	assert(t, serve(bob, http.MethodGet, "/order/1", "").Code, http.StatusForbidden)
+	assert(t, serve(bob, http.MethodDelete, orderPath, "").Code, http.StatusForbidden)
+	assert(t, serve(bob, http.MethodDelete, "/order/abc", "").Code, http.StatusBadRequest)
+	assert(t, serve(bob, http.MethodDelete, "/order/999", "").Code, http.StatusNotFound)
+
+	assert(t, serve(readOnly, http.MethodGet, "/order/1", "").Code, http.StatusOK)
+	assert(t, serve(readOnly, http.MethodDelete, orderPath, "").Code, http.StatusForbidden)
+	assert(t, serve(readOnly, http.MethodPost, "/apikeys", `{"Scopes":["TRADE"]}`).Code, http.StatusForbidden)
+	assert(t, serve(tradeOnly, http.MethodGet, "/order/1", "").Code, http.StatusForbidden)
+	assert(t, serve(tradeOnly, http.MethodPost, "/withdrawals", `{"Asset":"ETH","Amount":1}`).Code, http.StatusForbidden)
+
+	assert(t, serve(tradeOnly, http.MethodDelete, orderPath, "").Code, http.StatusOK)
+	assert(t, serve(alice, http.MethodDelete, orderPath, "").Code, http.StatusNotFound)
+	assert(t, len(ex.Orders[1]), 0)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+)
+
+var ErrInvalidCancelFilter = errors.New("invalid cancel filter")
+
+// errNoOrders stops a cancel all command that selected no order, so it is
+// not journaled.
+var errNoOrders = errors.New("no orders to cancel")
+
+// CancelFilter selects the open orders of a user cancelled by CancelAll:
+// those of Market, or of every market when it is empty, of the side Bid
+// when it is set, and with a price from MinPrice to MaxPrice when they are
+// not zero.
+type CancelFilter struct {
+	Market   Market
+	Bid      *bool
+	MinPrice float64
+	MaxPrice float64
+}
+
+// CancelAllResponse has the IDs of the orders cancelled by CancelAll.
+type CancelAllResponse struct {
+	OrderIDs []int64
+}
+
+func (f *CancelFilter) match(order *orderbook.Order) bool {
+	price := order.Limit.Price
+	switch {
+	case f.Bid != nil && order.Bid != *f.Bid:
+		return false
+	case f.MinPrice != 0 && price < f.MinPrice:
+		return false
+	case f.MaxPrice != 0 && price > f.MaxPrice:
+		return false
+	}
+	return true
+}
+
+// CancelAll cancels the open orders of the user selected by f, and returns
+// their IDs. The orders of a market are selected and cancelled by a single
+// command, so no order of the user is placed, filled or amended in between.
+func (ex *Exchange) CancelAll(userID int64, f CancelFilter) ([]int64, error) {
+	if f.MinPrice < 0 || f.MaxPrice < 0 || (f.MaxPrice != 0 && f.MinPrice > f.MaxPrice) {
+		return nil, ErrInvalidCancelFilter
+	}
+
+	markets := []Market{f.Market}
+	if f.Market == "" {
+		markets = markets[:0]
+		for market := range ex.orderbooks {
+			markets = append(markets, market)
+		}
+		sort.Slice(markets, func(i, j int) bool { return markets[i] < markets[j] })
+	} else if _, ok := ex.orderbooks[f.Market]; !ok {
+		return nil, ErrMarketNotFound
+	}
+
+	ids := []int64{}
+	for _, market := range markets {
+		orders, err := ex.cancelAll(market, userID, f)
+		if err != nil {
+			return ids, err
+		}
+		for _, order := range orders {
+			ids = append(ids, order.ID)
+		}
+	}
+
+	return ids, nil
+}
+
+// cancelAll cancels the orders of the user in a market selected by f.
+func (ex *Exchange) cancelAll(market Market, userID int64, f CancelFilter) ([]*orderbook.Order, error) {
+	var orders []*orderbook.Order
+	cmd := &Command{Type: CommandCancelAll, Time: ex.now().UnixNano(), UserID: userID}
+	_, err := ex.execute(market, cmd, func(ob *orderbook.Orderbook) error {
+		for _, order := range ob.UserOrders(userID) {
+			if f.match(order) {
+				orders = append(orders, order)
+				cmd.OrderIDs = append(cmd.OrderIDs, order.ID)
+			}
+		}
+		if len(orders) == 0 {
+			return errNoOrders
+		}
+		return nil
+	}, func(ob *orderbook.Orderbook) {
+		for _, order := range orders {
+			ob.CancelOrder(order)
+		}
+	})
+	if errors.Is(err, errNoOrders) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, order := range orders {
+		ex.removeUserOrder(order)
+	}
+	ex.publishMarket(market, nil, nil)
+	return orders, nil
+}
+
+// cancelFilter reads the market, side, minPrice and maxPrice query
+// parameters. Side is bid or ask.
+func cancelFilter(c echo.Context) (CancelFilter, error) {
+	f := CancelFilter{Market: Market(c.QueryParam("market"))}
+
+	switch side := strings.ToLower(c.QueryParam("side")); side {
+	case "":
+	case "bid", "ask":
+		bid := side == "bid"
+		f.Bid = &bid
+	default:
+		return f, errors.New("invalid side")
+	}
+
+	var err error
+	if s := c.QueryParam("minPrice"); s != "" {
+		if f.MinPrice, err = strconv.ParseFloat(s, 64); err != nil {
+			return f, errors.New("invalid min price")
+		}
+	}
+	if s := c.QueryParam("maxPrice"); s != "" {
+		if f.MaxPrice, err = strconv.ParseFloat(s, 64); err != nil {
+			return f, errors.New("invalid max price")
+		}
+	}
+
+	return f, nil
+}
+
+func (ex *Exchange) handleCancelAll(c echo.Context) error {
+	f, err := cancelFilter(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	userID, _ := authUserID(c)
+	ids, err := ex.CancelAll(userID, f)
+	if err != nil {
+		return c.JSON(orderErrorStatus(err), APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, CancelAllResponse{OrderIDs: ids})
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tahaontech/crypto_exchange/journal"
+)
+
+func TestCancelAll(t *testing.T) {
+	chain := newTestChain(t, 1)
+	ex := newTestExchange(t, chain)
+	dir := t.TempDir()
+	j, err := journal.Open(dir, journal.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.EnableJournal(j)
+
+	ids := map[float64]int64{}
+	for _, price := range []float64{90, 95, 105, 110} {
+		var resp PlaceOrderResponse
+		decode(t, placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Bid: price < 100, Size: 1, Price: price, Market: MarketETH}), &resp)
+		ids[price] = resp.OrderID
+	}
+	assert(t, placeOrder(t, ex, 2, PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 120, Market: MarketETH}).Code, http.StatusOK)
+
+	ask := false
+	cancelled, err := ex.CancelAll(1, CancelFilter{Market: MarketETH, Bid: &ask, MinPrice: 106})
+	assert(t, err, nil)
+	assert(t, cancelled, []int64{ids[110]})
+
+	cancelAll := func(target string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodDelete, target, nil), rec)
+		c.Set(contextUserID, int64(1))
+		if err := ex.handleCancelAll(c); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	rec := cancelAll("/orders?side=bid&maxPrice=100")
+	assert(t, rec.Code, http.StatusOK)
+	var resp CancelAllResponse
+	decode(t, rec, &resp)
+	assert(t, resp.OrderIDs, []int64{ids[90], ids[95]})
+	orders := ex.UserOrders(1)
+	assert(t, len(orders.Bids), 0)
+	assert(t, len(orders.Asks), 1)
+
+	// Nothing left to cancel is not an error.
+	resp = CancelAllResponse{}
+	decode(t, cancelAll("/orders?side=bid"), &resp)
+	assert(t, resp.OrderIDs, []int64{})
+
+	assert(t, cancelAll("/orders?side=up").Code, http.StatusBadRequest)
+	assert(t, cancelAll("/orders?minPrice=10&maxPrice=5").Code, http.StatusBadRequest)
+	assert(t, cancelAll("/orders?market=XRP").Code, http.StatusBadRequest)
+
+	// A cancel all command is replayed from the journal.
+	decode(t, cancelAll("/orders"), &resp)
+	assert(t, resp.OrderIDs, []int64{ids[105]})
+	assert(t, len(ex.orderbooks[MarketETH].Asks()), 1)
+	j.Close()
+
+	recovered := newTestExchange(t, chain)
+	assert(t, recovered.Recover(dir), nil)
+	assert(t, len(recovered.UserOrders(1).Asks), 0)
+	assert(t, len(recovered.UserOrders(2).Asks), 1)
+	assert(t, exchangeState(t, recovered), exchangeState(t, ex))
+}
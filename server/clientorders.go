@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// clientOrderWindow is how long a client order ID keeps naming its
+	// order after the order was placed, when the order is no longer open,
+	// so retries of orders filled right away are still recognized.
+	clientOrderWindow = 10 * time.Minute
+
+	maxClientOrderIDLen = 64
+)
+
+var ErrInvalidClientOrderID = errors.New("invalid client order id")
+
+// clientOrder is the order a client order ID of a user names, placed at
+// Unix nanoseconds placed.
+type clientOrder struct {
+	orderID int64
+	placed  int64
+}
+
+func checkClientOrderID(id string) error {
+	if len(id) > maxClientOrderIDLen {
+		return fmt.Errorf("%w: longer than %d characters", ErrInvalidClientOrderID, maxClientOrderIDLen)
+	}
+	return nil
+}
+
+// clientOrderLocked returns the order a client order ID of the user names,
+// if it is open or was placed within clientOrderWindow. It must be called
+// with ex.mu held.
+func (ex *Exchange) clientOrderLocked(userID int64, id string) (clientOrder, bool) {
+	o, ok := ex.clientOrders[userID][id]
+	if !ok {
+		return o, false
+	}
+	if _, open := ex.clientOrderIDs[o.orderID]; open {
+		return o, true
+	}
+	return o, ex.now().UnixNano()-o.placed < clientOrderWindow.Nanoseconds()
+}
+
+// bindClientOrderID names the order orderID of the user with a client order
+// ID, placed at Unix nanoseconds placed. If the ID already names an order,
+// the ID of that order is returned instead. The IDs of the user that no
+// longer name their orders are forgotten.
+func (ex *Exchange) bindClientOrderID(userID int64, id string, orderID, placed int64) (int64, bool) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	return ex.bindClientOrderIDLocked(userID, id, orderID, placed)
+}
+
+// bindClientOrderIDLocked is bindClientOrderID with ex.mu held.
+func (ex *Exchange) bindClientOrderIDLocked(userID int64, id string, orderID, placed int64) (int64, bool) {
+	if o, ok := ex.clientOrderLocked(userID, id); ok {
+		return o.orderID, false
+	}
+
+	orders, ok := ex.clientOrders[userID]
+	if !ok {
+		orders = make(map[string]clientOrder)
+		ex.clientOrders[userID] = orders
+	}
+	for other := range orders {
+		if _, ok := ex.clientOrderLocked(userID, other); !ok {
+			delete(orders, other)
+		}
+	}
+
+	orders[id] = clientOrder{orderID: orderID, placed: placed}
+	ex.clientOrderIDs[orderID] = id
+	return orderID, true
+}
+
+// unbindClientOrderID forgets the client order ID of a rejected order.
+func (ex *Exchange) unbindClientOrderID(userID, orderID int64) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if id, ok := ex.clientOrderIDs[orderID]; ok {
+		delete(ex.clientOrders[userID], id)
+		delete(ex.clientOrderIDs, orderID)
+	}
+}
+
+// closeClientOrderLocked marks an order with a client order ID as no
+// longer open. It must be called with ex.mu held.
+func (ex *Exchange) closeClientOrderLocked(orderID int64) {
+	delete(ex.clientOrderIDs, orderID)
+}
+
+// clientOrderID returns the client order ID of an open order.
+func (ex *Exchange) clientOrderID(orderID int64) string {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	return ex.clientOrderIDs[orderID]
+}
+
+// OrderID returns the ID of the order a client order ID of the user names.
+// An ID names its order while the order is open, and for a while after it
+// was placed.
+func (ex *Exchange) OrderID(userID int64, clientOrderID string) (int64, error) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	o, ok := ex.clientOrderLocked(userID, clientOrderID)
+	if !ok {
+		return 0, ErrOrderNotFound
+	}
+	return o.orderID, nil
+}
+
+func (ex *Exchange) handleGetClientOrder(c echo.Context) error {
+	userID, _ := authUserID(c)
+	id, err := ex.OrderID(userID, c.Param("clientOrderID"))
+	if err != nil {
+		return c.JSON(orderErrorStatus(err), APIError{Error: err.Error()})
+	}
+
+	order, err := ex.Order(userID, id)
+	if err != nil {
+		return c.JSON(orderErrorStatus(err), APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+func (ex *Exchange) cancelClientOrder(c echo.Context) error {
+	userID, _ := authUserID(c)
+	id, err := ex.OrderID(userID, c.Param("clientOrderID"))
+	if err == nil {
+		err = ex.CancelOrder(userID, id)
+	}
+	if err != nil {
+		return c.JSON(orderErrorStatus(err), APIError{Error: err.Error()})
+	}
+
+	return c.JSON(200, map[string]any{"msg": "order deleted"})
+}
+
+func (ex *Exchange) amendClientOrder(c echo.Context) error {
+	userID, _ := authUserID(c)
+	id, err := ex.OrderID(userID, c.Param("clientOrderID"))
+	if err != nil {
+		return c.JSON(orderErrorStatus(err), APIError{Error: err.Error()})
+	}
+
+	return ex.handleAmendOrder(c, id)
+}
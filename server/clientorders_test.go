@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+)
+
+func TestClientOrderID(t *testing.T) {
+	chain := newTestChain(t, 2)
+	ex := newTestExchange(t, chain)
+	for i, key := range chain.keys {
+		user := &User{ID: int64(i + 1), PrivateKey: key, Address: crypto.PubkeyToAddress(key.PublicKey)}
+		if err := ex.registerUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Unix(1_700_000_000, 0)
+	ex.now = func() time.Time { return start }
+
+	place := func(userID int64, req PlaceOrderRequest) (*PlaceOrderResponse, error) {
+		req.UserID = userID
+		req.Market = MarketETH
+		return ex.PlaceOrder(&req, "")
+	}
+
+	ask, err := place(1, PlaceOrderRequest{Type: LimitOrder, Size: 5, Price: 100, ClientOrderID: "ask-1"})
+	assert(t, err, nil)
+	assert(t, ask.ClientOrderID, "ask-1")
+
+	// A retry returns the first order, other users have their own IDs.
+	retry, err := place(1, PlaceOrderRequest{Type: LimitOrder, Size: 5, Price: 100, ClientOrderID: "ask-1"})
+	assert(t, err, nil)
+	assert(t, retry.OrderID, ask.OrderID)
+	assert(t, len(ex.UserOrders(1).Asks), 1)
+	other, err := place(2, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 1, Price: 90, ClientOrderID: "ask-1"})
+	assert(t, err, nil)
+	assert(t, other.OrderID != ask.OrderID, true)
+	assert(t, ex.UserOrders(2).Bids[0].ClientOrderID, "ask-1")
+
+	// Market orders are filled right away, and still recognized for a
+	// while after.
+	buy, err := place(2, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: 1, ClientOrderID: "buy"})
+	assert(t, err, nil)
+	retry, err = place(2, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: 1, ClientOrderID: "buy"})
+	assert(t, err, nil)
+	assert(t, retry.OrderID, buy.OrderID)
+	order, err := ex.Order(2, buy.OrderID)
+	assert(t, err, nil)
+	assert(t, order.ClientOrderID, "buy")
+	assert(t, order.Filled, 1.0)
+
+	ex.now = func() time.Time { return start.Add(clientOrderWindow) }
+	again, err := place(2, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: 1, ClientOrderID: "buy"})
+	assert(t, err, nil)
+	assert(t, again.OrderID != buy.OrderID, true)
+
+	// Open orders keep their ID past the window.
+	retry, err = place(1, PlaceOrderRequest{Type: LimitOrder, Size: 5, Price: 100, ClientOrderID: "ask-1"})
+	assert(t, err, nil)
+	assert(t, retry.OrderID, ask.OrderID)
+
+	// Rejected orders do not take their ID.
+	_, err = place(2, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: 100, ClientOrderID: "big"})
+	assert(t, errors.Is(err, ErrInvalidOrder), true)
+	_, err = ex.OrderID(2, "big")
+	assert(t, errors.Is(err, ErrOrderNotFound), true)
+	_, err = place(2, PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 100, ClientOrderID: strings.Repeat("x", maxClientOrderIDLen+1)})
+	assert(t, errors.Is(err, ErrInvalidClientOrderID), true)
+
+	// The ID survives a snapshot.
+	restored := newTestExchange(t, chain)
+	assert(t, restored.restore(ex.Snapshot()), nil)
+	id, err := restored.OrderID(1, "ask-1")
+	assert(t, err, nil)
+	assert(t, id, ask.OrderID)
+
+	serve := func(handler echo.HandlerFunc, method string, userID int64, param, value, body string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(method, "/", strings.NewReader(body)), rec)
+		c.Set(contextUserID, userID)
+		c.SetParamNames(param)
+		c.SetParamValues(value)
+		if err := handler(c); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	rec := serve(ex.handleGetClientOrder, http.MethodGet, 1, "clientOrderID", "ask-1", "")
+	assert(t, rec.Code, http.StatusOK)
+	var state OrderState
+	decode(t, rec, &state)
+	assert(t, state.ID, ask.OrderID)
+	assert(t, state.Status, OrderPartiallyFilled)
+
+	// Orders are amended by their ID or their client order ID.
+	amend := `{"Price": 101, "Size": 3}`
+	assert(t, serve(ex.amendClientOrder, http.MethodPut, 1, "clientOrderID", "ask-1", amend).Code, http.StatusOK)
+	assert(t, serve(ex.amendClientOrder, http.MethodPut, 1, "clientOrderID", "nope", amend).Code, http.StatusNotFound)
+	assert(t, serve(ex.amendOrder, http.MethodPut, 2, "id", strconv.FormatInt(ask.OrderID, 10), amend).Code, http.StatusForbidden)
+	assert(t, serve(ex.amendOrder, http.MethodPut, 1, "id", strconv.FormatInt(ask.OrderID, 10), `{"Price": 102, "Size": 0}`).Code, http.StatusBadRequest)
+	assert(t, serve(ex.amendOrder, http.MethodPut, 1, "id", strconv.FormatInt(ask.OrderID, 10), `{"Price": 102, "Size": 2}`).Code, http.StatusOK)
+	order, err = ex.Order(1, ask.OrderID)
+	assert(t, err, nil)
+	assert(t, order.Price, 102.0)
+	assert(t, order.Remaining, 2.0)
+
+	assert(t, serve(ex.cancelClientOrder, http.MethodDelete, 2, "clientOrderID", "ask-1", "").Code, http.StatusOK)
+	assert(t, serve(ex.cancelClientOrder, http.MethodDelete, 1, "clientOrderID", "nope", "").Code, http.StatusNotFound)
+	assert(t, serve(ex.cancelClientOrder, http.MethodDelete, 1, "clientOrderID", "ask-1", "").Code, http.StatusOK)
+	order, err = ex.Order(1, ask.OrderID)
+	assert(t, err, nil)
+	assert(t, order.Status, OrderCancelled)
+
+	// Cancelled orders free their ID once the window passed.
+	next, err := place(1, PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 100, ClientOrderID: "ask-1"})
+	assert(t, err, nil)
+	assert(t, next.OrderID != ask.OrderID, true)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tahaontech/crypto_exchange/journal"
+)
+
+type Config struct {
+	// KeystorePath is the go-ethereum keystore file of the exchange key.
+	KeystorePath string
+	// PasswordFile holds the passphrase of the keystore. The passphrase is
+	// prompted for when no file is given.
+	PasswordFile string
+	// Dev allows well-known development keys, and falls back to the first
+	// ganache account when no keystore is given.
+	Dev bool
+	// SignedOrders requires every order to be signed by its user.
+	SignedOrders bool
+	// Gateways are started with the exchange, to trade over other
+	// protocols than HTTP.
+	Gateways []func(ex *Exchange) error
+	// JournalDir is the directory of the journal of the books, off when
+	// empty.
+	JournalDir string
+	// JournalSync is the fsync policy of the journal.
+	JournalSync journal.SyncPolicy
+	// SnapshotInterval is the time between snapshots of the books in the
+	// journal directory.
+	SnapshotInterval time.Duration
+	// StorePath is the database of the users and the history of the
+	// exchange, which is kept in memory when empty.
+	StorePath string
+	// OperatorToken authenticates the operator of the exchange, who
+	// approves and rejects withdrawals.
+	OperatorToken string
+	// TrustedProxies are the IPs and CIDR ranges of the proxies whose
+	// X-Forwarded-For header gives the client IP.
+	TrustedProxies []string
+}
+
+// ConfigFromEnv reads the config from EXCHANGE_KEYSTORE,
+// EXCHANGE_PASSWORD_FILE, EXCHANGE_DEV, EXCHANGE_SIGNED_ORDERS,
+// EXCHANGE_JOURNAL_DIR, EXCHANGE_JOURNAL_SYNC,
+// EXCHANGE_SNAPSHOT_INTERVAL, EXCHANGE_DB, EXCHANGE_OPERATOR_TOKEN and
+// EXCHANGE_TRUSTED_PROXIES, a comma separated list.
+func ConfigFromEnv() Config {
+	snapshotInterval, _ := time.ParseDuration(os.Getenv("EXCHANGE_SNAPSHOT_INTERVAL"))
+
+	var trustedProxies []string
+	for _, proxy := range strings.Split(os.Getenv("EXCHANGE_TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+
+	return Config{
+		KeystorePath: os.Getenv("EXCHANGE_KEYSTORE"),
+		PasswordFile: os.Getenv("EXCHANGE_PASSWORD_FILE"),
+		Dev:          os.Getenv("EXCHANGE_DEV") != "",
+		SignedOrders: os.Getenv("EXCHANGE_SIGNED_ORDERS") != "",
+		JournalDir:   os.Getenv("EXCHANGE_JOURNAL_DIR"),
+		JournalSync:  journal.SyncPolicy(os.Getenv("EXCHANGE_JOURNAL_SYNC")),
+
+		SnapshotInterval: snapshotInterval,
+		StorePath:        os.Getenv("EXCHANGE_DB"),
+		OperatorToken:    os.Getenv("EXCHANGE_OPERATOR_TOKEN"),
+		TrustedProxies:   trustedProxies,
+	}
+}
@@ -0,0 +1,794 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/contracts/erc20"
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+const (
+	DepositPending   DepositStatus = "PENDING"
+	DepositConfirmed DepositStatus = "CONFIRMED"
+	// DepositOrphaned deposits were in a block that got reorged out
+	// before reaching the required confirmations.
+	DepositOrphaned DepositStatus = "ORPHANED"
+
+	// depositCursor is the name of the cursor of the first block whose
+	// deposits are not credited yet.
+	depositCursor = "deposits"
+)
+
+type DepositStatus string
+
+type Deposit struct {
+	UserID        int64
+	Asset         string
+	Amount        float64
+	Value         *big.Int // Amount in base units of the asset
+	TxHash        common.Hash
+	LogIndex      uint
+	BlockNumber   uint64
+	BlockHash     common.Hash
+	Confirmations uint64
+	Status        DepositStatus
+	Timestamp     int64
+
+	// id is the ID of the record of a credited deposit, and sweepTx the
+	// transaction that swept it.
+	id      uint64
+	sweepTx common.Hash
+	address common.Address
+	asset   *Asset
+}
+
+type DepositWatcherConfig struct {
+	// Confirmations is the number of blocks (including the one with the
+	// deposit) before a deposit is credited.
+	Confirmations uint64
+	PollInterval  time.Duration
+	// Tokens are the ERC-20 assets accepted as deposit. Native ETH is
+	// always accepted.
+	Tokens []*Asset
+	// SweepKey is the exchange key the deposit addresses are derived
+	// from. When it is set, confirmed deposits are swept to its address.
+	SweepKey *ecdsa.PrivateKey
+	// Nonces sends the transactions of SweepKey, which pay the gas of
+	// token sweeps. It is shared with the other senders of the key, and
+	// made for the key when nil.
+	Nonces *NonceManager
+}
+
+// DepositWatcher follows the chain and credits transfers to the deposit
+// addresses of users to the ledger once they are confirmed.
+type DepositWatcher struct {
+	client        ChainClient
+	ledger        *Ledger
+	confirmations uint64
+	pollInterval  time.Duration
+
+	mu        sync.RWMutex
+	tokens    map[common.Address]*Asset
+	addresses map[common.Address]int64
+	deposits  map[int64][]*Deposit
+	pending   []*Deposit
+	// blocks holds the hashes of the processed blocks that can still be
+	// reorged out, keyed by block number.
+	blocks map[uint64]common.Hash
+	// next is the number of the next block to process.
+	next    uint64
+	started bool
+	// records keeps the first block whose deposits are not credited, so
+	// the blocks mined while the exchange was down are scanned, and the
+	// credited deposits.
+	records store.Store
+	cursor  uint64
+
+	sweepKey *ecdsa.PrivateKey
+	nonces   *NonceManager
+	// sweeps are the confirmed deposits not swept yet.
+	sweeps map[holding]*sweep
+}
+
+// holding is an asset at a deposit address.
+type holding struct {
+	address common.Address
+	token   common.Address
+}
+
+// sweep is what is left to sweep of a holding, and the deposits it is
+// made of. Funding is the transaction paying the gas of a token sweep.
+type sweep struct {
+	userID   int64
+	asset    *Asset
+	value    *big.Int
+	deposits []*Deposit
+	funding  *types.Transaction
+}
+
+func NewDepositWatcher(client ChainClient, ledger *Ledger, cfg DepositWatcherConfig) *DepositWatcher {
+	if cfg.Confirmations == 0 {
+		cfg.Confirmations = 1
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = time.Second
+	}
+
+	tokens := make(map[common.Address]*Asset)
+	for _, asset := range cfg.Tokens {
+		tokens[asset.Token] = asset
+	}
+	if cfg.SweepKey != nil && cfg.Nonces == nil {
+		cfg.Nonces = NewNonceManager(client, cfg.SweepKey)
+	}
+
+	return &DepositWatcher{
+		client:        client,
+		ledger:        ledger,
+		confirmations: cfg.Confirmations,
+		pollInterval:  cfg.PollInterval,
+		tokens:        tokens,
+		addresses:     make(map[common.Address]int64),
+		deposits:      make(map[int64][]*Deposit),
+		blocks:        make(map[uint64]common.Hash),
+		sweepKey:      cfg.SweepKey,
+		nonces:        cfg.Nonces,
+		sweeps:        make(map[holding]*sweep),
+	}
+}
+
+// SetStore keeps the position of the watcher and the credited deposits in
+// records. Deposits are credited in one write with their records and the
+// position, so the ledger of the watcher has to keep its balances in the
+// same store. It has to be called before the first poll.
+func (w *DepositWatcher) SetStore(records store.Store) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.records = records
+}
+
+// deriveDepositKey derives the key of the deposit address of a user from
+// the exchange key, so the addresses survive a restart.
+func deriveDepositKey(exchangeKey *ecdsa.PrivateKey, userID int64) (*ecdsa.PrivateKey, error) {
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, uint64(userID))
+
+	seed := crypto.Keccak256(crypto.FromECDSA(exchangeKey), []byte("deposit"), id)
+	return crypto.ToECDSA(seed)
+}
+
+// AddToken starts accepting deposits of an ERC-20 asset.
+func (w *DepositWatcher) AddToken(asset *Asset) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.tokens[asset.Token] = asset
+}
+
+// Watch starts crediting transfers to address to the given user.
+func (w *DepositWatcher) Watch(userID int64, address common.Address) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.addresses[address] = userID
+}
+
+func (w *DepositWatcher) Deposits(userID int64) []*Deposit {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	deposits := make([]*Deposit, len(w.deposits[userID]))
+	for i, d := range w.deposits[userID] {
+		deposit := *d
+		deposits[i] = &deposit
+	}
+	return deposits
+}
+
+// Run polls the chain for new blocks until ctx is done. Blocks mined
+// before the first poll are not scanned, unless the watcher has a store
+// with the position it stopped at. The credited deposits are loaded from
+// the store then, and the ones not swept yet are swept again; pending
+// deposits are not stored, but found again by scanning from the position.
+func (w *DepositWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Poll(ctx); err != nil {
+			logrus.WithField("component", "deposits").Error(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll processes all blocks up to the current head, rolling back deposits
+// of blocks that were reorged out, and credits confirmed deposits.
+func (w *DepositWatcher) Poll(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	head, err := w.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+	headNumber := head.Number.Uint64()
+
+	if !w.started {
+		w.next = headNumber + 1
+		if w.records != nil {
+			if w.cursor, err = w.records.Cursor(depositCursor); err != nil {
+				return err
+			}
+			if w.cursor != 0 && w.cursor <= w.next {
+				w.next = w.cursor
+			}
+			if err := w.load(); err != nil {
+				return err
+			}
+		}
+		if err := w.saveCursor(w.next); err != nil {
+			return err
+		}
+		w.started = true
+		if w.next > headNumber {
+			return nil
+		}
+	}
+
+	if err := w.handleReorg(ctx); err != nil {
+		return err
+	}
+
+	for ; w.next <= headNumber; w.next++ {
+		block, err := w.client.BlockByNumber(ctx, new(big.Int).SetUint64(w.next))
+		if err != nil {
+			return err
+		}
+
+		// The chain reorged while we were catching up.
+		if parent, ok := w.blocks[w.next-1]; ok && parent != block.ParentHash() {
+			return w.handleReorg(ctx)
+		}
+
+		if err := w.processBlock(ctx, block); err != nil {
+			return err
+		}
+
+		w.blocks[w.next] = block.Hash()
+		delete(w.blocks, w.next-w.confirmations-1)
+	}
+
+	// The deposits of a block are credited once the head is
+	// confirmations-1 blocks after it.
+	cursor := w.cursor
+	if headNumber+2 > w.confirmations {
+		cursor = headNumber + 2 - w.confirmations
+	}
+	if err := w.confirm(headNumber, cursor); err != nil {
+		return err
+	}
+	w.sweep(ctx)
+
+	return nil
+}
+
+// load replaces the deposits with the credited deposits of the store, and
+// the sweeps with the ones not swept.
+func (w *DepositWatcher) load() error {
+	records, err := w.records.Deposits()
+	if err != nil {
+		return err
+	}
+
+	w.deposits = make(map[int64][]*Deposit)
+	w.sweeps = make(map[holding]*sweep)
+	for _, record := range records {
+		asset, ok := w.asset(record.Asset)
+		if !ok {
+			return fmt.Errorf("deposit %d of unknown asset %s", record.ID, record.Asset)
+		}
+		value, ok := new(big.Int).SetString(record.Value, 10)
+		if !ok {
+			return fmt.Errorf("deposit %d has invalid value %q", record.ID, record.Value)
+		}
+
+		d := &Deposit{
+			UserID:        record.UserID,
+			Asset:         asset.Symbol,
+			Amount:        asset.FromBaseUnits(value),
+			Value:         value,
+			TxHash:        common.HexToHash(record.TxHash),
+			LogIndex:      record.LogIndex,
+			BlockNumber:   record.BlockNumber,
+			BlockHash:     common.HexToHash(record.BlockHash),
+			Confirmations: w.confirmations,
+			Status:        DepositConfirmed,
+			Timestamp:     record.Timestamp,
+			id:            record.ID,
+			address:       common.HexToAddress(record.Address),
+			asset:         asset,
+		}
+		w.deposits[d.UserID] = append(w.deposits[d.UserID], d)
+		if record.SweepTx == "" {
+			w.addSweep(d)
+		} else {
+			d.sweepTx = common.HexToHash(record.SweepTx)
+		}
+	}
+	return nil
+}
+
+// asset looks up an accepted asset by its symbol.
+func (w *DepositWatcher) asset(symbol string) (*Asset, bool) {
+	if symbol == AssetETH.Symbol {
+		return AssetETH, true
+	}
+	for _, asset := range w.tokens {
+		if asset.Symbol == symbol {
+			return asset, true
+		}
+	}
+	return nil, false
+}
+
+// saveCursor stores the first block with deposits that are not credited,
+// where the watcher starts again after a restart.
+func (w *DepositWatcher) saveCursor(cursor uint64) error {
+	if w.records == nil || cursor <= w.cursor {
+		return nil
+	}
+
+	if err := w.records.Write(&store.Batch{Cursors: map[string]uint64{depositCursor: cursor}}); err != nil {
+		return err
+	}
+	w.cursor = cursor
+	return nil
+}
+
+// handleReorg walks back from the last processed block until it finds a
+// block that is still canonical, and orphans the pending deposits of all
+// blocks after it.
+func (w *DepositWatcher) handleReorg(ctx context.Context) error {
+	number := w.next - 1
+	for {
+		hash, ok := w.blocks[number]
+		if !ok {
+			break
+		}
+
+		header, err := w.client.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+		if err != nil {
+			return err
+		}
+		if header.Hash() == hash {
+			break
+		}
+
+		delete(w.blocks, number)
+		number--
+	}
+
+	if number == w.next-1 {
+		return nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"from": number + 1,
+		"to":   w.next - 1,
+	}).Warn("chain reorg, rolling back unconfirmed deposits")
+
+	pending := w.pending[:0]
+	for _, d := range w.pending {
+		if d.BlockNumber > number {
+			d.Status = DepositOrphaned
+			d.Confirmations = 0
+			continue
+		}
+		pending = append(pending, d)
+	}
+	w.pending = pending
+	w.next = number + 1
+
+	return nil
+}
+
+func (w *DepositWatcher) processBlock(ctx context.Context, block *types.Block) error {
+	for _, tx := range block.Transactions() {
+		if tx.To() == nil || tx.Value().Sign() == 0 {
+			continue
+		}
+
+		userID, ok := w.addresses[*tx.To()]
+		if !ok {
+			continue
+		}
+		// The gas sent to deposit addresses for token sweeps is not a
+		// deposit.
+		if w.sweepKey != nil {
+			from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+			if err != nil {
+				return err
+			}
+			if from == crypto.PubkeyToAddress(w.sweepKey.PublicKey) {
+				continue
+			}
+		}
+
+		receipt, err := w.client.TransactionReceipt(ctx, tx.Hash())
+		if err != nil {
+			return err
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			continue
+		}
+
+		w.addDeposit(userID, *tx.To(), AssetETH, tx.Value(), tx.Hash(), 0, block)
+	}
+
+	if len(w.tokens) == 0 || len(w.addresses) == 0 {
+		return nil
+	}
+
+	filterer, err := erc20.NewERC20Filterer(common.Address{}, w.client)
+	if err != nil {
+		return err
+	}
+
+	tokens := make([]common.Address, 0, len(w.tokens))
+	for token := range w.tokens {
+		tokens = append(tokens, token)
+	}
+
+	recipients := make([]common.Hash, 0, len(w.addresses))
+	for address := range w.addresses {
+		recipients = append(recipients, common.BytesToHash(address.Bytes()))
+	}
+
+	parsed, err := erc20.ERC20MetaData.GetAbi()
+	if err != nil {
+		return err
+	}
+
+	blockHash := block.Hash()
+	logs, err := w.client.FilterLogs(ctx, ethereum.FilterQuery{
+		BlockHash: &blockHash,
+		Addresses: tokens,
+		Topics:    [][]common.Hash{{parsed.Events["Transfer"].ID}, nil, recipients},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, l := range logs {
+		if l.Removed {
+			continue
+		}
+
+		transfer, err := filterer.ParseTransfer(l)
+		if err != nil {
+			return err
+		}
+
+		userID, ok := w.addresses[transfer.To]
+		if !ok {
+			continue
+		}
+
+		w.addDeposit(userID, transfer.To, w.tokens[l.Address], transfer.Value, l.TxHash, l.Index, block)
+	}
+
+	return nil
+}
+
+func (w *DepositWatcher) addDeposit(userID int64, address common.Address, asset *Asset, value *big.Int, txHash common.Hash, logIndex uint, block *types.Block) {
+	deposit := &Deposit{
+		UserID:      userID,
+		Asset:       asset.Symbol,
+		Amount:      asset.FromBaseUnits(value),
+		Value:       new(big.Int).Set(value),
+		TxHash:      txHash,
+		LogIndex:    logIndex,
+		BlockNumber: block.NumberU64(),
+		BlockHash:   block.Hash(),
+		Status:      DepositPending,
+		Timestamp:   time.Now().UnixNano(),
+		address:     address,
+		asset:       asset,
+	}
+
+	w.deposits[userID] = append(w.deposits[userID], deposit)
+	w.pending = append(w.pending, deposit)
+
+	logrus.WithFields(logrus.Fields{
+		"userID": userID,
+		"asset":  deposit.Asset,
+		"amount": deposit.Amount,
+		"tx":     txHash,
+	}).Info("new deposit")
+}
+
+// confirm credits the pending deposits with enough confirmations and
+// moves the position to cursor. The balances, the records of the deposits
+// and the position are written at once, so a deposit is credited exactly
+// once across restarts.
+func (w *DepositWatcher) confirm(head, cursor uint64) error {
+	var (
+		pending   []*Deposit
+		confirmed []*Deposit
+		entries   []Entry
+		batch     store.Batch
+	)
+	for _, d := range w.pending {
+		d.Confirmations = head - d.BlockNumber + 1
+		if d.Confirmations < w.confirmations {
+			pending = append(pending, d)
+			continue
+		}
+		confirmed = append(confirmed, d)
+		entries = append(entries, Entry{UserID: d.UserID, Asset: d.Asset, Amount: d.Value})
+		batch.Deposits = append(batch.Deposits, d.record())
+	}
+	if len(confirmed) == 0 {
+		return w.saveCursor(cursor)
+	}
+
+	if w.records != nil && cursor > w.cursor {
+		batch.Cursors = map[string]uint64{depositCursor: cursor}
+	}
+	// The deposits stay pending when the write fails, and are credited at
+	// the next poll.
+	if err := w.ledger.Post(&batch, entries...); err != nil {
+		return err
+	}
+	if batch.Cursors != nil {
+		w.cursor = cursor
+	}
+	w.pending = pending
+
+	for i, d := range confirmed {
+		d.Status = DepositConfirmed
+		d.id = batch.Deposits[i].ID
+		w.addSweep(d)
+
+		logrus.WithFields(logrus.Fields{
+			"userID": d.UserID,
+			"asset":  d.Asset,
+			"amount": d.Amount,
+		}).Info("deposit confirmed")
+	}
+	return nil
+}
+
+// record returns the record of a credited deposit.
+func (d *Deposit) record() *store.Deposit {
+	record := &store.Deposit{
+		ID:          d.id,
+		UserID:      d.UserID,
+		Asset:       d.Asset,
+		Value:       d.Value.String(),
+		Address:     d.address.Hex(),
+		TxHash:      d.TxHash.Hex(),
+		LogIndex:    d.LogIndex,
+		BlockNumber: d.BlockNumber,
+		BlockHash:   d.BlockHash.Hex(),
+		Timestamp:   d.Timestamp,
+	}
+	if d.sweepTx != (common.Hash{}) {
+		record.SweepTx = d.sweepTx.Hex()
+	}
+	return record
+}
+
+// addSweep adds a confirmed deposit to what is swept from its address.
+func (w *DepositWatcher) addSweep(d *Deposit) {
+	if w.sweepKey == nil {
+		return
+	}
+
+	h := holding{address: d.address, token: d.asset.Token}
+	s, ok := w.sweeps[h]
+	if !ok {
+		s = &sweep{userID: d.UserID, asset: d.asset, value: new(big.Int)}
+		w.sweeps[h] = s
+	}
+	s.value.Add(s.value, d.Value)
+	s.deposits = append(s.deposits, d)
+}
+
+// swept removes a sweep that was sent and stores the transaction with its
+// deposits. The transaction was sent, so a failed write is only logged;
+// the deposits are swept again after a restart, which fails without
+// funds to sweep.
+func (w *DepositWatcher) swept(h holding, s *sweep, tx *types.Transaction) {
+	delete(w.sweeps, h)
+
+	records := make([]*store.Deposit, len(s.deposits))
+	for i, d := range s.deposits {
+		d.sweepTx = tx.Hash()
+		records[i] = d.record()
+	}
+	if w.records != nil {
+		if err := w.records.Write(&store.Batch{Deposits: records}); err != nil {
+			logrus.WithField("tx", tx.Hash()).Errorf("store: %v", err)
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"address": h.address,
+		"asset":   s.asset.Symbol,
+		"tx":      tx.Hash(),
+	}).Info("deposit swept")
+}
+
+// sweep moves the confirmed deposits to the exchange address. The gas of a
+// token sweep is sent to the deposit address first, and the tokens are
+// swept once it is mined. Failed sweeps are tried again at the next poll.
+func (w *DepositWatcher) sweep(ctx context.Context) {
+	for h, s := range w.sweeps {
+		var err error
+		if s.asset.IsNative() {
+			err = w.sweepETH(ctx, h, s)
+		} else {
+			err = w.sweepToken(ctx, h, s)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"component": "deposits",
+				"address":   h.address,
+				"asset":     s.asset.Symbol,
+			}).Errorf("sweep: %v", err)
+		}
+	}
+}
+
+// sweepETH sends the deposited ETH, less the fee of the transfer, to the
+// exchange address.
+func (w *DepositWatcher) sweepETH(ctx context.Context, h holding, s *sweep) error {
+	key, err := w.depositKey(s.userID, h.address)
+	if err != nil {
+		return err
+	}
+
+	gasPrice, err := w.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return err
+	}
+	value := new(big.Int).Sub(s.value, new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(params.TxGas)))
+	if value.Sign() <= 0 {
+		// Not worth its fee yet.
+		return nil
+	}
+
+	nonce, err := w.client.PendingNonceAt(ctx, h.address)
+	if err != nil {
+		return err
+	}
+	tx, err := types.SignTx(types.NewTransaction(nonce, w.sweepAddress(), value, params.TxGas, gasPrice, nil), types.NewEIP155Signer(chainID), key)
+	if err != nil {
+		return err
+	}
+	if err := w.client.SendTransaction(ctx, tx); err != nil {
+		return err
+	}
+
+	w.swept(h, s, tx)
+	return nil
+}
+
+// sweepToken sends the gas of the token transfer to the deposit address,
+// then the deposited tokens to the exchange address once the gas is there.
+func (w *DepositWatcher) sweepToken(ctx context.Context, h holding, s *sweep) error {
+	if s.funding == nil {
+		parsed, err := erc20.ERC20MetaData.GetAbi()
+		if err != nil {
+			return err
+		}
+		input, err := parsed.Pack("transfer", w.sweepAddress(), s.value)
+		if err != nil {
+			return err
+		}
+		gas, err := w.client.EstimateGas(ctx, ethereum.CallMsg{From: h.address, To: &h.token, Data: input})
+		if err != nil {
+			return err
+		}
+		gasPrice, err := w.client.SuggestGasPrice(ctx)
+		if err != nil {
+			return err
+		}
+
+		// The gas price can rise until the tokens are sent, so the gas is
+		// paid for twice.
+		fee := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(2*(gas+gas*gasHeadroom/100)))
+		s.funding, err = transferETH(ctx, w.client, w.nonces, h.address, fee)
+		return err
+	}
+
+	receipt, err := w.client.TransactionReceipt(ctx, s.funding.Hash())
+	if errors.Is(err, ethereum.NotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		s.funding = nil
+		return fmt.Errorf("gas transfer %s reverted", receipt.TxHash)
+	}
+
+	key, err := w.depositKey(s.userID, h.address)
+	if err != nil {
+		return err
+	}
+	tx, err := transferERC20(ctx, w.client, h.token, NewNonceManager(w.client, key), w.sweepAddress(), s.value)
+	if err != nil {
+		return err
+	}
+
+	w.swept(h, s, tx)
+	return nil
+}
+
+func (w *DepositWatcher) sweepAddress() common.Address {
+	return crypto.PubkeyToAddress(w.sweepKey.PublicKey)
+}
+
+// depositKey derives the key of the deposit address of a user.
+func (w *DepositWatcher) depositKey(userID int64, address common.Address) (*ecdsa.PrivateKey, error) {
+	key, err := deriveDepositKey(w.sweepKey, userID)
+	if err != nil {
+		return nil, err
+	}
+	if crypto.PubkeyToAddress(key.PublicKey) != address {
+		return nil, fmt.Errorf("deposit address %s of user %d is not derived from the exchange key", address, userID)
+	}
+	return key, nil
+}
+
+type GetDepositsResponse struct {
+	Address  common.Address
+	Deposits []*Deposit
+}
+
+func (ex *Exchange) handleGetDeposits(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	if !isOwner(c, int64(userID)) {
+		return c.JSON(http.StatusForbidden, APIError{Error: "can not query the deposits of another user"})
+	}
+
+	user, ok := ex.user(int64(userID))
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	return c.JSON(http.StatusOK, GetDepositsResponse{
+		Address:  user.DepositAddress,
+		Deposits: ex.deposits.Deposits(user.ID),
+	})
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+func (c *testChain) sendETH(t *testing.T, from int, to [20]byte, amount *big.Int) {
+	t.Helper()
+
+	ctx := context.Background()
+	key := c.keys[from]
+	nonce, err := c.PendingNonceAt(ctx, crypto.PubkeyToAddress(key.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gasPrice, err := c.SuggestGasPrice(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := types.NewTransaction(nonce, to, amount, 21000, gasPrice, nil)
+	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SendTransaction(ctx, signedTx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestWatcher(t *testing.T, chain *testChain, confirmations uint64) (*DepositWatcher, *Ledger) {
+	t.Helper()
+
+	ledger := NewLedger()
+	w := NewDepositWatcher(chain, ledger, DepositWatcherConfig{Confirmations: confirmations})
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return w, ledger
+}
+
+func TestDepositWatcherCredits(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		chain   = newTestChain(t, 1)
+		deposit = [20]byte{0xde, 0x90}
+	)
+
+	addr, token := chain.deployToken(t, 6)
+	usdc := &Asset{Symbol: "USDC", Token: addr, Decimals: 6}
+
+	w, ledger := newTestWatcher(t, chain, 2)
+	w.AddToken(usdc)
+	w.Watch(1, deposit)
+
+	chain.sendETH(t, 0, deposit, AssetETH.ToBaseUnits(1.5))
+	if _, err := token.Mint(chain.transactor(t, chain.keys[0]), deposit, usdc.ToBaseUnits(250)); err != nil {
+		t.Fatal(err)
+	}
+	chain.Commit()
+
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	deposits := w.Deposits(1)
+	assert(t, len(deposits), 2)
+	assert(t, deposits[0].Status, DepositPending)
+	assert(t, deposits[0].Confirmations, uint64(1))
+	assert(t, ledger.Balance(1, "ETH").Sign(), 0)
+
+	chain.Commit()
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	deposits = w.Deposits(1)
+	assert(t, deposits[0].Status, DepositConfirmed)
+	assert(t, deposits[0].Amount, 1.5)
+	assert(t, deposits[1].Status, DepositConfirmed)
+	assert(t, deposits[1].Asset, "USDC")
+	assert(t, ledger.Balance(1, "ETH"), AssetETH.ToBaseUnits(1.5))
+	assert(t, ledger.Balance(1, "USDC"), usdc.ToBaseUnits(250))
+}
+
+func TestDepositWatcherReorg(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		chain   = newTestChain(t, 1)
+		deposit = [20]byte{0xde, 0x90}
+	)
+
+	w, ledger := newTestWatcher(t, chain, 3)
+	w.Watch(1, deposit)
+
+	parent, err := chain.HeaderByNumber(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain.sendETH(t, 0, deposit, big.NewInt(1000))
+	chain.Commit()
+
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, w.Deposits(1)[0].Status, DepositPending)
+
+	// Replace the block with the deposit by a longer chain without it.
+	if err := chain.Fork(ctx, parent.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		chain.Commit()
+	}
+
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	deposits := w.Deposits(1)
+	assert(t, len(deposits), 1)
+	assert(t, deposits[0].Status, DepositOrphaned)
+	assert(t, ledger.Balance(1, "ETH").Sign(), 0)
+}
+
+func TestDepositWatcherResumes(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		chain   = newTestChain(t, 1)
+		records = store.NewMemory()
+		deposit = [20]byte{0xde, 0x90}
+	)
+
+	start := func() (*DepositWatcher, *Ledger) {
+		ledger := NewLedger()
+		if err := ledger.SetStore(records); err != nil {
+			t.Fatal(err)
+		}
+		w := NewDepositWatcher(chain, ledger, DepositWatcherConfig{Confirmations: 2})
+		w.SetStore(records)
+		w.Watch(1, deposit)
+		if err := w.Poll(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return w, ledger
+	}
+
+	w, _ := start()
+	chain.sendETH(t, 0, deposit, big.NewInt(1000))
+	chain.Commit()
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, w.Deposits(1)[0].Status, DepositPending)
+
+	// The deposit that was pending and the one mined while the watcher
+	// was stopped are credited after a restart.
+	chain.sendETH(t, 0, deposit, big.NewInt(500))
+	chain.Commit()
+	w, ledger := start()
+	deposits := w.Deposits(1)
+	assert(t, len(deposits), 2)
+	assert(t, deposits[0].Status, DepositConfirmed)
+	assert(t, deposits[1].Status, DepositPending)
+	assert(t, ledger.Balance(1, "ETH"), big.NewInt(1000))
+
+	chain.Commit()
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, ledger.Balance(1, "ETH"), big.NewInt(1500))
+
+	// The credited deposits and the balances are loaded from the store,
+	// and the deposits are not scanned again.
+	w, ledger = start()
+	deposits = w.Deposits(1)
+	assert(t, len(deposits), 2)
+	assert(t, deposits[0].Status, DepositConfirmed)
+	assert(t, deposits[1].Value, big.NewInt(500))
+	assert(t, ledger.Balance(1, "ETH"), big.NewInt(1500))
+	chain.Commit()
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(w.Deposits(1)), 2)
+	assert(t, ledger.Balance(1, "ETH"), big.NewInt(1500))
+}
+
+func TestDepositWatcherSweeps(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		chain       = newTestChain(t, 2)
+		exchangeKey = chain.keys[1]
+		exchange    = crypto.PubkeyToAddress(exchangeKey.PublicKey)
+	)
+
+	depositKey, err := deriveDepositKey(exchangeKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deposit := crypto.PubkeyToAddress(depositKey.PublicKey)
+
+	addr, token := chain.deployToken(t, 6)
+	usdc := &Asset{Symbol: "USDC", Token: addr, Decimals: 6}
+
+	records := store.NewMemory()
+	start := func(sweepKey *ecdsa.PrivateKey) (*DepositWatcher, *Ledger) {
+		ledger := NewLedger()
+		if err := ledger.SetStore(records); err != nil {
+			t.Fatal(err)
+		}
+		w := NewDepositWatcher(chain, ledger, DepositWatcherConfig{Confirmations: 1, Tokens: []*Asset{usdc}, SweepKey: sweepKey})
+		w.SetStore(records)
+		w.Watch(1, deposit)
+		if err := w.Poll(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return w, ledger
+	}
+
+	// The deposits are credited by a watcher that does not sweep, and
+	// swept after a restart.
+	w, _ := start(nil)
+	chain.sendETH(t, 0, deposit, AssetETH.ToBaseUnits(1.5))
+	if _, err := token.Mint(chain.transactor(t, chain.keys[0]), deposit, usdc.ToBaseUnits(250)); err != nil {
+		t.Fatal(err)
+	}
+	chain.Commit()
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(w.Deposits(1)), 2)
+
+	w, ledger := start(exchangeKey)
+	assert(t, len(w.sweeps), 2)
+
+	before, err := chain.BalanceAt(ctx, exchange, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ETH is swept and the gas of the token sweep is sent, then the
+	// tokens are swept once the gas is mined.
+	for i := 0; i < 3; i++ {
+		if err := w.Poll(ctx); err != nil {
+			t.Fatal(err)
+		}
+		chain.Commit()
+	}
+
+	tokens, err := token.BalanceOf(nil, exchange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, tokens, usdc.ToBaseUnits(250))
+	left, err := token.BalanceOf(nil, deposit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, left.Sign(), 0)
+
+	after, err := chain.BalanceAt(ctx, exchange, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swept := new(big.Int).Sub(after, before)
+	assert(t, swept.Cmp(AssetETH.ToBaseUnits(1.4)) > 0, true)
+
+	// The gas sent by the exchange is not a deposit.
+	assert(t, len(w.Deposits(1)), 2)
+	assert(t, ledger.Balance(1, "ETH"), AssetETH.ToBaseUnits(1.5))
+	assert(t, len(w.sweeps), 0)
+
+	// Swept deposits are not swept again.
+	w, _ = start(exchangeKey)
+	assert(t, len(w.sweeps), 0)
+	for _, d := range w.Deposits(1) {
+		assert(t, d.sweepTx != common.Hash{}, true)
+	}
+}
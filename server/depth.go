@@ -0,0 +1,158 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+)
+
+const (
+	defaultDepthLevels = 50
+	maxDepthLevels     = 1000
+	// maxCachedDepths bounds the depths cached for a sequence number, one
+	// per number of levels and grouping asked for.
+	maxCachedDepths = 64
+)
+
+var ErrInvalidDepth = errors.New("invalid depth")
+
+// Depth is the L2 view of a market: its price levels, best first, with
+// the total size and the number of orders of each. Sequence is the
+// sequence number of the book channel the levels are at.
+type Depth struct {
+	Market   Market
+	Sequence int64
+	Bids     []orderbook.DepthLevel
+	Asks     []orderbook.DepthLevel
+}
+
+type depthKey struct {
+	levels int
+	group  float64
+}
+
+// Depth returns at most levels price levels of each side of a market, 50
+// when levels is zero. When group is not zero the levels are grouped by
+// multiples of group, bids rounded down and asks up. Depths are cached
+// until the book changes.
+func (ex *Exchange) Depth(market Market, levels int, group float64) (*Depth, error) {
+	feed, ok := ex.feeds[market]
+	if !ok {
+		return nil, ErrMarketNotFound
+	}
+	if levels < 0 || group < 0 || math.IsNaN(group) || math.IsInf(group, 0) {
+		return nil, ErrInvalidDepth
+	}
+	if levels == 0 {
+		levels = defaultDepthLevels
+	}
+	if levels > maxDepthLevels {
+		levels = maxDepthLevels
+	}
+
+	return feed.depth(levels, group), nil
+}
+
+// depth returns the depth of the book at the current sequence number.
+func (f *marketFeed) depth(levels int, group float64) *Depth {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Changes of the book not published yet get their sequence number.
+	f.updateBook()
+
+	if f.depthSequence != f.sequence || len(f.depths) >= maxCachedDepths {
+		f.depths = make(map[depthKey]*Depth)
+		f.depthSequence = f.sequence
+	}
+	key := depthKey{levels: levels, group: group}
+	if d, ok := f.depths[key]; ok {
+		return d
+	}
+
+	bids, asks := f.ob.Depth()
+	d := &Depth{
+		Market:   f.market,
+		Sequence: f.sequence,
+		Bids:     groupLevels(bids, levels, group, true),
+		Asks:     groupLevels(asks, levels, group, false),
+	}
+	f.depths[key] = d
+	return d
+}
+
+// groupLevels merges the levels of a side, best first, by group and keeps
+// the best n.
+func groupLevels(levels []orderbook.DepthLevel, n int, group float64, bid bool) []orderbook.DepthLevel {
+	grouped := []orderbook.DepthLevel{}
+	for _, level := range levels {
+		if group != 0 {
+			level.Price = groupPrice(level.Price, group, bid)
+		}
+
+		if last := len(grouped) - 1; last >= 0 && grouped[last].Price == level.Price {
+			grouped[last].Size += level.Size
+			grouped[last].Orders += level.Orders
+			continue
+		}
+		if len(grouped) == n {
+			break
+		}
+		grouped = append(grouped, level)
+	}
+	return grouped
+}
+
+// groupPrice rounds a price to a multiple of group, down for bids and up
+// for asks, so grouping never narrows the spread.
+func groupPrice(price, group float64, bid bool) float64 {
+	n := price / group
+	// Prices on a multiple of the group are kept despite rounding errors.
+	if r := math.Round(n); math.Abs(n-r) < 1e-9 {
+		n = r
+	}
+	if bid {
+		n = math.Floor(n)
+	} else {
+		n = math.Ceil(n)
+	}
+
+	// Round to the decimals of the group, so 0.1 groups 100.3 to 100.3
+	// and not 100.30000000000001.
+	decimals := 0
+	if s := strconv.FormatFloat(group, 'f', -1, 64); strings.Contains(s, ".") {
+		decimals = len(s) - strings.IndexByte(s, '.') - 1
+	}
+	pow := math.Pow10(decimals)
+	return math.Round(n*group*pow) / pow
+}
+
+func (ex *Exchange) handleGetDepth(c echo.Context) error {
+	var (
+		levels int
+		group  float64
+		err    error
+	)
+	if s := c.QueryParam("levels"); s != "" {
+		if levels, err = strconv.Atoi(s); err != nil || levels <= 0 {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "invalid levels"})
+		}
+	}
+	if s := c.QueryParam("group"); s != "" {
+		if group, err = strconv.ParseFloat(s, 64); err != nil || group <= 0 {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "invalid group"})
+		}
+	}
+
+	depth, err := ex.Depth(Market(c.Param("market")), levels, group)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, depth)
+}
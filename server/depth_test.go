@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+)
+
+func TestDepth(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+	for _, o := range []struct {
+		bid         bool
+		price, size float64
+	}{
+		{true, 99.9, 1}, {true, 99.9, 2}, {true, 99.6, 1}, {true, 99.4, 4}, {true, 98, 1},
+		{false, 100.1, 1}, {false, 100.5, 3}, {false, 100.6, 1},
+	} {
+		assert(t, placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Bid: o.bid, Size: o.size, Price: o.price, Market: MarketETH}).Code, http.StatusOK)
+	}
+
+	get := func(target string) (*Depth, int) {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)
+		c.SetParamNames("market")
+		c.SetParamValues("ETH")
+		if err := ex.handleGetDepth(c); err != nil {
+			t.Fatal(err)
+		}
+		var depth Depth
+		if rec.Code == http.StatusOK {
+			decode(t, rec, &depth)
+		}
+		return &depth, rec.Code
+	}
+
+	depth, code := get("/depth/ETH?levels=2")
+	assert(t, code, http.StatusOK)
+	assert(t, depth.Bids, []orderbook.DepthLevel{{Price: 99.9, Size: 3, Orders: 2}, {Price: 99.6, Size: 1, Orders: 1}})
+	assert(t, depth.Asks, []orderbook.DepthLevel{{Price: 100.1, Size: 1, Orders: 1}, {Price: 100.5, Size: 3, Orders: 1}})
+
+	// Bids are grouped down and asks up.
+	depth, _ = get("/depth/ETH?group=0.5")
+	assert(t, depth.Bids, []orderbook.DepthLevel{
+		{Price: 99.5, Size: 4, Orders: 3},
+		{Price: 99, Size: 4, Orders: 1},
+		{Price: 98, Size: 1, Orders: 1},
+	})
+	assert(t, depth.Asks, []orderbook.DepthLevel{{Price: 100.5, Size: 4, Orders: 2}, {Price: 101, Size: 1, Orders: 1}})
+	depth, _ = get("/depth/ETH?group=0.1&levels=1")
+	assert(t, depth.Bids, []orderbook.DepthLevel{{Price: 99.9, Size: 3, Orders: 2}})
+
+	_, code = get("/depth/ETH?group=-1")
+	assert(t, code, http.StatusBadRequest)
+	_, code = get("/depth/ETH?levels=x")
+	assert(t, code, http.StatusBadRequest)
+
+	// Depths are cached until the sequence number of the book changes.
+	first, err := ex.Depth(MarketETH, 5, 0)
+	assert(t, err, nil)
+	cached, _ := ex.Depth(MarketETH, 5, 0)
+	assert(t, cached == first, true)
+	assert(t, placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 100.1, Market: MarketETH}).Code, http.StatusOK)
+	next, _ := ex.Depth(MarketETH, 5, 0)
+	assert(t, next.Sequence, first.Sequence+1)
+	assert(t, next.Asks[0], orderbook.DepthLevel{Price: 100.1, Size: 2, Orders: 2})
+
+	// The L3 view does not tell who quotes.
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/book/ETH", nil), rec)
+	c.SetParamNames("market")
+	c.SetParamValues("ETH")
+	if err := ex.handleGetBook(c); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, strings.Contains(rec.Body.String(), "UserID"), false)
+	assert(t, strings.Contains(rec.Body.String(), "\"ID\""), true)
+
+	// Nor do the best bid and ask.
+	for _, best := range []struct {
+		target  string
+		handler echo.HandlerFunc
+		price   float64
+	}{
+		{"/book/ETH/bid", ex.handleGetBestBid, 99.9},
+		{"/book/ETH/ask", ex.handleGetBestAsk, 100.1},
+	} {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, best.target, nil), rec)
+		c.SetParamNames("market")
+		c.SetParamValues("ETH")
+		if err := best.handler(c); err != nil {
+			t.Fatal(err)
+		}
+		assert(t, rec.Code, http.StatusOK)
+		assert(t, strings.Contains(rec.Body.String(), "UserID"), false)
+
+		var order Order
+		decode(t, rec, &order)
+		assert(t, order.Price, best.price)
+	}
+}
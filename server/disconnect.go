@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+)
+
+const (
+	// CancelSession cancels the open orders placed with the credentials of
+	// the connection: its API key, or the session tokens of its user.
+	CancelSession CancelScope = "SESSION"
+	// CancelAccount cancels all open orders of the user.
+	CancelAccount CancelScope = "ACCOUNT"
+
+	// WSCancelOnDisconnect sets the cancel-on-disconnect scope and timeout
+	// of the connection. An empty scope turns it off.
+	WSCancelOnDisconnect WSOp = "cancel_on_disconnect"
+	// WSPing is a heartbeat of the client, answered with WSPong.
+	WSPing WSOp = "ping"
+
+	WSPong WSMessageType = "pong"
+	// WSCancelOnDisconnectSet confirms a cancel-on-disconnect request.
+	WSCancelOnDisconnectSet WSMessageType = "cancel_on_disconnect"
+
+	// cancelOnDisconnectReason is the reason of the order updates of
+	// orders cancelled on disconnect.
+	cancelOnDisconnectReason = "cancel on disconnect"
+)
+
+// CancelScope selects the orders cancelled when a connection with
+// cancel-on-disconnect closes.
+type CancelScope string
+
+// CancelOnDisconnect is the cancel-on-disconnect setting of a connection.
+type CancelOnDisconnect struct {
+	Scope CancelScope
+	// Timeout in milliseconds is how long the connection may stay silent
+	// before it is closed and its orders are cancelled. Clients have to
+	// send pings or answer the pings of the server within it.
+	Timeout int64
+}
+
+func (ex *Exchange) handleWSCancelOnDisconnect(conn *wsConn, req WSRequest) {
+	switch {
+	case conn.userID == 0:
+		conn.reply(req, WSMessage{Type: WSError, Error: "not authenticated"})
+		return
+	case !hasScope(conn.scopes, ScopeTrade):
+		conn.reply(req, WSMessage{Type: WSError, Error: fmt.Sprintf("missing %s scope", ScopeTrade)})
+		return
+	}
+
+	cod := CancelOnDisconnect{Scope: req.CancelScope, Timeout: req.Timeout}
+	switch cod.Scope {
+	case "", CancelSession, CancelAccount:
+	default:
+		conn.reply(req, WSMessage{Type: WSError, Error: "invalid cancel scope"})
+		return
+	}
+	if cod.Timeout < 0 {
+		conn.reply(req, WSMessage{Type: WSError, Error: "invalid timeout"})
+		return
+	}
+
+	// The timeout can only shorten the read timeout of the server.
+	conn.readTimeout = conn.cfg.ReadTimeout
+	if timeout := time.Duration(cod.Timeout) * time.Millisecond; timeout > 0 && timeout < conn.readTimeout {
+		conn.readTimeout = timeout
+	}
+	cod.Timeout = conn.readTimeout.Milliseconds()
+
+	conn.cancelScope = cod.Scope
+	conn.ws.SetReadDeadline(time.Now().Add(conn.readTimeout))
+	conn.reply(req, WSMessage{Type: WSCancelOnDisconnectSet, Data: cod})
+}
+
+// cancelOnDisconnect cancels the orders of a closed connection in its
+// cancel-on-disconnect scope. The cancellations are pushed to the user
+// when they subscribe to their orders again.
+func (ex *Exchange) cancelOnDisconnect(conn *wsConn) {
+	if conn.cancelScope == "" {
+		return
+	}
+
+	var orders []*orderbook.Order
+	ex.mu.RLock()
+	for _, order := range ex.Orders[conn.userID] {
+		if conn.cancelScope == CancelAccount || ex.orderAuthKeys[order.ID] == conn.authKey {
+			orders = append(orders, order)
+		}
+	}
+	ex.mu.RUnlock()
+
+	updates := []OrderUpdate{}
+	ids := []int64{}
+	for _, order := range orders {
+		market, _, ok := ex.findOrder(order.ID)
+		if !ok || order.Limit == nil {
+			continue
+		}
+		price := order.Limit.Price
+
+		if err := ex.removeOrder(market, order, CommandCancel); err != nil {
+			if !errors.Is(err, ErrOrderNotFound) {
+				logrus.WithField("order", order.ID).Errorf("cancelling order on disconnect: %v", err)
+			}
+			continue
+		}
+
+		ids = append(ids, order.ID)
+		updates = append(updates, OrderUpdate{
+			OrderID:   order.ID,
+			Market:    market,
+			Status:    OrderCancelled,
+			Bid:       order.Bid,
+			Price:     price,
+			Size:      order.Size,
+			Reason:    cancelOnDisconnectReason,
+			Timestamp: ex.now().UnixNano(),
+		})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"user":   conn.userID,
+		"scope":  conn.cancelScope,
+		"orders": ids,
+	}).Info("cancelled orders on disconnect")
+
+	ex.userFeeds.hold(conn.userID, updates)
+}
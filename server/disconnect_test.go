@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/websocket"
+)
+
+func TestCancelOnDisconnect(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+	e, url := startWSServer(t, ex)
+
+	token, _, err := ex.sessions.Issue(1, common.HexToAddress("0x01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := func() *websocket.Conn {
+		ws := dialWS(t, url)
+		ws.WriteJSON(WSRequest{Op: WSAuth, Token: token})
+		assert(t, readWS(t, ws, nil).Type, WSAuthenticated)
+		return ws
+	}
+
+	// One order is placed with the session token, the other with an API
+	// key.
+	var sessionOrder PlaceOrderResponse
+	decode(t, placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 1, Price: 90, Market: MarketETH}), &sessionOrder)
+
+	key, err := ex.apiKeys.Create(1, AllScopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, signedRequest(key, http.MethodPost, "/order", `{"Type":"LIMIT","Bid":true,"Size":2,"Price":80,"Market":"ETH"}`, "1", time.Now()))
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, len(ex.Orders[1]), 2)
+
+	ws := connect()
+	ws.WriteJSON(WSRequest{Op: WSCancelOnDisconnect, CancelScope: CancelSession})
+	var cod CancelOnDisconnect
+	assert(t, readWS(t, ws, &cod).Type, WSCancelOnDisconnectSet)
+	assert(t, cod, CancelOnDisconnect{Scope: CancelSession, Timeout: 30_000})
+	ws.Close()
+
+	waitForOrders(t, ex, 1, 1)
+	assert(t, ex.Orders[1][0].ID != sessionOrder.OrderID, true)
+
+	// The cancellation is pushed on reconnect.
+	ws = connect()
+	ws.WriteJSON(WSRequest{Op: WSSubscribe, Channel: ChannelOrders})
+	assert(t, readWS(t, ws, nil).Type, WSSubscribed)
+	var update OrderUpdate
+	assert(t, readWS(t, ws, &update).Type, WSOrder)
+	assert(t, []any{update.OrderID, update.Status, update.Price, update.Reason}, []any{sessionOrder.OrderID, OrderCancelled, 90.0, cancelOnDisconnectReason})
+
+	// A connection that stays silent for the timeout is closed, and with
+	// the account scope all orders of the user are cancelled.
+	ws.WriteJSON(WSRequest{Op: WSCancelOnDisconnect, CancelScope: CancelAccount, Timeout: 50})
+	assert(t, readWS(t, ws, &cod).Type, WSCancelOnDisconnectSet)
+	assert(t, cod, CancelOnDisconnect{Scope: CancelAccount, Timeout: 50})
+
+	waitForOrders(t, ex, 1, 0)
+}
+
+func waitForOrders(t *testing.T, ex *Exchange, userID int64, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		ex.mu.RLock()
+		open := len(ex.Orders[userID])
+		ex.mu.RUnlock()
+
+		if open == n {
+			return
+		}
+	}
+	t.Fatalf("user %d does not have %d open orders", userID, n)
+}
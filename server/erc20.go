@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/tahaontech/crypto_exchange/contracts/erc20"
+)
+
+// gasHeadroom is added on top of estimated gas (in percent) so a token
+// transfer does not run out of gas when state changes between estimation
+// and inclusion.
+const gasHeadroom = 20
+
+var (
+	ErrInsufficientAllowance = errors.New("insufficient token allowance")
+	ErrInsufficientBalance   = errors.New("insufficient token balance")
+	ErrTransferNotConfirmed  = errors.New("transfer log not found in receipt")
+)
+
+// Asset is something that can be settled on chain. A zero Token address
+// means the native coin of the chain (ETH).
+type Asset struct {
+	Symbol   string
+	Token    common.Address
+	Decimals uint8
+}
+
+// AssetETH is the native ETH asset.
+var AssetETH = &Asset{Symbol: "ETH", Decimals: 18}
+
+// LoadAsset reads the decimals of an ERC-20 token from the chain.
+func LoadAsset(ctx context.Context, client ChainClient, symbol string, token common.Address) (*Asset, error) {
+	caller, err := erc20.NewERC20Caller(token, client)
+	if err != nil {
+		return nil, err
+	}
+
+	decimals, err := caller.Decimals(&bind.CallOpts{Context: ctx})
+	if err != nil {
+		return nil, fmt.Errorf("reading decimals of %s: %w", symbol, err)
+	}
+
+	return &Asset{
+		Symbol:   symbol,
+		Token:    token,
+		Decimals: decimals,
+	}, nil
+}
+
+func (a *Asset) IsNative() bool {
+	return a.Token == (common.Address{})
+}
+
+// ToBaseUnits converts a human readable amount (1.5 ETH) into the smallest
+// unit of the asset (1500000000000000000 wei). Digits beyond the asset's
+// decimals are truncated.
+func (a *Asset) ToBaseUnits(amount float64) *big.Int {
+	s := strconv.FormatFloat(amount, 'f', -1, 64)
+	whole, frac, _ := strings.Cut(s, ".")
+
+	if len(frac) > int(a.Decimals) {
+		frac = frac[:a.Decimals]
+	}
+	frac += strings.Repeat("0", int(a.Decimals)-len(frac))
+
+	v, _ := new(big.Int).SetString(whole+frac, 10)
+	return v
+}
+
+// FromBaseUnits is the inverse of ToBaseUnits.
+func (a *Asset) FromBaseUnits(amount *big.Int) float64 {
+	unit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(a.Decimals)), nil)
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(amount), new(big.Float).SetInt(unit)).Float64()
+	return f
+}
+
+// transferERC20 sends amount base units of token from the key of sender
+// to the given address using the token's transfer method.
+func transferERC20(ctx context.Context, client ChainClient, token common.Address, sender *NonceManager, to common.Address, amount *big.Int) (*types.Transaction, error) {
+	from := sender.Address()
+
+	caller, err := erc20.NewERC20Caller(token, client)
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := caller.BalanceOf(&bind.CallOpts{Context: ctx}, from)
+	if err != nil {
+		return nil, err
+	}
+	if balance.Cmp(amount) < 0 {
+		return nil, fmt.Errorf("%w: %s has %s, needs %s", ErrInsufficientBalance, from, balance, amount)
+	}
+
+	return sendTokenTx(ctx, client, token, sender, "transfer", to, amount)
+}
+
+// transferFromERC20 moves amount base units of token from one address to
+// another on behalf of the key of spender. The owner of the tokens must
+// have approved the spender for at least amount beforehand.
+func transferFromERC20(ctx context.Context, client ChainClient, token common.Address, spender *NonceManager, from, to common.Address, amount *big.Int) (*types.Transaction, error) {
+
+	caller, err := erc20.NewERC20Caller(token, client)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &bind.CallOpts{Context: ctx}
+	allowance, err := caller.Allowance(opts, from, spender.Address())
+	if err != nil {
+		return nil, err
+	}
+	if allowance.Cmp(amount) < 0 {
+		return nil, fmt.Errorf("%w: %s allows %s, needs %s", ErrInsufficientAllowance, from, allowance, amount)
+	}
+
+	balance, err := caller.BalanceOf(opts, from)
+	if err != nil {
+		return nil, err
+	}
+	if balance.Cmp(amount) < 0 {
+		return nil, fmt.Errorf("%w: %s has %s, needs %s", ErrInsufficientBalance, from, balance, amount)
+	}
+
+	return sendTokenTx(ctx, client, token, spender, "transferFrom", from, to, amount)
+}
+
+func sendTokenTx(ctx context.Context, client ChainClient, token common.Address, sender *NonceManager, method string, args ...interface{}) (*types.Transaction, error) {
+	parsed, err := erc20.ERC20MetaData.GetAbi()
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := parsed.Pack(method, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	gas, err := client.EstimateGas(ctx, ethereum.CallMsg{
+		From: sender.Address(),
+		To:   &token,
+		Data: input,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("estimating gas for %s: %w", method, err)
+	}
+
+	gasPrice, err := client.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	contract := bind.NewBoundContract(token, *parsed, client, client, client)
+	return sender.Send(ctx, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		opts.GasLimit = gas + gas*gasHeadroom/100
+		opts.GasPrice = gasPrice
+		return contract.RawTransact(opts, input)
+	})
+}
+
+// confirmTokenTransfer waits for tx to be mined and checks that its receipt
+// contains a Transfer log of the given token matching from, to and amount.
+func confirmTokenTransfer(ctx context.Context, client ChainClient, tx *types.Transaction, token, from, to common.Address, amount *big.Int) (*types.Receipt, error) {
+	receipt, err := bind.WaitMined(ctx, client, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return receipt, fmt.Errorf("transfer tx %s reverted", tx.Hash())
+	}
+
+	filterer, err := erc20.NewERC20Filterer(token, client)
+	if err != nil {
+		return receipt, err
+	}
+
+	for _, l := range receipt.Logs {
+		if l.Address != token {
+			continue
+		}
+
+		transfer, err := filterer.ParseTransfer(*l)
+		if err != nil {
+			// not a Transfer event (e.g. Approval)
+			continue
+		}
+
+		if transfer.From == from && transfer.To == to && transfer.Value.Cmp(amount) == 0 {
+			return receipt, nil
+		}
+	}
+
+	return receipt, fmt.Errorf("%w: tx %s", ErrTransferNotConfirmed, tx.Hash())
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tahaontech/crypto_exchange/contracts/testtoken"
+)
+
+type testChain struct {
+	*backends.SimulatedBackend
+	keys []*ecdsa.PrivateKey
+}
+
+// newTestChain starts a simulated backend with n funded accounts.
+func newTestChain(t *testing.T, n int) *testChain {
+	t.Helper()
+
+	alloc := core.GenesisAlloc{}
+	keys := make([]*ecdsa.PrivateKey, n)
+	for i := range keys {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+
+		balance, _ := new(big.Int).SetString("1000000000000000000000", 10)
+		alloc[crypto.PubkeyToAddress(key.PublicKey)] = core.GenesisAccount{Balance: balance}
+	}
+
+	backend := backends.NewSimulatedBackend(alloc, 30_000_000)
+	t.Cleanup(func() { backend.Close() })
+
+	return &testChain{SimulatedBackend: backend, keys: keys}
+}
+
+func (c *testChain) transactor(t *testing.T, key *ecdsa.PrivateKey) *bind.TransactOpts {
+	t.Helper()
+
+	opts, err := bind.NewKeyedTransactorWithChainID(key, chainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+// deployToken deploys a TestToken with the given decimals from the first
+// account of the chain.
+func (c *testChain) deployToken(t *testing.T, decimals uint8) (common.Address, *testtoken.TestToken) {
+	t.Helper()
+
+	addr, _, token, err := testtoken.DeployTestToken(c.transactor(t, c.keys[0]), c, decimals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Commit()
+
+	return addr, token
+}
+
+func TestAssetBaseUnits(t *testing.T) {
+	usdc := &Asset{Symbol: "USDC", Decimals: 6}
+
+	assert(t, usdc.ToBaseUnits(12.5).String(), "12500000")
+	assert(t, usdc.ToBaseUnits(0.1).String(), "100000")
+	assert(t, usdc.ToBaseUnits(0.0000001).String(), "0")
+	assert(t, AssetETH.ToBaseUnits(1.5).String(), "1500000000000000000")
+	assert(t, usdc.FromBaseUnits(big.NewInt(2_500_000)), 2.5)
+}
+
+func TestLoadAsset(t *testing.T) {
+	chain := newTestChain(t, 1)
+	addr, _ := chain.deployToken(t, 6)
+
+	asset, err := LoadAsset(context.Background(), chain, "USDC", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, asset.Decimals, uint8(6))
+	assert(t, asset.IsNative(), false)
+}
+
+func TestTransferFromERC20(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		chain    = newTestChain(t, 3)
+		exchange = chain.keys[0]
+		seller   = crypto.PubkeyToAddress(chain.keys[1].PublicKey)
+		buyer    = crypto.PubkeyToAddress(chain.keys[2].PublicKey)
+	)
+
+	addr, token := chain.deployToken(t, 6)
+	asset := &Asset{Symbol: "USDC", Token: addr, Decimals: 6}
+	amount := asset.ToBaseUnits(12.5)
+
+	if _, err := token.Mint(chain.transactor(t, exchange), seller, asset.ToBaseUnits(100)); err != nil {
+		t.Fatal(err)
+	}
+	chain.Commit()
+
+	_, err := transferFromERC20(ctx, chain, addr, NewNonceManager(chain, exchange), seller, buyer, amount)
+	if !errors.Is(err, ErrInsufficientAllowance) {
+		t.Fatalf("expected insufficient allowance, got %v", err)
+	}
+
+	exchangeAddr := crypto.PubkeyToAddress(exchange.PublicKey)
+	if _, err := token.Approve(chain.transactor(t, chain.keys[1]), exchangeAddr, amount); err != nil {
+		t.Fatal(err)
+	}
+	chain.Commit()
+
+	tx, err := transferFromERC20(ctx, chain, addr, NewNonceManager(chain, exchange), seller, buyer, amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Commit()
+
+	if _, err := confirmTokenTransfer(ctx, chain, tx, addr, seller, buyer, amount); err != nil {
+		t.Fatal(err)
+	}
+
+	buyerBalance, err := token.BalanceOf(nil, buyer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, asset.FromBaseUnits(buyerBalance), 12.5)
+
+	allowance, err := token.Allowance(nil, seller, exchangeAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, allowance.Sign(), 0)
+
+	// The receipt does not contain a transfer to the seller.
+	if _, err := confirmTokenTransfer(ctx, chain, tx, addr, buyer, seller, amount); !errors.Is(err, ErrTransferNotConfirmed) {
+		t.Fatalf("expected unconfirmed transfer, got %v", err)
+	}
+}
+
+func TestTransferERC20(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		chain = newTestChain(t, 2)
+		from  = crypto.PubkeyToAddress(chain.keys[0].PublicKey)
+		to    = crypto.PubkeyToAddress(chain.keys[1].PublicKey)
+	)
+
+	addr, token := chain.deployToken(t, 18)
+	if _, err := token.Mint(chain.transactor(t, chain.keys[0]), from, big.NewInt(1000)); err != nil {
+		t.Fatal(err)
+	}
+	chain.Commit()
+
+	_, err := transferERC20(ctx, chain, addr, NewNonceManager(chain, chain.keys[0]), to, big.NewInt(1001))
+	if !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("expected insufficient balance, got %v", err)
+	}
+
+	tx, err := transferERC20(ctx, chain, addr, NewNonceManager(chain, chain.keys[0]), to, big.NewInt(400))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Commit()
+
+	if _, err := confirmTokenTransfer(ctx, chain, tx, addr, from, to, big.NewInt(400)); err != nil {
+		t.Fatal(err)
+	}
+
+	balance, err := token.BalanceOf(nil, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, balance.Int64(), int64(600))
+}
@@ -0,0 +1,917 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/contracts/escrow"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+const (
+	// SettlementDirect moves the funds of the users with transfers signed
+	// by the exchange.
+	SettlementDirect SettlementMode = "DIRECT"
+	// SettlementEscrow settles trades on the escrow contract, along orders
+	// signed by the users.
+	SettlementEscrow SettlementMode = "ESCROW"
+
+	// escrowPriceDecimals is the precision of the escrow contract prices,
+	// which are in quote base units per 1e18 base units.
+	escrowPriceDecimals = 18
+)
+
+var (
+	ErrInvalidSignature    = errors.New("invalid order signature")
+	ErrSignedOrderMismatch = errors.New("signed order does not match the order")
+	ErrOrderExpired        = errors.New("signed order expired")
+	ErrOrderNonceUsed      = errors.New("signed order nonce already used")
+	ErrInsufficientEscrow  = errors.New("insufficient escrow balance")
+)
+
+var (
+	eip712DomainTypeHash = crypto.Keccak256Hash([]byte("EIP712Domain(string name,string version,uint256 chainId,address verifyingContract)"))
+	escrowOrderTypeHash  = crypto.Keccak256Hash([]byte("Order(address user,address baseToken,address quoteToken,bool bid,uint256 price,uint256 size,uint256 nonce,uint256 expiry)"))
+	escrowDomainName     = crypto.Keccak256Hash([]byte("CryptoExchange"))
+	escrowDomainVersion  = crypto.Keccak256Hash([]byte("1"))
+)
+
+type SettlementMode string
+
+// SignedOrder is an order as signed by a user for the escrow contract
+// (EIP-712). Tokens are the zero address for ETH, Price is in quote base
+// units per 1e18 base units and Size in base units. For market orders
+// Price is the worst price the user accepts.
+type SignedOrder struct {
+	User       common.Address
+	BaseToken  common.Address
+	QuoteToken common.Address
+	Bid        bool
+	Price      *big.Int
+	Size       *big.Int
+	Nonce      *big.Int
+	Expiry     *big.Int // Unix time in seconds
+	Signature  hexutil.Bytes
+}
+
+// Hash returns the EIP-712 digest of the order, matching hashOrder of the
+// escrow contract deployed at verifyingContract.
+func (o *SignedOrder) Hash(chainID *big.Int, verifyingContract common.Address) common.Hash {
+	domainSeparator := crypto.Keccak256(
+		eip712DomainTypeHash.Bytes(),
+		escrowDomainName.Bytes(),
+		escrowDomainVersion.Bytes(),
+		math.U256Bytes(new(big.Int).Set(chainID)),
+		common.LeftPadBytes(verifyingContract.Bytes(), 32),
+	)
+
+	var bid int64
+	if o.Bid {
+		bid = 1
+	}
+
+	structHash := crypto.Keccak256(
+		escrowOrderTypeHash.Bytes(),
+		common.LeftPadBytes(o.User.Bytes(), 32),
+		common.LeftPadBytes(o.BaseToken.Bytes(), 32),
+		common.LeftPadBytes(o.QuoteToken.Bytes(), 32),
+		math.U256Bytes(big.NewInt(bid)),
+		math.U256Bytes(new(big.Int).Set(o.Price)),
+		math.U256Bytes(new(big.Int).Set(o.Size)),
+		math.U256Bytes(new(big.Int).Set(o.Nonce)),
+		math.U256Bytes(new(big.Int).Set(o.Expiry)),
+	)
+
+	return crypto.Keccak256Hash([]byte{0x19, 0x01}, domainSeparator, structHash)
+}
+
+// Sign signs the order with the key of its user.
+func (o *SignedOrder) Sign(key *ecdsa.PrivateKey, chainID *big.Int, verifyingContract common.Address) error {
+	sig, err := crypto.Sign(o.Hash(chainID, verifyingContract).Bytes(), key)
+	if err != nil {
+		return err
+	}
+
+	sig[64] += 27
+	o.Signature = sig
+	return nil
+}
+
+// Verify checks that the order was signed by its user.
+func (o *SignedOrder) Verify(chainID *big.Int, verifyingContract common.Address) error {
+	if len(o.Signature) != crypto.SignatureLength {
+		return ErrInvalidSignature
+	}
+
+	sig := make([]byte, crypto.SignatureLength)
+	copy(sig, o.Signature)
+	if sig[64] >= 27 {
+		sig[64] -= 27
+	}
+
+	pub, err := crypto.SigToPub(o.Hash(chainID, verifyingContract).Bytes(), sig)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if crypto.PubkeyToAddress(*pub) != o.User {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// accepts reports whether the order can be settled against a maker at
+// price, which the escrow contract only allows at the signed price or
+// better.
+func (o *SignedOrder) accepts(cfg MarketConfig, price float64) bool {
+	p := EscrowPrice(cfg.Base, cfg.Quote, price)
+	if o.Bid {
+		return p.Cmp(o.Price) <= 0
+	}
+	return p.Cmp(o.Price) >= 0
+}
+
+// spends returns the token the order pays with, and at most how much of it
+// size base units of the order cost. Bids pay the maker price, which is at
+// most their own.
+func (o *SignedOrder) spends(size *big.Int) (common.Address, *big.Int) {
+	if o.Bid {
+		quote := new(big.Int).Mul(size, o.Price)
+		return o.QuoteToken, quote.Div(quote, big.NewInt(1e18))
+	}
+	return o.BaseToken, new(big.Int).Set(size)
+}
+
+func (o *SignedOrder) escrowOrder() escrow.EscrowOrder {
+	order := escrow.EscrowOrder{
+		User:       o.User,
+		BaseToken:  o.BaseToken,
+		QuoteToken: o.QuoteToken,
+		Bid:        o.Bid,
+		Price:      o.Price,
+		Size:       o.Size,
+		Nonce:      o.Nonce,
+		Expiry:     o.Expiry,
+	}
+
+	if len(o.Signature) == crypto.SignatureLength {
+		copy(order.R[:], o.Signature[:32])
+		copy(order.S[:], o.Signature[32:64])
+		order.V = o.Signature[64]
+		if order.V < 27 {
+			order.V += 27
+		}
+	}
+
+	return order
+}
+
+// escrowToken is the address the escrow contract uses for an asset.
+func escrowToken(asset *Asset) common.Address {
+	if asset.IsNative() {
+		return common.Address{}
+	}
+	return asset.Token
+}
+
+// EscrowPrice converts a price to the units of the escrow contract.
+// Markets without a quote asset are priced with 18 decimals.
+func EscrowPrice(base, quote *Asset, price float64) *big.Int {
+	quoteDecimals := uint8(18)
+	if quote != nil {
+		quoteDecimals = quote.Decimals
+	}
+
+	units := &Asset{Decimals: quoteDecimals + escrowPriceDecimals - base.Decimals}
+	return units.ToBaseUnits(price)
+}
+
+// NewSignedOrder builds the signed form of an order on a market. The
+// caller still has to sign it.
+func NewSignedOrder(user common.Address, cfg MarketConfig, bid bool, price, size float64, nonce int64, expiry time.Time) *SignedOrder {
+	var quoteToken common.Address
+	if cfg.Quote != nil {
+		quoteToken = escrowToken(cfg.Quote)
+	}
+
+	return &SignedOrder{
+		User:       user,
+		BaseToken:  escrowToken(cfg.Base),
+		QuoteToken: quoteToken,
+		Bid:        bid,
+		Price:      EscrowPrice(cfg.Base, cfg.Quote, price),
+		Size:       cfg.Base.ToBaseUnits(size),
+		Nonce:      big.NewInt(nonce),
+		Expiry:     big.NewInt(expiry.Unix()),
+	}
+}
+
+// verifyingContract is the contract signed orders are bound to: the
+// escrow contract, or the zero address when the exchange does not settle
+// in escrow.
+func (ex *Exchange) verifyingContract() common.Address {
+	if ex.escrow == nil {
+		return common.Address{}
+	}
+	return ex.escrow.Address()
+}
+
+// checkSignedOrder verifies that signed is a valid signature of user for
+// the order placed with req, and uses up its nonce. Market orders carry
+// their worst price in the signed order, so only the price of limit
+// orders is compared.
+func (ex *Exchange) checkSignedOrder(user *User, cfg MarketConfig, req *PlaceOrderRequest, signed *SignedOrder) error {
+	if signed == nil {
+		return fmt.Errorf("%w: missing signed order", ErrSignedOrderMismatch)
+	}
+	if ex.settlement == SettlementEscrow && cfg.Quote == nil {
+		return fmt.Errorf("market %s can not be settled in escrow", req.Market)
+	}
+
+	expected := NewSignedOrder(user.Address, cfg, req.Bid, req.Price, req.Size, 0, time.Time{})
+	switch {
+	case signed.Price == nil || signed.Size == nil || signed.Nonce == nil || signed.Expiry == nil:
+		return fmt.Errorf("%w: missing fields", ErrSignedOrderMismatch)
+	case signed.User != expected.User:
+		return fmt.Errorf("%w: user", ErrSignedOrderMismatch)
+	case signed.BaseToken != expected.BaseToken || signed.QuoteToken != expected.QuoteToken:
+		return fmt.Errorf("%w: market", ErrSignedOrderMismatch)
+	case signed.Bid != expected.Bid:
+		return fmt.Errorf("%w: side", ErrSignedOrderMismatch)
+	case signed.Size.Cmp(expected.Size) != 0:
+		return fmt.Errorf("%w: size", ErrSignedOrderMismatch)
+	case req.Type == LimitOrder && signed.Price.Cmp(expected.Price) != 0:
+		return fmt.Errorf("%w: price", ErrSignedOrderMismatch)
+	case signed.Expiry.Cmp(big.NewInt(time.Now().Unix())) < 0:
+		return ErrOrderExpired
+	}
+
+	if err := signed.Verify(chainID, ex.verifyingContract()); err != nil {
+		return err
+	}
+	if ex.escrow != nil {
+		if err := ex.checkEscrowBalance(user.ID, signed); err != nil {
+			return err
+		}
+	}
+
+	return ex.useOrderNonce(signed.User, signed.Nonce)
+}
+
+// checkEscrowBalance checks that the escrow balance of the user covers the
+// signed order, on top of what the open orders of the user and their fills
+// not settled yet spend.
+func (ex *Exchange) checkEscrowBalance(userID int64, signed *SignedOrder) error {
+	orders := ex.openOrders(userID)
+
+	var open []*SignedOrder
+	ex.mu.RLock()
+	for _, order := range orders {
+		if o, ok := ex.signedOrders[order.ID]; ok {
+			open = append(open, o)
+		}
+	}
+	ex.mu.RUnlock()
+
+	token, cost := signed.spends(signed.Size)
+	balance, err := ex.escrow.contract.BalanceOf(&bind.CallOpts{}, token, signed.User)
+	if err != nil {
+		return err
+	}
+
+	needed := cost.Add(cost, ex.escrow.committed(signed.User, token, open))
+	if balance.Cmp(needed) < 0 {
+		return fmt.Errorf("%w: %s has %s of %s, needs %s", ErrInsufficientEscrow, signed.User, balance, token, needed)
+	}
+	return nil
+}
+
+// useOrderNonce marks the nonce of a signed order of address as used,
+// failing if it already was. Used nonces are stored, so they stay used
+// after a restart.
+func (ex *Exchange) useOrderNonce(address common.Address, nonce *big.Int) error {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if !ex.markOrderNonceLocked(address, nonce.String()) {
+		return fmt.Errorf("%w: %s", ErrOrderNonceUsed, nonce)
+	}
+	record := &store.Nonce{Address: address.Hex(), Nonce: nonce.String()}
+	if err := ex.store.Write(&store.Batch{Nonces: []*store.Nonce{record}}); err != nil {
+		delete(ex.orderNonces[address], nonce.String())
+		return err
+	}
+
+	return nil
+}
+
+// markOrderNonceLocked marks a nonce of address as used, and reports
+// whether it was not yet.
+func (ex *Exchange) markOrderNonceLocked(address common.Address, nonce string) bool {
+	nonces, ok := ex.orderNonces[address]
+	if !ok {
+		nonces = make(map[string]bool)
+		ex.orderNonces[address] = nonces
+	}
+
+	if nonces[nonce] {
+		return false
+	}
+	nonces[nonce] = true
+	return true
+}
+
+// ExpireOrders removes the resting signed orders whose expiry passed
+// before now from the books. They could no longer be settled in escrow.
+func (ex *Exchange) ExpireOrders(now time.Time) {
+	var expired []int64
+
+	ex.mu.RLock()
+	for id, signed := range ex.signedOrders {
+		if signed.Expiry != nil && signed.Expiry.Cmp(big.NewInt(now.Unix())) < 0 {
+			expired = append(expired, id)
+		}
+	}
+	ex.mu.RUnlock()
+
+	for _, id := range expired {
+		if market, order, ok := ex.findOrder(id); ok {
+			if err := ex.removeOrder(market, order, CommandExpire); err != nil && !errors.Is(err, ErrOrderNotFound) {
+				logrus.WithField("order", id).Errorf("expiring order: %v", err)
+				continue
+			}
+		}
+
+		ex.mu.Lock()
+		delete(ex.signedOrders, id)
+		ex.mu.Unlock()
+	}
+}
+
+// RunExpiry expires signed orders every interval until ctx is done.
+func (ex *Exchange) RunExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			ex.ExpireOrders(now)
+		}
+	}
+}
+
+// queueEscrowFills hands the matches of taker, recorded as trades, to the
+// escrow settler.
+func (ex *Exchange) queueEscrowFills(cfg MarketConfig, taker *orderbook.Order, matches []orderbook.Match, trades []*store.Trade) error {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	takerSigned, ok := ex.signedOrders[taker.ID]
+	if !ok {
+		return fmt.Errorf("no signed order for order %d", taker.ID)
+	}
+
+	for i, match := range matches {
+		maker := match.Bid
+		if taker.Bid {
+			maker = match.Ask
+		}
+
+		makerSigned, ok := ex.signedOrders[maker.ID]
+		if !ok {
+			return fmt.Errorf("no signed order for order %d", maker.ID)
+		}
+
+		ex.escrow.Add(makerSigned, takerSigned, cfg.Base.ToBaseUnits(match.SizeFilled), tradeRef(trades, i))
+	}
+
+	return nil
+}
+
+type EscrowConfig struct {
+	// BatchSize is the number of fills that triggers a settlement before
+	// the next tick of Interval.
+	BatchSize int
+	Interval  time.Duration
+	// Nonces sends the transactions of the operator key. It is shared
+	// with the other senders of the key, and made for the key when nil.
+	Nonces *NonceManager
+}
+
+type escrowFill struct {
+	maker *SignedOrder
+	taker *SignedOrder
+	size  *big.Int
+	trade store.TradeRef
+	// record is the record of the fill, nil when it is not stored.
+	record *store.EscrowFill
+}
+
+// EscrowSettler batches the fills of signed orders and settles them on the
+// escrow contract with the exchange key as operator. The fills are stored
+// until they are settled, so the fills queued or sent in a batch that is
+// not mined yet are settled after a restart.
+type EscrowSettler struct {
+	client    ChainClient
+	address   common.Address
+	contract  *escrow.Escrow
+	operator  *ecdsa.PrivateKey
+	nonces    *NonceManager
+	batchSize int
+	interval  time.Duration
+
+	mu    sync.Mutex
+	fills []escrowFill
+	// sent are the batches that are not mined yet.
+	sent []*escrowBatch
+	// queued is the size of every order that is already queued or
+	// settled, keyed by order hash.
+	queued map[common.Hash]*big.Int
+	flush  chan struct{}
+	// records, if set, keeps a settlement record of every batch and the
+	// fills that are not settled.
+	records store.Store
+}
+
+func NewEscrowSettler(client ChainClient, address common.Address, operator *ecdsa.PrivateKey, cfg EscrowConfig) (*EscrowSettler, error) {
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 32
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	if cfg.Nonces == nil {
+		cfg.Nonces = NewNonceManager(client, operator)
+	}
+
+	contract, err := escrow.NewEscrow(address, client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EscrowSettler{
+		client:    client,
+		address:   address,
+		contract:  contract,
+		operator:  operator,
+		nonces:    cfg.Nonces,
+		batchSize: cfg.BatchSize,
+		interval:  cfg.Interval,
+		queued:    make(map[common.Hash]*big.Int),
+		flush:     make(chan struct{}, 1),
+	}, nil
+}
+
+func (s *EscrowSettler) Address() common.Address {
+	return s.address
+}
+
+// SetStore keeps the settlements and the fills in records, and replaces
+// the queued fills and sent batches with the ones stored in it.
+func (s *EscrowSettler) SetStore(records store.Store) error {
+	stored, err := records.EscrowFills()
+	if err != nil {
+		return err
+	}
+
+	var (
+		fills   []escrowFill
+		sent    []*escrowBatch
+		batches = make(map[uint64]*escrowBatch)
+	)
+	for _, record := range stored {
+		fill := escrowFill{trade: record.Trade, record: record}
+		if err := json.Unmarshal(record.Maker, &fill.maker); err != nil {
+			return fmt.Errorf("escrow fill %d: %w", record.ID, err)
+		}
+		if err := json.Unmarshal(record.Taker, &fill.taker); err != nil {
+			return fmt.Errorf("escrow fill %d: %w", record.ID, err)
+		}
+		size, ok := new(big.Int).SetString(record.Size, 10)
+		if !ok {
+			return fmt.Errorf("escrow fill %d has invalid size %q", record.ID, record.Size)
+		}
+		fill.size = size
+
+		if record.SettlementID == 0 {
+			fills = append(fills, fill)
+			continue
+		}
+		batch, ok := batches[record.SettlementID]
+		if !ok {
+			settlement, err := records.Settlement(record.SettlementID)
+			if err != nil {
+				return fmt.Errorf("settlement %d of escrow fill %d: %w", record.SettlementID, record.ID, err)
+			}
+			batch = &escrowBatch{settlement: settlement, nonce: record.Nonce}
+			batches[record.SettlementID] = batch
+			sent = append(sent, batch)
+		}
+		batch.fills = append(batch.fills, fill)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fills, s.sent = fills, sent
+	s.queued = make(map[common.Hash]*big.Int)
+	for _, fill := range fills {
+		s.queue(fill)
+	}
+	for _, batch := range sent {
+		for _, fill := range batch.fills {
+			s.queue(fill)
+		}
+	}
+	s.records = records
+	return nil
+}
+
+// Add queues a fill of size base units between maker and taker for a trade,
+// which is zero for fills without a trade record. The size is clamped to
+// what is left of both orders, as fills computed from float sizes can round
+// above the signed size.
+func (s *EscrowSettler) Add(maker, taker *SignedOrder, size *big.Int, trade store.TradeRef) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size = new(big.Int).Set(size)
+	makerHash := maker.Hash(chainID, s.address)
+	takerHash := taker.Hash(chainID, s.address)
+
+	for _, o := range []struct {
+		hash  common.Hash
+		order *SignedOrder
+	}{{makerHash, maker}, {takerHash, taker}} {
+		left := new(big.Int).Set(o.order.Size)
+		if queued, ok := s.queued[o.hash]; ok {
+			left.Sub(left, queued)
+		}
+		if size.Cmp(left) > 0 {
+			size = left
+		}
+	}
+
+	if size.Sign() <= 0 {
+		return
+	}
+
+	fill := escrowFill{maker: maker, taker: taker, size: size, trade: trade}
+	s.queue(fill)
+	s.fills = append(s.fills, fill)
+	if s.records != nil {
+		// A fill that could not be stored is still settled, but lost on
+		// a restart.
+		if err := s.saveFill(&s.fills[len(s.fills)-1]); err != nil {
+			logrus.WithField("component", "escrow").Errorf("store: %v", err)
+		}
+	}
+
+	if len(s.fills) >= s.batchSize {
+		select {
+		case s.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// queue adds the size of a fill to what is queued of its orders. It must
+// be called with the lock held.
+func (s *EscrowSettler) queue(fill escrowFill) {
+	for _, o := range []*SignedOrder{fill.maker, fill.taker} {
+		hash := o.Hash(chainID, s.address)
+		if _, ok := s.queued[hash]; !ok {
+			s.queued[hash] = new(big.Int)
+		}
+		s.queued[hash].Add(s.queued[hash], fill.size)
+	}
+}
+
+// saveFill writes a new record of a fill.
+func (s *EscrowSettler) saveFill(fill *escrowFill) error {
+	maker, err := json.Marshal(fill.maker)
+	if err != nil {
+		return err
+	}
+	taker, err := json.Marshal(fill.taker)
+	if err != nil {
+		return err
+	}
+
+	record := &store.EscrowFill{Maker: maker, Taker: taker, Size: fill.size.String(), Trade: fill.trade}
+	if err := s.records.Write(&store.Batch{EscrowFills: []*store.EscrowFill{record}}); err != nil {
+		return err
+	}
+	fill.record = record
+	return nil
+}
+
+// escrowBatch is a settlement transaction and the fills it settles.
+type escrowBatch struct {
+	settlement *store.Settlement
+	fills      []escrowFill
+	// nonce is the nonce of the transaction.
+	nonce uint64
+}
+
+// Flush settles all queued fills in a single transaction. It returns a nil
+// transaction when there is nothing to settle. Fills that would make the
+// batch revert, like those of a user whose balance dropped since they
+// matched, are dropped and the others settled.
+func (s *EscrowSettler) Flush(ctx context.Context) (*types.Transaction, error) {
+	s.mu.Lock()
+	fills := s.fills
+	s.fills = nil
+	s.mu.Unlock()
+
+	if len(fills) == 0 {
+		return nil, nil
+	}
+
+	// A batch that may have been sent is not sent again: it is confirmed
+	// like a sent batch once it is mined.
+	tx, err := s.send(ctx, fills)
+	if err != nil && !errors.Is(err, ErrSendUnknown) {
+		valid, invalid := s.checkFills(ctx, fills)
+		s.drop(invalid, err)
+		if len(valid) == 0 {
+			return nil, fmt.Errorf("settling %d fills: %w", len(fills), err)
+		}
+
+		fills = valid
+		if tx, err = s.send(ctx, fills); err != nil && !errors.Is(err, ErrSendUnknown) {
+			s.drop(fills, err)
+			return nil, fmt.Errorf("settling %d fills: %w", len(fills), err)
+		}
+	}
+
+	if err != nil {
+		logrus.WithField("tx", tx.Hash()).Warn(err)
+	}
+	logrus.WithFields(logrus.Fields{
+		"fills": len(fills),
+		"tx":    tx.Hash(),
+	}).Info("escrow settlement sent")
+
+	// The settlement gets its ID in the first write, which the fills are
+	// written with in the second.
+	batch := &escrowBatch{settlement: fillSettlement(fills, store.SettlementSent), fills: fills, nonce: tx.Nonce()}
+	batch.settlement.TxHash = tx.Hash().Hex()
+	recordSettlement(s.records, batch.settlement, nil)
+	if records := fillRecords(fills, batch.settlement.ID, batch.nonce); len(records) > 0 {
+		if err := s.records.Write(&store.Batch{EscrowFills: records}); err != nil {
+			logrus.WithField("tx", tx.Hash()).Errorf("store: %v", err)
+		}
+	}
+
+	s.mu.Lock()
+	s.sent = append(s.sent, batch)
+	s.mu.Unlock()
+	return tx, nil
+}
+
+// fillRecords updates the records of the stored fills with the settlement
+// and nonce of the transaction sending them, which are zero for fills
+// that are queued, and returns them.
+func fillRecords(fills []escrowFill, settlementID, nonce uint64) []*store.EscrowFill {
+	var records []*store.EscrowFill
+	for _, fill := range fills {
+		if fill.record != nil {
+			fill.record.SettlementID, fill.record.Nonce = settlementID, nonce
+			records = append(records, fill.record)
+		}
+	}
+	return records
+}
+
+// settledFills returns the IDs of the records of the stored fills.
+func settledFills(fills []escrowFill) []uint64 {
+	var ids []uint64
+	for _, fill := range fills {
+		if fill.record != nil {
+			ids = append(ids, fill.record.ID)
+		}
+	}
+	return ids
+}
+
+func (s *EscrowSettler) send(ctx context.Context, fills []escrowFill) (*types.Transaction, error) {
+	makers, takers, sizes := escrowArgs(fills)
+	return s.nonces.Send(ctx, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		return s.contract.Settle(opts, makers, takers, sizes)
+	})
+}
+
+// escrowArgs returns the arguments of the settle method of the escrow
+// contract for fills.
+func escrowArgs(fills []escrowFill) (makers, takers []escrow.EscrowOrder, sizes []*big.Int) {
+	makers = make([]escrow.EscrowOrder, len(fills))
+	takers = make([]escrow.EscrowOrder, len(fills))
+	sizes = make([]*big.Int, len(fills))
+	for i, fill := range fills {
+		makers[i] = fill.maker.escrowOrder()
+		takers[i] = fill.taker.escrowOrder()
+		sizes[i] = fill.size
+	}
+	return makers, takers, sizes
+}
+
+func fillSettlement(fills []escrowFill, status store.SettlementStatus) *store.Settlement {
+	settlement := &store.Settlement{Mode: string(SettlementEscrow), Fills: len(fills), Status: status}
+	for _, fill := range fills {
+		if fill.trade.ID != 0 {
+			settlement.Trades = append(settlement.Trades, fill.trade)
+		}
+	}
+	return settlement
+}
+
+// checkFills simulates settling fills one more at a time, in order, and
+// splits them into the fills that settle and those that revert.
+func (s *EscrowSettler) checkFills(ctx context.Context, fills []escrowFill) (valid, invalid []escrowFill) {
+	raw := &escrow.EscrowRaw{Contract: s.contract}
+	opts := &bind.CallOpts{From: crypto.PubkeyToAddress(s.operator.PublicKey), Context: ctx}
+
+	for _, fill := range fills {
+		makers, takers, sizes := escrowArgs(append(valid[:len(valid):len(valid)], fill))
+		var out []interface{}
+		if err := raw.Call(opts, &out, "settle", makers, takers, sizes); err != nil {
+			invalid = append(invalid, fill)
+			continue
+		}
+		valid = append(valid, fill)
+	}
+	return valid, invalid
+}
+
+// drop gives up on fills that can not be settled, releasing their queued
+// sizes.
+func (s *EscrowSettler) drop(fills []escrowFill, reason error) {
+	if len(fills) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	for _, fill := range fills {
+		for _, o := range []*SignedOrder{fill.maker, fill.taker} {
+			if queued, ok := s.queued[o.Hash(chainID, s.address)]; ok {
+				queued.Sub(queued, fill.size)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"component": "escrow",
+		"fills":     len(fills),
+	}).Errorf("dropping fills that can not be settled: %v", reason)
+
+	settlement := fillSettlement(fills, store.SettlementFailed)
+	settlement.Error = reason.Error()
+	recordSettlement(s.records, settlement, &store.Batch{SettledFills: settledFills(fills)})
+}
+
+// requeue puts fills back in front of the queue, to be settled with the
+// next batch.
+func (s *EscrowSettler) requeue(fills []escrowFill) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fills = append(fills[:len(fills):len(fills)], s.fills...)
+}
+
+// committed returns how much of token the user still spends: what is left
+// of their open orders, and their fills that are not settled yet.
+func (s *EscrowSettler) committed(user, token common.Address, open []*SignedOrder) *big.Int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := new(big.Int)
+	add := func(o *SignedOrder, size *big.Int) {
+		if t, cost := o.spends(size); t == token {
+			total.Add(total, cost)
+		}
+	}
+
+	for _, o := range open {
+		left := new(big.Int).Set(o.Size)
+		if queued, ok := s.queued[o.Hash(chainID, s.address)]; ok {
+			left.Sub(left, queued)
+		}
+		if left.Sign() > 0 {
+			add(o, left)
+		}
+	}
+	for _, fill := range s.fills {
+		for _, o := range []*SignedOrder{fill.maker, fill.taker} {
+			if o.User == user {
+				add(o, fill.size)
+			}
+		}
+	}
+	return total
+}
+
+// Run settles the queued fills every interval, or earlier when a batch is
+// full, and tracks the sent batches until ctx is done.
+func (s *EscrowSettler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.flush:
+		}
+
+		if _, err := s.Flush(ctx); err != nil {
+			logrus.WithField("component", "escrow").Error(err)
+		}
+		s.track(ctx)
+	}
+}
+
+// track checks the receipts of the sent batches. The fills of a batch that
+// reverted, or whose transaction will not be mined, are queued again, so
+// the next batch settles those that still can. It must not run
+// concurrently with itself.
+func (s *EscrowSettler) track(ctx context.Context) {
+	s.mu.Lock()
+	sent := s.sent
+	s.sent = nil
+	s.mu.Unlock()
+
+	for _, batch := range sent {
+		hash := common.HexToHash(batch.settlement.TxHash)
+
+		// The nonce is read before the receipt: a transaction that is not
+		// mined by then while its nonce is used never will be.
+		mined, err := s.client.NonceAt(ctx, s.nonces.Address(), nil)
+		var receipt *types.Receipt
+		if err == nil {
+			receipt, err = s.client.TransactionReceipt(ctx, hash)
+		}
+
+		settlement := *batch.settlement
+		switch {
+		case errors.Is(err, ethereum.NotFound) && mined > batch.nonce:
+			logrus.WithField("tx", hash).Error("escrow settlement was not sent")
+			settlement.Status = store.SettlementFailed
+			settlement.Error = "transaction was not sent"
+			s.retry(&settlement, batch.fills)
+		case errors.Is(err, ethereum.NotFound):
+			s.keep(batch)
+		case err != nil:
+			logrus.WithField("tx", hash).Error(err)
+			s.keep(batch)
+		case receipt.Status != types.ReceiptStatusSuccessful:
+			logrus.WithField("tx", hash).Error("escrow settlement reverted")
+			settlement.Status = store.SettlementReverted
+			s.retry(&settlement, batch.fills)
+		default:
+			settlement.Status = store.SettlementConfirmed
+			recordSettlement(s.records, &settlement, &store.Batch{SettledFills: settledFills(batch.fills)})
+
+			logrus.WithFields(logrus.Fields{
+				"tx":    hash,
+				"block": receipt.BlockNumber,
+				"gas":   receipt.GasUsed,
+			}).Info("escrow settlement confirmed")
+		}
+	}
+}
+
+// keep tracks a sent batch again on the next poll.
+func (s *EscrowSettler) keep(batch *escrowBatch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sent = append(s.sent, batch)
+}
+
+// retry records the settlement of a batch that did not settle together
+// with its fills, which are queued again.
+func (s *EscrowSettler) retry(settlement *store.Settlement, fills []escrowFill) {
+	recordSettlement(s.records, settlement, &store.Batch{EscrowFills: fillRecords(fills, 0, 0)})
+	s.requeue(fills)
+}
@@ -0,0 +1,395 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tahaontech/crypto_exchange/contracts/escrow"
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+func (c *testChain) deployEscrow(t *testing.T) (common.Address, *escrow.Escrow) {
+	t.Helper()
+
+	addr, _, contract, err := escrow.DeployEscrow(c.transactor(t, c.keys[0]), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Commit()
+
+	return addr, contract
+}
+
+func (c *testChain) mined(t *testing.T, tx *types.Transaction) *types.Receipt {
+	t.Helper()
+
+	c.Commit()
+	receipt, err := bind.WaitMined(context.Background(), c, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		t.Fatalf("tx %s reverted", tx.Hash())
+	}
+	return receipt
+}
+
+func signOrder(t *testing.T, key *ecdsa.PrivateKey, cfg MarketConfig, escrowAddr common.Address, bid bool, price, size float64) *SignedOrder {
+	t.Helper()
+
+	order := NewSignedOrder(crypto.PubkeyToAddress(key.PublicKey), cfg, bid, price, size, 1, time.Now().Add(time.Hour))
+	if err := order.Sign(key, chainID, escrowAddr); err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+// fundEscrow deploys the escrow contract for a market of ETH against a
+// token, and deposits 2 ETH of the seller and 5000 of the token of the
+// buyer, keys 1 and 2 of the chain.
+func (c *testChain) fundEscrow(t *testing.T) (common.Address, *escrow.Escrow, MarketConfig) {
+	t.Helper()
+
+	var (
+		operator = c.keys[0]
+		seller   = c.keys[1]
+		buyer    = c.keys[2]
+	)
+
+	tokenAddr, token := c.deployToken(t, 6)
+	escrowAddr, contract := c.deployEscrow(t)
+	cfg := MarketConfig{Base: AssetETH, Quote: &Asset{Symbol: "USDC", Token: tokenAddr, Decimals: 6}}
+
+	depositETH := c.transactor(t, seller)
+	depositETH.Value = AssetETH.ToBaseUnits(2)
+	tx, err := contract.Deposit(depositETH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mined(t, tx)
+
+	buyerAddr := crypto.PubkeyToAddress(buyer.PublicKey)
+	if _, err := token.Mint(c.transactor(t, operator), buyerAddr, cfg.Quote.ToBaseUnits(5000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := token.Approve(c.transactor(t, buyer), escrowAddr, cfg.Quote.ToBaseUnits(5000)); err != nil {
+		t.Fatal(err)
+	}
+	c.Commit()
+	if tx, err = contract.DepositToken(c.transactor(t, buyer), tokenAddr, cfg.Quote.ToBaseUnits(5000)); err != nil {
+		t.Fatal(err)
+	}
+	c.mined(t, tx)
+
+	return escrowAddr, contract, cfg
+}
+
+func TestEscrowSettle(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		chain     = newTestChain(t, 3)
+		operator  = chain.keys[0]
+		seller    = chain.keys[1]
+		buyer     = chain.keys[2]
+		buyerAddr = crypto.PubkeyToAddress(buyer.PublicKey)
+	)
+
+	escrowAddr, contract, cfg := chain.fundEscrow(t)
+	tokenAddr := cfg.Quote.Token
+
+	maker := signOrder(t, seller, cfg, escrowAddr, false, 2000, 1)
+	taker := signOrder(t, buyer, cfg, escrowAddr, true, 2100, 1)
+
+	hash, err := contract.HashOrder(&bind.CallOpts{}, maker.escrowOrder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, common.Hash(hash), maker.Hash(chainID, escrowAddr))
+	if err := maker.Verify(chainID, escrowAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	settler, err := NewEscrowSettler(chain, escrowAddr, operator, EscrowConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second fill is clamped to what is left of the orders.
+	settler.Add(maker, taker, AssetETH.ToBaseUnits(0.4), store.TradeRef{})
+	settler.Add(maker, taker, AssetETH.ToBaseUnits(0.8), store.TradeRef{})
+
+	tx, err := settler.Flush(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.mined(t, tx)
+
+	sellerAddr := crypto.PubkeyToAddress(seller.PublicKey)
+	balance := func(token, user common.Address) *big.Int {
+		b, err := contract.BalanceOf(&bind.CallOpts{}, token, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	assert(t, balance(common.Address{}, sellerAddr), AssetETH.ToBaseUnits(1))
+	assert(t, balance(common.Address{}, buyerAddr), AssetETH.ToBaseUnits(1))
+	assert(t, balance(tokenAddr, sellerAddr), cfg.Quote.ToBaseUnits(2000))
+	assert(t, balance(tokenAddr, buyerAddr), cfg.Quote.ToBaseUnits(3000))
+
+	// Orders can not be settled past their size, or with a signature of
+	// someone else.
+	settler.Add(maker, taker, AssetETH.ToBaseUnits(0.1), store.TradeRef{})
+	if tx, _ := settler.Flush(ctx); tx != nil {
+		t.Fatal("expected no settlement for filled orders")
+	}
+	_, err = contract.Settle(chain.transactor(t, operator),
+		[]escrow.EscrowOrder{maker.escrowOrder()}, []escrow.EscrowOrder{taker.escrowOrder()}, []*big.Int{big.NewInt(1)})
+	if err == nil {
+		t.Fatal("expected the contract to reject overfilling an order")
+	}
+
+	forged := signOrder(t, operator, cfg, escrowAddr, true, 2000, 1)
+	forged.User = buyerAddr
+	fresh := signOrder(t, seller, cfg, escrowAddr, false, 2000, 0.5)
+	settler.Add(fresh, forged, AssetETH.ToBaseUnits(0.5), store.TradeRef{})
+	if _, err := settler.Flush(ctx); err == nil {
+		t.Fatal("expected settlement with a forged signature to fail")
+	}
+
+	before, err := chain.BalanceAt(ctx, sellerAddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tx, err = contract.Withdraw(chain.transactor(t, seller), common.Address{}, AssetETH.ToBaseUnits(1)); err != nil {
+		t.Fatal(err)
+	}
+	receipt := chain.mined(t, tx)
+	fee := new(big.Int).Mul(new(big.Int).SetUint64(receipt.GasUsed), receipt.EffectiveGasPrice)
+
+	after, err := chain.BalanceAt(ctx, sellerAddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, new(big.Int).Sub(after.Add(after, fee), before), AssetETH.ToBaseUnits(1))
+	assert(t, balance(common.Address{}, sellerAddr).Sign(), 0)
+
+	// A fill that would revert is dropped, and the rest of its batch is
+	// settled.
+	high := signOrder(t, buyer, cfg, escrowAddr, false, 2500, 0.5)
+	ask := signOrder(t, buyer, cfg, escrowAddr, false, 2000, 0.25)
+	settler.Add(high, signOrder(t, seller, cfg, escrowAddr, true, 2000, 0.5), AssetETH.ToBaseUnits(0.5), store.TradeRef{})
+	settler.Add(ask, signOrder(t, seller, cfg, escrowAddr, true, 2000, 0.25), AssetETH.ToBaseUnits(0.25), store.TradeRef{})
+	tx, err = settler.Flush(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.mined(t, tx)
+
+	assert(t, balance(common.Address{}, sellerAddr), AssetETH.ToBaseUnits(0.25))
+	assert(t, balance(tokenAddr, sellerAddr), cfg.Quote.ToBaseUnits(1500))
+	assert(t, settler.queued[high.Hash(chainID, escrowAddr)].Sign(), 0)
+}
+
+func TestEscrowSettlerResumes(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		chain    = newTestChain(t, 3)
+		operator = chain.keys[0]
+		records  = store.NewMemory()
+	)
+
+	escrowAddr, contract, cfg := chain.fundEscrow(t)
+	start := func() *EscrowSettler {
+		settler, err := NewEscrowSettler(chain, escrowAddr, operator, EscrowConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := settler.SetStore(records); err != nil {
+			t.Fatal(err)
+		}
+		return settler
+	}
+
+	maker := signOrder(t, chain.keys[1], cfg, escrowAddr, false, 2000, 1)
+	taker := signOrder(t, chain.keys[2], cfg, escrowAddr, true, 2000, 1)
+	settler := start()
+	settler.Add(maker, taker, AssetETH.ToBaseUnits(0.4), store.TradeRef{Market: "ETH", ID: 1})
+
+	// The queued fill is settled after a restart, and still counts against
+	// the size of its orders.
+	settler = start()
+	settler.Add(maker, taker, AssetETH.ToBaseUnits(0.8), store.TradeRef{Market: "ETH", ID: 2})
+	tx, err := settler.Flush(ctx)
+	assert(t, err, nil)
+
+	// The sent batch is tracked after a restart, and its fills are deleted
+	// once it is confirmed.
+	settler = start()
+	assert(t, len(settler.fills), 0)
+	assert(t, len(settler.sent), 1)
+	chain.mined(t, tx)
+	settler.track(ctx)
+	assert(t, len(settler.sent), 0)
+
+	fills, err := records.EscrowFills()
+	assert(t, err, nil)
+	assert(t, len(fills), 0)
+	settlement, err := records.Settlement(1)
+	assert(t, err, nil)
+	assert(t, settlement.Status, store.SettlementConfirmed)
+	assert(t, settlement.Trades, []store.TradeRef{{Market: "ETH", ID: 1}, {Market: "ETH", ID: 2}})
+
+	balance, err := contract.BalanceOf(&bind.CallOpts{}, common.Address{}, crypto.PubkeyToAddress(chain.keys[2].PublicKey))
+	assert(t, err, nil)
+	assert(t, balance, AssetETH.ToBaseUnits(1))
+}
+
+func TestEscrowOrderChecks(t *testing.T) {
+	var (
+		chain  = newTestChain(t, 2)
+		ex     = newTestExchange(t, chain)
+		seller = chain.keys[0]
+		buyer  = chain.keys[1]
+		market = Market("ETH-USDC")
+	)
+
+	tokenAddr, _ := chain.deployToken(t, 6)
+	escrowAddr, contract := chain.deployEscrow(t)
+	cfg := MarketConfig{Base: AssetETH, Quote: &Asset{Symbol: "USDC", Token: tokenAddr, Decimals: 6}}
+	if err := ex.AddMarket(market, cfg); err != nil {
+		t.Fatal(err)
+	}
+	settler, err := NewEscrowSettler(chain, escrowAddr, seller, EscrowConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ex.EnableEscrow(settler); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range chain.keys {
+		if err := ex.registerUser(&User{ID: int64(i + 1), Address: crypto.PubkeyToAddress(key.PublicKey)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deposit := chain.transactor(t, seller)
+	deposit.Value = AssetETH.ToBaseUnits(1)
+	tx, err := contract.Deposit(deposit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.mined(t, tx)
+
+	place := func(userID int64, key *ecdsa.PrivateKey, typ OrderType, bid bool, price, size float64, nonce int64) int {
+		t.Helper()
+
+		signed := NewSignedOrder(crypto.PubkeyToAddress(key.PublicKey), cfg, bid, price, size, nonce, time.Now().Add(time.Hour))
+		if err := signed.Sign(key, chainID, escrowAddr); err != nil {
+			t.Fatal(err)
+		}
+		req := PlaceOrderRequest{Type: typ, Bid: bid, Size: size, Market: market, Signed: signed}
+		if typ == LimitOrder {
+			req.Price = price
+		}
+		return placeOrder(t, ex, userID, req).Code
+	}
+
+	// Open orders count against the escrow balance.
+	assert(t, place(1, seller, LimitOrder, false, 2000, 0.6, 1), http.StatusOK)
+	assert(t, place(1, seller, LimitOrder, false, 2100, 0.6, 2), http.StatusBadRequest)
+	assert(t, place(1, seller, LimitOrder, false, 2100, 0.4, 2), http.StatusOK)
+	assert(t, place(2, buyer, LimitOrder, true, 1900, 1, 1), http.StatusBadRequest)
+	assert(t, len(ex.Orders[1]), 2)
+
+	// A rejected order did not use up its nonce.
+	deposit = chain.transactor(t, buyer)
+	deposit.Value = AssetETH.ToBaseUnits(1)
+	tx, err = contract.Deposit(deposit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.mined(t, tx)
+	assert(t, place(2, buyer, LimitOrder, false, 2200, 1, 1), http.StatusOK)
+}
+
+func TestSignedMarketOrderWorstPrice(t *testing.T) {
+	var (
+		chain = newTestChain(t, 2)
+		ex    = newTestExchange(t, chain)
+		cfg   = ex.markets[MarketETH]
+	)
+
+	ex.RequireSignedOrders()
+	for i, key := range chain.keys {
+		if err := ex.registerUser(&User{ID: int64(i + 1), Address: crypto.PubkeyToAddress(key.PublicKey)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	place := func(userID int64, typ OrderType, bid bool, price, size float64, nonce int64) int {
+		t.Helper()
+
+		key := chain.keys[userID-1]
+		req := PlaceOrderRequest{Type: typ, Bid: bid, Size: size, Market: MarketETH}
+		if typ == LimitOrder {
+			req.Price = price
+		}
+		req.Signed = NewSignedOrder(crypto.PubkeyToAddress(key.PublicKey), cfg, bid, price, size, nonce, time.Now().Add(time.Minute))
+		if err := req.Signed.Sign(key, chainID, common.Address{}); err != nil {
+			t.Fatal(err)
+		}
+		return placeOrder(t, ex, userID, req).Code
+	}
+
+	assert(t, place(2, LimitOrder, false, 1500, 1, 1), http.StatusOK)
+	assert(t, place(2, LimitOrder, false, 1700, 1, 2), http.StatusOK)
+
+	// Only the ask at 1500 is within the signed price of the bid.
+	assert(t, place(1, MarketOrder, true, 1600, 2, 1), http.StatusBadRequest)
+	assert(t, len(ex.Orders[2]), 2)
+	assert(t, place(1, MarketOrder, true, 1700, 2, 2), http.StatusOK)
+	assert(t, len(ex.Orders[2]), 0)
+}
+
+func TestPlaceSignedOrder(t *testing.T) {
+	var (
+		chain = newTestChain(t, 1)
+		ex    = newTestExchange(t, chain)
+		key   = chain.keys[0]
+		cfg   = ex.markets[MarketETH]
+	)
+
+	ex.RequireSignedOrders()
+	if err := ex.registerUser(&User{ID: 1, Address: crypto.PubkeyToAddress(key.PublicKey)}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 2, Price: 1500, Market: MarketETH}
+	assert(t, placeOrder(t, ex, 1, req).Code, http.StatusBadRequest)
+
+	req.Signed = NewSignedOrder(crypto.PubkeyToAddress(key.PublicKey), cfg, true, 1500, 2, 7, time.Now().Add(time.Minute))
+	if err := req.Signed.Sign(key, chainID, common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, placeOrder(t, ex, 1, req).Code, http.StatusOK)
+
+	// The nonce was used up by the first order.
+	assert(t, placeOrder(t, ex, 1, req).Code, http.StatusConflict)
+
+	req.Price = 1600
+	assert(t, placeOrder(t, ex, 1, req).Code, http.StatusBadRequest)
+
+	orders := ex.Orders[1]
+	assert(t, len(orders), 1)
+	assert(t, ex.signedOrders[orders[0].ID].Signature, req.Signed.Signature)
+}
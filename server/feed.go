@@ -0,0 +1,277 @@
+package server
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+)
+
+const (
+	// ChannelTrades streams the trades of a market.
+	ChannelTrades Channel = "trades"
+	// ChannelBook streams an L2 snapshot of a market followed by
+	// incremental updates.
+	ChannelBook Channel = "book"
+	// ChannelBBO streams the best bid and offer of a market.
+	ChannelBBO Channel = "bbo"
+)
+
+type Channel string
+
+// BookLevels are the price levels of an L2 snapshot, or the levels that
+// changed in an update. A level with zero size was removed.
+type BookLevels struct {
+	Bids []orderbook.Level
+	Asks []orderbook.Level
+}
+
+// BBO is the best bid and offer of a market. Prices and sizes are zero for
+// an empty side.
+type BBO struct {
+	BidPrice float64
+	BidSize  float64
+	AskPrice float64
+	AskSize  float64
+}
+
+// marketFeed publishes the market data of one orderbook to the websocket
+// connections subscribed to it, and to the handlers of other gateways. Book
+// updates are diffs against the levels of the last update, numbered by
+// sequence, so a snapshot followed by the updates with higher sequence
+// numbers always yields the current book.
+type marketFeed struct {
+	market Market
+	ob     *orderbook.Orderbook
+
+	mu       sync.Mutex
+	sequence int64
+	bids     map[float64]float64
+	asks     map[float64]float64
+	bbo      BBO
+	subs     map[Channel]map[*wsConn]bool
+	// handlers are called with the messages of a channel, by the ID
+	// handle returned them with.
+	handlers    map[Channel]map[int]func(WSMessage)
+	nextHandler int
+	// depths are the depths served at sequence number depthSequence.
+	depths        map[depthKey]*Depth
+	depthSequence int64
+}
+
+func newMarketFeed(market Market, ob *orderbook.Orderbook) *marketFeed {
+	return &marketFeed{
+		market: market,
+		ob:     ob,
+		bids:   make(map[float64]float64),
+		asks:   make(map[float64]float64),
+		subs: map[Channel]map[*wsConn]bool{
+			ChannelTrades: {},
+			ChannelBook:   {},
+			ChannelBBO:    {},
+		},
+		handlers: map[Channel]map[int]func(WSMessage){
+			ChannelTrades: {},
+			ChannelBook:   {},
+			ChannelBBO:    {},
+		},
+	}
+}
+
+// publishMarket sends the trades of matches and the changes of the book of
+// market to the subscribers.
+func (ex *Exchange) publishMarket(market Market, taker *orderbook.Order, matches []orderbook.Match) {
+	feed, ok := ex.feeds[market]
+	if !ok {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	for _, match := range matches {
+		feed.publishTrade(&orderbook.Trade{
+			Price:     match.Price,
+			Size:      match.SizeFilled,
+			Bid:       taker.Bid,
+			Timestamp: now,
+		})
+	}
+
+	feed.publishBook()
+}
+
+func (f *marketFeed) publishTrade(trade *orderbook.Trade) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.broadcast(ChannelTrades, WSMessage{Type: WSTrade, Data: trade})
+}
+
+func (f *marketFeed) publishBook() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.updateBook()
+}
+
+// updateBook diffs the book against the last published levels and sends
+// the changes. It must be called with the lock held.
+func (f *marketFeed) updateBook() {
+	bids, asks := f.ob.Levels()
+
+	var update BookLevels
+	update.Bids, f.bids = diffLevels(f.bids, bids)
+	update.Asks, f.asks = diffLevels(f.asks, asks)
+	if len(update.Bids) == 0 && len(update.Asks) == 0 {
+		return
+	}
+
+	sort.Slice(update.Bids, func(i, j int) bool { return update.Bids[i].Price > update.Bids[j].Price })
+	sort.Slice(update.Asks, func(i, j int) bool { return update.Asks[i].Price < update.Asks[j].Price })
+
+	f.sequence++
+	f.broadcast(ChannelBook, WSMessage{Type: WSUpdate, Sequence: f.sequence, Data: update})
+
+	var bbo BBO
+	if len(bids) > 0 {
+		bbo.BidPrice, bbo.BidSize = bids[0].Price, bids[0].Size
+	}
+	if len(asks) > 0 {
+		bbo.AskPrice, bbo.AskSize = asks[0].Price, asks[0].Size
+	}
+	if bbo != f.bbo {
+		f.bbo = bbo
+		f.broadcast(ChannelBBO, WSMessage{Type: WSBBO, Sequence: f.sequence, Data: bbo})
+	}
+}
+
+// diffLevels returns the levels that changed since prev, and levels as a
+// map to diff the next update against.
+func diffLevels(prev map[float64]float64, levels []orderbook.Level) ([]orderbook.Level, map[float64]float64) {
+	next := make(map[float64]float64, len(levels))
+	changed := []orderbook.Level{}
+
+	for _, level := range levels {
+		next[level.Price] = level.Size
+		if size, ok := prev[level.Price]; !ok || size != level.Size {
+			changed = append(changed, level)
+		}
+	}
+	for price := range prev {
+		if _, ok := next[price]; !ok {
+			changed = append(changed, orderbook.Level{Price: price})
+		}
+	}
+
+	return changed, next
+}
+
+// snapshot returns the last published levels, best first. It must be
+// called with the lock held.
+func (f *marketFeed) snapshot() BookLevels {
+	snapshot := BookLevels{
+		Bids: make([]orderbook.Level, 0, len(f.bids)),
+		Asks: make([]orderbook.Level, 0, len(f.asks)),
+	}
+	for price, size := range f.bids {
+		snapshot.Bids = append(snapshot.Bids, orderbook.Level{Price: price, Size: size})
+	}
+	for price, size := range f.asks {
+		snapshot.Asks = append(snapshot.Asks, orderbook.Level{Price: price, Size: size})
+	}
+
+	sort.Slice(snapshot.Bids, func(i, j int) bool { return snapshot.Bids[i].Price > snapshot.Bids[j].Price })
+	sort.Slice(snapshot.Asks, func(i, j int) bool { return snapshot.Asks[i].Price < snapshot.Asks[j].Price })
+
+	return snapshot
+}
+
+// subscribe adds conn to the subscribers of channel. Book subscribers get
+// a snapshot, BBO subscribers the current best bid and offer, before any
+// update.
+func (f *marketFeed) subscribe(conn *wsConn, channel Channel, requestID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Bring the published levels up to date, so the snapshot is the
+	// current book.
+	f.updateBook()
+
+	f.subs[channel][conn] = true
+	conn.send(WSMessage{Type: WSSubscribed, ID: requestID, Channel: channel, Market: f.market})
+
+	if msg, ok := f.initial(channel); ok {
+		conn.send(msg)
+	}
+}
+
+// initial is the first message to a new subscriber of channel: a snapshot
+// of the book or the best bid and offer. It must be called with the lock
+// held.
+func (f *marketFeed) initial(channel Channel) (WSMessage, bool) {
+	switch channel {
+	case ChannelBook:
+		return WSMessage{Type: WSSnapshot, Channel: channel, Market: f.market, Sequence: f.sequence, Data: f.snapshot()}, true
+	case ChannelBBO:
+		return WSMessage{Type: WSBBO, Channel: channel, Market: f.market, Sequence: f.sequence, Data: f.bbo}, true
+	default:
+		return WSMessage{}, false
+	}
+}
+
+// handle calls handler with the messages of channel, starting like
+// subscribe, until the returned func is called.
+func (f *marketFeed) handle(channel Channel, handler func(WSMessage)) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.updateBook()
+
+	f.nextHandler++
+	id := f.nextHandler
+	f.handlers[channel][id] = handler
+
+	if msg, ok := f.initial(channel); ok {
+		handler(msg)
+	}
+
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		delete(f.handlers[channel], id)
+	}
+}
+
+func (f *marketFeed) unsubscribe(conn *wsConn, channel Channel) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.subs[channel], conn)
+}
+
+// broadcast sends msg to the subscribers of channel. It must be called
+// with the lock held.
+func (f *marketFeed) broadcast(channel Channel, msg WSMessage) {
+	msg.Channel = channel
+	msg.Market = f.market
+
+	for _, handler := range f.handlers[channel] {
+		handler(msg)
+	}
+	if len(f.subs[channel]) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	for conn := range f.subs[channel] {
+		conn.enqueue(b)
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// TradeQuery selects a page of the trades of a market, or of the fills of
+// a user in any market when Market is empty. Cursor is the NextCursor of
+// the previous page. From and To bound the time of the trades in Unix
+// nanoseconds, To excluded, when they are not zero. Limit is the size of
+// the page, 100 by default and at most 1000.
+type TradeQuery struct {
+	Market Market
+	Cursor string
+	From   int64
+	To     int64
+	Limit  int
+}
+
+// Trade is a trade of a market. Bid is the side of the taker.
+type Trade struct {
+	ID           uint64
+	Market       Market
+	Price        float64
+	Size         float64
+	Bid          bool
+	MakerOrderID int64
+	TakerOrderID int64
+	Timestamp    int64
+}
+
+// TradesResponse is a page of trades, oldest first. NextCursor is set when
+// the page is full, as there may be more trades after it.
+type TradesResponse struct {
+	Trades     []Trade
+	NextCursor string `json:",omitempty"`
+}
+
+// FillsResponse is a page of the fills of a user, oldest first, like
+// TradesResponse.
+type FillsResponse struct {
+	Fills      []Fill
+	NextCursor string `json:",omitempty"`
+}
+
+// page returns the position a cursor points after and the size of a page
+// of at most limit records.
+func page(cursor string, limit int) (uint64, int, error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	if cursor == "" {
+		return 0, limit, nil
+	}
+	after, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil {
+		return 0, 0, ErrInvalidCursor
+	}
+	return after, limit, nil
+}
+
+// TradeHistory returns a page of the trades of a market.
+func (ex *Exchange) TradeHistory(q TradeQuery) (*TradesResponse, error) {
+	if _, ok := ex.orderbooks[q.Market]; !ok {
+		return nil, ErrMarketNotFound
+	}
+	after, limit, err := page(q.Cursor, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := ex.store.QueryTrades(store.TradeQuery{
+		Market:  string(q.Market),
+		AfterID: after,
+		From:    q.From,
+		To:      q.To,
+		Limit:   limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &TradesResponse{Trades: make([]Trade, len(records))}
+	for i, record := range records {
+		resp.Trades[i] = Trade{
+			ID:           record.ID,
+			Market:       q.Market,
+			Price:        record.Price,
+			Size:         record.Size,
+			Bid:          record.Bid,
+			MakerOrderID: record.MakerOrderID,
+			TakerOrderID: record.TakerOrderID,
+			Timestamp:    record.Timestamp,
+		}
+	}
+	if len(records) == limit {
+		resp.NextCursor = strconv.FormatUint(records[len(records)-1].ID, 10)
+	}
+
+	return resp, nil
+}
+
+// Fills returns a page of the fills of a user.
+func (ex *Exchange) Fills(userID int64, q TradeQuery) (*FillsResponse, error) {
+	if _, ok := ex.orderbooks[q.Market]; !ok && q.Market != "" {
+		return nil, ErrMarketNotFound
+	}
+	after, limit, err := page(q.Cursor, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := ex.store.UserTrades(store.UserTradeQuery{
+		UserID:   userID,
+		Market:   string(q.Market),
+		AfterSeq: after,
+		From:     q.From,
+		To:       q.To,
+		Limit:    limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &FillsResponse{Fills: []Fill{}}
+	for _, record := range records {
+		resp.Fills = append(resp.Fills, userFills(userID, record.Trade)...)
+	}
+	if len(records) == limit {
+		resp.NextCursor = strconv.FormatUint(records[len(records)-1].Seq, 10)
+	}
+
+	return resp, nil
+}
+
+// userFills returns the fills of the orders of a user in a trade, two for
+// a user who traded with himself.
+func userFills(userID int64, trade *store.Trade) []Fill {
+	fill := Fill{
+		TradeID:       trade.ID,
+		Market:        Market(trade.Market),
+		Price:         trade.Price,
+		Size:          trade.Size,
+		FeeAsset:      trade.FeeAsset,
+		SettlementTxs: trade.SettlementTxs,
+		Timestamp:     trade.Timestamp,
+	}
+
+	var fills []Fill
+	if trade.TakerUserID == userID {
+		taker := fill
+		taker.OrderID = trade.TakerOrderID
+		taker.Bid = trade.Bid
+		taker.Fee = trade.TakerFee
+		fills = append(fills, taker)
+	}
+	if trade.MakerUserID == userID {
+		maker := fill
+		maker.OrderID = trade.MakerOrderID
+		maker.Bid = !trade.Bid
+		maker.Maker = true
+		maker.Fee = trade.MakerFee
+		fills = append(fills, maker)
+	}
+	return fills
+}
+
+// tradeQuery reads the cursor, from, to and limit query parameters. Times
+// are in Unix nanoseconds or RFC 3339.
+func tradeQuery(c echo.Context) (TradeQuery, error) {
+	q := TradeQuery{
+		Market: Market(c.QueryParam("market")),
+		Cursor: c.QueryParam("cursor"),
+	}
+
+	var err error
+	if s := c.QueryParam("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return q, errors.New("invalid limit")
+		}
+	}
+	if q.From, err = parseTime(c.QueryParam("from")); err != nil {
+		return q, errors.New("invalid from time")
+	}
+	if q.To, err = parseTime(c.QueryParam("to")); err != nil {
+		return q, errors.New("invalid to time")
+	}
+
+	return q, nil
+}
+
+func parseTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if ns, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ns, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano(), nil
+}
+
+func (ex *Exchange) handleGetTrades(c echo.Context) error {
+	q, err := tradeQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	q.Market = Market(c.Param("market"))
+
+	trades, err := ex.TradeHistory(q)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, trades)
+}
+
+func (ex *Exchange) handleGetFills(c echo.Context) error {
+	q, err := tradeQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	userID, _ := authUserID(c)
+	fills, err := ex.Fills(userID, q)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, fills)
+}
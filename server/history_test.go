@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+)
+
+func TestTradeHistory(t *testing.T) {
+	chain := newTestChain(t, 2)
+	ex := newTestExchange(t, chain)
+	for i, key := range chain.keys {
+		user := &User{ID: int64(i + 1), PrivateKey: key, Address: crypto.PubkeyToAddress(key.PublicKey)}
+		if err := ex.registerUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Unix(1_700_000_000, 0)
+	var ask PlaceOrderResponse
+	ex.now = func() time.Time { return start }
+	decode(t, placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Size: 3, Price: 100, Market: MarketETH}), &ask)
+	for i := 1; i <= 3; i++ {
+		ex.now = func() time.Time { return start.Add(time.Duration(i) * time.Second) }
+		assert(t, placeOrder(t, ex, 2, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: 1, Market: MarketETH}).Code, http.StatusOK)
+	}
+
+	get := func(handler echo.HandlerFunc, userID int64, target string, v any) int {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)
+		c.Set(contextUserID, userID)
+		c.SetParamNames("market")
+		c.SetParamValues("ETH")
+		if err := handler(c); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code == http.StatusOK {
+			decode(t, rec, v)
+		}
+		return rec.Code
+	}
+
+	var page TradesResponse
+	assert(t, get(ex.handleGetTrades, 0, "/trades/ETH?limit=2", &page), http.StatusOK)
+	assert(t, len(page.Trades), 2)
+	assert(t, page.Trades[0].ID, uint64(1))
+	assert(t, page.Trades[0].MakerOrderID, ask.OrderID)
+	assert(t, page.Trades[0].Bid, true)
+	assert(t, page.NextCursor, "2")
+
+	cursor := page.NextCursor
+	page = TradesResponse{}
+	assert(t, get(ex.handleGetTrades, 0, "/trades/ETH?limit=2&cursor="+cursor, &page), http.StatusOK)
+	assert(t, len(page.Trades), 1)
+	assert(t, page.Trades[0].ID, uint64(3))
+	assert(t, page.NextCursor, "")
+
+	// Trades from the second up to the third second.
+	from := start.Add(2 * time.Second).Format(time.RFC3339)
+	assert(t, get(ex.handleGetTrades, 0, "/trades/ETH?from="+from+"&to="+start.Add(3*time.Second).Format(time.RFC3339), &page), http.StatusOK)
+	assert(t, len(page.Trades), 1)
+	assert(t, page.Trades[0].Timestamp, start.Add(2*time.Second).UnixNano())
+
+	assert(t, get(ex.handleGetTrades, 0, "/trades/ETH?cursor=nope", &page), http.StatusBadRequest)
+	assert(t, get(ex.handleGetTrades, 0, "/trades/ETH?limit=-1", &page), http.StatusBadRequest)
+
+	var fills FillsResponse
+	assert(t, get(ex.handleGetFills, 1, "/fills?market=ETH", &fills), http.StatusOK)
+	assert(t, len(fills.Fills), 3)
+	fill := fills.Fills[0]
+	assert(t, fill.TradeID, uint64(1))
+	assert(t, fill.OrderID, ask.OrderID)
+	assert(t, fill.Bid, false)
+	assert(t, fill.Maker, true)
+	assert(t, fill.FeeAsset, "ETH")
+	assert(t, len(fill.SettlementTxs), 1)
+
+	assert(t, get(ex.handleGetFills, 2, "/fills?limit=1&cursor=2", &fills), http.StatusOK)
+	assert(t, len(fills.Fills), 1)
+	assert(t, fills.Fills[0].TradeID, uint64(3))
+	assert(t, fills.Fills[0].Maker, false)
+	assert(t, fills.Fills[0].Bid, true)
+	assert(t, fills.NextCursor, "3")
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/journal"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+const (
+	CommandPlace  CommandType = "PLACE"
+	CommandCancel CommandType = "CANCEL"
+	CommandAmend  CommandType = "AMEND"
+	CommandExpire CommandType = "EXPIRE"
+	// CommandCancelAll cancels the orders OrderIDs of a user at once.
+	CommandCancelAll CommandType = "CANCEL_ALL"
+)
+
+type CommandType string
+
+// JournalEntry is a record of the journal of the exchange: a command it
+// accepted, or an event of a book resulting from the command before it.
+type JournalEntry struct {
+	Market  Market
+	Command *Command   `json:",omitempty"`
+	Event   *BookEvent `json:",omitempty"`
+}
+
+// Command is a change of a book. Time is when the exchange accepted it,
+// in Unix nanoseconds, and the time of the trades and orders it makes.
+// Placed orders have every field, cancelled and expired orders only their
+// ID, amended orders their new price and size, and cancel all commands the
+// IDs of the orders they cancel.
+type Command struct {
+	Type      CommandType
+	Time      int64
+	OrderID   int64
+	UserID    int64        `json:",omitempty"`
+	OrderType OrderType    `json:",omitempty"`
+	Bid       bool         `json:",omitempty"`
+	Price     float64      `json:",omitempty"`
+	Size      float64      `json:",omitempty"`
+	Signed    *SignedOrder `json:",omitempty"`
+	// ClientOrderID is the client order ID of a placed order.
+	ClientOrderID string `json:",omitempty"`
+	// OrderIDs are the orders of a cancel all command.
+	OrderIDs []int64 `json:",omitempty"`
+}
+
+// BookEvent is an orderbook.Event. Size is the size left of the order, or
+// the size filled by a match, whose taker is OrderID and maker MakerID.
+type BookEvent struct {
+	Type    orderbook.EventType
+	OrderID int64
+	UserID  int64
+	Bid     bool
+	Price   float64
+	Size    float64
+	MakerID int64 `json:",omitempty"`
+}
+
+// EnableJournal writes every command the exchange accepts, and the events
+// of the books resulting from it, to j. Commands are only run once they
+// are written.
+func (ex *Exchange) EnableJournal(j *journal.Journal) {
+	ex.journal = j
+}
+
+// execute runs a command on the book of a market once it is journaled.
+// validate, if not nil, is called first to reject the command against the
+// current book. The commands of a market run one at a time, so the journal
+// has them in the order they ran, followed by their events. The book runs
+// at the time of the command, so replaying it gives the same result. The
+// records of the events are stored once the command ran, and returned.
+func (ex *Exchange) execute(market Market, cmd *Command, validate func(ob *orderbook.Orderbook) error, run func(ob *orderbook.Orderbook)) (*store.Batch, error) {
+	state := ex.bookState(market)
+	state.Lock()
+	defer state.Unlock()
+
+	ob := ex.orderbooks[market]
+	if validate != nil {
+		if err := validate(ob); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ex.appendJournal(JournalEntry{Market: market, Command: cmd}); err != nil {
+		return nil, err
+	}
+
+	ob.SetClock(cmd.clock)
+	run(ob)
+	return ex.writeRecords(state), nil
+}
+
+func (cmd *Command) clock() int64 {
+	return cmd.Time
+}
+
+// ApplyCommand runs a journaled command on a book at the time of the
+// command, without the checks of the exchange or settling its matches.
+// Placed orders without an ID get the next ID of the book. It returns the
+// order of the command, and the matches of a market order.
+func ApplyCommand(ob *orderbook.Orderbook, cmd *Command) (*orderbook.Order, []orderbook.Match, error) {
+	ob.SetClock(cmd.clock)
+
+	if cmd.Type == CommandPlace {
+		if cmd.Size <= 0 {
+			return nil, nil, fmt.Errorf("%w: size must be positive", ErrInvalidOrder)
+		}
+
+		order := &orderbook.Order{
+			ID:        cmd.OrderID,
+			UserID:    cmd.UserID,
+			Size:      cmd.Size,
+			Bid:       cmd.Bid,
+			Timestamp: cmd.Time,
+		}
+		if cmd.OrderID == 0 {
+			order = ob.NewOrder(cmd.Bid, cmd.Size, cmd.UserID)
+		}
+
+		switch cmd.OrderType {
+		case LimitOrder:
+			ob.PlaceLimitOrder(cmd.Price, order)
+			return order, nil, nil
+		case MarketOrder:
+			if order.Size > bookVolume(ob, order.Bid, nil) {
+				return nil, nil, fmt.Errorf("%w: not enough volume", ErrInvalidOrder)
+			}
+			return order, ob.PlaceMarketOrder(order), nil
+		default:
+			return nil, nil, fmt.Errorf("%w: unknown type %q", ErrInvalidOrder, cmd.OrderType)
+		}
+	}
+
+	if cmd.Type == CommandCancelAll {
+		orders := make([]*orderbook.Order, len(cmd.OrderIDs))
+		for i, id := range cmd.OrderIDs {
+			order, ok := ob.Order(id)
+			if !ok || order.Limit == nil {
+				return nil, nil, fmt.Errorf("%w: %d", ErrOrderNotFound, id)
+			}
+			orders[i] = order
+		}
+		for _, order := range orders {
+			ob.CancelOrder(order)
+		}
+		return nil, nil, nil
+	}
+
+	order, ok := ob.Order(cmd.OrderID)
+	if !ok || order.Limit == nil {
+		return nil, nil, fmt.Errorf("%w: %d", ErrOrderNotFound, cmd.OrderID)
+	}
+
+	switch cmd.Type {
+	case CommandCancel:
+		ob.CancelOrder(order)
+	case CommandExpire:
+		ob.ExpireOrder(order)
+	case CommandAmend:
+		if cmd.Price <= 0 || cmd.Size <= 0 {
+			return nil, nil, fmt.Errorf("%w: price and size must be positive", ErrInvalidOrder)
+		}
+		ob.AmendOrder(order, cmd.Price, cmd.Size)
+	default:
+		return nil, nil, fmt.Errorf("unknown command %q", cmd.Type)
+	}
+	return order, nil, nil
+}
+
+// journalEvent writes an event of a book. It is called with the book
+// locked by execute.
+func (ex *Exchange) journalEvent(market Market, event orderbook.Event) {
+	e := &BookEvent{
+		Type:    event.Type,
+		OrderID: event.Order.ID,
+		UserID:  event.Order.UserID,
+		Bid:     event.Order.Bid,
+		Price:   event.Price,
+		Size:    event.Order.Size,
+	}
+	if event.Match != nil {
+		e.Size = event.Match.SizeFilled
+		e.MakerID = event.Match.Ask.ID
+		if event.Match.Ask == event.Order {
+			e.MakerID = event.Match.Bid.ID
+		}
+	}
+
+	// The command is journaled already, so its events can be derived
+	// again by replaying it.
+	if err := ex.appendJournal(JournalEntry{Market: market, Event: e}); err != nil {
+		logrus.WithField("event", e.Type).Errorf("journal: %v", err)
+	}
+}
+
+func (ex *Exchange) appendJournal(entry JournalEntry) error {
+	if ex.journal == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = ex.journal.Append(b)
+	return err
+}
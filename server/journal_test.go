@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/tahaontech/crypto_exchange/journal"
+)
+
+func TestJournal(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+	dir := t.TempDir()
+	j, err := journal.Open(dir, journal.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.EnableJournal(j)
+
+	var resp PlaceOrderResponse
+	decode(t, placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 2, Price: 100, Market: MarketETH}), &resp)
+	var taker PlaceOrderResponse
+	decode(t, placeOrder(t, ex, 2, PlaceOrderRequest{Type: MarketOrder, Size: 0.5, Market: MarketETH}), &taker)
+	if err := ex.AmendOrder(1, resp.OrderID, 99, 1); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, cancelOrder(t, ex, 1, resp.OrderID).Code, http.StatusOK)
+
+	// Rejected commands are not journaled.
+	assert(t, cancelOrder(t, ex, 1, resp.OrderID).Code, http.StatusNotFound)
+	assert(t, placeOrder(t, ex, 2, PlaceOrderRequest{Type: MarketOrder, Size: 1, Market: MarketETH}).Code, http.StatusBadRequest)
+
+	// Commands that can not be journaled are not run.
+	j.Close()
+	assert(t, placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 1, Price: 100, Market: MarketETH}).Code, http.StatusBadRequest)
+	assert(t, len(ex.orderbooks[MarketETH].Bids()), 0)
+
+	var entries []JournalEntry
+	err = journal.Read(dir, 1, func(seq uint64, data []byte) error {
+		var entry JournalEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := []string{}
+	for _, entry := range entries {
+		assert(t, entry.Market, MarketETH)
+		if entry.Command != nil {
+			types = append(types, string(entry.Command.Type))
+		} else {
+			types = append(types, string(entry.Event.Type))
+		}
+	}
+	assert(t, types, []string{"PLACE", "ACCEPTED", "PLACE", "ACCEPTED", "MATCH", "AMEND", "AMENDED", "CANCEL", "CANCELLED"})
+
+	assert(t, *entries[0].Command, Command{Type: CommandPlace, Time: entries[0].Command.Time, OrderID: resp.OrderID, UserID: 1, OrderType: LimitOrder, Bid: true, Price: 100, Size: 2})
+	assert(t, *entries[4].Event, BookEvent{Type: "MATCH", OrderID: taker.OrderID, UserID: 2, Price: 100, Size: 0.5, MakerID: resp.OrderID})
+	assert(t, *entries[5].Command, Command{Type: CommandAmend, Time: entries[5].Command.Time, OrderID: resp.OrderID, Price: 99, Size: 1})
+}
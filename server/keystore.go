@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/console/prompt"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	ErrNoKeystore = errors.New("no exchange keystore configured")
+	ErrDevKey     = errors.New("refusing to use a well-known development key outside of dev mode")
+)
+
+// devKeys are the private keys of the deterministic ganache (ganache -d)
+// and hardhat accounts. Anyone can take the funds of these accounts.
+var devKeys = []string{
+	"4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d",
+	"6cbed15c793ce57650b9877cf6fa156fbef513c4e6134f022a85b1ffdd59b2a1",
+	"6370fd033278c143179d81c5526140625662b8daa446c22ee2d73db3707e620c",
+	"646f1ce2fdad0e6deeeb5c7e8e5543bdde65e86029e2fd9fc169899c440a7913",
+	"add53f9a7e588d003326d1cbf9e4a43c061aadd9bc938c843a79e7b4fd2ad743",
+	"395df67f0c2d2d9fe1ad08d1bc8b6627011959b79c53d7dd6a3536a33ab8a4fd",
+	"e485d098507f54e7733a205420dfddbe58db035fa577fc294ebd14db90767a52",
+	"a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3",
+	"829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4",
+	"b0057716d5917badaf911b193b12b910811c1497b5bada8d7711f758981c3773",
+	"ac0974bec39a17e36ba4a6b4d238ff944bacb478cbed5efcae784d7bf4f2ff80",
+	"59c6995e998f97a5a0044966f0945389dc9e86dae88c7a8412f4603b6b78690d",
+}
+
+var devAddresses = func() map[common.Address]bool {
+	addresses := make(map[common.Address]bool)
+	for _, hex := range devKeys {
+		key, err := crypto.HexToECDSA(hex)
+		if err != nil {
+			panic(err)
+		}
+		addresses[crypto.PubkeyToAddress(key.PublicKey)] = true
+	}
+	return addresses
+}()
+
+// IsDevKey reports whether key is one of the well-known development keys.
+func IsDevKey(key *ecdsa.PrivateKey) bool {
+	return devAddresses[crypto.PubkeyToAddress(key.PublicKey)]
+}
+
+// LoadExchangeKey decrypts the exchange key from the keystore of cfg.
+func LoadExchangeKey(cfg Config) (*ecdsa.PrivateKey, error) {
+	if cfg.KeystorePath == "" {
+		if !cfg.Dev {
+			return nil, ErrNoKeystore
+		}
+		return crypto.HexToECDSA(devKeys[0])
+	}
+
+	keyJSON, err := os.ReadFile(cfg.KeystorePath)
+	if err != nil {
+		return nil, err
+	}
+
+	passphrase, err := readPassphrase(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := keystore.DecryptKey(keyJSON, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %w", cfg.KeystorePath, err)
+	}
+
+	if IsDevKey(key.PrivateKey) && !cfg.Dev {
+		return nil, ErrDevKey
+	}
+
+	return key.PrivateKey, nil
+}
+
+func readPassphrase(cfg Config) (string, error) {
+	if cfg.PasswordFile == "" {
+		return prompt.Stdin.PromptPassword(fmt.Sprintf("Passphrase for %s: ", cfg.KeystorePath))
+	}
+
+	b, err := os.ReadFile(cfg.PasswordFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func writeKeystore(t *testing.T, hexKey, passphrase string) Config {
+	t.Helper()
+
+	dir := t.TempDir()
+	ks := keystore.NewKeyStore(dir, keystore.LightScryptN, keystore.LightScryptP)
+	account, err := ks.ImportECDSA(mustKey(t, hexKey), passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte(passphrase+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return Config{KeystorePath: account.URL.Path, PasswordFile: passwordFile}
+}
+
+func TestLoadExchangeKey(t *testing.T) {
+	hexKey := "8a1f9a8f95be41cd7ccb6168179afb4504aefe388d1e14474d32c45c72ce7b7a"
+	cfg := writeKeystore(t, hexKey, "secret")
+
+	key, err := LoadExchangeKey(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, crypto.FromECDSA(key), crypto.FromECDSA(mustKey(t, hexKey)))
+
+	if err := os.WriteFile(cfg.PasswordFile, []byte("wrong"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadExchangeKey(cfg); !errors.Is(err, keystore.ErrDecrypt) {
+		t.Fatalf("expected decrypt error, got %v", err)
+	}
+
+	if _, err := LoadExchangeKey(Config{}); !errors.Is(err, ErrNoKeystore) {
+		t.Fatalf("expected no keystore error, got %v", err)
+	}
+}
+
+func TestLoadExchangeKeyRefusesDevKeys(t *testing.T) {
+	cfg := writeKeystore(t, devKeys[0], "secret")
+
+	if _, err := LoadExchangeKey(cfg); !errors.Is(err, ErrDevKey) {
+		t.Fatalf("expected dev key error, got %v", err)
+	}
+
+	cfg.Dev = true
+	key, err := LoadExchangeKey(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, IsDevKey(key), true)
+}
+
+func mustKey(t *testing.T, hexKey string) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := crypto.HexToECDSA(hexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
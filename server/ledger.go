@@ -0,0 +1,185 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// Ledger keeps the internal balances of the exchange users in base units
+// of each asset, keyed by asset symbol.
+type Ledger struct {
+	mu       sync.RWMutex
+	balances map[int64]map[string]*big.Int
+	onChange func(userID int64, asset string, balance *big.Int)
+	// records keeps the balances, which are written with every change.
+	records store.Store
+}
+
+// Entry is a change of the balance of a user by Amount, which is negative
+// for debits. A debit fails when the balance is too low, unless Owed is
+// set, which lets the balance go negative like Charge does.
+type Entry struct {
+	UserID int64
+	Asset  string
+	Amount *big.Int
+	Owed   bool
+}
+
+// balanceKey identifies a balance of the ledger.
+type balanceKey struct {
+	userID int64
+	asset  string
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{
+		balances: make(map[int64]map[string]*big.Int),
+	}
+}
+
+// OnChange sets a handler called with the new balance after every credit
+// and debit.
+func (l *Ledger) OnChange(handler func(userID int64, asset string, balance *big.Int)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.onChange = handler
+}
+
+// SetStore keeps the balances in records and loads the balances stored in
+// it. It has to be called before the first change.
+func (l *Ledger) SetStore(records store.Store) error {
+	stored, err := records.Balances()
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, record := range stored {
+		value, ok := new(big.Int).SetString(record.Value, 10)
+		if !ok {
+			return fmt.Errorf("invalid %s balance of user %d: %q", record.Asset, record.UserID, record.Value)
+		}
+		l.balance(record.UserID, record.Asset).Set(value)
+	}
+	l.records = records
+	return nil
+}
+
+func (l *Ledger) Credit(userID int64, asset string, amount *big.Int) error {
+	return l.Post(nil, Entry{UserID: userID, Asset: asset, Amount: amount})
+}
+
+// Debit takes amount from the balance of the user, failing without any
+// change when the balance is too low.
+func (l *Ledger) Debit(userID int64, asset string, amount *big.Int) error {
+	return l.Post(nil, Entry{UserID: userID, Asset: asset, Amount: new(big.Int).Neg(amount)})
+}
+
+// Charge takes amount from the balance of the user like Debit, but does
+// not fail on a low balance: what the balance lacks is owed, as a negative
+// balance that later credits pay back first.
+func (l *Ledger) Charge(userID int64, asset string, amount *big.Int) error {
+	return l.Post(nil, Entry{UserID: userID, Asset: asset, Amount: new(big.Int).Neg(amount), Owed: true})
+}
+
+// Post applies the entries at once, and writes the balances they changed
+// to the store in one write with the records of b, which may be nil.
+// Without a store b is not written. When a debit or the write fails,
+// nothing changes.
+func (l *Ledger) Post(b *store.Batch, entries ...Entry) error {
+	l.mu.Lock()
+
+	var (
+		keys     []balanceKey
+		balances = make(map[balanceKey]*big.Int)
+	)
+	for _, e := range entries {
+		k := balanceKey{userID: e.UserID, asset: e.Asset}
+		balance, ok := balances[k]
+		if !ok {
+			balance = new(big.Int).Set(l.balance(e.UserID, e.Asset))
+			balances[k] = balance
+			keys = append(keys, k)
+		}
+
+		if e.Amount.Sign() < 0 && !e.Owed && new(big.Int).Add(balance, e.Amount).Sign() < 0 {
+			l.mu.Unlock()
+			return fmt.Errorf("%w: user %d has %s %s, needs %s", ErrInsufficientFunds, e.UserID, balance, e.Asset, new(big.Int).Neg(e.Amount))
+		}
+		balance.Add(balance, e.Amount)
+	}
+
+	if l.records != nil {
+		records := store.Batch{}
+		if b != nil {
+			records = *b
+		}
+		for _, k := range keys {
+			records.Balances = append(records.Balances, &store.Balance{UserID: k.userID, Asset: k.asset, Value: balances[k].String()})
+		}
+		if err := l.records.Write(&records); err != nil {
+			l.mu.Unlock()
+			return err
+		}
+	}
+
+	for _, k := range keys {
+		l.balance(k.userID, k.asset).Set(balances[k])
+	}
+	handler := l.onChange
+	l.mu.Unlock()
+
+	if handler != nil {
+		for _, k := range keys {
+			handler(k.userID, k.asset, balances[k])
+		}
+	}
+	return nil
+}
+
+func (l *Ledger) Balance(userID int64, asset string) *big.Int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if b, ok := l.balances[userID][asset]; ok {
+		return new(big.Int).Set(b)
+	}
+	return new(big.Int)
+}
+
+// Balances returns a copy of all balances of the user.
+func (l *Ledger) Balances(userID int64) map[string]*big.Int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	balances := make(map[string]*big.Int)
+	for asset, b := range l.balances[userID] {
+		balances[asset] = new(big.Int).Set(b)
+	}
+	return balances
+}
+
+// balance must be called with the lock held.
+func (l *Ledger) balance(userID int64, asset string) *big.Int {
+	userBalances, ok := l.balances[userID]
+	if !ok {
+		userBalances = make(map[string]*big.Int)
+		l.balances[userID] = userBalances
+	}
+
+	b, ok := userBalances[asset]
+	if !ok {
+		b = new(big.Int)
+		userBalances[asset] = b
+	}
+	return b
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// ErrSendUnknown marks a transaction whose send failed in a way that does
+// not tell whether the node got it, like a timeout. It may still be mined.
+var ErrSendUnknown = errors.New("transaction may have been sent")
+
+// NonceManager signs and sends the transactions of a key. The nonce of a
+// transaction is taken and the transaction sent under one lock, so the
+// transactions sent with the key from several goroutines do not take the
+// same pending nonce. Every sender of a key has to share its manager.
+type NonceManager struct {
+	client ChainClient
+	key    *ecdsa.PrivateKey
+
+	mu sync.Mutex
+}
+
+func NewNonceManager(client ChainClient, key *ecdsa.PrivateKey) *NonceManager {
+	return &NonceManager{client: client, key: key}
+}
+
+func (m *NonceManager) Address() common.Address {
+	return crypto.PubkeyToAddress(m.key.PublicKey)
+}
+
+// Send builds a transaction with the next nonce of the key and sends it.
+// build gets transact options with the nonce set that sign without
+// sending, and returns the signed transaction. A send error that leaves
+// open whether the node got the transaction is wrapped in ErrSendUnknown
+// and returned with the transaction.
+func (m *NonceManager) Send(ctx context.Context, build func(opts *bind.TransactOpts) (*types.Transaction, error)) (*types.Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nonce, err := m.client.PendingNonceAt(ctx, m.Address())
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := bind.NewKeyedTransactorWithChainID(m.key, chainID)
+	if err != nil {
+		return nil, err
+	}
+	opts.Context = ctx
+	opts.Nonce = new(big.Int).SetUint64(nonce)
+	opts.NoSend = true
+
+	tx, err := build(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// A node refuses a transaction with an RPC error of its own. Any
+	// other error, like a timeout or a dropped connection, may come after
+	// the node got it.
+	var rpcErr rpc.Error
+	err = m.client.SendTransaction(ctx, tx)
+	switch {
+	case err == nil:
+		return tx, nil
+	case !errors.As(err, &rpcErr):
+		return tx, fmt.Errorf("%w: %v", ErrSendUnknown, err)
+	case strings.Contains(err.Error(), "already known"):
+		return tx, nil
+	default:
+		return nil, err
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// slowNonceChain is slow to return the pending nonce, so concurrent
+// senders read it before any of them sent its transaction.
+type slowNonceChain struct {
+	*testChain
+}
+
+func (c *slowNonceChain) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	nonce, err := c.testChain.PendingNonceAt(ctx, account)
+	time.Sleep(10 * time.Millisecond)
+	return nonce, err
+}
+
+func TestNonceManager(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		chain  = &slowNonceChain{testChain: newTestChain(t, 1)}
+		nonces = NewNonceManager(chain, chain.keys[0])
+		to     = common.Address{0xaa}
+		wg     sync.WaitGroup
+		errs   = make(chan error, 8)
+	)
+
+	// Transactions sent at once with the key take a nonce each.
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := transferETH(ctx, chain, nonces, to, AssetETH.ToBaseUnits(1))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert(t, err, nil)
+	}
+
+	chain.Commit()
+	balance, err := chain.BalanceAt(ctx, to, nil)
+	assert(t, err, nil)
+	assert(t, balance, AssetETH.ToBaseUnits(8))
+}
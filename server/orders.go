@@ -0,0 +1,223 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+var ErrInvalidStatus = errors.New("invalid order status")
+
+// orderTransitions are the statuses an order can move to from each open
+// status. Filled, cancelled, expired and rejected orders are final.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderAccepted:        {OrderPartiallyFilled, OrderFilled, OrderCancelled, OrderExpired, OrderAmended},
+	OrderPartiallyFilled: {OrderPartiallyFilled, OrderFilled, OrderCancelled, OrderExpired, OrderAmended},
+	OrderAmended:         {OrderPartiallyFilled, OrderFilled, OrderCancelled, OrderExpired, OrderAmended},
+}
+
+// Open reports whether an order with the status is still in the book.
+func (s OrderStatus) Open() bool {
+	_, ok := orderTransitions[s]
+	return ok
+}
+
+// canMoveTo reports whether an order with the status can move to status
+// to.
+func (s OrderStatus) canMoveTo(to OrderStatus) bool {
+	for _, status := range orderTransitions[s] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (s OrderStatus) valid() bool {
+	switch s {
+	case OrderAccepted, OrderPartiallyFilled, OrderFilled, OrderCancelled, OrderExpired, OrderRejected, OrderAmended:
+		return true
+	}
+	return false
+}
+
+// OrderState is the state of an order. OriginalSize is the size the order
+// was placed with, and Size its size after it was amended. AvgPrice is the
+// average price of its fills. Times are in Unix nanoseconds.
+type OrderState struct {
+	ID            int64
+	UserID        int64
+	Market        Market
+	Type          OrderType
+	Bid           bool
+	Price         float64
+	ClientOrderID string `json:",omitempty"`
+	Status        OrderStatus
+	OriginalSize  float64
+	Size          float64
+	Filled        float64
+	Remaining     float64
+	AvgPrice      float64
+	CreatedAt     int64
+	UpdatedAt     int64
+}
+
+// OrderQuery selects a page of the orders of a user, in a market and with
+// one of the statuses when they are not empty. Cursor and Limit page the
+// orders like those of a TradeQuery.
+type OrderQuery struct {
+	Market   Market
+	Statuses []OrderStatus
+	Cursor   string
+	Limit    int
+}
+
+// OrdersResponse is a page of the orders of a user, oldest first, like
+// TradesResponse.
+type OrdersResponse struct {
+	Orders     []OrderState
+	NextCursor string `json:",omitempty"`
+}
+
+func orderState(record *store.Order) OrderState {
+	state := OrderState{
+		ID:            record.ID,
+		UserID:        record.UserID,
+		Market:        Market(record.Market),
+		Type:          OrderType(record.Type),
+		Bid:           record.Bid,
+		Price:         record.Price,
+		ClientOrderID: record.ClientOrderID,
+		Status:        OrderStatus(record.Status),
+		OriginalSize:  record.OriginalSize,
+		Size:          record.Size,
+		Filled:        record.Filled,
+		AvgPrice:      record.AvgPrice,
+		CreatedAt:     record.CreatedAt,
+		UpdatedAt:     record.UpdatedAt,
+	}
+	if state.Status.Open() {
+		state.Remaining = record.Size - record.Filled
+	}
+	return state
+}
+
+// Order returns the state of an order of the user.
+func (ex *Exchange) Order(userID, id int64) (*OrderState, error) {
+	record, err := ex.store.Order(id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if record.UserID != userID {
+		return nil, ErrNotOrderOwner
+	}
+
+	state := orderState(record)
+	return &state, nil
+}
+
+// OrderHistory returns a page of the orders of a user.
+func (ex *Exchange) OrderHistory(userID int64, q OrderQuery) (*OrdersResponse, error) {
+	if _, ok := ex.orderbooks[q.Market]; !ok && q.Market != "" {
+		return nil, ErrMarketNotFound
+	}
+	after, limit, err := page(q.Cursor, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]string, len(q.Statuses))
+	for i, status := range q.Statuses {
+		if !status.valid() {
+			return nil, ErrInvalidStatus
+		}
+		statuses[i] = string(status)
+	}
+
+	records, err := ex.store.UserOrders(store.OrderQuery{
+		UserID:   userID,
+		Market:   string(q.Market),
+		Statuses: statuses,
+		AfterID:  int64(after),
+		Limit:    limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &OrdersResponse{Orders: make([]OrderState, len(records))}
+	for i, record := range records {
+		resp.Orders[i] = orderState(record)
+	}
+	if len(records) == limit {
+		resp.NextCursor = strconv.FormatInt(records[len(records)-1].ID, 10)
+	}
+
+	return resp, nil
+}
+
+// orderQuery reads the market, status, cursor and limit query parameters.
+// Status is a comma separated list of statuses, where "open" stands for
+// the statuses of the orders in the book.
+func orderQuery(c echo.Context) (OrderQuery, error) {
+	q := OrderQuery{
+		Market: Market(c.QueryParam("market")),
+		Cursor: c.QueryParam("cursor"),
+	}
+
+	if s := c.QueryParam("limit"); s != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return q, errors.New("invalid limit")
+		}
+	}
+	if s := c.QueryParam("status"); s != "" {
+		for _, status := range strings.Split(s, ",") {
+			status = strings.ToUpper(strings.TrimSpace(status))
+			if status == "OPEN" {
+				q.Statuses = append(q.Statuses, OrderAccepted, OrderPartiallyFilled, OrderAmended)
+				continue
+			}
+			q.Statuses = append(q.Statuses, OrderStatus(status))
+		}
+	}
+
+	return q, nil
+}
+
+func (ex *Exchange) handleGetOrder(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid order id"})
+	}
+
+	userID, _ := authUserID(c)
+	order, err := ex.Order(userID, id)
+	if err != nil {
+		return c.JSON(orderErrorStatus(err), APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+func (ex *Exchange) handleGetOrderHistory(c echo.Context) error {
+	q, err := orderQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	userID, _ := authUserID(c)
+	orders, err := ex.OrderHistory(userID, q)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, orders)
+}
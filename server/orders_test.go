@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+func TestOrderState(t *testing.T) {
+	chain := newTestChain(t, 2)
+	ex := newTestExchange(t, chain)
+	for i, key := range chain.keys {
+		user := &User{ID: int64(i + 1), PrivateKey: key, Address: crypto.PubkeyToAddress(key.PublicKey)}
+		if err := ex.registerUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ask1, ask2, taker PlaceOrderResponse
+	decode(t, placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 100, Market: MarketETH}), &ask1)
+	decode(t, placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Size: 2, Price: 103, Market: MarketETH}), &ask2)
+	decode(t, placeOrder(t, ex, 2, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: 2, Market: MarketETH}), &taker)
+
+	get := func(handler echo.HandlerFunc, userID int64, target, id string, v any) int {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)
+		c.Set(contextUserID, userID)
+		c.SetParamNames("id")
+		c.SetParamValues(id)
+		if err := handler(c); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code == http.StatusOK {
+			decode(t, rec, v)
+		}
+		return rec.Code
+	}
+	getOrder := func(userID, id int64) (OrderState, int) {
+		t.Helper()
+
+		var order OrderState
+		s := strconv.FormatInt(id, 10)
+		return order, get(ex.handleGetOrder, userID, "/orders/"+s, s, &order)
+	}
+
+	order, code := getOrder(2, taker.OrderID)
+	assert(t, code, http.StatusOK)
+	assert(t, order.Type, MarketOrder)
+	assert(t, order.Status, OrderFilled)
+	assert(t, order.Filled, 2.0)
+	assert(t, order.Remaining, 0.0)
+	assert(t, order.AvgPrice, 101.5)
+
+	order, code = getOrder(1, ask2.OrderID)
+	assert(t, code, http.StatusOK)
+	assert(t, order.Status, OrderPartiallyFilled)
+	assert(t, order.OriginalSize, 2.0)
+	assert(t, order.Filled, 1.0)
+	assert(t, order.Remaining, 1.0)
+	assert(t, order.AvgPrice, 103.0)
+	assert(t, order.CreatedAt != 0, true)
+
+	_, code = getOrder(2, ask2.OrderID)
+	assert(t, code, http.StatusForbidden)
+	_, code = getOrder(1, 999)
+	assert(t, code, http.StatusNotFound)
+
+	// Cancelled orders stay in the history.
+	if err := ex.CancelOrder(1, ask2.OrderID); err != nil {
+		t.Fatal(err)
+	}
+	order, _ = getOrder(1, ask2.OrderID)
+	assert(t, order.Status, OrderCancelled)
+	assert(t, order.Filled, 1.0)
+	assert(t, order.Remaining, 0.0)
+
+	var history OrdersResponse
+	assert(t, get(ex.handleGetOrderHistory, 1, "/orders", "", &history), http.StatusOK)
+	assert(t, len(history.Orders), 2)
+	assert(t, history.Orders[0].ID, ask1.OrderID)
+	assert(t, history.Orders[0].Status, OrderFilled)
+
+	history = OrdersResponse{}
+	assert(t, get(ex.handleGetOrderHistory, 1, "/orders?status=cancelled,expired&limit=1", "", &history), http.StatusOK)
+	assert(t, len(history.Orders), 1)
+	assert(t, history.Orders[0].ID, ask2.OrderID)
+	assert(t, history.NextCursor, strconv.FormatInt(ask2.OrderID, 10))
+
+	history = OrdersResponse{}
+	assert(t, get(ex.handleGetOrderHistory, 1, "/orders?status=open", "", &history), http.StatusOK)
+	assert(t, len(history.Orders), 0)
+	assert(t, get(ex.handleGetOrderHistory, 1, "/orders?status=GONE", "", &history), http.StatusBadRequest)
+
+	// Final statuses do not change.
+	record := &store.Order{ID: 1, Status: string(OrderFilled)}
+	setStatus(record, OrderCancelled)
+	assert(t, record.Status, string(OrderFilled))
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	HeaderRateLimitLimit     = "X-Ratelimit-Limit"
+	HeaderRateLimitRemaining = "X-Ratelimit-Remaining"
+)
+
+// sweepInterval is how often the rate limiters drop the state of keys that
+// went idle, so it does not grow with every IP and key ever seen.
+const sweepInterval = time.Minute
+
+type RateLimitConfig struct {
+	// OrderRate is the number of order entry requests per second of one
+	// API key, OrderBurst the bucket size.
+	OrderRate  float64
+	OrderBurst float64
+	// OrderIPRate and OrderIPBurst limit order entry per IP.
+	OrderIPRate  float64
+	OrderIPBurst float64
+	// MarketDataRate and MarketDataBurst limit market data requests per
+	// IP.
+	MarketDataRate  float64
+	MarketDataBurst float64
+
+	// An account that placed or cancelled at least MinOrders orders in
+	// RatioWindow is throttled until the end of the window if it has more
+	// than MaxOrderTradeRatio orders per trade.
+	MinOrders          int
+	MaxOrderTradeRatio float64
+	RatioWindow        time.Duration
+}
+
+var defaultRateLimitConfig = RateLimitConfig{
+	OrderRate:          10,
+	OrderBurst:         20,
+	OrderIPRate:        20,
+	OrderIPBurst:       40,
+	MarketDataRate:     20,
+	MarketDataBurst:    40,
+	MinOrders:          200,
+	MaxOrderTradeRatio: 50,
+	RatioWindow:        time.Minute,
+}
+
+// SetRateLimits replaces the rate limiters of the exchange, resetting all
+// buckets and counts.
+func (ex *Exchange) SetRateLimits(cfg RateLimitConfig) {
+	ex.orderLimiter = NewRateLimiter(cfg.OrderRate, cfg.OrderBurst)
+	ex.orderIPLimiter = NewRateLimiter(cfg.OrderIPRate, cfg.OrderIPBurst)
+	ex.marketDataLimiter = NewRateLimiter(cfg.MarketDataRate, cfg.MarketDataBurst)
+	ex.orderTradeRatio = NewOrderTradeRatio(cfg.MinOrders, cfg.MaxOrderTradeRatio, cfg.RatioWindow)
+}
+
+// SetTrustedProxies takes the client IP of requests from the X-Forwarded-For
+// header when they come through one of the proxies, given as IPs or CIDR
+// ranges. Without proxies the client IP is the peer address, as headers can
+// be set by anyone.
+func (ex *Exchange) SetTrustedProxies(proxies []string) error {
+	if len(proxies) == 0 {
+		ex.ipExtractor = echo.ExtractIPDirect()
+		return nil
+	}
+
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range proxies {
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			ipRange = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	ex.ipExtractor = echo.ExtractIPFromXFFHeader(options...)
+	return nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a set of token buckets, one per key, refilled at rate
+// tokens per second up to burst tokens.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(rate, burst float64) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   burst,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket of key. It returns the tokens left,
+// and when no token was available, how long until the next one is.
+func (l *RateLimiter) Allow(key string) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, 0, wait
+	}
+
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// sweep drops the buckets that refilled since they were last used, which
+// are the same as new ones. It must be called with the lock held.
+func (l *RateLimiter) sweep(now time.Time) {
+	if l.rate <= 0 || now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type orderTradeCounts struct {
+	start  time.Time
+	orders int
+	trades int
+}
+
+// OrderTradeRatio counts the orders and trades of every user in fixed
+// windows and throttles users with too many orders per trade.
+type OrderTradeRatio struct {
+	minOrders int
+	maxRatio  float64
+	window    time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	counts    map[int64]*orderTradeCounts
+	lastSweep time.Time
+}
+
+func NewOrderTradeRatio(minOrders int, maxRatio float64, window time.Duration) *OrderTradeRatio {
+	return &OrderTradeRatio{
+		minOrders: minOrders,
+		maxRatio:  maxRatio,
+		window:    window,
+		now:       time.Now,
+		counts:    make(map[int64]*orderTradeCounts),
+	}
+}
+
+// current must be called with the lock held. It drops the counts of
+// windows that ended.
+func (r *OrderTradeRatio) current(userID int64) *orderTradeCounts {
+	now := r.now()
+	if now.Sub(r.lastSweep) >= sweepInterval {
+		r.lastSweep = now
+		for id, c := range r.counts {
+			if now.Sub(c.start) >= r.window {
+				delete(r.counts, id)
+			}
+		}
+	}
+
+	c, ok := r.counts[userID]
+	if !ok || now.Sub(c.start) >= r.window {
+		c = &orderTradeCounts{start: now}
+		r.counts[userID] = c
+	}
+	return c
+}
+
+func (r *OrderTradeRatio) RecordOrder(userID int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.current(userID).orders++
+}
+
+func (r *OrderTradeRatio) RecordTrade(userID int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.current(userID).trades++
+}
+
+// Allow reports whether the user may enter orders, and if not, how long
+// until their window ends.
+func (r *OrderTradeRatio) Allow(userID int64) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := r.current(userID)
+	if c.orders < r.minOrders {
+		return true, 0
+	}
+	if float64(c.orders)/math.Max(1, float64(c.trades)) <= r.maxRatio {
+		return true, 0
+	}
+
+	return false, c.start.Add(r.window).Sub(r.now())
+}
+
+// limitMarketData is a middleware that rate limits market data requests
+// per IP.
+func (ex *Exchange) limitMarketData(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if ok, retryAfter := checkRateLimit(c, ex.marketDataLimiter, "ip:"+c.RealIP()); !ok {
+			return tooManyRequests(c, retryAfter, "rate limit exceeded")
+		}
+		return next(c)
+	}
+}
+
+// limitOrderEntry is a middleware, to be used after authenticate, that
+// rate limits order entry per API key and per IP, and throttles accounts
+// with a bad order-to-trade ratio. Successful requests count as orders.
+func (ex *Exchange) limitOrderEntry(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, _ := authUserID(c)
+
+		if ok, retryAfter := checkRateLimit(c, ex.orderIPLimiter, "ip:"+c.RealIP()); !ok {
+			return tooManyRequests(c, retryAfter, "rate limit exceeded")
+		}
+		if ok, retryAfter := checkRateLimit(c, ex.orderLimiter, authKey(c)); !ok {
+			return tooManyRequests(c, retryAfter, "rate limit exceeded")
+		}
+
+		if ok, retryAfter := ex.orderTradeRatio.Allow(userID); !ok {
+			return tooManyRequests(c, retryAfter, "too many orders per trade")
+		}
+
+		if err := next(c); err != nil {
+			return err
+		}
+
+		if c.Response().Status < http.StatusBadRequest {
+			ex.orderTradeRatio.RecordOrder(userID)
+		}
+		return nil
+	}
+}
+
+// checkRateLimit takes a token from the bucket of key and sets the rate
+// limit headers.
+func checkRateLimit(c echo.Context, limiter *RateLimiter, key string) (bool, time.Duration) {
+	ok, remaining, retryAfter := limiter.Allow(key)
+
+	header := c.Response().Header()
+	header.Set(HeaderRateLimitLimit, strconv.Itoa(int(limiter.burst)))
+	header.Set(HeaderRateLimitRemaining, strconv.Itoa(remaining))
+
+	return ok, retryAfter
+}
+
+func tooManyRequests(c echo.Context, retryAfter time.Duration, msg string) error {
+	seconds := retryAfterSeconds(retryAfter)
+
+	c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(seconds))
+	return c.JSON(http.StatusTooManyRequests, APIError{Error: fmt.Sprintf("%s, retry after %ds", msg, seconds)})
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds, at least one.
+func retryAfterSeconds(retryAfter time.Duration) int {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	for i := 2; i >= 0; i-- {
+		ok, remaining, _ := limiter.Allow("a")
+		assert(t, ok, true)
+		assert(t, remaining, i)
+	}
+
+	ok, _, retryAfter := limiter.Allow("a")
+	assert(t, ok, false)
+	assert(t, retryAfter, 500*time.Millisecond)
+
+	// Other keys have their own bucket.
+	ok, _, _ = limiter.Allow("b")
+	assert(t, ok, true)
+
+	now = now.Add(retryAfter)
+	ok, _, _ = limiter.Allow("a")
+	assert(t, ok, true)
+
+	// Buckets that refilled are dropped.
+	now = now.Add(sweepInterval)
+	limiter.Allow("c")
+	assert(t, len(limiter.buckets), 1)
+}
+
+func TestOrderTradeRatio(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ratio := NewOrderTradeRatio(10, 4, time.Minute)
+	ratio.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		ratio.RecordOrder(1)
+	}
+	ratio.RecordTrade(1)
+	ratio.RecordTrade(1)
+
+	ok, _ := ratio.Allow(1)
+	assert(t, ok, false)
+
+	ratio.RecordTrade(1)
+	ok, _ = ratio.Allow(1)
+	assert(t, ok, true)
+
+	for i := 0; i < 10; i++ {
+		ratio.RecordOrder(1)
+	}
+	now = now.Add(20 * time.Second)
+	ok, retryAfter := ratio.Allow(1)
+	assert(t, ok, false)
+	assert(t, retryAfter, 40*time.Second)
+
+	now = now.Add(retryAfter)
+	ok, _ = ratio.Allow(1)
+	assert(t, ok, true)
+
+	// The counts of windows that ended are dropped.
+	now = now.Add(sweepInterval)
+	ratio.RecordOrder(2)
+	assert(t, len(ratio.counts), 1)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+	ex.SetRateLimits(RateLimitConfig{
+		OrderRate:          1,
+		OrderBurst:         2,
+		OrderIPRate:        100,
+		OrderIPBurst:       100,
+		MarketDataRate:     1,
+		MarketDataBurst:    1,
+		MinOrders:          100,
+		MaxOrderTradeRatio: 1,
+		RatioWindow:        time.Minute,
+	})
+
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	key, err := ex.apiKeys.Create(1, AllScopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := `{"Type":"LIMIT","Bid":true,"Size":1,"Price":100,"Market":"ETH"}`
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, signedRequest(key, http.MethodPost, "/order", order, strconv.Itoa(i), time.Now()))
+
+		if i < 2 {
+			assert(t, rec.Code, http.StatusOK)
+			assert(t, rec.Header().Get(HeaderRateLimitLimit), "2")
+			assert(t, rec.Header().Get(HeaderRateLimitRemaining), strconv.Itoa(1-i))
+			continue
+		}
+		assert(t, rec.Code, http.StatusTooManyRequests)
+		assert(t, rec.Header().Get(echo.HeaderRetryAfter), "1")
+	}
+
+	// Market data has its own bucket.
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/book/ETH", nil))
+	assert(t, rec.Code, http.StatusOK)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/book/ETH", nil))
+	assert(t, rec.Code, http.StatusTooManyRequests)
+
+	// Forwarded addresses are only trusted from the configured proxies.
+	spoofed := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/book/ETH", nil)
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+		req.Header.Set(echo.HeaderXRealIP, "203.0.113.7")
+		return req
+	}
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, spoofed())
+	assert(t, rec.Code, http.StatusTooManyRequests)
+
+	assert(t, ex.SetTrustedProxies([]string{"proxy"}) != nil, true)
+	assert(t, ex.SetTrustedProxies([]string{"192.0.2.0/24"}), nil)
+	e = echo.New()
+	ex.registerRoutes(e)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, spoofed())
+	assert(t, rec.Code, http.StatusOK)
+}
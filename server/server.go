@@ -4,20 +4,26 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/journal"
 	"github.com/tahaontech/crypto_exchange/orderbook"
+	"github.com/tahaontech/crypto_exchange/store"
 )
 
 const (
@@ -26,9 +32,17 @@ const (
 	MarketOrder OrderType = "MARKET"
 	LimitOrder  OrderType = "LIMIT"
 
-	exchangePrivateKey = "4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d"
+	depositConfirmations = 3
 )
 
+var defaultWithdrawalConfig = WithdrawalConfig{
+	DailyLimits:        map[string]float64{"ETH": 100},
+	ApprovalThresholds: map[string]float64{"ETH": 10},
+}
+
+// chainID is the chain ID of ganache and of the go-ethereum simulated backend.
+var chainID = big.NewInt(1337)
+
 type (
 	OrderType string
 	Market    string
@@ -40,17 +54,28 @@ type (
 		Size   float64
 		Price  float64
 		Market Market
+		// Signed is the order signed by the user, required when the
+		// exchange settles in escrow or requires signed orders.
+		Signed *SignedOrder
+		// ClientOrderID optionally names the order for its user, see
+		// Exchange.PlaceOrder.
+		ClientOrderID string `json:",omitempty"`
 	}
 
 	Order struct {
-		UserID    int64
+		UserID    int64 `json:",omitempty"`
 		ID        int64
 		Price     float64
 		Size      float64
 		Bid       bool
 		Timestamp int64
+		// Signed is the order as signed by the user, if it was.
+		Signed        *SignedOrder
+		ClientOrderID string `json:",omitempty"`
 	}
 
+	// OrderbookData is the L3 view of a market. Its orders have no UserID,
+	// so it does not tell who quotes.
 	OrderbookData struct {
 		TotalBidVolume float64
 		TotalAskVolume float64
@@ -70,251 +95,517 @@ type (
 	}
 )
 
-func StartServer() {
+var (
+	ErrMarketNotFound = errors.New("market not found")
+	ErrUserNotFound   = errors.New("user not found")
+	ErrInvalidOrder   = errors.New("invalid order")
+	ErrOrderNotFound  = errors.New("order not found")
+	ErrNotOrderOwner  = errors.New("order belongs to another user")
+)
+
+func StartServer(cfg Config) {
 	e := echo.New()
 	e.HTTPErrorHandler = httpErrorHandler
 
+	privateKey, err := LoadExchangeKey(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Dev {
+		logrus.Warn("running in dev mode, do not use with real funds")
+	}
+
 	client, err := ethclient.Dial("http://localhost:8545")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	ex, err := NewExchange(exchangePrivateKey, client)
+	ex, err := NewExchange(privateKey, client)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if cfg.SignedOrders {
+		ex.RequireSignedOrders()
+	}
+	if cfg.OperatorToken != "" {
+		if err := ex.SetOperatorToken(cfg.OperatorToken); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		logrus.Warn("no operator token, withdrawals held for approval can not be approved")
+	}
+	if err := ex.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.StorePath != "" {
+		s, err := store.OpenBolt(cfg.StorePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ex.EnableStore(s); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.JournalDir != "" {
+		j, err := journal.Open(cfg.JournalDir, journal.Config{Sync: cfg.JournalSync})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ex.Recover(cfg.JournalDir); err != nil {
+			log.Fatal(err)
+		}
+		ex.EnableJournal(j)
 
-	ex.registerUser("829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", 8)
-	ex.registerUser("a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", 7)
-	ex.registerUser("e485d098507f54e7733a205420dfddbe58db035fa577fc294ebd14db90767a52", 666)
+		interval := cfg.SnapshotInterval
+		if interval == 0 {
+			interval = defaultSnapshotInterval
+		}
+		go ex.RunSnapshots(context.Background(), cfg.JournalDir, interval)
+	}
 
-	e.POST("/order", ex.handlePlaceOrder)
+	if address := os.Getenv("EXCHANGE_ESCROW_ADDRESS"); address != "" {
+		settler, err := NewEscrowSettler(client, common.HexToAddress(address), ex.PrivateKey, EscrowConfig{Nonces: ex.nonces})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ex.EnableEscrow(settler); err != nil {
+			log.Fatal(err)
+		}
+		go settler.Run(context.Background())
+	}
+
+	go ex.deposits.Run(context.Background())
+	go ex.withdrawals.Run(context.Background())
+	go ex.RunExpiry(context.Background(), time.Second)
 
-	e.GET("/trades/:market", ex.handleGetTrades)
-	e.GET("/order/:userID", ex.handleGetOrders)
-	e.GET("/book/:market", ex.handleGetBook)
-	e.GET("/book/:market/bid", ex.handleGetBestBid)
-	e.GET("/book/:market/ask", ex.handleGetBestAsk)
+	for _, gateway := range cfg.Gateways {
+		go func(gateway func(*Exchange) error) {
+			if err := gateway(ex); err != nil {
+				log.Fatal(err)
+			}
+		}(gateway)
+	}
 
-	e.DELETE("/order/:id", ex.cancelOrder)
+	ex.registerRoutes(e)
 
 	e.Start(":3000")
 }
 
+// registerRoutes adds the API of the exchange to e. The client IP of e is
+// the one the exchange trusts, so it can not be spoofed with headers.
+func (ex *Exchange) registerRoutes(e *echo.Echo) {
+	e.IPExtractor = ex.ipExtractor
+
+	var (
+		read       = []echo.MiddlewareFunc{ex.authenticate, requireScope(ScopeRead)}
+		trade      = []echo.MiddlewareFunc{ex.authenticate, requireScope(ScopeTrade), ex.limitOrderEntry}
+		withdraw   = []echo.MiddlewareFunc{ex.authenticate, requireScope(ScopeWithdraw)}
+		marketData = ex.limitMarketData
+	)
+
+	e.POST("/users", ex.handleRegisterUser)
+	e.POST("/auth/challenge", ex.handleChallenge)
+	e.POST("/auth/login", ex.handleLogin)
+	e.POST("/order", ex.handlePlaceOrder, trade...)
+
+	e.GET("/trades/:market", ex.handleGetTrades, marketData)
+	e.GET("/order/:userID", ex.handleGetOrders, read...)
+	e.GET("/fills", ex.handleGetFills, read...)
+	e.GET("/orders", ex.handleGetOrderHistory, read...)
+	e.GET("/orders/:id", ex.handleGetOrder, read...)
+	e.GET("/orders/client/:clientOrderID", ex.handleGetClientOrder, read...)
+	e.GET("/book/:market", ex.handleGetBook, marketData)
+	e.GET("/depth/:market", ex.handleGetDepth, marketData)
+	e.GET("/book/:market/bid", ex.handleGetBestBid, marketData)
+	e.GET("/book/:market/ask", ex.handleGetBestAsk, marketData)
+	e.GET("/ws", ex.handleWebSocket, marketData)
+	e.GET("/deposits/:userID", ex.handleGetDeposits, read...)
+	e.GET("/withdrawals/:userID", ex.handleGetWithdrawals, read...)
+	e.GET("/withdrawal/:id", ex.handleGetWithdrawal, read...)
+
+	e.GET("/apikeys", ex.handleGetAPIKeys, read...)
+	e.POST("/apikeys", ex.handleCreateAPIKey, ex.authenticate)
+	e.DELETE("/apikeys/:key", ex.handleRevokeAPIKey, ex.authenticate)
+
+	e.POST("/withdrawals", ex.handleRequestWithdrawal, withdraw...)
+	e.POST("/withdrawal/:id/approve", ex.handleApproveWithdrawal, ex.requireOperator)
+	e.POST("/withdrawal/:id/reject", ex.handleRejectWithdrawal, ex.requireOperator)
+
+	e.PUT("/order/:id", ex.amendOrder, trade...)
+	e.PUT("/order/client/:clientOrderID", ex.amendClientOrder, trade...)
+	e.DELETE("/order/:id", ex.cancelOrder, trade...)
+	e.DELETE("/order/client/:clientOrderID", ex.cancelClientOrder, trade...)
+	e.DELETE("/orders", ex.handleCancelAll, trade...)
+}
+
 type User struct {
 	ID         int64
 	PrivateKey *ecdsa.PrivateKey
+	Address    common.Address
+	// DepositAddress is where the user sends funds to credit their balance.
+	DepositAddress common.Address
 }
 
-func NewUser(privKey string, id int64) *User {
+func NewUser(privKey string, id int64) (*User, error) {
 	pk, err := crypto.HexToECDSA(privKey)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	return &User{
 		ID:         id,
 		PrivateKey: pk,
-	}
+		Address:    crypto.PubkeyToAddress(pk.PublicKey),
+	}, nil
 }
 
 func httpErrorHandler(err error, c echo.Context) {
 	fmt.Println(err)
 }
 
+// ChainClient is the part of ethclient.Client the exchange uses. It is an
+// interface so tests can run against a simulated backend.
+type ChainClient interface {
+	bind.ContractBackend
+	bind.DeployBackend
+	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+}
+
+// MarketConfig describes what is settled when orders on a market match.
+// The base asset goes from the seller to the buyer and the quote asset
+// (size * price) from the buyer to the seller. Quote may be nil for
+// markets that only settle the base asset.
+type MarketConfig struct {
+	Base  *Asset
+	Quote *Asset
+	// MakerFee and TakerFee are the fees of a fill as a fraction of its
+	// quote amount, or of its size on markets without a quote asset. They
+	// are charged from the ledger balances of the users.
+	MakerFee float64
+	TakerFee float64
+}
+
 type Exchange struct {
-	Client *ethclient.Client
+	Client ChainClient
 	mu     sync.RWMutex
 	Users  map[int64]*User
+	// nextUserID is the last ID assigned to a user that registered
+	// without one.
+	nextUserID    int64
+	userAddresses map[common.Address]int64
 	// Orders maps a user to his orders.
 	Orders     map[int64][]*orderbook.Order
 	PrivateKey *ecdsa.PrivateKey
-	orderbooks map[Market]*orderbook.Orderbook
+	// nonces sends every transaction signed with the exchange key:
+	// withdrawals, token settlements, escrow settlements and the gas of
+	// token sweeps.
+	nonces      *NonceManager
+	orderbooks  map[Market]*orderbook.Orderbook
+	markets     map[Market]MarketConfig
+	Ledger      *Ledger
+	deposits    *DepositWatcher
+	withdrawals *Withdrawals
+	apiKeys     *APIKeys
+	sessions    *Sessions
+	// operatorToken authenticates the operator, who approves and rejects
+	// withdrawals. They can not be approved over HTTP when it is empty.
+	operatorToken string
+	// orderLimiter, orderIPLimiter and marketDataLimiter rate limit
+	// order entry per API key and per IP, and market data per IP.
+	orderLimiter      *RateLimiter
+	orderIPLimiter    *RateLimiter
+	marketDataLimiter *RateLimiter
+	orderTradeRatio   *OrderTradeRatio
+	// ipExtractor is the client IP the API is rate limited by: the peer
+	// address, or the X-Forwarded-For address of a trusted proxy.
+	ipExtractor echo.IPExtractor
+	// feeds publish the market data of every orderbook to websocket
+	// clients.
+	feeds      map[Market]*marketFeed
+	userFeeds  *userFeeds
+	wsConfig   WSConfig
+	settlement SettlementMode
+	escrow     *EscrowSettler
+	// requireSignedOrders rejects orders that are not signed by their
+	// user. It is always on in escrow settlement mode.
+	requireSignedOrders bool
+	// orderAuthKeys maps the ID of an open order to the credentials it was
+	// placed with.
+	orderAuthKeys map[int64]string
+	// signedOrders maps an order ID to the order signed by the user.
+	signedOrders map[int64]*SignedOrder
+	// clientOrders maps the client order IDs of every user to their
+	// orders, and clientOrderIDs the ID of an open order to its client
+	// order ID.
+	clientOrders   map[int64]map[string]clientOrder
+	clientOrderIDs map[int64]string
+	// journal, if enabled, records the commands run on the books, which
+	// bookStates serialize per market.
+	journal    *journal.Journal
+	bookStates map[Market]*bookState
+	// store keeps the users and the history of orders, trades and
+	// settlements.
+	store store.Store
+	// lastOrderID is the last ID assigned to an order.
+	lastOrderID int64
+	// now is the time of the commands run on the books.
+	now func() time.Time
+	// orderNonces holds the used nonces of the signed orders of every
+	// address.
+	orderNonces map[common.Address]map[string]bool
 }
 
-func NewExchange(privateKey string, client *ethclient.Client) (*Exchange, error) {
+func NewExchange(pk *ecdsa.PrivateKey, client ChainClient) (*Exchange, error) {
 	orderbooks := make(map[Market]*orderbook.Orderbook)
 	orderbooks[MarketETH] = orderbook.NewOrderbook()
 
-	pk, err := crypto.HexToECDSA(privateKey)
+	markets := make(map[Market]MarketConfig)
+	markets[MarketETH] = MarketConfig{Base: AssetETH}
+
+	sessions, err := NewSessions()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Exchange{
-		Client:     client,
-		Users:      make(map[int64]*User),
-		Orders:     make(map[int64][]*orderbook.Order),
-		PrivateKey: pk,
-		orderbooks: orderbooks,
-	}, nil
+	ledger := NewLedger()
+	nonces := NewNonceManager(client, pk)
+	deposits := NewDepositWatcher(client, ledger, DepositWatcherConfig{
+		Confirmations: depositConfirmations,
+		SweepKey:      pk,
+		Nonces:        nonces,
+	})
+
+	ex := &Exchange{
+		Client:         client,
+		Users:          make(map[int64]*User),
+		userAddresses:  make(map[common.Address]int64),
+		Orders:         make(map[int64][]*orderbook.Order),
+		PrivateKey:     pk,
+		nonces:         nonces,
+		orderbooks:     orderbooks,
+		markets:        markets,
+		Ledger:         ledger,
+		deposits:       deposits,
+		withdrawals:    NewWithdrawals(client, ledger, nonces, defaultWithdrawalConfig),
+		apiKeys:        NewAPIKeys(),
+		sessions:       sessions,
+		feeds:          map[Market]*marketFeed{MarketETH: newMarketFeed(MarketETH, orderbooks[MarketETH])},
+		userFeeds:      newUserFeeds(),
+		wsConfig:       defaultWSConfig,
+		settlement:     SettlementDirect,
+		orderAuthKeys:  make(map[int64]string),
+		signedOrders:   make(map[int64]*SignedOrder),
+		bookStates:     make(map[Market]*bookState),
+		clientOrders:   make(map[int64]map[string]clientOrder),
+		clientOrderIDs: make(map[int64]string),
+		store:          store.NewMemory(),
+		orderNonces:    make(map[common.Address]map[string]bool),
+		now:            time.Now,
+		ipExtractor:    echo.ExtractIPDirect(),
+	}
+	ex.apiKeys.save = ex.saveAPIKey
+	ex.SetRateLimits(defaultRateLimitConfig)
+	orderbooks[MarketETH].SetTradeLimit(recentTrades)
+	ex.watchOrderbook(MarketETH, orderbooks[MarketETH])
+	ledger.OnChange(ex.publishBalance)
+
+	return ex, nil
 }
 
-type GetOrdersResponse struct {
-	Asks []Order
-	Bids []Order
+// RequireSignedOrders makes every order carry an EIP-712 signature of its
+// user. Signed orders are verified even when they are not required.
+func (ex *Exchange) RequireSignedOrders() {
+	ex.requireSignedOrders = true
 }
 
-func (ex *Exchange) registerUser(pk string, userId int64) {
-	user := NewUser(pk, userId)
-	ex.Users[userId] = user
+// EnableEscrow switches the exchange to escrow settlement. Orders then
+// have to be signed by their users, and matches are settled in batches by
+// the settler instead of with transfers. The settler keeps its fills in
+// the store of the exchange, and settles the ones stored in it.
+func (ex *Exchange) EnableEscrow(settler *EscrowSettler) error {
+	if err := settler.SetStore(ex.store); err != nil {
+		return err
+	}
+	ex.settlement = SettlementEscrow
+	ex.escrow = settler
+	ex.requireSignedOrders = true
+	return nil
+}
 
-	logrus.WithFields(logrus.Fields{
-		"id": userId,
-	}).Info("new exchange user")
+// AddMarket opens a new market settling the given assets. ERC-20 assets
+// are settled with transferFrom by the exchange, so users have to approve
+// the exchange address for the tokens they sell.
+func (ex *Exchange) AddMarket(market Market, cfg MarketConfig) error {
+	if _, ok := ex.orderbooks[market]; ok {
+		return fmt.Errorf("market already exists: %s", market)
+	}
+	if cfg.Base == nil {
+		return fmt.Errorf("market %s has no base asset", market)
+	}
+
+	ex.orderbooks[market] = orderbook.NewOrderbook()
+	ex.orderbooks[market].SetTradeLimit(recentTrades)
+	ex.markets[market] = cfg
+	ex.feeds[market] = newMarketFeed(market, ex.orderbooks[market])
+	ex.watchOrderbook(market, ex.orderbooks[market])
+
+	for _, asset := range []*Asset{cfg.Base, cfg.Quote} {
+		if asset != nil && !asset.IsNative() {
+			ex.deposits.AddToken(asset)
+		}
+	}
+
+	return nil
 }
 
-func (ex *Exchange) handleGetTrades(c echo.Context) error {
-	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
-	if !ok {
-		return c.JSON(http.StatusBadRequest, APIError{Error: "orderbook not found"})
+// asset looks up an asset traded on any market by its symbol.
+func (ex *Exchange) asset(symbol string) (*Asset, bool) {
+	for _, cfg := range ex.markets {
+		if cfg.Base.Symbol == symbol {
+			return cfg.Base, true
+		}
+		if cfg.Quote != nil && cfg.Quote.Symbol == symbol {
+			return cfg.Quote, true
+		}
 	}
+	return nil, false
+}
 
-	return c.JSON(http.StatusOK, ob.Trades)
+type GetOrdersResponse struct {
+	Asks []Order
+	Bids []Order
 }
 
 func (ex *Exchange) handleGetOrders(c echo.Context) error {
 	userIDStr := c.Param("userID")
 	userID, err := strconv.Atoi(userIDStr)
 	if err != nil {
-		return err
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+	if !isOwner(c, int64(userID)) {
+		return c.JSON(http.StatusForbidden, APIError{Error: "can not query the orders of another user"})
 	}
 
-	ex.mu.RLock()
-	orderbookOrders := ex.Orders[int64(userID)]
-	ordersResp := &GetOrdersResponse{
-		Asks: []Order{},
-		Bids: []Order{},
+	return c.JSON(http.StatusOK, ex.UserOrders(int64(userID)))
+}
+
+func (ex *Exchange) handleGetBook(c echo.Context) error {
+	book, err := ex.Book(Market(c.Param("market")))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
 	}
 
-	for i := 0; i < len(orderbookOrders); i++ {
-		// It could be that the order is getting filled even though its included in this
-		// response. We must double check if the limit is not nil
-		if orderbookOrders[i].Limit == nil {
-			continue
-		}
+	return c.JSON(http.StatusOK, book)
+}
 
-		order := Order{
-			ID:        orderbookOrders[i].ID,
-			UserID:    orderbookOrders[i].UserID,
-			Price:     orderbookOrders[i].Limit.Price,
-			Size:      orderbookOrders[i].Size,
-			Timestamp: orderbookOrders[i].Timestamp,
-			Bid:       orderbookOrders[i].Bid,
-		}
+type PriceResponse struct {
+	Price float64
+}
 
-		if order.Bid {
-			ordersResp.Bids = append(ordersResp.Bids, order)
-		} else {
-			ordersResp.Asks = append(ordersResp.Asks, order)
-		}
+func (ex *Exchange) handleGetBestBid(c echo.Context) error {
+	order, err := ex.BestBid(Market(c.Param("market")))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
 	}
-	ex.mu.RUnlock()
 
-	return c.JSON(http.StatusOK, ordersResp)
+	return c.JSON(http.StatusOK, order)
 }
 
-func (ex *Exchange) handleGetBook(c echo.Context) error {
-	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
-	if !ok {
-		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "market not found"})
+func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
+	order, err := ex.BestAsk(Market(c.Param("market")))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
 	}
 
-	orderbookData := OrderbookData{
-		TotalBidVolume: ob.BidTotalVolume(),
-		TotalAskVolume: ob.AskTotalVolume(),
-		Asks:           []*Order{},
-		Bids:           []*Order{},
-	}
+	return c.JSON(http.StatusOK, order)
+}
 
-	for _, limit := range ob.Asks() {
-		for _, order := range limit.Orders {
-			o := Order{
-				UserID:    order.UserID,
-				ID:        order.ID,
-				Price:     limit.Price,
-				Size:      order.Size,
-				Bid:       order.Bid,
-				Timestamp: order.Timestamp,
-			}
-			orderbookData.Asks = append(orderbookData.Asks, &o)
-		}
+func (ex *Exchange) cancelOrder(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid order id"})
 	}
 
-	for _, limit := range ob.Bids() {
-		for _, order := range limit.Orders {
-			o := Order{
-				UserID:    order.UserID,
-				ID:        order.ID,
-				Price:     limit.Price,
-				Size:      order.Size,
-				Bid:       order.Bid,
-				Timestamp: order.Timestamp,
-			}
-			orderbookData.Bids = append(orderbookData.Bids, &o)
-		}
+	userID, _ := authUserID(c)
+	if err := ex.CancelOrder(userID, id); err != nil {
+		return c.JSON(orderErrorStatus(err), APIError{Error: err.Error()})
 	}
 
-	return c.JSON(http.StatusOK, orderbookData)
+	return c.JSON(200, map[string]any{"msg": "order deleted"})
 }
 
-type PriceResponse struct {
+// AmendOrderRequest is the new price and size of an amended order.
+type AmendOrderRequest struct {
 	Price float64
+	Size  float64
 }
 
-func (ex *Exchange) handleGetBestBid(c echo.Context) error {
-	var (
-		market = Market(c.Param("market"))
-		ob     = ex.orderbooks[market]
-		order  = Order{}
-	)
-
-	if len(ob.Bids()) == 0 {
-		return c.JSON(http.StatusOK, order)
+func (ex *Exchange) amendOrder(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid order id"})
 	}
 
-	bestLimit := ob.Bids()[0]
-	bestOrder := bestLimit.Orders[0]
-
-	order.Price = bestLimit.Price
-	order.UserID = bestOrder.UserID
-
-	return c.JSON(http.StatusOK, order)
+	return ex.handleAmendOrder(c, id)
 }
 
-func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
-	var (
-		market = Market(c.Param("market"))
-		ob     = ex.orderbooks[market]
-		order  = Order{}
-	)
-
-	if len(ob.Asks()) == 0 {
-		return c.JSON(http.StatusOK, order)
+// handleAmendOrder amends the order id of the authenticated user to the
+// price and size of the request body.
+func (ex *Exchange) handleAmendOrder(c echo.Context, id int64) error {
+	var req AmendOrderRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request body"})
 	}
 
-	bestLimit := ob.Asks()[0]
-	bestOrder := bestLimit.Orders[0]
+	userID, _ := authUserID(c)
+	if err := ex.AmendOrder(userID, id, req.Price, req.Size); err != nil {
+		return c.JSON(orderErrorStatus(err), APIError{Error: err.Error()})
+	}
 
-	order.Price = bestLimit.Price
-	order.UserID = bestOrder.UserID
+	return c.JSON(200, map[string]any{"msg": "order amended"})
+}
 
-	return c.JSON(http.StatusOK, order)
+// orderErrorStatus is the HTTP status of an error placing, cancelling or
+// amending an order.
+func orderErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNotOrderOwner):
+		return http.StatusForbidden
+	case errors.Is(err, ErrOrderNonceUsed):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
 }
 
-func (ex *Exchange) cancelOrder(c echo.Context) error {
-	idStr := c.Param("id")
-	id, _ := strconv.Atoi(idStr)
+// findOrder looks up an order in the books of all markets.
+func (ex *Exchange) findOrder(id int64) (Market, *orderbook.Order, bool) {
+	for market, ob := range ex.orderbooks {
+		if order, ok := ob.Order(id); ok {
+			return market, order, true
+		}
+	}
+	return "", nil, false
+}
 
-	ob := ex.orderbooks[MarketETH]
-	order := ob.Orders[int64(id)]
-	ob.CancelOrder(order)
+// removeUserOrder stops tracking a cancelled order of a user.
+func (ex *Exchange) removeUserOrder(order *orderbook.Order) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
 
-	log.Println("order canceled id => ", id)
+	delete(ex.orderAuthKeys, order.ID)
+	ex.closeClientOrderLocked(order.ID)
 
-	return c.JSON(200, map[string]any{"msg": "order deleted"})
+	orders := ex.Orders[order.UserID]
+	for i, o := range orders {
+		if o == order {
+			ex.Orders[order.UserID] = append(orders[:i:i], orders[i+1:]...)
+			break
+		}
+	}
 }
 
 func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrder) {
@@ -356,6 +647,14 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 		"avgPrice": avgPrice,
 	}).Info("filled market order")
 
+	ex.untrackFilledOrders()
+
+	return matches, matchedOrders
+}
+
+// untrackFilledOrders stops tracking the orders of the users that were
+// filled.
+func (ex *Exchange) untrackFilledOrders() {
 	newOrderMap := make(map[int64][]*orderbook.Order)
 
 	ex.mu.Lock()
@@ -365,29 +664,34 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 			// this means that size of the order = 0
 			if !orderbookOrders[i].IsFilled() {
 				newOrderMap[userID] = append(newOrderMap[userID], orderbookOrders[i])
+			} else {
+				delete(ex.orderAuthKeys, orderbookOrders[i].ID)
+				ex.closeClientOrderLocked(orderbookOrders[i].ID)
 			}
 		}
 	}
 	ex.Orders = newOrderMap
 	ex.mu.Unlock()
-
-	return matches, matchedOrders
 }
 
-func (ex *Exchange) handlePlaceLimitOrder(market Market, price float64, order *orderbook.Order) error {
+func (ex *Exchange) handlePlaceLimitOrder(market Market, price float64, order *orderbook.Order, authKey string) {
 	ob := ex.orderbooks[market]
 	ob.PlaceLimitOrder(price, order)
+	ex.trackOrder(order, authKey)
+}
 
-	// keep track of the user orders
+// trackOrder keeps track of a limit order of a user, placed with the given
+// credentials.
+func (ex *Exchange) trackOrder(order *orderbook.Order, authKey string) {
 	ex.mu.Lock()
 	ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
+	ex.orderAuthKeys[order.ID] = authKey
 	ex.mu.Unlock()
-
-	return nil
 }
 
 type PlaceOrderResponse struct {
-	OrderID int64
+	OrderID       int64
+	ClientOrderID string `json:",omitempty"`
 }
 
 func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
@@ -396,85 +700,170 @@ func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 		return err
 	}
 
-	market := Market(placeOrderData.Market)
-	order := orderbook.NewOrder(placeOrderData.Bid, placeOrderData.Size, placeOrderData.UserID)
-
-	// Limit orders
-	if placeOrderData.Type == LimitOrder {
-		if err := ex.handlePlaceLimitOrder(market, placeOrderData.Price, order); err != nil {
-			return err
-		}
+	userID, _ := authUserID(c)
+	if placeOrderData.UserID != 0 && placeOrderData.UserID != userID {
+		return c.JSON(http.StatusForbidden, APIError{Error: "user id does not match the api key"})
 	}
+	placeOrderData.UserID = userID
 
-	// market orders
-	if placeOrderData.Type == MarketOrder {
-		matches, _ := ex.handlePlaceMarketOrder(market, order)
-		if err := ex.handleMatches(matches); err != nil {
-			return err
-		}
+	resp, err := ex.PlaceOrder(&placeOrderData, authKey(c))
+	if err != nil {
+		return c.JSON(orderErrorStatus(err), APIError{Error: err.Error()})
 	}
 
-	resp := &PlaceOrderResponse{
-		OrderID: order.ID,
+	return c.JSON(200, resp)
+}
+
+// bookVolume is the size a market order on the given side can fill, at
+// the prices within reports true for when it is not nil. Levels are best
+// first, so the volume stops at the first price out of reach.
+func bookVolume(ob *orderbook.Orderbook, bid bool, within func(price float64) bool) float64 {
+	bids, asks := ob.Levels()
+	levels := bids
+	if bid {
+		levels = asks
 	}
 
-	return c.JSON(200, resp)
+	volume := 0.0
+	for _, level := range levels {
+		if within != nil && !within(level.Price) {
+			break
+		}
+		volume += level.Size
+	}
+	return volume
 }
 
-func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
+// handleMatches settles the matches of a taker. trades are the records of
+// the matches, in the same order.
+func (ex *Exchange) handleMatches(market Market, taker *orderbook.Order, matches []orderbook.Match, trades []*store.Trade) error {
+	cfg, ok := ex.markets[market]
+	if !ok {
+		return fmt.Errorf("market not found: %s", market)
+	}
+
 	for _, match := range matches {
-		fromUser, ok := ex.Users[match.Ask.UserID]
+		ex.orderTradeRatio.RecordTrade(match.Ask.UserID)
+		ex.orderTradeRatio.RecordTrade(match.Bid.UserID)
+	}
+
+	if ex.settlement == SettlementEscrow {
+		return ex.queueEscrowFills(cfg, taker, matches, trades)
+	}
+
+	for i, match := range matches {
+		seller, ok := ex.user(match.Ask.UserID)
 		if !ok {
 			return fmt.Errorf("user not found: %d", match.Ask.UserID)
 		}
 
-		toUser, ok := ex.Users[match.Bid.UserID]
+		buyer, ok := ex.user(match.Bid.UserID)
 		if !ok {
 			return fmt.Errorf("user not found: %d", match.Bid.UserID)
 		}
-		toAddresss := crypto.PubkeyToAddress(toUser.PrivateKey.PublicKey)
 
-		// this is only used for the fees
-		// exchangePubKey := ex.PrivateKey.Public()
-		// publicKeyECDSA, ok := exchangePubKey.(*ecdsa.PublicKey)
-		// if !ok {
-		// 	return fmt.Errorf("error casting public key to ECDSA")
-		// }
+		// The match already happened in the book, so a failed transfer is
+		// logged instead of failing the order.
+		if err := ex.transferAsset(market, tradeRef(trades, i), cfg.Base, seller, buyer, match.SizeFilled); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"asset": cfg.Base.Symbol,
+				"from":  seller.ID,
+				"to":    buyer.ID,
+			}).Error(err)
+		}
 
-		amount := big.NewInt(int64(match.SizeFilled))
-		transferETH(ex.Client, fromUser.PrivateKey, toAddresss, amount)
+		if cfg.Quote == nil {
+			continue
+		}
+
+		if err := ex.transferAsset(market, tradeRef(trades, i), cfg.Quote, buyer, seller, match.SizeFilled*match.Price); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"asset": cfg.Quote.Symbol,
+				"from":  buyer.ID,
+				"to":    seller.ID,
+			}).Error(err)
+		}
 	}
 
 	return nil
 }
 
-func transferETH(client *ethclient.Client, fromPrivKey *ecdsa.PrivateKey, to common.Address, amount *big.Int) error {
-	ctx := context.Background()
-	publicKey := fromPrivKey.Public()
-	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("error casting public key to ECDSA")
+// tradeRef returns the reference of the i-th trade record, or a zero
+// reference if it was not stored.
+func tradeRef(trades []*store.Trade, i int) store.TradeRef {
+	if i >= len(trades) || trades[i].ID == 0 {
+		return store.TradeRef{}
+	}
+	return store.TradeRef{Market: trades[i].Market, ID: trades[i].ID}
+}
+
+// transferAsset settles amount of an asset of a trade on market from one
+// user to another, and records the settlement.
+func (ex *Exchange) transferAsset(market Market, trade store.TradeRef, asset *Asset, from, to *User, amount float64) error {
+	settlement := &store.Settlement{
+		Mode:       string(SettlementDirect),
+		Market:     string(market),
+		Asset:      asset.Symbol,
+		FromUserID: from.ID,
+		ToUserID:   to.ID,
+		Amount:     amount,
+		Status:     store.SettlementSent,
+	}
+	if trade.ID != 0 {
+		settlement.Trades = []store.TradeRef{trade}
 	}
 
-	fromAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
-	nonce, err := client.PendingNonceAt(ctx, fromAddress)
+	tx, err := ex.sendTransfer(asset, from, to, asset.ToBaseUnits(amount))
 	if err != nil {
+		settlement.Status = store.SettlementFailed
+		settlement.Error = err.Error()
+		recordSettlement(ex.store, settlement, nil)
 		return err
 	}
 
-	gasLimit := uint64(21000)
-	gasPrice, err := client.SuggestGasPrice(ctx)
-	if err != nil {
-		log.Fatal(err)
+	settlement.TxHash = tx.Hash().Hex()
+	recordSettlement(ex.store, settlement, nil)
+
+	if asset.IsNative() {
+		return nil
+	}
+
+	// The confirmation records its status through a copy, as the recorded
+	// settlement may still be read.
+	confirmed := *settlement
+	go func(settlement *store.Settlement) {
+		settlement.Status = store.SettlementConfirmed
+		if _, err := confirmTokenTransfer(context.Background(), ex.Client, tx, asset.Token, from.Address, to.Address, asset.ToBaseUnits(amount)); err != nil {
+			logrus.WithField("tx", tx.Hash()).Error(err)
+			settlement.Status = store.SettlementReverted
+			settlement.Error = err.Error()
+		}
+		recordSettlement(ex.store, settlement, nil)
+	}(&confirmed)
+
+	return nil
+}
+
+func (ex *Exchange) sendTransfer(asset *Asset, from, to *User, value *big.Int) (*types.Transaction, error) {
+	if asset.IsNative() {
+		if from.PrivateKey == nil {
+			return nil, fmt.Errorf("%w: %d", ErrNoUserKey, from.ID)
+		}
+		return transferETH(context.Background(), ex.Client, NewNonceManager(ex.Client, from.PrivateKey), to.Address, value)
 	}
 
-	tx := types.NewTransaction(nonce, to, amount, gasLimit, gasPrice, nil)
+	return transferFromERC20(context.Background(), ex.Client, asset.Token, ex.nonces, from.Address, to.Address, value)
+}
 
-	chainID := big.NewInt(1337)
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), fromPrivKey)
+func transferETH(ctx context.Context, client ChainClient, sender *NonceManager, to common.Address, amount *big.Int) (*types.Transaction, error) {
+	gasLimit := uint64(21000)
+	gasPrice, err := client.SuggestGasPrice(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return client.SendTransaction(ctx, signedTx)
+	return sender.Send(ctx, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		tx := types.NewTransaction(opts.Nonce.Uint64(), to, amount, gasLimit, gasPrice, nil)
+		return opts.Signer(opts.From, tx)
+	})
 }
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+// serveAs calls handler with body as the request of the user
+// authenticated with a session token.
+func serveAs(t *testing.T, handler echo.HandlerFunc, userID int64, method string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(method, "/", bytes.NewReader(b)), rec)
+	c.Set(contextUserID, userID)
+	c.Set(contextAuthKey, sessionAuthKey(userID))
+
+	if err := handler(c); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func placeOrder(t *testing.T, ex *Exchange, userID int64, req PlaceOrderRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	return serveAs(t, ex.handlePlaceOrder, userID, http.MethodPost, req)
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func cancelOrder(t *testing.T, ex *Exchange, userID, orderID int64) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodDelete, "/", nil), rec)
+	c.Set(contextUserID, userID)
+	c.SetParamNames("id")
+	c.SetParamValues(strconv.FormatInt(orderID, 10))
+
+	if err := ex.cancelOrder(c); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
@@ -0,0 +1,495 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+)
+
+// The methods below are the operations of the exchange, independent of the
+// transport. The REST and websocket handlers, and the gateways in other
+// packages which speak other protocols, authenticate the caller and then
+// call them, so every API behaves the same.
+
+// RateLimitError is returned by AllowOrderEntry and AllowMarketData when
+// the caller is over a limit.
+type RateLimitError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %ds", e.Reason, retryAfterSeconds(e.RetryAfter))
+}
+
+// Caller is an authenticated user of a gateway.
+type Caller struct {
+	UserID int64
+	Scopes []Scope
+	// AuthKey identifies the credentials of the caller, see APIKeyAuth.
+	AuthKey string
+}
+
+func (c *Caller) HasScope(scope Scope) bool {
+	return hasScope(c.Scopes, scope)
+}
+
+// VerifyAPIKey checks a request signed with SignRequest and returns the key
+// it was signed with.
+func (ex *Exchange) VerifyAPIKey(key, timestamp, nonce, signature, method, path string, body []byte) (*APIKey, error) {
+	return ex.apiKeys.Verify(key, timestamp, nonce, signature, method, path, body)
+}
+
+// VerifySession checks a session token and returns its user, who has
+// every scope.
+func (ex *Exchange) VerifySession(token string) (*Caller, error) {
+	userID, err := ex.sessions.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+	return &Caller{UserID: userID, Scopes: AllScopes, AuthKey: sessionAuthKey(userID)}, nil
+}
+
+// AllowOrderEntry applies the order entry limits per IP and per
+// credentials, and the order-to-trade ratio of the user. Accepted orders
+// are counted with RecordOrder.
+func (ex *Exchange) AllowOrderEntry(authKey string, userID int64, ip string) error {
+	if ok, _, retryAfter := ex.orderIPLimiter.Allow("ip:" + ip); !ok {
+		return &RateLimitError{Reason: "rate limit exceeded", RetryAfter: retryAfter}
+	}
+	if ok, _, retryAfter := ex.orderLimiter.Allow(authKey); !ok {
+		return &RateLimitError{Reason: "rate limit exceeded", RetryAfter: retryAfter}
+	}
+	if ok, retryAfter := ex.orderTradeRatio.Allow(userID); !ok {
+		return &RateLimitError{Reason: "too many orders per trade", RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// RecordOrder counts an order placed, cancelled or amended by the user for
+// their order-to-trade ratio.
+func (ex *Exchange) RecordOrder(userID int64) {
+	ex.orderTradeRatio.RecordOrder(userID)
+}
+
+// AllowMarketData applies the market data limit per IP.
+func (ex *Exchange) AllowMarketData(ip string) error {
+	if ok, _, retryAfter := ex.marketDataLimiter.Allow("ip:" + ip); !ok {
+		return &RateLimitError{Reason: "rate limit exceeded", RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// PlaceOrder checks and places an order of req.UserID with the given
+// credentials. Orders that fail the checks are rejected. An order with the
+// ClientOrderID of an order of the user that is open, or was placed within
+// clientOrderWindow, is not placed again: the response is the one of the
+// first order, so orders can be retried safely.
+func (ex *Exchange) PlaceOrder(placeOrderData *PlaceOrderRequest, authKey string) (*PlaceOrderResponse, error) {
+	market := Market(placeOrderData.Market)
+	clientOrderID := placeOrderData.ClientOrderID
+
+	reject := func(err error) (*PlaceOrderResponse, error) {
+		ex.publishRejected(placeOrderData.UserID, placeOrderData, err.Error())
+		return nil, err
+	}
+
+	if clientOrderID != "" {
+		if err := checkClientOrderID(clientOrderID); err != nil {
+			return reject(err)
+		}
+		// Retries are answered before the checks, which a signed order
+		// would fail the second time as its nonce is used.
+		if id, err := ex.OrderID(placeOrderData.UserID, clientOrderID); err == nil {
+			return &PlaceOrderResponse{OrderID: id, ClientOrderID: clientOrderID}, nil
+		}
+	}
+
+	cfg, ok := ex.markets[market]
+	if !ok {
+		return reject(ErrMarketNotFound)
+	}
+	if placeOrderData.Type != LimitOrder && placeOrderData.Type != MarketOrder {
+		return reject(fmt.Errorf("%w: unknown type %q", ErrInvalidOrder, placeOrderData.Type))
+	}
+	if placeOrderData.Size <= 0 {
+		return reject(fmt.Errorf("%w: size must be positive", ErrInvalidOrder))
+	}
+	if placeOrderData.Type == LimitOrder && placeOrderData.Price <= 0 {
+		return reject(fmt.Errorf("%w: price must be positive", ErrInvalidOrder))
+	}
+	if err := ex.checkFeesPaid(placeOrderData.UserID, cfg); err != nil {
+		return reject(err)
+	}
+
+	if ex.requireSignedOrders || placeOrderData.Signed != nil {
+		user, ok := ex.user(placeOrderData.UserID)
+		if !ok {
+			return reject(ErrUserNotFound)
+		}
+
+		if err := ex.checkSignedOrder(user, cfg, placeOrderData, placeOrderData.Signed); err != nil {
+			return reject(err)
+		}
+	}
+
+	order := &orderbook.Order{
+		ID:        ex.newOrderID(),
+		UserID:    placeOrderData.UserID,
+		Size:      placeOrderData.Size,
+		Bid:       placeOrderData.Bid,
+		Timestamp: ex.now().UnixNano(),
+	}
+
+	cmd := &Command{
+		Type:          CommandPlace,
+		Time:          order.Timestamp,
+		OrderID:       order.ID,
+		UserID:        order.UserID,
+		OrderType:     placeOrderData.Type,
+		Bid:           order.Bid,
+		Price:         placeOrderData.Price,
+		Size:          order.Size,
+		Signed:        placeOrderData.Signed,
+		ClientOrderID: clientOrderID,
+	}
+
+	if clientOrderID != "" {
+		// A retry racing the first order gets the ID of the first.
+		if id, ok := ex.bindClientOrderID(order.UserID, clientOrderID, order.ID, order.Timestamp); !ok {
+			return &PlaceOrderResponse{OrderID: id, ClientOrderID: clientOrderID}, nil
+		}
+	}
+	if placeOrderData.Signed != nil {
+		ex.mu.Lock()
+		ex.signedOrders[order.ID] = placeOrderData.Signed
+		ex.mu.Unlock()
+	}
+	rejectPlaced := func(err error) (*PlaceOrderResponse, error) {
+		ex.mu.Lock()
+		delete(ex.signedOrders, order.ID)
+		ex.mu.Unlock()
+		ex.unbindClientOrderID(order.UserID, order.ID)
+		return reject(err)
+	}
+
+	// Limit orders
+	if placeOrderData.Type == LimitOrder {
+		_, err := ex.execute(market, cmd, nil, func(*orderbook.Orderbook) {
+			ex.handlePlaceLimitOrder(market, placeOrderData.Price, order, authKey)
+		})
+		if err != nil {
+			return rejectPlaced(err)
+		}
+		ex.publishMarket(market, order, nil)
+	}
+
+	// market orders
+	if placeOrderData.Type == MarketOrder {
+		// A signed market order only fills up to the worst price it was
+		// signed with, or its fills could not be settled.
+		var within func(price float64) bool
+		if signed := placeOrderData.Signed; signed != nil {
+			within = func(price float64) bool { return signed.accepts(cfg, price) }
+		}
+
+		var matches []orderbook.Match
+		records, err := ex.execute(market, cmd, func(ob *orderbook.Orderbook) error {
+			if order.Size > bookVolume(ob, order.Bid, within) {
+				return fmt.Errorf("%w: not enough volume", ErrInvalidOrder)
+			}
+			return nil
+		}, func(*orderbook.Orderbook) {
+			matches, _ = ex.handlePlaceMarketOrder(market, order)
+		})
+		if err != nil {
+			return rejectPlaced(err)
+		}
+		ex.mu.Lock()
+		ex.closeClientOrderLocked(order.ID)
+		ex.mu.Unlock()
+		ex.publishMarket(market, order, matches)
+
+		// The order is already filled, so settlement errors are logged
+		// instead of failing it.
+		if err := ex.handleMatches(market, order, matches, records.Trades); err != nil {
+			logrus.WithField("order", order.ID).Error(err)
+		}
+	}
+
+	return &PlaceOrderResponse{
+		OrderID:       order.ID,
+		ClientOrderID: clientOrderID,
+	}, nil
+}
+
+// newOrderID assigns the next order ID.
+func (ex *Exchange) newOrderID() int64 {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	ex.lastOrderID++
+	return ex.lastOrderID
+}
+
+// CancelOrder cancels an open order of the user.
+func (ex *Exchange) CancelOrder(userID, id int64) error {
+	market, order, ok := ex.findOrder(id)
+	if !ok {
+		return ErrOrderNotFound
+	}
+	if order.UserID != userID {
+		return ErrNotOrderOwner
+	}
+
+	if err := ex.removeOrder(market, order, CommandCancel); err != nil {
+		return err
+	}
+
+	log.Println("order canceled id => ", id)
+
+	return nil
+}
+
+// removeOrder cancels or expires a resting order.
+func (ex *Exchange) removeOrder(market Market, order *orderbook.Order, cmdType CommandType) error {
+	cmd := &Command{Type: cmdType, Time: ex.now().UnixNano(), OrderID: order.ID}
+	_, err := ex.execute(market, cmd, restingOrder(order), func(ob *orderbook.Orderbook) {
+		if cmdType == CommandExpire {
+			ob.ExpireOrder(order)
+		} else {
+			ob.CancelOrder(order)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	ex.removeUserOrder(order)
+	ex.publishMarket(market, order, nil)
+	return nil
+}
+
+// restingOrder validates that a command finds the order still resting in
+// the book.
+func restingOrder(order *orderbook.Order) func(*orderbook.Orderbook) error {
+	return func(*orderbook.Orderbook) error {
+		if order.Limit == nil {
+			return ErrOrderNotFound
+		}
+		return nil
+	}
+}
+
+// AmendOrder changes the price and size of an open limit order of the
+// user. Signed orders can not be amended.
+func (ex *Exchange) AmendOrder(userID, id int64, price, size float64) error {
+	if price <= 0 || size <= 0 {
+		return fmt.Errorf("%w: price and size must be positive", ErrInvalidOrder)
+	}
+
+	market, order, ok := ex.findOrder(id)
+	if !ok {
+		return ErrOrderNotFound
+	}
+	if order.UserID != userID {
+		return ErrNotOrderOwner
+	}
+
+	ex.mu.RLock()
+	_, signed := ex.signedOrders[id]
+	ex.mu.RUnlock()
+	if signed {
+		return fmt.Errorf("%w: signed orders can not be amended", ErrInvalidOrder)
+	}
+
+	cmd := &Command{Type: CommandAmend, Time: ex.now().UnixNano(), OrderID: id, Price: price, Size: size}
+	_, err := ex.execute(market, cmd, restingOrder(order), func(ob *orderbook.Orderbook) {
+		ob.AmendOrder(order, price, size)
+	})
+	if err != nil {
+		return err
+	}
+	ex.publishMarket(market, order, nil)
+
+	return nil
+}
+
+// Book returns every order in the book of a market.
+func (ex *Exchange) Book(market Market) (*OrderbookData, error) {
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return nil, ErrMarketNotFound
+	}
+
+	// The book is copied under its lock, so the view is consistent while
+	// orders are matched.
+	bids, asks := ob.Book()
+	book := &OrderbookData{
+		Asks: []*Order{},
+		Bids: []*Order{},
+	}
+
+	for _, limit := range asks {
+		book.TotalAskVolume += limit.TotalVolume
+		for _, order := range limit.Orders {
+			book.Asks = append(book.Asks, bookOrder(limit.Price, order))
+		}
+	}
+	for _, limit := range bids {
+		book.TotalBidVolume += limit.TotalVolume
+		for _, order := range limit.Orders {
+			book.Bids = append(book.Bids, bookOrder(limit.Price, order))
+		}
+	}
+
+	return book, nil
+}
+
+func bookOrder(price float64, order orderbook.OrderSnapshot) *Order {
+	return &Order{
+		ID:        order.ID,
+		Price:     price,
+		Size:      order.Size,
+		Bid:       order.Bid,
+		Timestamp: order.Timestamp,
+	}
+}
+
+// Levels returns the price levels of a market, best first.
+func (ex *Exchange) Levels(market Market) (BookLevels, error) {
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return BookLevels{}, ErrMarketNotFound
+	}
+
+	bids, asks := ob.Levels()
+	return BookLevels{Bids: bids, Asks: asks}, nil
+}
+
+// BestBid returns the first order at the best bid of a market, without its
+// user like the orders of Book, or a zero order when there are no bids.
+func (ex *Exchange) BestBid(market Market) (Order, error) {
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return Order{}, ErrMarketNotFound
+	}
+	return bestOrder(ob, true), nil
+}
+
+// BestAsk returns the first order at the best ask of a market, like
+// BestBid, or a zero order when there are no asks.
+func (ex *Exchange) BestAsk(market Market) (Order, error) {
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return Order{}, ErrMarketNotFound
+	}
+	return bestOrder(ob, false), nil
+}
+
+func bestOrder(ob *orderbook.Orderbook, bid bool) Order {
+	order, price, ok := ob.BestOrder(bid)
+	if !ok {
+		return Order{}
+	}
+
+	return *bookOrder(price, order)
+}
+
+// Trades returns the last trades of a market from the store, oldest first.
+func (ex *Exchange) Trades(market Market) ([]*orderbook.Trade, error) {
+	if _, ok := ex.orderbooks[market]; !ok {
+		return nil, ErrMarketNotFound
+	}
+
+	records, err := ex.store.Trades(string(market), recentTrades)
+	if err != nil {
+		return nil, err
+	}
+
+	trades := make([]*orderbook.Trade, len(records))
+	for i, record := range records {
+		trades[i] = &orderbook.Trade{
+			Price:     record.Price,
+			Size:      record.Size,
+			Bid:       record.Bid,
+			Timestamp: record.Timestamp,
+		}
+	}
+	return trades, nil
+}
+
+// UserOrders returns the open limit orders of a user, by ID.
+func (ex *Exchange) UserOrders(userID int64) *GetOrdersResponse {
+	open := ex.openOrders(userID)
+
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	orders := &GetOrdersResponse{
+		Asks: []Order{},
+		Bids: []Order{},
+	}
+
+	for _, o := range open {
+		order := Order{
+			ID:            o.ID,
+			UserID:        o.UserID,
+			Price:         o.Price,
+			Size:          o.Size,
+			Timestamp:     o.Timestamp,
+			Bid:           o.Bid,
+			Signed:        ex.signedOrders[o.ID],
+			ClientOrderID: ex.clientOrderIDs[o.ID],
+		}
+
+		if order.Bid {
+			orders.Bids = append(orders.Bids, order)
+		} else {
+			orders.Asks = append(orders.Asks, order)
+		}
+	}
+
+	return orders
+}
+
+// openOrders returns the open limit orders of a user in every market, by
+// ID. They are copied under the locks of their books, as the books fill
+// and amend them concurrently.
+func (ex *Exchange) openOrders(userID int64) []orderbook.OpenOrder {
+	var orders []orderbook.OpenOrder
+	for _, ob := range ex.orderbooks {
+		orders = append(orders, ob.OpenOrders(userID)...)
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return orders
+}
+
+// SubscribeMarket calls handler with the messages of a channel of a market
+// until the returned func is called, starting with a snapshot for the book
+// channel and the current best bid and offer for the BBO channel. The
+// handler is called with the feed locked, so it must not block or call
+// back into the exchange.
+func (ex *Exchange) SubscribeMarket(market Market, channel Channel, handler func(WSMessage)) (func(), error) {
+	feed, ok := ex.feeds[market]
+	if !ok {
+		return nil, ErrMarketNotFound
+	}
+	if _, ok := feed.subs[channel]; !ok {
+		return nil, fmt.Errorf("unknown channel %q", channel)
+	}
+
+	return feed.handle(channel, handler), nil
+}
+
+// SubscribeUser calls handler with the order updates, fills and balance
+// changes of the user until the returned func is called. The handler is
+// called with the orderbook locked, so it must not block or call back into
+// the exchange.
+func (ex *Exchange) SubscribeUser(userID int64, handler func(UserEvent)) func() {
+	return ex.userFeeds.handle(userID, handler)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestPlaceOrderChecks(t *testing.T) {
+	chain := newTestChain(t, 2)
+	ex := newTestExchange(t, chain)
+	for i, key := range chain.keys {
+		user := &User{ID: int64(i + 1), PrivateKey: key, Address: crypto.PubkeyToAddress(key.PublicKey)}
+		if err := ex.registerUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, req := range []PlaceOrderRequest{
+		{Type: "STOP", Size: 1, Price: 100},
+		{Type: LimitOrder, Size: 0, Price: 100},
+		{Type: LimitOrder, Size: -1, Price: 100},
+		{Type: LimitOrder, Size: 1, Price: 0},
+		{Type: LimitOrder, Size: 1, Price: -100},
+		{Type: MarketOrder, Size: 0},
+	} {
+		req.UserID = 1
+		req.Market = MarketETH
+		_, err := ex.PlaceOrder(&req, "")
+		if !errors.Is(err, ErrInvalidOrder) {
+			t.Errorf("%+v: expected %v, got %v", req, ErrInvalidOrder, err)
+		}
+	}
+	assert(t, len(ex.UserOrders(1).Asks), 0)
+
+	// Market orders need no price.
+	_, err := ex.PlaceOrder(&PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 1, Price: 100, Market: MarketETH}, "")
+	assert(t, err, nil)
+	_, err = ex.PlaceOrder(&PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 1, Market: MarketETH}, "")
+	assert(t, err, nil)
+}
+
+// TestUserOrdersConcurrent reads the orders of a user while they are
+// amended and filled, for the race detector.
+func TestUserOrdersConcurrent(t *testing.T) {
+	chain := newTestChain(t, 2)
+	ex := newTestExchange(t, chain)
+	for i, key := range chain.keys {
+		user := &User{ID: int64(i + 1), PrivateKey: key, Address: crypto.PubkeyToAddress(key.PublicKey)}
+		if err := ex.registerUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	placed, err := ex.PlaceOrder(&PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 10, Price: 100, Market: MarketETH}, "")
+	assert(t, err, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 20; i++ {
+			ex.AmendOrder(1, placed.OrderID, 100+float64(i), 10)
+			ex.PlaceOrder(&PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 0.1, Market: MarketETH}, "")
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			orders := ex.UserOrders(1)
+			assert(t, len(orders.Asks), 1)
+			assert(t, orders.Asks[0].Price, 120.0)
+			return
+		default:
+			for _, o := range ex.UserOrders(1).Asks {
+				if o.Price < 100 || o.Size <= 0 {
+					t.Fatalf("unexpected order %+v", o)
+				}
+			}
+		}
+	}
+}
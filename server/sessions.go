@@ -0,0 +1,229 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	challengeTTL = 5 * time.Minute
+	sessionTTL   = 15 * time.Minute
+)
+
+var (
+	ErrChallengeNotFound = errors.New("challenge not found or expired")
+	ErrInvalidSession    = errors.New("invalid session token")
+)
+
+type Challenge struct {
+	Address   common.Address
+	Nonce     string
+	Message   string
+	ExpiresAt int64
+}
+
+// Sessions issues sign-in challenges for wallets and the session tokens
+// (HS256 JWTs) of the wallets that signed them.
+type Sessions struct {
+	secret []byte
+	now    func() time.Time
+
+	mu         sync.Mutex
+	challenges map[string]*Challenge
+}
+
+func NewSessions() (*Sessions, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return &Sessions{
+		secret:     secret,
+		now:        time.Now,
+		challenges: make(map[string]*Challenge),
+	}, nil
+}
+
+// Challenge returns a new message for address to sign with personal_sign
+// (EIP-191).
+func (s *Sessions) Challenge(address common.Address) (*Challenge, error) {
+	nonce, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	challenge := &Challenge{
+		Address:   address,
+		Nonce:     nonce,
+		ExpiresAt: now.Add(challengeTTL).Unix(),
+		Message: fmt.Sprintf("Sign in to CryptoExchange\nAddress: %s\nNonce: %s\nIssued At: %s",
+			address.Hex(), nonce, now.UTC().Format(time.RFC3339)),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for n, c := range s.challenges {
+		if now.Unix() > c.ExpiresAt {
+			delete(s.challenges, n)
+		}
+	}
+	s.challenges[nonce] = challenge
+
+	c := *challenge
+	return &c, nil
+}
+
+// Verify consumes the challenge with the given nonce and returns the
+// address that signed it. The address has to be the one the challenge was
+// issued for.
+func (s *Sessions) Verify(nonce string, signature []byte) (common.Address, error) {
+	s.mu.Lock()
+	challenge, ok := s.challenges[nonce]
+	delete(s.challenges, nonce)
+	s.mu.Unlock()
+
+	if !ok || s.now().Unix() > challenge.ExpiresAt {
+		return common.Address{}, ErrChallengeNotFound
+	}
+
+	if len(signature) != crypto.SignatureLength {
+		return common.Address{}, ErrInvalidSignature
+	}
+	sig := make([]byte, crypto.SignatureLength)
+	copy(sig, signature)
+	if sig[64] >= 27 {
+		sig[64] -= 27
+	}
+
+	pub, err := crypto.SigToPub(accounts.TextHash([]byte(challenge.Message)), sig)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	address := crypto.PubkeyToAddress(*pub)
+	if address != challenge.Address {
+		return common.Address{}, ErrInvalidSignature
+	}
+
+	return address, nil
+}
+
+// Issue returns a session token for the user.
+func (s *Sessions) Issue(userID int64, address common.Address) (string, int64, error) {
+	now := s.now()
+	expiresAt := now.Add(sessionTTL)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   strconv.FormatInt(userID, 10),
+		Audience:  jwt.ClaimStrings{address.Hex()},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	})
+
+	signed, err := token.SignedString(s.secret)
+	if err != nil {
+		return "", 0, err
+	}
+	return signed, expiresAt.Unix(), nil
+}
+
+// Parse returns the user of a valid session token.
+func (s *Sessions) Parse(token string) (int64, error) {
+	claims := &jwt.RegisteredClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+
+	if _, err := parser.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+		return s.secret, nil
+	}); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidSession, err)
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidSession
+	}
+	return userID, nil
+}
+
+type ChallengeRequest struct {
+	Address common.Address
+}
+
+type LoginRequest struct {
+	Nonce     string
+	Signature hexutil.Bytes
+}
+
+type LoginResponse struct {
+	UserID    int64
+	Address   common.Address
+	Token     string
+	ExpiresAt int64
+}
+
+func (ex *Exchange) handleChallenge(c echo.Context) error {
+	var req ChallengeRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request body"})
+	}
+	if req.Address == (common.Address{}) {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "missing address"})
+	}
+
+	challenge, err := ex.sessions.Challenge(req.Address)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, challenge)
+}
+
+// handleLogin exchanges a signed challenge for a session token. Wallets
+// that sign in for the first time are registered as new users.
+func (ex *Exchange) handleLogin(c echo.Context) error {
+	var req LoginRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request body"})
+	}
+
+	address, err := ex.sessions.Verify(req.Nonce, req.Signature)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, APIError{Error: err.Error()})
+	}
+
+	user, ok := ex.userByAddress(address)
+	if !ok {
+		user = &User{Address: address}
+		if err := ex.registerUser(user); err != nil {
+			return err
+		}
+	}
+
+	token, expiresAt, err := ex.sessions.Issue(user.ID, address)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, LoginResponse{
+		UserID:    user.ID,
+		Address:   address,
+		Token:     token,
+		ExpiresAt: expiresAt,
+	})
+}
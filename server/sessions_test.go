@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+)
+
+func TestWalletLogin(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+
+	e := echo.New()
+	e.POST("/auth/challenge", ex.handleChallenge)
+	e.POST("/auth/login", ex.handleLogin)
+	e.GET("/whoami", func(c echo.Context) error {
+		userID, _ := authUserID(c)
+		return c.String(http.StatusOK, strconv.FormatInt(userID, 10))
+	}, ex.authenticate)
+
+	post := func(path string, body any, out any) int {
+		t.Helper()
+
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(string(b))))
+		if out != nil && rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code
+	}
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey)
+
+	sign := func(message string) hexutil.Bytes {
+		sig, err := crypto.Sign(accounts.TextHash([]byte(message)), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig[64] += 27
+		return sig
+	}
+
+	var challenge Challenge
+	assert(t, post("/auth/challenge", ChallengeRequest{Address: address}, &challenge), http.StatusOK)
+
+	// A signature of another message does not log in, and burns the
+	// challenge.
+	assert(t, post("/auth/login", LoginRequest{Nonce: challenge.Nonce, Signature: sign("hello")}, nil), http.StatusUnauthorized)
+	assert(t, post("/auth/login", LoginRequest{Nonce: challenge.Nonce, Signature: sign(challenge.Message)}, nil), http.StatusUnauthorized)
+
+	assert(t, post("/auth/challenge", ChallengeRequest{Address: address}, &challenge), http.StatusOK)
+
+	var login LoginResponse
+	assert(t, post("/auth/login", LoginRequest{Nonce: challenge.Nonce, Signature: sign(challenge.Message)}, &login), http.StatusOK)
+	assert(t, login.Address, address)
+
+	user, ok := ex.userByAddress(address)
+	assert(t, ok, true)
+	assert(t, user.ID, login.UserID)
+
+	req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+login.Token)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, rec.Body.String(), fmt.Sprint(login.UserID))
+
+	req = httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+login.Token+"x")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert(t, rec.Code, http.StatusUnauthorized)
+}
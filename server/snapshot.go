@@ -0,0 +1,394 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/journal"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+)
+
+const (
+	snapshotExt = ".snapshot"
+	// snapshotTrades is the number of the last trades of every book kept
+	// in a snapshot.
+	snapshotTrades = 1000
+	// snapshotsKept is the number of snapshots kept, so the exchange can
+	// recover from an older one when the last is damaged.
+	snapshotsKept = 2
+
+	defaultSnapshotInterval = time.Minute
+)
+
+// Snapshot is the state of the books of the exchange after the journal
+// record Seq.
+type Snapshot struct {
+	Seq         uint64
+	LastOrderID int64
+	Books       map[Market]*orderbook.Snapshot
+	// SignedOrders are the signatures of the signed orders in the books.
+	SignedOrders map[int64]*SignedOrder `json:",omitempty"`
+	// ClientOrderIDs are the client order IDs of the orders in the books.
+	ClientOrderIDs map[int64]string `json:",omitempty"`
+	// OrderNonces are the used nonces of the signed orders of every
+	// address.
+	OrderNonces map[common.Address][]string `json:",omitempty"`
+}
+
+// Snapshot returns the state of the books. Commands wait while it is
+// taken, so it matches the journal up to Seq.
+func (ex *Exchange) Snapshot() *Snapshot {
+	markets := make([]string, 0, len(ex.orderbooks))
+	for market := range ex.orderbooks {
+		markets = append(markets, string(market))
+	}
+	sort.Strings(markets)
+
+	for _, market := range markets {
+		state := ex.bookState(Market(market))
+		state.Lock()
+		defer state.Unlock()
+	}
+
+	s := &Snapshot{
+		Books:          make(map[Market]*orderbook.Snapshot),
+		SignedOrders:   make(map[int64]*SignedOrder),
+		ClientOrderIDs: make(map[int64]string),
+		OrderNonces:    make(map[common.Address][]string),
+	}
+	if ex.journal != nil {
+		s.Seq = ex.journal.NextSeq() - 1
+	}
+	for market, ob := range ex.orderbooks {
+		s.Books[market] = ob.Snapshot(snapshotTrades)
+	}
+
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	s.LastOrderID = ex.lastOrderID
+	for address, used := range ex.orderNonces {
+		nonces := make([]string, 0, len(used))
+		for nonce := range used {
+			nonces = append(nonces, nonce)
+		}
+		sort.Strings(nonces)
+		s.OrderNonces[address] = nonces
+	}
+	for _, book := range s.Books {
+		for _, limits := range [][]orderbook.LimitSnapshot{book.Bids, book.Asks} {
+			for _, limit := range limits {
+				for _, o := range limit.Orders {
+					if signed, ok := ex.signedOrders[o.ID]; ok {
+						s.SignedOrders[o.ID] = signed
+					}
+					if id, ok := ex.clientOrderIDs[o.ID]; ok {
+						s.ClientOrderIDs[o.ID] = id
+					}
+				}
+			}
+		}
+	}
+
+	return s
+}
+
+// Recover restores the books from the last snapshot in dir and replays the
+// commands journaled after it, which gives the books the exchange had when
+// it stopped. It must be called once the markets are added, before the
+// exchange runs commands and before the journal is enabled. Fills are not
+// charged or published again while the commands are replayed.
+func (ex *Exchange) Recover(dir string) error {
+	for market, ob := range ex.orderbooks {
+		ob.OnEvent(nil)
+		defer ex.watchOrderbook(market, ob)
+	}
+
+	s, err := LoadSnapshot(dir)
+	if err != nil {
+		return err
+	}
+
+	from := uint64(1)
+	if s != nil {
+		if err := ex.restore(s); err != nil {
+			return err
+		}
+		from = s.Seq + 1
+	}
+
+	commands := 0
+	err = journal.Read(dir, from, func(seq uint64, data []byte) error {
+		var entry JournalEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("journal record %d: %w", seq, err)
+		}
+		if entry.Command == nil {
+			return nil
+		}
+
+		if err := ex.replay(entry.Market, entry.Command); err != nil {
+			return fmt.Errorf("journal record %d: %w", seq, err)
+		}
+		commands++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"snapshot": from - 1,
+		"commands": commands,
+	}).Info("recovered books")
+
+	return nil
+}
+
+// restore replaces the books with a snapshot.
+func (ex *Exchange) restore(s *Snapshot) error {
+	for market, book := range s.Books {
+		ob, ok := ex.orderbooks[market]
+		if !ok {
+			return fmt.Errorf("snapshot of unknown market %s", market)
+		}
+		ob.Restore(book)
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	// The store can know orders placed after the snapshot, whose commands
+	// are replayed next.
+	if s.LastOrderID > ex.lastOrderID {
+		ex.lastOrderID = s.LastOrderID
+	}
+	ex.Orders = make(map[int64][]*orderbook.Order)
+	for market, book := range s.Books {
+		for _, limits := range [][]orderbook.LimitSnapshot{book.Bids, book.Asks} {
+			for _, limit := range limits {
+				for _, o := range limit.Orders {
+					order, _ := ex.orderbooks[market].Order(o.ID)
+					ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
+					if id, ok := s.ClientOrderIDs[o.ID]; ok {
+						ex.bindClientOrderIDLocked(order.UserID, id, o.ID, o.Timestamp)
+					}
+				}
+			}
+		}
+	}
+	for id, signed := range s.SignedOrders {
+		ex.signedOrders[id] = signed
+	}
+	for address, nonces := range s.OrderNonces {
+		for _, nonce := range nonces {
+			ex.markOrderNonceLocked(address, nonce)
+		}
+	}
+
+	return nil
+}
+
+// replay runs a journaled command on the book of its market again,
+// without settling its matches.
+func (ex *Exchange) replay(market Market, cmd *Command) error {
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return ErrMarketNotFound
+	}
+
+	var cancelled []*orderbook.Order
+	for _, id := range cmd.OrderIDs {
+		if order, ok := ob.Order(id); ok {
+			cancelled = append(cancelled, order)
+		}
+	}
+
+	order, _, err := ApplyCommand(ob, cmd)
+	if err != nil {
+		return err
+	}
+
+	switch cmd.Type {
+	case CommandPlace:
+		ex.mu.Lock()
+		if order.ID > ex.lastOrderID {
+			ex.lastOrderID = order.ID
+		}
+		if cmd.Signed != nil {
+			ex.signedOrders[order.ID] = cmd.Signed
+			ex.markOrderNonceLocked(cmd.Signed.User, cmd.Signed.Nonce.String())
+		}
+		ex.mu.Unlock()
+
+		if cmd.ClientOrderID != "" {
+			ex.bindClientOrderID(order.UserID, cmd.ClientOrderID, order.ID, cmd.Time)
+		}
+		if cmd.OrderType == LimitOrder {
+			ex.trackOrder(order, "")
+		} else {
+			ex.mu.Lock()
+			ex.closeClientOrderLocked(order.ID)
+			ex.mu.Unlock()
+			ex.untrackFilledOrders()
+		}
+	case CommandCancel, CommandExpire:
+		ex.removeUserOrder(order)
+	case CommandCancelAll:
+		for _, order := range cancelled {
+			ex.removeUserOrder(order)
+		}
+	}
+	return nil
+}
+
+// RunSnapshots writes a snapshot of the books to the journal directory
+// every interval until ctx is done, and removes the journal segments
+// before the oldest snapshot kept. It needs the journal to be enabled.
+func (ex *Exchange) RunSnapshots(ctx context.Context, dir string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s := ex.Snapshot()
+		if s.Seq == last {
+			continue
+		}
+		if err := WriteSnapshot(dir, s); err != nil {
+			logrus.Errorf("snapshot: %v", err)
+			continue
+		}
+		last = s.Seq
+
+		seqs, err := snapshotSeqs(dir)
+		if err != nil {
+			logrus.Errorf("snapshot: %v", err)
+			continue
+		}
+		if err := ex.journal.Compact(seqs[0] + 1); err != nil {
+			logrus.Errorf("journal compaction: %v", err)
+		}
+	}
+}
+
+// WriteSnapshot writes a snapshot to dir and removes the older snapshots
+// but the last. The snapshot is written to a temporary file first, so a
+// crash never leaves a partial snapshot.
+func WriteSnapshot(dir string, s *Snapshot) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	path := snapshotPath(dir, s.Seq)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	seqs, err := snapshotSeqs(dir)
+	if err != nil {
+		return err
+	}
+	for len(seqs) > snapshotsKept {
+		if err := os.Remove(snapshotPath(dir, seqs[0])); err != nil {
+			return err
+		}
+		seqs = seqs[1:]
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// LoadSnapshot reads the last snapshot in dir that can be read, or returns
+// nil if there is none.
+func LoadSnapshot(dir string) (*Snapshot, error) {
+	seqs, err := snapshotSeqs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(seqs) - 1; i >= 0; i-- {
+		path := snapshotPath(dir, seqs[i])
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var s Snapshot
+		if err := json.Unmarshal(b, &s); err != nil {
+			logrus.WithField("snapshot", path).Warnf("skipping damaged snapshot: %v", err)
+			continue
+		}
+		return &s, nil
+	}
+	return nil, nil
+}
+
+// snapshotSeqs returns the journal sequence numbers of the snapshots in
+// dir, oldest first.
+func snapshotSeqs(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, snapshotExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, snapshotExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, k int) bool { return seqs[i] < seqs[k] })
+	return seqs, nil
+}
+
+func snapshotPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seq, snapshotExt))
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tahaontech/crypto_exchange/journal"
+)
+
+// runCommands runs the commands from to to of a stream of random orders,
+// amends and cancels on ex. The command i runs at i milliseconds.
+func runCommands(t *testing.T, ex *Exchange, rng *rand.Rand, from, to int) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		now := time.Unix(0, int64(i)*int64(time.Millisecond))
+		ex.now = func() time.Time { return now }
+
+		book, err := ex.Book(MarketETH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		orders := append(book.Bids, book.Asks...)
+
+		switch n := rng.Intn(10); {
+		case n < 5 || len(orders) == 0:
+			bid := rng.Intn(2) == 0
+			price := float64(101 + rng.Intn(10))
+			if bid {
+				price = float64(90 + rng.Intn(10))
+			}
+			_, err = ex.PlaceOrder(&PlaceOrderRequest{
+				UserID: int64(1 + rng.Intn(3)),
+				Type:   LimitOrder,
+				Bid:    bid,
+				Size:   float64(1+rng.Intn(100)) / 10,
+				Price:  price,
+				Market: MarketETH,
+			}, "")
+		case n < 7:
+			bid := rng.Intn(2) == 0
+			volume := book.TotalBidVolume
+			if bid {
+				volume = book.TotalAskVolume
+			}
+			size := math.Floor(volume*rng.Float64()*10) / 10
+			if size == 0 {
+				continue
+			}
+			_, err = ex.PlaceOrder(&PlaceOrderRequest{
+				UserID: 4,
+				Type:   MarketOrder,
+				Bid:    bid,
+				Size:   size,
+				Market: MarketETH,
+			}, "")
+		case n < 8:
+			o := orders[rng.Intn(len(orders))]
+			err = ex.AmendOrder(orderUser(ex, o.ID), o.ID, o.Price+float64(rng.Intn(3)-1), float64(1+rng.Intn(100))/10)
+		default:
+			o := orders[rng.Intn(len(orders))]
+			err = ex.CancelOrder(orderUser(ex, o.ID), o.ID)
+		}
+		if err != nil {
+			t.Fatalf("command %d: %v", i, err)
+		}
+	}
+}
+
+// placeSignedOrder places a small market bid of user 5, signed by key with
+// nonce.
+func placeSignedOrder(t *testing.T, ex *Exchange, key *ecdsa.PrivateKey, nonce int64) error {
+	t.Helper()
+
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	if _, ok := ex.user(5); !ok {
+		if err := ex.registerUser(&User{ID: 5, Address: address}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	signed := NewSignedOrder(address, ex.markets[MarketETH], true, 1000, 0.1, nonce, time.Now().Add(time.Hour))
+	if err := signed.Sign(key, chainID, common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ex.PlaceOrder(&PlaceOrderRequest{UserID: 5, Type: MarketOrder, Bid: true, Size: 0.1, Market: MarketETH, Signed: signed}, "")
+	return err
+}
+
+// orderUser returns the user of an order of the book, which the L3 view
+// does not show.
+func orderUser(ex *Exchange, id int64) int64 {
+	order, _ := ex.orderbooks[MarketETH].Order(id)
+	return order.UserID
+}
+
+// exchangeState encodes the books of ex, without the journal sequence number.
+func exchangeState(t *testing.T, ex *Exchange) []byte {
+	t.Helper()
+
+	s := ex.Snapshot()
+	s.Seq = 0
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRecover(t *testing.T) {
+	const (
+		snapshotAt = 80
+		killAt     = 150
+		end        = 300
+	)
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedOrders := func(ex *Exchange, nonces ...int64) {
+		t.Helper()
+
+		for _, nonce := range nonces {
+			if err := placeSignedOrder(t, ex, key, nonce); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The uninterrupted run. Signed orders are placed before and after the
+	// snapshot.
+	ex := newTestExchange(t, newTestChain(t, 1))
+	rng := rand.New(rand.NewSource(1))
+	runCommands(t, ex, rng, 0, snapshotAt)
+	signedOrders(ex, 1, 2)
+	runCommands(t, ex, rng, snapshotAt, end)
+	want := exchangeState(t, ex)
+
+	// The same run, killed after killAt commands.
+	dir := t.TempDir()
+	rng = rand.New(rand.NewSource(1))
+	killed := newTestExchange(t, newTestChain(t, 1))
+	j, err := journal.Open(dir, journal.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	killed.EnableJournal(j)
+
+	runCommands(t, killed, rng, 0, snapshotAt)
+	signedOrders(killed, 1)
+	if err := WriteSnapshot(dir, killed.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	signedOrders(killed, 2)
+	runCommands(t, killed, rng, snapshotAt, killAt)
+	atKill := exchangeState(t, killed)
+
+	// The kill tears the last record and a snapshot being written.
+	j.Close()
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.journal"))
+	last := segments[len(segments)-1]
+	info, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(snapshotPath(dir, 1<<40), []byte(`{"Seq": 1`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := newTestExchange(t, newTestChain(t, 1))
+	j, err = journal.Open(dir, journal.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if err := recovered.Recover(dir); err != nil {
+		t.Fatal(err)
+	}
+	recovered.EnableJournal(j)
+
+	if got := exchangeState(t, recovered); !bytes.Equal(got, atKill) {
+		t.Fatalf("recovered books differ from the killed books:\n%s\n%s", got, atKill)
+	}
+
+	runCommands(t, recovered, rng, killAt, end)
+	if got := exchangeState(t, recovered); !bytes.Equal(got, want) {
+		t.Fatalf("books differ from the uninterrupted run:\n%s\n%s", got, want)
+	}
+	assert(t, len(recovered.UserOrders(1).Bids)+len(recovered.UserOrders(1).Asks) > 0, true)
+
+	// The nonces of the signed orders in the snapshot and in the journal
+	// stay used.
+	for _, nonce := range []int64{1, 2} {
+		assert(t, errors.Is(placeSignedOrder(t, recovered, key, nonce), ErrOrderNonceUsed), true)
+	}
+	assert(t, placeSignedOrder(t, recovered, key, 3), nil)
+}
@@ -0,0 +1,470 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+// recentTrades is the number of trades a book keeps in memory, and the
+// number of trades returned by Trades. Older trades are in the store.
+const recentTrades = 1000
+
+// bookState serializes the commands of a market and collects the records
+// of their events, which are written to the store once the command ran.
+type bookState struct {
+	sync.Mutex
+	// orders are the records of the open orders of the market.
+	orders  map[int64]*store.Order
+	pending store.Batch
+	// takerLeft is what is left of the market order of the command.
+	takerLeft float64
+}
+
+func (ex *Exchange) bookState(market Market) *bookState {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	state, ok := ex.bookStates[market]
+	if !ok {
+		state = &bookState{orders: make(map[int64]*store.Order)}
+		ex.bookStates[market] = state
+	}
+	return state
+}
+
+// EnableStore keeps the history of the exchange in s and adds the users
+// stored in it. It has to be called before the exchange runs commands.
+func (ex *Exchange) EnableStore(s store.Store) error {
+	records, err := s.Users()
+	if err != nil {
+		return err
+	}
+	lastOrderID, err := s.LastOrderID()
+	if err != nil {
+		return err
+	}
+	nonces, err := s.Nonces()
+	if err != nil {
+		return err
+	}
+	apiKeyRecords, err := s.APIKeys()
+	if err != nil {
+		return err
+	}
+
+	var (
+		users  = make([]*User, len(records))
+		legacy []*store.User
+	)
+	for i, record := range records {
+		if users[i], err = ex.userFromRecord(record); err != nil {
+			return err
+		}
+		if record.PrivateKey != "" {
+			// Keys stored in plain are encrypted in place.
+			if record, err = ex.userRecord(users[i]); err != nil {
+				return err
+			}
+			legacy = append(legacy, record)
+		}
+	}
+	if len(legacy) > 0 {
+		if err := s.Write(&store.Batch{Users: legacy}); err != nil {
+			return err
+		}
+	}
+
+	var apiKeys []*APIKey
+	for _, record := range apiKeyRecords {
+		if record.RevokedAt != 0 {
+			continue
+		}
+		apiKey, err := ex.apiKeyFromRecord(record)
+		if err != nil {
+			return err
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+	ex.apiKeys.load(apiKeys)
+
+	if ex.escrow != nil {
+		if err := ex.escrow.SetStore(s); err != nil {
+			return err
+		}
+	}
+
+	ex.mu.Lock()
+	ex.store = s
+	if lastOrderID > ex.lastOrderID {
+		ex.lastOrderID = lastOrderID
+	}
+	for _, user := range users {
+		ex.Users[user.ID] = user
+		ex.userAddresses[user.Address] = user.ID
+	}
+	for _, nonce := range nonces {
+		ex.markOrderNonceLocked(common.HexToAddress(nonce.Address), nonce.Nonce)
+	}
+	ex.mu.Unlock()
+
+	if err := ex.Ledger.SetStore(s); err != nil {
+		return err
+	}
+	ex.deposits.SetStore(s)
+	if err := ex.withdrawals.SetStore(s, ex.asset); err != nil {
+		return err
+	}
+	for _, user := range users {
+		ex.deposits.Watch(user.ID, user.DepositAddress)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"users":       len(users),
+		"apiKeys":     len(apiKeys),
+		"lastOrderID": lastOrderID,
+	}).Info("loaded store")
+
+	return nil
+}
+
+// userRecord returns the record of a user. The key of the user is
+// encrypted with a key derived from the exchange key, so it is never
+// stored in plain.
+func (ex *Exchange) userRecord(user *User) (*store.User, error) {
+	record := &store.User{
+		ID:             user.ID,
+		Address:        user.Address.Hex(),
+		DepositAddress: user.DepositAddress.Hex(),
+	}
+	if user.PrivateKey != nil {
+		sealed, err := ex.seal(crypto.FromECDSA(user.PrivateKey), userKeyData(user.ID))
+		if err != nil {
+			return nil, err
+		}
+		record.EncryptedKey = sealed
+	}
+	return record, nil
+}
+
+func (ex *Exchange) userFromRecord(record *store.User) (*User, error) {
+	user := &User{
+		ID:             record.ID,
+		Address:        common.HexToAddress(record.Address),
+		DepositAddress: common.HexToAddress(record.DepositAddress),
+	}
+
+	var plain []byte
+	switch {
+	case record.EncryptedKey != "":
+		var err error
+		if plain, err = ex.open(record.EncryptedKey, userKeyData(record.ID)); err != nil {
+			return nil, fmt.Errorf("decrypting the key of user %d: %w", record.ID, err)
+		}
+	case record.PrivateKey != "":
+		var err error
+		if plain, err = hex.DecodeString(record.PrivateKey); err != nil {
+			return nil, err
+		}
+	default:
+		return user, nil
+	}
+
+	key, err := crypto.ToECDSA(plain)
+	if err != nil {
+		return nil, err
+	}
+	user.PrivateKey = key
+	return user, nil
+}
+
+// seal encrypts a secret to be stored, bound to data, and returns it hex
+// encoded with its nonce.
+func (ex *Exchange) seal(plain, data []byte) (string, error) {
+	aead, err := ex.userKeyCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(aead.Seal(nonce, nonce, plain, data)), nil
+}
+
+// open decrypts a secret encrypted by seal with the same data.
+func (ex *Exchange) open(sealed string, data []byte) ([]byte, error) {
+	b, err := hex.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := ex.userKeyCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("truncated secret")
+	}
+	return aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], data)
+}
+
+// userKeyCipher is the cipher of the stored user keys and API key secrets,
+// keyed by the exchange key like the deposit addresses.
+func (ex *Exchange) userKeyCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(crypto.Keccak256(crypto.FromECDSA(ex.PrivateKey), []byte("user keys")))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// userKeyData binds an encrypted key to its user, so it can not be moved
+// to another record.
+func userKeyData(userID int64) []byte {
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, uint64(userID))
+	return id
+}
+
+// saveAPIKey writes an API key to the store, its secret encrypted like the
+// keys of the users. revokedAt is the time the key was revoked, if it was.
+func (ex *Exchange) saveAPIKey(apiKey *APIKey, revokedAt int64) error {
+	secret, err := ex.seal([]byte(apiKey.Secret), apiKeyData(apiKey.Key))
+	if err != nil {
+		return err
+	}
+	record := &store.APIKey{
+		Key:             apiKey.Key,
+		UserID:          apiKey.UserID,
+		EncryptedSecret: secret,
+		CreatedAt:       apiKey.CreatedAt,
+		RevokedAt:       revokedAt,
+	}
+	for _, scope := range apiKey.Scopes {
+		record.Scopes = append(record.Scopes, string(scope))
+	}
+	return ex.store.Write(&store.Batch{APIKeys: []*store.APIKey{record}})
+}
+
+func (ex *Exchange) apiKeyFromRecord(record *store.APIKey) (*APIKey, error) {
+	secret, err := ex.open(record.EncryptedSecret, apiKeyData(record.Key))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting the secret of api key %s: %w", record.Key, err)
+	}
+	apiKey := &APIKey{
+		Key:       record.Key,
+		Secret:    string(secret),
+		UserID:    record.UserID,
+		CreatedAt: record.CreatedAt,
+	}
+	for _, scope := range record.Scopes {
+		apiKey.Scopes = append(apiKey.Scopes, Scope(scope))
+	}
+	return apiKey, nil
+}
+
+// apiKeyData binds an encrypted secret to its API key. It can not be
+// mistaken for the data of a user key, which is 8 bytes long.
+func apiKeyData(key string) []byte {
+	return []byte("api key " + key)
+}
+
+// recordEvent adds the records of an event of a book to the batch of the
+// command that caused it. It is called with the book locked by execute.
+func (ex *Exchange) recordEvent(market Market, event orderbook.Event) {
+	state := ex.bookState(market)
+	o := event.Order
+
+	switch event.Type {
+	case orderbook.EventAccepted:
+		orderType := LimitOrder
+		if event.Price == 0 {
+			orderType = MarketOrder
+		}
+		record := &store.Order{
+			ID:            o.ID,
+			UserID:        o.UserID,
+			Market:        string(market),
+			Type:          string(orderType),
+			Bid:           o.Bid,
+			Price:         event.Price,
+			ClientOrderID: ex.clientOrderID(o.ID),
+			OriginalSize:  o.Size,
+			Size:          o.Size,
+			Status:        string(OrderAccepted),
+			CreatedAt:     event.Time,
+		}
+		state.orders[o.ID] = record
+		state.takerLeft = o.Size
+		state.update(record, event.Time)
+	case orderbook.EventMatch:
+		taker, maker := event.Match.Bid, event.Match.Ask
+		if taker != o {
+			taker, maker = maker, taker
+		}
+		for _, order := range []*orderbook.Order{maker, taker} {
+			record := ex.orderRecord(state, market, order, event.Price)
+			filled := record.Filled + event.Match.SizeFilled
+			record.AvgPrice = (record.AvgPrice*record.Filled + event.Price*event.Match.SizeFilled) / filled
+			record.Filled = filled
+
+			left := order.Size
+			if order == taker {
+				// The matches of a market order are emitted once it was
+				// filled, so what is left of it is counted down here the
+				// way the book did.
+				state.takerLeft -= event.Match.SizeFilled
+				left = state.takerLeft
+			} else {
+				record.Size = record.Filled + left
+			}
+			if left == 0 {
+				setStatus(record, OrderFilled)
+			} else {
+				setStatus(record, OrderPartiallyFilled)
+			}
+			state.update(record, event.Time)
+		}
+
+		feeAsset, makerFee := fillFee(ex.markets[market], event.Match.SizeFilled, event.Price, true)
+		_, takerFee := fillFee(ex.markets[market], event.Match.SizeFilled, event.Price, false)
+		state.pending.Trades = append(state.pending.Trades, &store.Trade{
+			Market:       string(market),
+			Price:        event.Price,
+			Size:         event.Match.SizeFilled,
+			Bid:          taker.Bid,
+			TakerOrderID: taker.ID,
+			TakerUserID:  taker.UserID,
+			MakerOrderID: maker.ID,
+			MakerUserID:  maker.UserID,
+			MakerFee:     makerFee,
+			TakerFee:     takerFee,
+			FeeAsset:     feeAsset.Symbol,
+			Timestamp:    event.Time,
+		})
+	case orderbook.EventCancelled, orderbook.EventExpired:
+		record := ex.orderRecord(state, market, o, event.Price)
+		if event.Type == orderbook.EventExpired {
+			setStatus(record, OrderExpired)
+		} else {
+			setStatus(record, OrderCancelled)
+		}
+		state.update(record, event.Time)
+	case orderbook.EventAmended:
+		record := ex.orderRecord(state, market, o, event.Price)
+		record.Price = event.Price
+		record.Size = record.Filled + o.Size
+		setStatus(record, OrderAmended)
+		state.update(record, event.Time)
+	}
+}
+
+// orderRecord returns the record of an open order. Orders that are not
+// known since a restart are read from the store, or recorded from the book
+// if the store lost them.
+func (ex *Exchange) orderRecord(state *bookState, market Market, order *orderbook.Order, price float64) *store.Order {
+	if record, ok := state.orders[order.ID]; ok {
+		return record
+	}
+
+	record, err := ex.store.Order(order.ID)
+	if err != nil {
+		record = &store.Order{
+			ID:            order.ID,
+			UserID:        order.UserID,
+			Market:        string(market),
+			Type:          string(LimitOrder),
+			Bid:           order.Bid,
+			Price:         price,
+			ClientOrderID: ex.clientOrderID(order.ID),
+			OriginalSize:  order.Size,
+			Size:          order.Size,
+			Status:        string(OrderAccepted),
+			CreatedAt:     order.Timestamp,
+		}
+	}
+	state.orders[order.ID] = record
+	return record
+}
+
+// setStatus moves an order record to a status. An event that moves an
+// order out of a final status is a bug, so the status is kept and logged.
+func setStatus(record *store.Order, status OrderStatus) {
+	from := OrderStatus(record.Status)
+	if !from.canMoveTo(status) {
+		logrus.WithFields(logrus.Fields{
+			"order": record.ID,
+			"from":  from,
+			"to":    status,
+		}).Error("invalid order status transition")
+		return
+	}
+	record.Status = string(status)
+}
+
+// update adds an order record to the pending batch, and forgets the orders
+// that left the book.
+func (s *bookState) update(record *store.Order, now int64) {
+	record.UpdatedAt = now
+
+	if !OrderStatus(record.Status).Open() {
+		delete(s.orders, record.ID)
+	}
+
+	for _, pending := range s.pending.Orders {
+		if pending == record {
+			return
+		}
+	}
+	s.pending.Orders = append(s.pending.Orders, record)
+}
+
+// writeRecords writes and returns the records of the last command of a
+// market. It is called with the book locked by execute. The books are
+// recovered from the journal, so a failed write only loses history and is
+// logged.
+func (ex *Exchange) writeRecords(state *bookState) *store.Batch {
+	records := state.pending
+	state.pending = store.Batch{}
+	if records.Empty() {
+		return &records
+	}
+
+	if err := ex.store.Write(&records); err != nil {
+		logrus.Errorf("store: %v", err)
+	}
+	return &records
+}
+
+// recordSettlement writes a settlement to records, if there are any,
+// together with the records of b, which may be nil.
+func recordSettlement(records store.Store, settlement *store.Settlement, b *store.Batch) {
+	if records == nil {
+		return
+	}
+
+	settlement.UpdatedAt = time.Now().UnixNano()
+	if settlement.CreatedAt == 0 {
+		settlement.CreatedAt = settlement.UpdatedAt
+	}
+	batch := store.Batch{}
+	if b != nil {
+		batch = *b
+	}
+	batch.Settlements = append(batch.Settlements, settlement)
+	if err := records.Write(&batch); err != nil {
+		logrus.WithField("tx", settlement.TxHash).Errorf("store: %v", err)
+	}
+}
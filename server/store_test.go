@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+func TestStoreHistory(t *testing.T) {
+	chain := newTestChain(t, 2)
+	path := filepath.Join(t.TempDir(), "exchange.db")
+
+	open := func() (*Exchange, store.Store) {
+		s, err := store.OpenBolt(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex := newTestExchange(t, chain)
+		if err := ex.EnableStore(s); err != nil {
+			t.Fatal(err)
+		}
+		return ex, s
+	}
+
+	ex, s := open()
+	for i, key := range chain.keys {
+		user := &User{ID: int64(i + 1), PrivateKey: key, Address: crypto.PubkeyToAddress(key.PublicKey)}
+		if err := ex.registerUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ask, taker PlaceOrderResponse
+	decode(t, placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Size: 2, Price: 100, Market: MarketETH}), &ask)
+	decode(t, placeOrder(t, ex, 2, PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: 0.5, Market: MarketETH}), &taker)
+	if err := ex.CancelOrder(1, ask.OrderID); err != nil {
+		t.Fatal(err)
+	}
+
+	order, err := s.Order(ask.OrderID)
+	assert(t, err, nil)
+	assert(t, order.Status, string(OrderCancelled))
+	assert(t, order.Size, 2.0)
+	assert(t, order.Filled, 0.5)
+	order, err = s.Order(taker.OrderID)
+	assert(t, err, nil)
+	assert(t, order.Type, string(MarketOrder))
+	assert(t, order.Status, string(OrderFilled))
+
+	trades, err := s.Trades(string(MarketETH), 10)
+	assert(t, err, nil)
+	assert(t, len(trades), 1)
+	assert(t, trades[0].MakerOrderID, ask.OrderID)
+	assert(t, trades[0].TakerUserID, int64(2))
+
+	settlement, err := s.Settlement(1)
+	assert(t, err, nil)
+	assert(t, settlement.Status, store.SettlementSent)
+	assert(t, settlement.FromUserID, int64(1))
+	assert(t, settlement.TxHash != "", true)
+
+	// Keys are stored encrypted. A key stored in plain by an older version
+	// is encrypted on the next start.
+	records, err := s.Users()
+	assert(t, err, nil)
+	for _, record := range records {
+		assert(t, record.PrivateKey, "")
+		assert(t, strings.Contains(record.EncryptedKey, hex.EncodeToString(crypto.FromECDSA(chain.keys[record.ID-1]))), false)
+	}
+	records[1].EncryptedKey = ""
+	records[1].PrivateKey = hex.EncodeToString(crypto.FromECDSA(chain.keys[1]))
+	assert(t, s.Write(&store.Batch{Users: records[1:]}), nil)
+
+	// So are the secrets of API keys, and revoked keys stay revoked.
+	apiKey, err := ex.apiKeys.Create(1, []Scope{ScopeRead})
+	assert(t, err, nil)
+	revoked, err := ex.apiKeys.Create(1, AllScopes)
+	assert(t, err, nil)
+	assert(t, ex.apiKeys.Revoke(1, revoked.Key), nil)
+	apiKeyRecords, err := s.APIKeys()
+	assert(t, err, nil)
+	assert(t, len(apiKeyRecords), 2)
+	for _, record := range apiKeyRecords {
+		assert(t, strings.Contains(record.EncryptedSecret, hex.EncodeToString([]byte(apiKey.Secret))), false)
+		assert(t, strings.Contains(record.EncryptedSecret, apiKey.Secret), false)
+	}
+	assert(t, s.Close(), nil)
+
+	// The users and the history survive a restart.
+	ex, s = open()
+	defer s.Close()
+
+	user, ok := ex.user(1)
+	assert(t, ok, true)
+	assert(t, user.PrivateKey.D, chain.keys[0].D)
+	user, _ = ex.user(2)
+	assert(t, user.PrivateKey.D, chain.keys[1].D)
+	records, _ = s.Users()
+	assert(t, records[1].PrivateKey, "")
+	assert(t, records[1].EncryptedKey != "", true)
+	assert(t, ex.registerUser(&User{ID: 2}) != nil, true)
+
+	assert(t, len(ex.apiKeys.List(1)), 1)
+	verify := func(apiKey *APIKey) error {
+		ts := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		_, err := ex.apiKeys.Verify(apiKey.Key, ts, "n1", SignRequest(apiKey.Secret, "GET", "/orders", ts, "n1", nil), "GET", "/orders", nil)
+		return err
+	}
+	assert(t, verify(apiKey), nil)
+	assert(t, verify(revoked), ErrInvalidAPIKey)
+	assert(t, ex.apiKeys.List(1)[0].Scopes, []Scope{ScopeRead})
+
+	tradesResp, err := ex.Trades(MarketETH)
+	assert(t, err, nil)
+	assert(t, len(tradesResp), 1)
+	assert(t, tradesResp[0].Price, 100.0)
+
+	var next PlaceOrderResponse
+	decode(t, placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Size: 1, Price: 100, Market: MarketETH}), &next)
+	assert(t, next.OrderID, taker.OrderID+1)
+}
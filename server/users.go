@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+var (
+	ErrUserExists = errors.New("user already exists")
+	ErrNoUserKey  = errors.New("user has no key on the exchange")
+)
+
+// RegisterUserRequest registers a user for direct settlement, where the
+// exchange signs the transfers of the user with their PrivateKey. Users who
+// keep custody of their keys register by signing in with their wallet.
+type RegisterUserRequest struct {
+	// ID is optional, the next free ID is assigned when it is zero.
+	ID int64
+	// Address is optional and checked against the PrivateKey.
+	Address    common.Address
+	PrivateKey string
+}
+
+// RegisterUserResponse holds the first API key of the user. The secret
+// can not be retrieved again.
+type RegisterUserResponse struct {
+	ID             int64
+	Address        common.Address
+	DepositAddress common.Address
+	APIKey         string
+	APISecret      string
+}
+
+// user looks up a registered user.
+func (ex *Exchange) user(id int64) (*User, bool) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	user, ok := ex.Users[id]
+	return user, ok
+}
+
+func (ex *Exchange) userByAddress(address common.Address) (*User, bool) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	id, ok := ex.userAddresses[address]
+	if !ok {
+		return nil, false
+	}
+	return ex.Users[id], true
+}
+
+// registerUser adds user to the exchange and the store, assigning them the
+// next free ID when they have none, and starts watching their deposit
+// address.
+func (ex *Exchange) registerUser(user *User) error {
+	ex.mu.Lock()
+	if user.ID == 0 {
+		for {
+			ex.nextUserID++
+			if _, ok := ex.Users[ex.nextUserID]; !ok {
+				break
+			}
+		}
+		user.ID = ex.nextUserID
+	}
+	if _, ok := ex.Users[user.ID]; ok {
+		ex.mu.Unlock()
+		return fmt.Errorf("%w: %d", ErrUserExists, user.ID)
+	}
+	if _, ok := ex.userAddresses[user.Address]; ok {
+		ex.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUserExists, user.Address)
+	}
+
+	depositKey, err := deriveDepositKey(ex.PrivateKey, user.ID)
+	if err != nil {
+		ex.mu.Unlock()
+		return err
+	}
+	user.DepositAddress = crypto.PubkeyToAddress(depositKey.PublicKey)
+	record, err := ex.userRecord(user)
+	if err != nil {
+		ex.mu.Unlock()
+		return err
+	}
+	if err := ex.store.Write(&store.Batch{Users: []*store.User{record}}); err != nil {
+		ex.mu.Unlock()
+		return err
+	}
+	ex.Users[user.ID] = user
+	ex.userAddresses[user.Address] = user.ID
+	ex.mu.Unlock()
+
+	ex.deposits.Watch(user.ID, user.DepositAddress)
+
+	logrus.WithFields(logrus.Fields{
+		"id":             user.ID,
+		"address":        user.Address,
+		"depositAddress": user.DepositAddress,
+	}).Info("new exchange user")
+
+	return nil
+}
+
+// RegisterUser adds a user with a private key on the exchange and creates
+// their first API key.
+func (ex *Exchange) RegisterUser(user *User) (*APIKey, error) {
+	if err := ex.registerUser(user); err != nil {
+		return nil, err
+	}
+	return ex.apiKeys.Create(user.ID, AllScopes)
+}
+
+func (ex *Exchange) handleRegisterUser(c echo.Context) error {
+	var req RegisterUserRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request body"})
+	}
+	if req.ID < 0 {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	if req.PrivateKey == "" {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "missing private key, sign in with your wallet instead"})
+	}
+
+	user, err := NewUser(req.PrivateKey, req.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid private key"})
+	}
+	if req.Address != (common.Address{}) && req.Address != user.Address {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "address does not match the private key"})
+	}
+
+	apiKey, err := ex.RegisterUser(user)
+	if err != nil {
+		if errors.Is(err, ErrUserExists) {
+			return c.JSON(http.StatusConflict, APIError{Error: err.Error()})
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, RegisterUserResponse{
+		ID:             user.ID,
+		Address:        user.Address,
+		DepositAddress: user.DepositAddress,
+		APIKey:         apiKey.Key,
+		APISecret:      apiKey.Secret,
+	})
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo/v4"
+)
+
+func newTestExchange(t *testing.T, chain *testChain) *Exchange {
+	t.Helper()
+
+	key := mustKey(t, "8a1f9a8f95be41cd7ccb6168179afb4504aefe388d1e14474d32c45c72ce7b7a")
+	ex, err := NewExchange(key, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ex
+}
+
+func TestRegisterUser(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+
+	register := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		if err := ex.handleRegisterUser(echo.New().NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	rec := register(`{"PrivateKey": "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4"}`)
+	assert(t, rec.Code, http.StatusOK)
+
+	var resp RegisterUserResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, resp.ID, int64(1))
+	assert(t, resp.Address, common.HexToAddress("0xACa94ef8bD5ffEE41947b4585a84BdA5a3d3DA6E"))
+
+	user, ok := ex.user(resp.ID)
+	assert(t, ok, true)
+	assert(t, user.DepositAddress, resp.DepositAddress)
+
+	rec = register(`{"ID": 8, "PrivateKey": "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3"}`)
+	assert(t, rec.Code, http.StatusOK)
+	rec = register(`{"ID": 8, "PrivateKey": "e485d098507f54e7733a205420dfddbe58db035fa577fc294ebd14db90767a52"}`)
+	assert(t, rec.Code, http.StatusConflict)
+	rec = register(`{"PrivateKey": "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4"}`)
+	assert(t, rec.Code, http.StatusConflict)
+	rec = register(`{"Address": "0x00000000000000000000000000000000000000aa"}`)
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = register(`{"PrivateKey": "nope"}`)
+	assert(t, rec.Code, http.StatusBadRequest)
+	rec = register(`{}`)
+	assert(t, rec.Code, http.StatusBadRequest)
+}
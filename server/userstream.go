@@ -0,0 +1,333 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+)
+
+const (
+	OrderAccepted        OrderStatus = "ACCEPTED"
+	OrderPartiallyFilled OrderStatus = "PARTIALLY_FILLED"
+	OrderFilled          OrderStatus = "FILLED"
+	OrderCancelled       OrderStatus = "CANCELLED"
+	OrderExpired         OrderStatus = "EXPIRED"
+	OrderRejected        OrderStatus = "REJECTED"
+	// OrderAmended is the status of an order after its price or size was
+	// changed.
+	OrderAmended OrderStatus = "AMENDED"
+
+	// ChannelOrders streams the order updates, fills and balance changes
+	// of the authenticated user.
+	ChannelOrders Channel = "orders"
+
+	// feeAccount is the ledger account the fees are credited to.
+	feeAccount int64 = 0
+)
+
+// ErrFeesOwed rejects the orders of users who owe fees the ledger balance
+// did not cover.
+var ErrFeesOwed = errors.New("fees owed")
+
+type OrderStatus string
+
+// OrderUpdate is a change of the status of an order. Size is what is left
+// of the order. Rejected orders have no ID.
+type OrderUpdate struct {
+	OrderID   int64
+	Market    Market
+	Status    OrderStatus
+	Bid       bool
+	Price     float64
+	Size      float64
+	Reason    string `json:",omitempty"`
+	Timestamp int64
+}
+
+// Fill is the part of an order filled by one match. The fills of the
+// history of a user also have the ID of their trade and the hashes of the
+// transactions that settled it.
+type Fill struct {
+	TradeID       uint64 `json:",omitempty"`
+	OrderID       int64
+	Market        Market
+	Bid           bool
+	Price         float64
+	Size          float64
+	Maker         bool
+	Fee           float64
+	FeeAsset      string
+	SettlementTxs []string `json:",omitempty"`
+	Timestamp     int64
+}
+
+// BalanceUpdate is the new ledger balance of the user in an asset.
+type BalanceUpdate struct {
+	Asset   string
+	Balance float64
+	Value   *big.Int // Balance in base units of the asset
+}
+
+// UserEvent is a private event of a user. Data is an OrderUpdate, a Fill
+// or a BalanceUpdate, depending on Type.
+type UserEvent struct {
+	Type WSMessageType
+	Data any
+}
+
+// userFeeds sends the private events of every user to their websocket
+// connections and to the handlers of other gateways.
+type userFeeds struct {
+	mu    sync.Mutex
+	conns map[int64]map[*wsConn]bool
+	// held are the order updates sent to a user when they subscribe the
+	// next time.
+	held        map[int64][]OrderUpdate
+	handlers    map[int64]map[int]func(UserEvent)
+	nextHandler int
+}
+
+func newUserFeeds() *userFeeds {
+	return &userFeeds{
+		conns:    make(map[int64]map[*wsConn]bool),
+		held:     make(map[int64][]OrderUpdate),
+		handlers: make(map[int64]map[int]func(UserEvent)),
+	}
+}
+
+// hold keeps order updates for the next subscription of the user.
+func (f *userFeeds) hold(userID int64, updates []OrderUpdate) {
+	if len(updates) == 0 {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.held[userID] = append(f.held[userID], updates...)
+}
+
+func (f *userFeeds) subscribe(userID int64, conn *wsConn, requestID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.conns[userID] == nil {
+		f.conns[userID] = make(map[*wsConn]bool)
+	}
+	f.conns[userID][conn] = true
+	conn.send(WSMessage{Type: WSSubscribed, ID: requestID, Channel: ChannelOrders})
+
+	for _, update := range f.held[userID] {
+		conn.send(WSMessage{Type: WSOrder, Channel: ChannelOrders, Data: update})
+	}
+	delete(f.held, userID)
+}
+
+func (f *userFeeds) unsubscribe(userID int64, conn *wsConn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.conns[userID], conn)
+	if len(f.conns[userID]) == 0 {
+		delete(f.conns, userID)
+	}
+}
+
+// handle adds a handler of the events of the user and returns the func
+// removing it.
+func (f *userFeeds) handle(userID int64, handler func(UserEvent)) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nextHandler++
+	id := f.nextHandler
+	if f.handlers[userID] == nil {
+		f.handlers[userID] = make(map[int]func(UserEvent))
+	}
+	f.handlers[userID][id] = handler
+
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		delete(f.handlers[userID], id)
+		if len(f.handlers[userID]) == 0 {
+			delete(f.handlers, userID)
+		}
+	}
+}
+
+func (f *userFeeds) publish(userID int64, msgType WSMessageType, data any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, handler := range f.handlers[userID] {
+		handler(UserEvent{Type: msgType, Data: data})
+	}
+
+	if len(f.conns[userID]) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(WSMessage{Type: msgType, Channel: ChannelOrders, Data: data})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	for conn := range f.conns[userID] {
+		conn.enqueue(b)
+	}
+}
+
+// watchOrderbook turns the events of the orderbook of market into order
+// updates and fills for the users.
+func (ex *Exchange) watchOrderbook(market Market, ob *orderbook.Orderbook) {
+	ob.OnEvent(func(event orderbook.Event) {
+		ex.handleEngineEvent(market, event)
+	})
+}
+
+// handleEngineEvent is called with the orderbook locked.
+func (ex *Exchange) handleEngineEvent(market Market, event orderbook.Event) {
+	ex.journalEvent(market, event)
+	ex.recordEvent(market, event)
+
+	switch event.Type {
+	case orderbook.EventAccepted:
+		ex.publishOrderUpdate(market, event.Order, event.Price, OrderAccepted, event.Time)
+	case orderbook.EventCancelled:
+		ex.publishOrderUpdate(market, event.Order, event.Price, OrderCancelled, event.Time)
+	case orderbook.EventExpired:
+		ex.publishOrderUpdate(market, event.Order, event.Price, OrderExpired, event.Time)
+	case orderbook.EventAmended:
+		ex.publishOrderUpdate(market, event.Order, event.Price, OrderAmended, event.Time)
+	case orderbook.EventMatch:
+		taker, maker := event.Match.Bid, event.Match.Ask
+		if taker != event.Order {
+			taker, maker = maker, taker
+		}
+		ex.fill(market, maker, event.Match, true, event.Time)
+		ex.fill(market, taker, event.Match, false, event.Time)
+	}
+}
+
+// fill publishes the fill of the order for a match at Unix nanoseconds
+// timestamp and charges its fee.
+func (ex *Exchange) fill(market Market, order *orderbook.Order, match *orderbook.Match, maker bool, timestamp int64) {
+	feeAsset, fee := fillFee(ex.markets[market], match.SizeFilled, match.Price, maker)
+
+	ex.userFeeds.publish(order.UserID, WSFill, Fill{
+		OrderID:   order.ID,
+		Market:    market,
+		Bid:       order.Bid,
+		Price:     match.Price,
+		Size:      match.SizeFilled,
+		Maker:     maker,
+		Fee:       fee,
+		FeeAsset:  feeAsset.Symbol,
+		Timestamp: timestamp,
+	})
+
+	status := OrderPartiallyFilled
+	if order.IsFilled() {
+		status = OrderFilled
+	}
+	// Takers are market orders, which have no price.
+	price := match.Price
+	if !maker {
+		price = 0
+	}
+	ex.publishOrderUpdate(market, order, price, status, timestamp)
+
+	if fee > 0 {
+		ex.chargeFee(order.UserID, feeAsset, fee)
+	}
+}
+
+// fillFee returns the maker or taker fee of a fill. Fees are paid in the
+// quote asset, or the base asset on markets without one.
+func fillFee(cfg MarketConfig, size, price float64, maker bool) (*Asset, float64) {
+	rate := cfg.TakerFee
+	if maker {
+		rate = cfg.MakerFee
+	}
+
+	if cfg.Quote != nil {
+		return cfg.Quote, size * price * rate
+	}
+	return cfg.Base, size * rate
+}
+
+// feeAsset is the asset the fees of a market are paid in.
+func (cfg MarketConfig) feeAsset() *Asset {
+	asset, _ := fillFee(cfg, 0, 0, false)
+	return asset
+}
+
+// chargeFee moves a fee from the ledger balance of the user to the fee
+// account. The part of the fee the balance does not cover is owed, and
+// the user can not place orders until the debt is paid with a deposit.
+func (ex *Exchange) chargeFee(userID int64, asset *Asset, fee float64) {
+	value := asset.ToBaseUnits(fee)
+	err := ex.Ledger.Post(nil,
+		Entry{UserID: userID, Asset: asset.Symbol, Amount: new(big.Int).Neg(value), Owed: true},
+		Entry{UserID: feeAccount, Asset: asset.Symbol, Amount: value},
+	)
+	if err != nil {
+		logrus.WithField("user", userID).Errorf("charging fee: %v", err)
+	}
+}
+
+// checkFeesPaid fails when the user owes fees in the fee asset of a
+// market.
+func (ex *Exchange) checkFeesPaid(userID int64, cfg MarketConfig) error {
+	asset := cfg.feeAsset()
+	if balance := ex.Ledger.Balance(userID, asset.Symbol); balance.Sign() < 0 {
+		return fmt.Errorf("%w: %v %s", ErrFeesOwed, -asset.FromBaseUnits(balance), asset.Symbol)
+	}
+	return nil
+}
+
+// publishOrderUpdate publishes the status of an order at Unix nanoseconds
+// timestamp, the time of the book event that changed it.
+func (ex *Exchange) publishOrderUpdate(market Market, order *orderbook.Order, price float64, status OrderStatus, timestamp int64) {
+	ex.userFeeds.publish(order.UserID, WSOrder, OrderUpdate{
+		OrderID:   order.ID,
+		Market:    market,
+		Status:    status,
+		Bid:       order.Bid,
+		Price:     price,
+		Size:      order.Size,
+		Timestamp: timestamp,
+	})
+}
+
+// publishRejected tells the user that their order was rejected before it
+// reached the book.
+func (ex *Exchange) publishRejected(userID int64, req *PlaceOrderRequest, reason string) {
+	ex.userFeeds.publish(userID, WSOrder, OrderUpdate{
+		Market:    req.Market,
+		Status:    OrderRejected,
+		Bid:       req.Bid,
+		Price:     req.Price,
+		Size:      req.Size,
+		Reason:    reason,
+		Timestamp: ex.now().UnixNano(),
+	})
+}
+
+// publishBalance is the change handler of the ledger.
+func (ex *Exchange) publishBalance(userID int64, symbol string, balance *big.Int) {
+	update := BalanceUpdate{Asset: symbol, Value: balance}
+	if asset, ok := ex.asset(symbol); ok {
+		update.Balance = asset.FromBaseUnits(balance)
+	}
+
+	ex.userFeeds.publish(userID, WSBalance, update)
+}
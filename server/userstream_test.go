@@ -0,0 +1,106 @@
+package server
+
+import (
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestUserStream(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+	ex.markets[MarketETH] = MarketConfig{Base: AssetETH, MakerFee: 0.001, TakerFee: 0.002}
+	now := time.Unix(1_700_000_000, 0)
+	ex.now = func() time.Time { return now }
+	for id, address := range map[int64]string{1: "0x01", 2: "0x02"} {
+		if err := ex.registerUser(&User{ID: id, Address: common.HexToAddress(address)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ws := newWSClient(t, ex)
+
+	// The private channel needs an authenticated connection.
+	ws.WriteJSON(WSRequest{Op: WSSubscribe, Channel: ChannelOrders})
+	assert(t, readWS(t, ws, nil).Error, "not authenticated")
+
+	token, _, err := ex.sessions.Issue(1, common.HexToAddress("0x01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.WriteJSON(WSRequest{Op: WSAuth, Token: token})
+	assert(t, readWS(t, ws, nil).Type, WSAuthenticated)
+	ws.WriteJSON(WSRequest{Op: WSSubscribe, Channel: ChannelOrders})
+	assert(t, readWS(t, ws, nil).Type, WSSubscribed)
+
+	ex.Ledger.Credit(1, "ETH", AssetETH.ToBaseUnits(1))
+	var balance BalanceUpdate
+	assert(t, readWS(t, ws, &balance).Type, WSBalance)
+	assert(t, balance, BalanceUpdate{Asset: "ETH", Balance: 1, Value: AssetETH.ToBaseUnits(1)})
+
+	placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 2, Price: 90, Market: "BTC"})
+	var update OrderUpdate
+	assert(t, readWS(t, ws, &update).Type, WSOrder)
+	assert(t, []any{update.Status, update.Reason}, []any{OrderRejected, "market not found"})
+
+	placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 2, Price: 90, Market: MarketETH})
+	readWS(t, ws, &update)
+	assert(t, []any{update.Status, update.Price, update.Size}, []any{OrderAccepted, 90.0, 2.0})
+	orderID := update.OrderID
+
+	// Only the events of the user are sent to them.
+	ex.Ledger.Credit(2, "ETH", AssetETH.ToBaseUnits(1))
+	placeOrder(t, ex, 2, PlaceOrderRequest{Type: MarketOrder, Bid: false, Size: 0.5, Market: MarketETH})
+
+	var fill Fill
+	assert(t, readWS(t, ws, &fill).Type, WSFill)
+	assert(t, fill, Fill{OrderID: orderID, Market: MarketETH, Bid: true, Price: 90, Size: 0.5, Maker: true, Fee: 0.0005, FeeAsset: "ETH", Timestamp: now.UnixNano()})
+
+	// Updates carry the time of the book event.
+	readWS(t, ws, &update)
+	assert(t, []any{update.OrderID, update.Status, update.Size, update.Timestamp}, []any{orderID, OrderPartiallyFilled, 1.5, now.UnixNano()})
+
+	readWS(t, ws, &balance)
+	assert(t, balance.Value, new(big.Int).Sub(AssetETH.ToBaseUnits(1), AssetETH.ToBaseUnits(0.0005)))
+	assert(t, ex.Ledger.Balance(feeAccount, "ETH"), AssetETH.ToBaseUnits(0.0015))
+
+	// A fee the balance does not cover is owed, and no more orders are
+	// placed until it is paid.
+	assert(t, ex.Ledger.Debit(2, "ETH", ex.Ledger.Balance(2, "ETH")), nil)
+	placeOrder(t, ex, 2, PlaceOrderRequest{Type: MarketOrder, Bid: false, Size: 0.5, Market: MarketETH})
+	assert(t, ex.Ledger.Balance(2, "ETH"), AssetETH.ToBaseUnits(-0.001))
+	rec := placeOrder(t, ex, 2, PlaceOrderRequest{Type: LimitOrder, Bid: false, Size: 1, Price: 100, Market: MarketETH})
+	assert(t, rec.Code, http.StatusBadRequest)
+	assert(t, strings.Contains(rec.Body.String(), ErrFeesOwed.Error()), true)
+	ex.Ledger.Credit(2, "ETH", AssetETH.ToBaseUnits(0.001))
+	assert(t, placeOrder(t, ex, 2, PlaceOrderRequest{Type: LimitOrder, Bid: false, Size: 1, Price: 100, Market: MarketETH}).Code, http.StatusOK)
+
+	assert(t, readWS(t, ws, &fill).Type, WSFill)
+	assert(t, readWS(t, ws, &update).Type, WSOrder)
+	assert(t, readWS(t, ws, &balance).Type, WSBalance)
+
+	cancelOrder(t, ex, 1, orderID)
+	readWS(t, ws, &update)
+	assert(t, []any{update.OrderID, update.Status, update.Size}, []any{orderID, OrderCancelled, 1.0})
+}
+
+func TestExpireOrders(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+
+	var resp PlaceOrderResponse
+	decode(t, placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Bid: false, Size: 1, Price: 100, Market: MarketETH}), &resp)
+
+	now := time.Now()
+	ex.signedOrders[resp.OrderID] = &SignedOrder{Expiry: big.NewInt(now.Unix())}
+
+	ex.ExpireOrders(now)
+	assert(t, len(ex.orderbooks[MarketETH].Asks()), 1)
+
+	ex.ExpireOrders(now.Add(time.Second))
+	assert(t, len(ex.orderbooks[MarketETH].Asks()), 0)
+	assert(t, len(ex.Orders[1]), 0)
+	assert(t, len(ex.signedOrders), 0)
+}
@@ -0,0 +1,396 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	WSSubscribe   WSOp = "subscribe"
+	WSUnsubscribe WSOp = "unsubscribe"
+	// WSAuth authenticates the connection with a session token, for
+	// clients that can not set headers on the websocket request.
+	WSAuth WSOp = "auth"
+
+	WSSubscribed   WSMessageType = "subscribed"
+	WSUnsubscribed WSMessageType = "unsubscribed"
+	WSSnapshot     WSMessageType = "snapshot"
+	WSUpdate       WSMessageType = "update"
+	WSTrade        WSMessageType = "trade"
+	WSBBO          WSMessageType = "bbo"
+	WSOrder        WSMessageType = "order"
+	WSFill         WSMessageType = "fill"
+	WSBalance      WSMessageType = "balance"
+	WSHeartbeat    WSMessageType = "heartbeat"
+	WSError        WSMessageType = "error"
+	// WSAuthenticated confirms an auth request.
+	WSAuthenticated WSMessageType = "authenticated"
+
+	// wsReadLimit is the maximum size of a client message.
+	wsReadLimit = 4096
+)
+
+type (
+	WSOp          string
+	WSMessageType string
+)
+
+// WSRequest is a message from a websocket client. ID is chosen by the
+// client and echoed in the reply.
+type WSRequest struct {
+	ID      string `json:",omitempty"`
+	Op      WSOp
+	Channel Channel `json:",omitempty"`
+	Market  Market  `json:",omitempty"`
+	// Token is the session token of auth requests.
+	Token string `json:",omitempty"`
+	// CancelScope and Timeout are the settings of cancel_on_disconnect
+	// requests.
+	CancelScope CancelScope `json:",omitempty"`
+	Timeout     int64       `json:",omitempty"`
+	// Order is the order of place requests.
+	Order *PlaceOrderRequest `json:",omitempty"`
+	// OrderID, Price and Size are the order of cancel requests, and the
+	// order and its new price and size of amend requests. ClientOrderID
+	// names the order instead of OrderID when it is set.
+	OrderID       int64   `json:",omitempty"`
+	ClientOrderID string  `json:",omitempty"`
+	Price         float64 `json:",omitempty"`
+	Size          float64 `json:",omitempty"`
+}
+
+// WSMessage is a message to a websocket client. Data holds a trade,
+// BookLevels, BBO, OrderUpdate, Fill or BalanceUpdate depending on the
+// type.
+type WSMessage struct {
+	Type WSMessageType
+	// ID is the ID of the request a message replies to.
+	ID       string  `json:",omitempty"`
+	Channel  Channel `json:",omitempty"`
+	Market   Market  `json:",omitempty"`
+	Sequence int64   `json:",omitempty"`
+	// Time is the server time of heartbeats in Unix nanoseconds.
+	Time  int64  `json:",omitempty"`
+	Data  any    `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+type WSConfig struct {
+	// HeartbeatInterval is how often heartbeat messages and pings are sent
+	// to clients.
+	HeartbeatInterval time.Duration
+	// ReadTimeout disconnects clients that sent nothing, not even a pong,
+	// for that long.
+	ReadTimeout time.Duration
+	// WriteTimeout disconnects clients that do not accept a message for
+	// that long.
+	WriteTimeout time.Duration
+	// SendBuffer is the number of messages queued for a client. Clients
+	// that fall further behind are disconnected as slow consumers.
+	SendBuffer int
+}
+
+var defaultWSConfig = WSConfig{
+	HeartbeatInterval: 10 * time.Second,
+	ReadTimeout:       30 * time.Second,
+	WriteTimeout:      10 * time.Second,
+	SendBuffer:        256,
+}
+
+var upgrader = websocket.Upgrader{
+	// Clients authenticate with headers or messages rather than cookies,
+	// so connections from any origin are fine.
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+type wsSubscription struct {
+	market  Market
+	channel Channel
+}
+
+// wsConn is a websocket client. Messages are queued and written by
+// writeLoop, requests are read by the handler goroutine.
+type wsConn struct {
+	ws    *websocket.Conn
+	cfg   WSConfig
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+	// closeMsg is the close message writeLoop sends once done is closed.
+	closeMsg []byte
+
+	// userID, scopes and authKey are set when the connection is
+	// authenticated. They and the fields below are only used by the
+	// reading goroutine.
+	userID      int64
+	scopes      []Scope
+	authKey     string
+	ip          string
+	subs        map[wsSubscription]bool
+	readTimeout time.Duration
+	cancelScope CancelScope
+}
+
+func newWSConn(ws *websocket.Conn, cfg WSConfig) *wsConn {
+	return &wsConn{
+		ws:          ws,
+		cfg:         cfg,
+		queue:       make(chan []byte, cfg.SendBuffer),
+		done:        make(chan struct{}),
+		subs:        make(map[wsSubscription]bool),
+		readTimeout: cfg.ReadTimeout,
+	}
+}
+
+// reply sends msg as the reply to req.
+func (c *wsConn) reply(req WSRequest, msg WSMessage) {
+	msg.ID = req.ID
+	c.send(msg)
+}
+
+func (c *wsConn) send(msg WSMessage) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	c.enqueue(b)
+}
+
+// enqueue queues a message without blocking. A client whose queue is full
+// is disconnected, also without blocking, as it is called with the feeds
+// locked.
+func (c *wsConn) enqueue(msg []byte) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	select {
+	case c.queue <- msg:
+	default:
+		logrus.WithField("remote", c.ws.RemoteAddr()).Warn("disconnecting slow websocket consumer")
+		c.closeWith(websocket.ClosePolicyViolation, "slow consumer")
+	}
+}
+
+// closeWith closes the connection with a close message to the client.
+// writeLoop sends the message and closes the socket, so a client that does
+// not read never blocks the caller.
+func (c *wsConn) closeWith(code int, reason string) {
+	c.once.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, reason)
+		close(c.done)
+	})
+}
+
+func (c *wsConn) close() {
+	c.closeWith(websocket.CloseNormalClosure, "")
+}
+
+// writeLoop writes the queued messages and the heartbeats until the
+// connection is closed, then sends the close message and closes the
+// socket.
+func (c *wsConn) writeLoop() {
+	heartbeat := time.NewTicker(c.cfg.HeartbeatInterval)
+	defer heartbeat.Stop()
+	defer c.ws.Close()
+
+	for {
+		var msg []byte
+
+		select {
+		case <-c.done:
+			deadline := time.Now().Add(c.cfg.WriteTimeout)
+			c.ws.WriteControl(websocket.CloseMessage, c.closeMsg, deadline)
+			return
+		case msg = <-c.queue:
+		case now := <-heartbeat.C:
+			deadline := now.Add(c.cfg.WriteTimeout)
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				c.close()
+				return
+			}
+			msg, _ = json.Marshal(WSMessage{Type: WSHeartbeat, Time: now.UnixNano()})
+		}
+
+		c.ws.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+		if err := c.ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+			c.close()
+			return
+		}
+	}
+}
+
+// handleWebSocket upgrades the connection and serves the requests of the
+// client until it disconnects. Requests with a session token or API key
+// signature are authenticated for the private channel.
+func (ex *Exchange) handleWebSocket(c echo.Context) error {
+	header := c.Request().Header
+	if header.Get(echo.HeaderAuthorization) != "" || header.Get(HeaderAPIKey) != "" {
+		return ex.authenticate(ex.upgradeWebSocket)(c)
+	}
+	return ex.upgradeWebSocket(c)
+}
+
+func (ex *Exchange) upgradeWebSocket(c echo.Context) error {
+	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// The upgrader already replied with an error.
+		return nil
+	}
+
+	conn := newWSConn(ws, ex.wsConfig)
+	conn.userID, _ = authUserID(c)
+	conn.scopes = authScopes(c)
+	conn.authKey = authKey(c)
+	conn.ip = c.RealIP()
+	go conn.writeLoop()
+
+	ex.serveWS(conn)
+	return nil
+}
+
+func (ex *Exchange) serveWS(conn *wsConn) {
+	defer func() {
+		conn.close()
+		for sub := range conn.subs {
+			ex.unsubscribeWS(conn, sub)
+		}
+		ex.cancelOnDisconnect(conn)
+	}()
+
+	extendDeadline := func(string) error {
+		return conn.ws.SetReadDeadline(time.Now().Add(conn.readTimeout))
+	}
+	conn.ws.SetReadLimit(wsReadLimit)
+	conn.ws.SetPongHandler(extendDeadline)
+	extendDeadline("")
+
+	for {
+		_, data, err := conn.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		extendDeadline("")
+
+		var req WSRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			conn.send(WSMessage{Type: WSError, Error: "invalid request"})
+			continue
+		}
+
+		ex.handleWSRequest(conn, req)
+	}
+}
+
+func (ex *Exchange) handleWSRequest(conn *wsConn, req WSRequest) {
+	switch req.Op {
+	case WSAuth:
+		ex.handleWSAuth(conn, req)
+		return
+	case WSPing:
+		conn.reply(req, WSMessage{Type: WSPong, Time: time.Now().UnixNano()})
+		return
+	case WSCancelOnDisconnect:
+		ex.handleWSCancelOnDisconnect(conn, req)
+		return
+	case WSPlace, WSCancel, WSAmend:
+		ex.handleWSOrderEntry(conn, req)
+		return
+	case WSSubscribe, WSUnsubscribe:
+	default:
+		conn.reply(req, WSMessage{Type: WSError, Error: "unknown op"})
+		return
+	}
+
+	if req.Channel == ChannelOrders {
+		ex.handleWSOrdersSubscription(conn, req)
+		return
+	}
+
+	feed, ok := ex.feeds[req.Market]
+	if !ok {
+		conn.reply(req, WSMessage{Type: WSError, Channel: req.Channel, Market: req.Market, Error: "market not found"})
+		return
+	}
+	if _, ok := feed.subs[req.Channel]; !ok {
+		conn.reply(req, WSMessage{Type: WSError, Channel: req.Channel, Market: req.Market, Error: "unknown channel"})
+		return
+	}
+
+	sub := wsSubscription{market: req.Market, channel: req.Channel}
+
+	if req.Op == WSUnsubscribe {
+		ex.unsubscribeWS(conn, sub)
+		delete(conn.subs, sub)
+		conn.reply(req, WSMessage{Type: WSUnsubscribed, Channel: req.Channel, Market: req.Market})
+		return
+	}
+
+	if conn.subs[sub] {
+		conn.reply(req, WSMessage{Type: WSError, Channel: req.Channel, Market: req.Market, Error: "already subscribed"})
+		return
+	}
+	conn.subs[sub] = true
+	feed.subscribe(conn, req.Channel, req.ID)
+}
+
+func (ex *Exchange) handleWSAuth(conn *wsConn, req WSRequest) {
+	if conn.userID != 0 {
+		conn.reply(req, WSMessage{Type: WSError, Error: "already authenticated"})
+		return
+	}
+
+	userID, err := ex.sessions.Parse(req.Token)
+	if err != nil {
+		conn.reply(req, WSMessage{Type: WSError, Error: err.Error()})
+		return
+	}
+
+	conn.userID = userID
+	conn.scopes = AllScopes
+	conn.authKey = sessionAuthKey(userID)
+	conn.reply(req, WSMessage{Type: WSAuthenticated})
+}
+
+// handleWSOrdersSubscription subscribes the connection to the private
+// events of its user, which requires the read scope.
+func (ex *Exchange) handleWSOrdersSubscription(conn *wsConn, req WSRequest) {
+	sub := wsSubscription{channel: ChannelOrders}
+
+	if req.Op == WSUnsubscribe {
+		ex.unsubscribeWS(conn, sub)
+		delete(conn.subs, sub)
+		conn.reply(req, WSMessage{Type: WSUnsubscribed, Channel: ChannelOrders})
+		return
+	}
+
+	switch {
+	case conn.userID == 0:
+		conn.reply(req, WSMessage{Type: WSError, Channel: ChannelOrders, Error: "not authenticated"})
+	case !hasScope(conn.scopes, ScopeRead):
+		conn.reply(req, WSMessage{Type: WSError, Channel: ChannelOrders, Error: fmt.Sprintf("missing %s scope", ScopeRead)})
+	case conn.subs[sub]:
+		conn.reply(req, WSMessage{Type: WSError, Channel: ChannelOrders, Error: "already subscribed"})
+	default:
+		conn.subs[sub] = true
+		ex.userFeeds.subscribe(conn.userID, conn, req.ID)
+	}
+}
+
+func (ex *Exchange) unsubscribeWS(conn *wsConn, sub wsSubscription) {
+	if sub.channel == ChannelOrders {
+		ex.userFeeds.unsubscribe(conn.userID, conn)
+		return
+	}
+	ex.feeds[sub.market].unsubscribe(conn, sub.channel)
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/tahaontech/crypto_exchange/orderbook"
+)
+
+// wsMessage is a WSMessage with the data left undecoded.
+type wsMessage struct {
+	WSMessage
+	Data json.RawMessage
+}
+
+// startWSServer serves the routes of ex and returns them with the URL of
+// the websocket.
+func startWSServer(t *testing.T, ex *Exchange) (*echo.Echo, string) {
+	t.Helper()
+
+	e := echo.New()
+	ex.registerRoutes(e)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	return e, "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+func dialWS(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func newWSClient(t *testing.T, ex *Exchange) *websocket.Conn {
+	t.Helper()
+
+	_, url := startWSServer(t, ex)
+	return dialWS(t, url)
+}
+
+// readWS returns the next message that is not a heartbeat, decoding its
+// data into data.
+func readWS(t *testing.T, ws *websocket.Conn, data any) WSMessage {
+	t.Helper()
+
+	for {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		var msg wsMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == WSHeartbeat {
+			continue
+		}
+
+		if data != nil {
+			if err := json.Unmarshal(msg.Data, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return msg.WSMessage
+	}
+}
+
+func TestWebSocketMarketData(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+	for id, address := range map[int64]string{1: "0x01", 2: "0x02"} {
+		if err := ex.registerUser(&User{ID: id, Address: common.HexToAddress(address)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	placeOrder(t, ex, 1, PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 2, Price: 90, Market: MarketETH})
+
+	ws := newWSClient(t, ex)
+	for _, channel := range []Channel{ChannelBook, ChannelBBO, ChannelTrades} {
+		if err := ws.WriteJSON(WSRequest{Op: WSSubscribe, Channel: channel, Market: MarketETH}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assert(t, readWS(t, ws, nil).Type, WSSubscribed)
+
+	var snapshot BookLevels
+	msg := readWS(t, ws, &snapshot)
+	assert(t, msg.Type, WSSnapshot)
+	assert(t, msg.Sequence, int64(1))
+	assert(t, snapshot, BookLevels{Bids: []orderbook.Level{{Price: 90, Size: 2}}, Asks: []orderbook.Level{}})
+
+	assert(t, readWS(t, ws, nil).Type, WSSubscribed)
+	var bbo BBO
+	assert(t, readWS(t, ws, &bbo).Type, WSBBO)
+	assert(t, bbo, BBO{BidPrice: 90, BidSize: 2})
+	assert(t, readWS(t, ws, nil).Type, WSSubscribed)
+
+	placeOrder(t, ex, 2, PlaceOrderRequest{Type: MarketOrder, Bid: false, Size: 0.5, Market: MarketETH})
+
+	var trade orderbook.Trade
+	msg = readWS(t, ws, &trade)
+	assert(t, msg.Type, WSTrade)
+	assert(t, []float64{trade.Price, trade.Size}, []float64{90, 0.5})
+
+	var update BookLevels
+	msg = readWS(t, ws, &update)
+	assert(t, msg.Type, WSUpdate)
+	assert(t, msg.Sequence, int64(2))
+	assert(t, update, BookLevels{Bids: []orderbook.Level{{Price: 90, Size: 1.5}}, Asks: []orderbook.Level{}})
+
+	assert(t, readWS(t, ws, &bbo).Type, WSBBO)
+	assert(t, bbo, BBO{BidPrice: 90, BidSize: 1.5})
+
+	// Cancelling the last order of a level removes it.
+	cancelOrder(t, ex, 1, ex.Orders[1][0].ID)
+
+	msg = readWS(t, ws, &update)
+	assert(t, msg.Sequence, int64(3))
+	assert(t, update, BookLevels{Bids: []orderbook.Level{{Price: 90}}, Asks: []orderbook.Level{}})
+}
+
+func TestWebSocketHeartbeat(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+	ex.wsConfig.HeartbeatInterval = 20 * time.Millisecond
+	ex.wsConfig.ReadTimeout = 100 * time.Millisecond
+
+	ws := newWSClient(t, ex)
+
+	var msg WSMessage
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, msg.Type, WSHeartbeat)
+
+	// A client that does not answer pings is disconnected.
+	ws.SetPingHandler(func(string) error { return nil })
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			break
+		}
+	}
+}
+
+func TestWebSocketSlowConsumer(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+	ws := newWSClient(t, ex)
+
+	// Without a writer, the queue of the connection fills up.
+	conn := newWSConn(ws, WSConfig{WriteTimeout: time.Second, SendBuffer: 2})
+	feed := ex.feeds[MarketETH]
+	feed.subscribe(conn, ChannelTrades, "")
+
+	for i := 0; i < 3; i++ {
+		feed.publishTrade(&orderbook.Trade{Price: 100, Size: 1})
+	}
+
+	select {
+	case <-conn.done:
+	default:
+		t.Fatal("slow consumer was not disconnected")
+	}
+}
+
+// TestWebSocketStalledConsumer publishes to a client that never reads, so
+// the writes to it block. Disconnecting it must not block the publisher.
+func TestWebSocketStalledConsumer(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+	ex.wsConfig.SendBuffer = 1024
+	ex.wsConfig.WriteTimeout = 2 * time.Second
+
+	ws := newWSClient(t, ex)
+	if err := ws.WriteJSON(WSRequest{Op: WSSubscribe, Channel: ChannelTrades, Market: MarketETH}); err != nil {
+		t.Fatal(err)
+	}
+	readWS(t, ws, nil)
+
+	feed := ex.feeds[MarketETH]
+	var conn *wsConn
+	feed.mu.Lock()
+	for c := range feed.subs[ChannelTrades] {
+		conn = c
+	}
+	feed.mu.Unlock()
+
+	// Fill the socket without overflowing the queue, until the queue stays
+	// full as the writes block.
+	trade := &orderbook.Trade{Price: 100, Size: 1, Bid: true}
+	deadline := time.Now().Add(10 * time.Second)
+	for full := time.Now(); time.Since(full) < 200*time.Millisecond; {
+		if time.Now().After(deadline) {
+			t.Fatal("writes to the client did not block")
+		}
+		if len(conn.queue) < cap(conn.queue) {
+			feed.publishTrade(trade)
+			full = time.Now()
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	start := time.Now()
+	feed.publishTrade(trade)
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Fatalf("publishing took %v", took)
+	}
+	select {
+	case <-conn.done:
+	default:
+		t.Fatal("stalled consumer was not disconnected")
+	}
+}
@@ -0,0 +1,597 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+const (
+	WithdrawalPendingApproval WithdrawalStatus = "PENDING_APPROVAL"
+	WithdrawalQueued          WithdrawalStatus = "QUEUED"
+	WithdrawalSent            WithdrawalStatus = "SENT"
+	// WithdrawalUnknown withdrawals failed to send in a way that does not
+	// tell whether their transaction reached the node. They are tracked by
+	// their hash like sent ones, and refunded once another transaction
+	// took their nonce.
+	WithdrawalUnknown   WithdrawalStatus = "UNKNOWN"
+	WithdrawalConfirmed WithdrawalStatus = "CONFIRMED"
+	WithdrawalFailed    WithdrawalStatus = "FAILED"
+	WithdrawalRejected  WithdrawalStatus = "REJECTED"
+)
+
+var (
+	ErrDailyLimitExceeded   = errors.New("daily withdrawal limit exceeded")
+	ErrWithdrawalNotFound   = errors.New("withdrawal not found")
+	ErrInvalidWithdrawal    = errors.New("invalid withdrawal")
+	ErrWithdrawalNotPending = errors.New("withdrawal is not pending approval")
+)
+
+type WithdrawalStatus string
+
+type Withdrawal struct {
+	ID        int64
+	UserID    int64
+	Asset     string
+	Amount    float64
+	Value     *big.Int // Amount in base units of the asset
+	To        common.Address
+	Status    WithdrawalStatus
+	TxHash    common.Hash
+	Reason    string
+	CreatedAt int64
+	UpdatedAt int64
+
+	// nonce is the nonce of the transaction.
+	nonce uint64
+	asset *Asset
+}
+
+type WithdrawalConfig struct {
+	// DailyLimits is the maximum amount per asset symbol a user can
+	// withdraw in 24 hours. Assets without limit can be withdrawn freely.
+	DailyLimits map[string]float64
+	// ApprovalThresholds is the amount per asset symbol from which a
+	// withdrawal has to be approved manually before it is sent.
+	ApprovalThresholds map[string]float64
+	PollInterval       time.Duration
+}
+
+// Withdrawals debits withdrawals from the ledger and sends them from the
+// exchange hot wallet. Withdrawals that fail on chain are refunded.
+type Withdrawals struct {
+	client    ChainClient
+	ledger    *Ledger
+	hotWallet *NonceManager
+	cfg       WithdrawalConfig
+	// records keeps the withdrawals, and assets looks up the asset of the
+	// ones loaded from it.
+	records store.Store
+	assets  func(symbol string) (*Asset, bool)
+
+	mu     sync.Mutex
+	nextID int64
+	byID   map[int64]*Withdrawal
+	byUser map[int64][]*Withdrawal
+	queue  []*Withdrawal
+	sent   []*Withdrawal
+}
+
+func NewWithdrawals(client ChainClient, ledger *Ledger, hotWallet *NonceManager, cfg WithdrawalConfig) *Withdrawals {
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = time.Second
+	}
+
+	return &Withdrawals{
+		client:    client,
+		ledger:    ledger,
+		hotWallet: hotWallet,
+		cfg:       cfg,
+		nextID:    1,
+		byID:      make(map[int64]*Withdrawal),
+		byUser:    make(map[int64][]*Withdrawal),
+	}
+}
+
+// SetStore keeps the withdrawals in records and loads the withdrawals
+// stored in it: queued ones are sent, and sent ones tracked again. A
+// withdrawal is stored in one write with its debit and refund, so the
+// ledger has to keep its balances in the same store. It has to be called
+// before Run.
+func (ws *Withdrawals) SetStore(records store.Store, assets func(symbol string) (*Asset, bool)) error {
+	stored, err := records.Withdrawals()
+	if err != nil {
+		return err
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for _, record := range stored {
+		value, ok := new(big.Int).SetString(record.Value, 10)
+		if !ok {
+			return fmt.Errorf("withdrawal %d has invalid value %q", record.ID, record.Value)
+		}
+
+		w := &Withdrawal{
+			ID:        record.ID,
+			UserID:    record.UserID,
+			Asset:     record.Asset,
+			Amount:    record.Amount,
+			Value:     value,
+			To:        common.HexToAddress(record.To),
+			Status:    WithdrawalStatus(record.Status),
+			TxHash:    common.HexToHash(record.TxHash),
+			Reason:    record.Reason,
+			CreatedAt: record.CreatedAt,
+			UpdatedAt: record.UpdatedAt,
+			nonce:     record.Nonce,
+		}
+		ws.byID[w.ID] = w
+		ws.byUser[w.UserID] = append(ws.byUser[w.UserID], w)
+		switch w.Status {
+		case WithdrawalQueued:
+			ws.queue = append(ws.queue, w)
+		case WithdrawalSent, WithdrawalUnknown:
+			ws.sent = append(ws.sent, w)
+		}
+		if w.ID >= ws.nextID {
+			ws.nextID = w.ID + 1
+		}
+	}
+	ws.records = records
+	ws.assets = assets
+	return nil
+}
+
+// Request debits the ledger and queues a withdrawal, or parks it until it
+// is approved when it is above the approval threshold of the asset.
+func (ws *Withdrawals) Request(userID int64, asset *Asset, amount float64, to common.Address) (*Withdrawal, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidWithdrawal)
+	}
+	if to == (common.Address{}) {
+		return nil, fmt.Errorf("%w: missing destination address", ErrInvalidWithdrawal)
+	}
+
+	value := asset.ToBaseUnits(amount)
+	if value.Sign() == 0 {
+		return nil, fmt.Errorf("%w: amount below the precision of %s", ErrInvalidWithdrawal, asset.Symbol)
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	now := time.Now()
+	if limit, ok := ws.cfg.DailyLimits[asset.Symbol]; ok {
+		used := ws.withdrawnSince(userID, asset.Symbol, now.Add(-24*time.Hour))
+		if used+amount > limit {
+			return nil, fmt.Errorf("%w: %.8g of %.8g %s used", ErrDailyLimitExceeded, used, limit, asset.Symbol)
+		}
+	}
+
+	w := &Withdrawal{
+		ID:        ws.nextID,
+		UserID:    userID,
+		Asset:     asset.Symbol,
+		Amount:    amount,
+		Value:     value,
+		To:        to,
+		Status:    WithdrawalQueued,
+		CreatedAt: now.UnixNano(),
+		UpdatedAt: now.UnixNano(),
+		asset:     asset,
+	}
+	threshold, ok := ws.cfg.ApprovalThresholds[asset.Symbol]
+	if ok && amount >= threshold {
+		w.Status = WithdrawalPendingApproval
+	}
+
+	debit := Entry{UserID: userID, Asset: asset.Symbol, Amount: new(big.Int).Neg(value)}
+	if err := ws.ledger.Post(&store.Batch{Withdrawals: []*store.Withdrawal{w.record()}}, debit); err != nil {
+		return nil, err
+	}
+
+	ws.nextID++
+	if w.Status == WithdrawalQueued {
+		ws.queue = append(ws.queue, w)
+	}
+
+	ws.byID[w.ID] = w
+	ws.byUser[userID] = append(ws.byUser[userID], w)
+
+	logrus.WithFields(logrus.Fields{
+		"id":     w.ID,
+		"userID": userID,
+		"asset":  w.Asset,
+		"amount": amount,
+		"status": w.Status,
+	}).Info("new withdrawal")
+
+	return w.copy(), nil
+}
+
+// withdrawnSince must be called with the lock held.
+func (ws *Withdrawals) withdrawnSince(userID int64, asset string, since time.Time) float64 {
+	total := 0.0
+	for _, w := range ws.byUser[userID] {
+		if w.Asset != asset || w.CreatedAt < since.UnixNano() {
+			continue
+		}
+		if w.Status == WithdrawalFailed || w.Status == WithdrawalRejected {
+			continue
+		}
+		total += w.Amount
+	}
+	return total
+}
+
+func (ws *Withdrawals) Approve(id int64) (*Withdrawal, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	w, ok := ws.byID[id]
+	if !ok {
+		return nil, ErrWithdrawalNotFound
+	}
+	if w.Status != WithdrawalPendingApproval {
+		return nil, ErrWithdrawalNotPending
+	}
+
+	if err := ws.setStatus(w, WithdrawalQueued, ""); err != nil {
+		return nil, err
+	}
+	ws.queue = append(ws.queue, w)
+
+	return w.copy(), nil
+}
+
+func (ws *Withdrawals) Reject(id int64, reason string) (*Withdrawal, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	w, ok := ws.byID[id]
+	if !ok {
+		return nil, ErrWithdrawalNotFound
+	}
+	if w.Status != WithdrawalPendingApproval {
+		return nil, ErrWithdrawalNotPending
+	}
+
+	if err := ws.refund(w, WithdrawalRejected, reason); err != nil {
+		return nil, err
+	}
+
+	return w.copy(), nil
+}
+
+func (ws *Withdrawals) Get(id int64) (*Withdrawal, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	w, ok := ws.byID[id]
+	if !ok {
+		return nil, false
+	}
+	return w.copy(), true
+}
+
+func (ws *Withdrawals) History(userID int64) []*Withdrawal {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	history := make([]*Withdrawal, len(ws.byUser[userID]))
+	for i, w := range ws.byUser[userID] {
+		history[i] = w.copy()
+	}
+	return history
+}
+
+// Run sends queued withdrawals and tracks sent ones until ctx is done.
+func (ws *Withdrawals) Run(ctx context.Context) {
+	ticker := time.NewTicker(ws.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		ws.processQueue(ctx)
+		ws.track(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processQueue signs and broadcasts all queued withdrawals one by one, so
+// the hot wallet nonces do not collide.
+func (ws *Withdrawals) processQueue(ctx context.Context) {
+	ws.mu.Lock()
+	queue := ws.queue
+	ws.queue = nil
+	ws.mu.Unlock()
+
+	for _, w := range queue {
+		tx, err := ws.send(ctx, w)
+
+		ws.mu.Lock()
+		switch {
+		case errors.Is(err, ErrSendUnknown):
+			// The transaction may be mined, so the withdrawal can not be
+			// refunded until it is known that it will not be.
+			ws.markSent(w, tx, WithdrawalUnknown, err.Error())
+		case err != nil:
+			if err := ws.refund(w, WithdrawalFailed, err.Error()); err != nil {
+				// Nothing was sent, so the withdrawal is sent again.
+				logrus.WithField("id", w.ID).Errorf("refund: %v", err)
+				ws.queue = append(ws.queue, w)
+			}
+		default:
+			ws.markSent(w, tx, WithdrawalSent, "")
+		}
+		ws.mu.Unlock()
+	}
+}
+
+func (ws *Withdrawals) send(ctx context.Context, w *Withdrawal) (*types.Transaction, error) {
+	if w.asset == nil {
+		asset, ok := ws.assets(w.Asset)
+		if !ok {
+			return nil, fmt.Errorf("unknown asset %s", w.Asset)
+		}
+		w.asset = asset
+	}
+
+	if w.asset.IsNative() {
+		return transferETH(ctx, ws.client, ws.hotWallet, w.To, w.Value)
+	}
+	return transferERC20(ctx, ws.client, w.asset.Token, ws.hotWallet, w.To, w.Value)
+}
+
+// markSent moves a withdrawal whose transaction was sent to a status and
+// tracks it. The transaction was sent, so a failed write is only logged.
+// It must be called with the lock held.
+func (ws *Withdrawals) markSent(w *Withdrawal, tx *types.Transaction, status WithdrawalStatus, reason string) {
+	w.TxHash, w.nonce = tx.Hash(), tx.Nonce()
+	if err := ws.setStatus(w, status, reason); err != nil {
+		logrus.WithField("id", w.ID).Errorf("store: %v", err)
+		w.Status, w.Reason = status, reason
+	}
+	ws.sent = append(ws.sent, w)
+}
+
+// track checks the receipts of sent withdrawals, and of the ones whose
+// send is unknown. It must not run concurrently with processQueue.
+func (ws *Withdrawals) track(ctx context.Context) {
+	ws.mu.Lock()
+	sent := ws.sent
+	ws.sent = nil
+	ws.mu.Unlock()
+
+	for _, w := range sent {
+		dropped := false
+		if w.Status == WithdrawalUnknown {
+			// The nonce is read before the receipt: a transaction that is
+			// not mined by then while its nonce is used never will be.
+			mined, err := ws.client.NonceAt(ctx, ws.hotWallet.Address(), nil)
+			if err != nil {
+				logrus.WithField("withdrawal", w.ID).Error(err)
+			}
+			dropped = err == nil && mined > w.nonce
+		}
+		receipt, err := ws.client.TransactionReceipt(ctx, w.TxHash)
+
+		// Withdrawals whose receipt could not be read, or whose change
+		// could not be stored, are tracked again on the next poll.
+		ws.mu.Lock()
+		switch {
+		case errors.Is(err, ethereum.NotFound) && dropped:
+			err = ws.refund(w, WithdrawalFailed, "transaction was not sent")
+		case errors.Is(err, ethereum.NotFound):
+			ws.sent = append(ws.sent, w)
+			err = nil
+		case err != nil:
+		case receipt.Status != types.ReceiptStatusSuccessful:
+			err = ws.refund(w, WithdrawalFailed, "transaction reverted")
+		default:
+			err = ws.setStatus(w, WithdrawalConfirmed, "")
+		}
+		if err != nil {
+			logrus.WithField("withdrawal", w.ID).Error(err)
+			ws.sent = append(ws.sent, w)
+		}
+		ws.mu.Unlock()
+	}
+}
+
+// refund credits the withdrawal back to the ledger in one write with the
+// status change, so a withdrawal is never refunded twice. It must be
+// called with the lock held.
+func (ws *Withdrawals) refund(w *Withdrawal, status WithdrawalStatus, reason string) error {
+	return ws.setStatus(w, status, reason, Entry{UserID: w.UserID, Asset: w.Asset, Amount: w.Value})
+}
+
+// setStatus moves a withdrawal to a status and stores it, together with
+// the ledger entries if there are any. When the write fails nothing
+// changes. It must be called with the lock held.
+func (ws *Withdrawals) setStatus(w *Withdrawal, status WithdrawalStatus, reason string, entries ...Entry) error {
+	next := *w
+	next.Status = status
+	next.Reason = reason
+	next.UpdatedAt = time.Now().UnixNano()
+
+	var (
+		err     error
+		records = &store.Batch{Withdrawals: []*store.Withdrawal{next.record()}}
+	)
+	switch {
+	case len(entries) > 0:
+		err = ws.ledger.Post(records, entries...)
+	case ws.records != nil:
+		err = ws.records.Write(records)
+	}
+	if err != nil {
+		return err
+	}
+	*w = next
+
+	logrus.WithFields(logrus.Fields{
+		"id":     w.ID,
+		"status": status,
+		"reason": reason,
+	}).Info("withdrawal status changed")
+	return nil
+}
+
+// record returns the record of a withdrawal.
+func (w *Withdrawal) record() *store.Withdrawal {
+	record := &store.Withdrawal{
+		ID:        w.ID,
+		UserID:    w.UserID,
+		Asset:     w.Asset,
+		Amount:    w.Amount,
+		Value:     w.Value.String(),
+		To:        w.To.Hex(),
+		Status:    string(w.Status),
+		Nonce:     w.nonce,
+		Reason:    w.Reason,
+		CreatedAt: w.CreatedAt,
+		UpdatedAt: w.UpdatedAt,
+	}
+	if w.TxHash != (common.Hash{}) {
+		record.TxHash = w.TxHash.Hex()
+	}
+	return record
+}
+
+func (w *Withdrawal) copy() *Withdrawal {
+	c := *w
+	return &c
+}
+
+type WithdrawalRequest struct {
+	UserID int64
+	Asset  string
+	Amount float64
+	To     common.Address
+}
+
+type RejectWithdrawalRequest struct {
+	Reason string
+}
+
+func (ex *Exchange) handleRequestWithdrawal(c echo.Context) error {
+	var req WithdrawalRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request body"})
+	}
+
+	userID, _ := authUserID(c)
+	if req.UserID != 0 && req.UserID != userID {
+		return c.JSON(http.StatusForbidden, APIError{Error: "user id does not match the api key"})
+	}
+	req.UserID = userID
+
+	if _, ok := ex.user(req.UserID); !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	asset, ok := ex.asset(req.Asset)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "unknown asset"})
+	}
+
+	w, err := ex.withdrawals.Request(req.UserID, asset, req.Amount, req.To)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, w)
+}
+
+func (ex *Exchange) handleGetWithdrawals(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+	if !isOwner(c, int64(userID)) {
+		return c.JSON(http.StatusForbidden, APIError{Error: "can not query the withdrawals of another user"})
+	}
+
+	return c.JSON(http.StatusOK, ex.withdrawals.History(int64(userID)))
+}
+
+func (ex *Exchange) handleGetWithdrawal(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid withdrawal id"})
+	}
+
+	w, ok := ex.withdrawals.Get(int64(id))
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: ErrWithdrawalNotFound.Error()})
+	}
+	if !isOwner(c, w.UserID) {
+		return c.JSON(http.StatusForbidden, APIError{Error: "withdrawal belongs to another user"})
+	}
+
+	return c.JSON(http.StatusOK, w)
+}
+
+func (ex *Exchange) handleApproveWithdrawal(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid withdrawal id"})
+	}
+
+	w, err := ex.withdrawals.Approve(int64(id))
+	if err != nil {
+		return c.JSON(withdrawalErrorStatus(err), APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, w)
+}
+
+func (ex *Exchange) handleRejectWithdrawal(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid withdrawal id"})
+	}
+
+	var req RejectWithdrawalRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		req.Reason = "rejected"
+	}
+
+	w, err := ex.withdrawals.Reject(int64(id), req.Reason)
+	if err != nil {
+		return c.JSON(withdrawalErrorStatus(err), APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, w)
+}
+
+func withdrawalErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrWithdrawalNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrWithdrawalNotPending):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/labstack/echo/v4"
+	"github.com/tahaontech/crypto_exchange/store"
+)
+
+func TestWithdrawalConfirmed(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		chain  = newTestChain(t, 1)
+		ledger = NewLedger()
+		to     = common.Address{0xaa}
+		ws     = NewWithdrawals(chain, ledger, NewNonceManager(chain, chain.keys[0]), WithdrawalConfig{})
+	)
+
+	ledger.Credit(1, "ETH", AssetETH.ToBaseUnits(2))
+
+	w, err := ws.Request(1, AssetETH, 1.5, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, w.Status, WithdrawalQueued)
+	assert(t, ledger.Balance(1, "ETH"), AssetETH.ToBaseUnits(0.5))
+
+	ws.processQueue(ctx)
+	w, _ = ws.Get(w.ID)
+	assert(t, w.Status, WithdrawalSent)
+
+	chain.Commit()
+	ws.track(ctx)
+
+	w, _ = ws.Get(w.ID)
+	assert(t, w.Status, WithdrawalConfirmed)
+
+	balance, err := chain.BalanceAt(ctx, to, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, balance, AssetETH.ToBaseUnits(1.5))
+}
+
+func TestWithdrawalFailedIsRefunded(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		chain  = newTestChain(t, 1)
+		ledger = NewLedger()
+		ws     = NewWithdrawals(chain, ledger, NewNonceManager(chain, chain.keys[0]), WithdrawalConfig{})
+	)
+
+	// The hot wallet does not hold any of the token.
+	addr, _ := chain.deployToken(t, 6)
+	usdc := &Asset{Symbol: "USDC", Token: addr, Decimals: 6}
+	ledger.Credit(1, "USDC", usdc.ToBaseUnits(100))
+
+	w, err := ws.Request(1, usdc, 40, common.Address{0xaa})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, ledger.Balance(1, "USDC"), usdc.ToBaseUnits(60))
+
+	ws.processQueue(ctx)
+
+	w, _ = ws.Get(w.ID)
+	assert(t, w.Status, WithdrawalFailed)
+	assert(t, ledger.Balance(1, "USDC"), usdc.ToBaseUnits(100))
+}
+
+// unreliableChain returns err from SendTransaction, after sending the
+// transaction unless lost is set.
+type unreliableChain struct {
+	*testChain
+	err  error
+	lost bool
+}
+
+func (c *unreliableChain) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if !c.lost {
+		if err := c.testChain.SendTransaction(ctx, tx); err != nil {
+			return err
+		}
+	}
+	return c.err
+}
+
+func TestWithdrawalUnknownSend(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		chain  = &unreliableChain{testChain: newTestChain(t, 1), err: context.DeadlineExceeded}
+		ledger = NewLedger()
+		to     = common.Address{0xaa}
+		ws     = NewWithdrawals(chain, ledger, NewNonceManager(chain, chain.keys[0]), WithdrawalConfig{})
+	)
+	ledger.Credit(1, "ETH", AssetETH.ToBaseUnits(10))
+
+	// A send that timed out is not refunded, and confirmed once its
+	// transaction is mined.
+	sent, err := ws.Request(1, AssetETH, 1, to)
+	assert(t, err, nil)
+	ws.processQueue(ctx)
+	sent, _ = ws.Get(sent.ID)
+	assert(t, sent.Status, WithdrawalUnknown)
+	chain.Commit()
+	ws.track(ctx)
+	sent, _ = ws.Get(sent.ID)
+	assert(t, sent.Status, WithdrawalConfirmed)
+
+	// A transaction that did not reach the node is refunded once the next
+	// transaction took its nonce.
+	chain.lost = true
+	lost, err := ws.Request(1, AssetETH, 2, to)
+	assert(t, err, nil)
+	ws.processQueue(ctx)
+	ws.track(ctx)
+	lost, _ = ws.Get(lost.ID)
+	assert(t, lost.Status, WithdrawalUnknown)
+	assert(t, ledger.Balance(1, "ETH"), AssetETH.ToBaseUnits(7))
+
+	chain.err, chain.lost = nil, false
+	next, err := ws.Request(1, AssetETH, 3, to)
+	assert(t, err, nil)
+	ws.processQueue(ctx)
+	chain.Commit()
+	ws.track(ctx)
+	lost, _ = ws.Get(lost.ID)
+	assert(t, lost.Status, WithdrawalFailed)
+	next, _ = ws.Get(next.ID)
+	assert(t, next.Status, WithdrawalConfirmed)
+	assert(t, ledger.Balance(1, "ETH"), AssetETH.ToBaseUnits(6))
+
+	balance, err := chain.BalanceAt(ctx, to, nil)
+	assert(t, err, nil)
+	assert(t, balance, AssetETH.ToBaseUnits(4))
+}
+
+func TestWithdrawalsResume(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		chain   = newTestChain(t, 1)
+		records = store.NewMemory()
+		nonces  = NewNonceManager(chain, chain.keys[0])
+		to      = common.Address{0xaa}
+	)
+
+	start := func() (*Withdrawals, *Ledger) {
+		ledger := NewLedger()
+		if err := ledger.SetStore(records); err != nil {
+			t.Fatal(err)
+		}
+		ws := NewWithdrawals(chain, ledger, nonces, WithdrawalConfig{ApprovalThresholds: map[string]float64{"ETH": 3}})
+		if err := ws.SetStore(records, func(string) (*Asset, bool) { return AssetETH, true }); err != nil {
+			t.Fatal(err)
+		}
+		return ws, ledger
+	}
+
+	ws, ledger := start()
+	assert(t, ledger.Credit(1, "ETH", AssetETH.ToBaseUnits(10)), nil)
+	sent, err := ws.Request(1, AssetETH, 1, to)
+	assert(t, err, nil)
+	large, err := ws.Request(1, AssetETH, 4, to)
+	assert(t, err, nil)
+	ws.processQueue(ctx)
+
+	// The sent withdrawal is tracked and the large one can be approved
+	// after a restart, and their debits are kept.
+	ws, ledger = start()
+	assert(t, len(ws.History(1)), 2)
+	assert(t, ledger.Balance(1, "ETH"), AssetETH.ToBaseUnits(5))
+	chain.Commit()
+	ws.track(ctx)
+	sent, _ = ws.Get(sent.ID)
+	assert(t, sent.Status, WithdrawalConfirmed)
+	_, err = ws.Approve(large.ID)
+	assert(t, err, nil)
+
+	// The approved withdrawal is sent after a restart, and new ones do not
+	// reuse the stored IDs.
+	ws, ledger = start()
+	queued, err := ws.Request(1, AssetETH, 2, to)
+	assert(t, err, nil)
+	assert(t, queued.ID, int64(3))
+	ws.processQueue(ctx)
+	chain.Commit()
+	ws.track(ctx)
+	for _, w := range ws.History(1) {
+		assert(t, w.Status, WithdrawalConfirmed)
+	}
+
+	ws, ledger = start()
+	assert(t, ledger.Balance(1, "ETH"), AssetETH.ToBaseUnits(3))
+	large, _ = ws.Get(large.ID)
+	assert(t, large.Status, WithdrawalConfirmed)
+	assert(t, len(ws.queue)+len(ws.sent), 0)
+
+	balance, err := chain.BalanceAt(ctx, to, nil)
+	assert(t, err, nil)
+	assert(t, balance, AssetETH.ToBaseUnits(7))
+}
+
+func TestWithdrawalLimitsAndApproval(t *testing.T) {
+	var (
+		chain  = newTestChain(t, 1)
+		ledger = NewLedger()
+		to     = common.Address{0xaa}
+		ws     = NewWithdrawals(chain, ledger, NewNonceManager(chain, chain.keys[0]), WithdrawalConfig{
+			DailyLimits:        map[string]float64{"ETH": 5},
+			ApprovalThresholds: map[string]float64{"ETH": 3},
+		})
+	)
+
+	ledger.Credit(1, "ETH", AssetETH.ToBaseUnits(10))
+
+	large, err := ws.Request(1, AssetETH, 3, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, large.Status, WithdrawalPendingApproval)
+
+	if _, err := ws.Request(1, AssetETH, 2.5, to); !errors.Is(err, ErrDailyLimitExceeded) {
+		t.Fatalf("expected daily limit error, got %v", err)
+	}
+
+	if _, err := ws.Request(2, AssetETH, 1, to); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+
+	rejected, err := ws.Reject(large.ID, "suspicious")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, rejected.Status, WithdrawalRejected)
+	assert(t, ledger.Balance(1, "ETH"), AssetETH.ToBaseUnits(10))
+
+	if _, err := ws.Approve(large.ID); !errors.Is(err, ErrWithdrawalNotPending) {
+		t.Fatalf("expected not pending error, got %v", err)
+	}
+
+	small, err := ws.Request(1, AssetETH, 2.5, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, small.Status, WithdrawalQueued)
+	assert(t, len(ws.History(1)), 2)
+}
+
+func TestWithdrawalApprovalRequiresOperator(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+	token := strings.Repeat("t", minOperatorTokenLen)
+	assert(t, errors.Is(ex.SetOperatorToken("short"), ErrOperatorToken), true)
+	assert(t, ex.SetOperatorToken(token), nil)
+
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	ex.Ledger.Credit(1, "ETH", AssetETH.ToBaseUnits(10))
+	ex.withdrawals.cfg.ApprovalThresholds = map[string]float64{"ETH": 1}
+	w, err := ex.withdrawals.Request(1, AssetETH, 2, common.Address{0xaa})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, w.Status, WithdrawalPendingApproval)
+	path := "/withdrawal/" + strconv.FormatInt(w.ID, 10) + "/approve"
+
+	key, err := ex.apiKeys.Create(1, AllScopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(req *http.Request) int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert(t, serve(httptest.NewRequest(http.MethodPost, path, nil)), http.StatusUnauthorized)
+	// Users can not approve their own withdrawals, or reject others'.
+	assert(t, serve(signedRequest(key, http.MethodPost, path, "", "n1", time.Now())), http.StatusForbidden)
+	reject := "/withdrawal/" + strconv.FormatInt(w.ID, 10) + "/reject"
+	assert(t, serve(signedRequest(key, http.MethodPost, reject, "", "n2", time.Now())), http.StatusForbidden)
+
+	req := httptest.NewRequest(http.MethodPost, path, nil)
+	req.Header.Set(HeaderOperatorToken, "wrong")
+	assert(t, serve(req), http.StatusUnauthorized)
+	assert(t, ex.withdrawals.History(1)[0].Status, WithdrawalPendingApproval)
+
+	req = httptest.NewRequest(http.MethodPost, path, nil)
+	req.Header.Set(HeaderOperatorToken, token)
+	assert(t, serve(req), http.StatusOK)
+	assert(t, ex.withdrawals.History(1)[0].Status, WithdrawalQueued)
+}
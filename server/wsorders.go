@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+)
+
+const (
+	// WSPlace places the Order of the request.
+	WSPlace WSOp = "place"
+	// WSCancel cancels the order OrderID or ClientOrderID.
+	WSCancel WSOp = "cancel"
+	// WSAmend changes the Price and Size of the order OrderID or
+	// ClientOrderID.
+	WSAmend WSOp = "amend"
+
+	// WSResponse is the reply to a successful place, cancel or amend
+	// request. Its data is a PlaceOrderResponse.
+	WSResponse WSMessageType = "response"
+)
+
+// handleWSOrderEntry places, cancels and amends orders for authenticated
+// connections with the trade scope, with the limits of REST order entry.
+func (ex *Exchange) handleWSOrderEntry(conn *wsConn, req WSRequest) {
+	switch {
+	case conn.userID == 0:
+		conn.reply(req, WSMessage{Type: WSError, Error: "not authenticated"})
+		return
+	case !hasScope(conn.scopes, ScopeTrade):
+		conn.reply(req, WSMessage{Type: WSError, Error: fmt.Sprintf("missing %s scope", ScopeTrade)})
+		return
+	}
+
+	if err := ex.AllowOrderEntry(conn.authKey, conn.userID, conn.ip); err != nil {
+		conn.reply(req, WSMessage{Type: WSError, Error: err.Error()})
+		return
+	}
+
+	orderID, err := ex.wsOrderEntry(conn, req)
+	if err != nil {
+		conn.reply(req, WSMessage{Type: WSError, Error: err.Error()})
+		return
+	}
+
+	ex.RecordOrder(conn.userID)
+	conn.reply(req, WSMessage{Type: WSResponse, Data: PlaceOrderResponse{OrderID: orderID}})
+}
+
+func (ex *Exchange) wsOrderEntry(conn *wsConn, req WSRequest) (int64, error) {
+	switch req.Op {
+	case WSPlace:
+		if req.Order == nil {
+			return 0, fmt.Errorf("%w: missing order", ErrInvalidOrder)
+		}
+
+		order := *req.Order
+		if order.UserID != 0 && order.UserID != conn.userID {
+			return 0, fmt.Errorf("%w: user id does not match the connection", ErrInvalidOrder)
+		}
+		order.UserID = conn.userID
+
+		resp, err := ex.PlaceOrder(&order, conn.authKey)
+		if err != nil {
+			return 0, err
+		}
+		return resp.OrderID, nil
+	}
+
+	id := req.OrderID
+	if req.ClientOrderID != "" {
+		var err error
+		if id, err = ex.OrderID(conn.userID, req.ClientOrderID); err != nil {
+			return 0, err
+		}
+	}
+	if req.Op == WSCancel {
+		return id, ex.CancelOrder(conn.userID, id)
+	}
+	return id, ex.AmendOrder(conn.userID, id, req.Price, req.Size)
+}
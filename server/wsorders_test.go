@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestWebSocketOrderEntry(t *testing.T) {
+	ex := newTestExchange(t, newTestChain(t, 1))
+	ws := newWSClient(t, ex)
+
+	order := &PlaceOrderRequest{Type: LimitOrder, Bid: true, Size: 2, Price: 90, Market: MarketETH}
+	ws.WriteJSON(WSRequest{ID: "1", Op: WSPlace, Order: order})
+	msg := readWS(t, ws, nil)
+	assert(t, []any{msg.ID, msg.Type, msg.Error}, []any{"1", WSError, "not authenticated"})
+
+	token, _, err := ex.sessions.Issue(1, common.HexToAddress("0x01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.WriteJSON(WSRequest{Op: WSAuth, Token: token})
+	assert(t, readWS(t, ws, nil).Type, WSAuthenticated)
+
+	var resp PlaceOrderResponse
+	ws.WriteJSON(WSRequest{ID: "2", Op: WSPlace, Order: order})
+	msg = readWS(t, ws, &resp)
+	assert(t, []any{msg.ID, msg.Type}, []any{"2", WSResponse})
+	assert(t, len(ex.Orders[1]), 1)
+	assert(t, ex.Orders[1][0].ID, resp.OrderID)
+
+	// Orders can only be placed for the user of the connection.
+	ws.WriteJSON(WSRequest{ID: "3", Op: WSPlace, Order: &PlaceOrderRequest{UserID: 2, Type: LimitOrder, Bid: true, Size: 1, Price: 90, Market: MarketETH}})
+	msg = readWS(t, ws, nil)
+	assert(t, []any{msg.ID, msg.Type}, []any{"3", WSError})
+
+	ws.WriteJSON(WSRequest{ID: "4", Op: WSAmend, OrderID: resp.OrderID, Price: 95, Size: 1})
+	msg = readWS(t, ws, nil)
+	assert(t, []any{msg.ID, msg.Type}, []any{"4", WSResponse})
+	assert(t, ex.orderbooks[MarketETH].Bids()[0].Price, 95.0)
+	assert(t, ex.Orders[1][0].Size, 1.0)
+
+	ws.WriteJSON(WSRequest{ID: "5", Op: WSCancel, OrderID: resp.OrderID})
+	msg = readWS(t, ws, nil)
+	assert(t, []any{msg.ID, msg.Type}, []any{"5", WSResponse})
+	assert(t, len(ex.Orders[1]), 0)
+
+	ws.WriteJSON(WSRequest{ID: "6", Op: WSCancel, OrderID: resp.OrderID})
+	msg = readWS(t, ws, nil)
+	assert(t, []any{msg.ID, msg.Type, msg.Error}, []any{"6", WSError, ErrOrderNotFound.Error()})
+}
@@ -0,0 +1,503 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketUsers       = []byte("users")
+	bucketOrders      = []byte("orders")
+	bucketUserOrders  = []byte("userOrders")
+	bucketTrades      = []byte("trades")
+	bucketUserTrades  = []byte("userTrades")
+	bucketSettlements = []byte("settlements")
+	bucketCursors     = []byte("cursors")
+	bucketNonces      = []byte("nonces")
+	bucketAPIKeys     = []byte("apiKeys")
+	bucketBalances    = []byte("balances")
+	bucketDeposits    = []byte("deposits")
+	bucketWithdrawals = []byte("withdrawals")
+	bucketEscrowFills = []byte("escrowFills")
+)
+
+// Bolt is a Store in a bbolt database file. Records are JSON, keyed by
+// their big-endian ID, and trades are kept in a bucket per market. The
+// trades of every user are indexed in a bucket per user, which maps the
+// sequence number of a trade of the user to its TradeRef, and so are the
+// IDs of the orders of every user.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens the database at path, creating it if it does not exist.
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketUsers, bucketOrders, bucketUserOrders, bucketTrades, bucketUserTrades, bucketSettlements, bucketCursors, bucketNonces, bucketAPIKeys, bucketBalances, bucketDeposits, bucketWithdrawals, bucketEscrowFills} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Bolt{db: db}, nil
+}
+
+func (s *Bolt) Write(b *Batch) error {
+	if b.Empty() {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(bucketUsers)
+		for _, user := range b.Users {
+			if err := put(users, uint64(user.ID), user); err != nil {
+				return err
+			}
+		}
+
+		orders := tx.Bucket(bucketOrders)
+		for _, order := range b.Orders {
+			if err := put(orders, uint64(order.ID), order); err != nil {
+				return err
+			}
+
+			index, err := tx.Bucket(bucketUserOrders).CreateBucketIfNotExists(key(uint64(order.UserID)))
+			if err != nil {
+				return err
+			}
+			if err := index.Put(key(uint64(order.ID)), nil); err != nil {
+				return err
+			}
+		}
+
+		for _, trade := range b.Trades {
+			trades, err := tx.Bucket(bucketTrades).CreateBucketIfNotExists([]byte(trade.Market))
+			if err != nil {
+				return err
+			}
+			if trade.ID, err = trades.NextSequence(); err != nil {
+				return err
+			}
+			if err := put(trades, trade.ID, trade); err != nil {
+				return err
+			}
+
+			for _, userID := range tradeUsers(trade) {
+				index, err := tx.Bucket(bucketUserTrades).CreateBucketIfNotExists(key(uint64(userID)))
+				if err != nil {
+					return err
+				}
+				seq, err := index.NextSequence()
+				if err != nil {
+					return err
+				}
+				if err := put(index, seq, TradeRef{Market: trade.Market, ID: trade.ID}); err != nil {
+					return err
+				}
+			}
+		}
+
+		settlements := tx.Bucket(bucketSettlements)
+		for _, settlement := range b.Settlements {
+			if settlement.ID == 0 {
+				id, err := settlements.NextSequence()
+				if err != nil {
+					return err
+				}
+				settlement.ID = id
+			}
+			if err := put(settlements, settlement.ID, settlement); err != nil {
+				return err
+			}
+
+			if settlement.TxHash == "" {
+				continue
+			}
+			for _, ref := range settlement.Trades {
+				trades := tx.Bucket(bucketTrades).Bucket([]byte(ref.Market))
+				if trades == nil {
+					continue
+				}
+				var trade Trade
+				if err := get(trades, ref.ID, &trade); err != nil {
+					continue
+				}
+				addTx(&trade, settlement.TxHash)
+				if err := put(trades, ref.ID, &trade); err != nil {
+					return err
+				}
+			}
+		}
+
+		for name, pos := range b.Cursors {
+			if err := tx.Bucket(bucketCursors).Put([]byte(name), key(pos)); err != nil {
+				return err
+			}
+		}
+		for _, nonce := range b.Nonces {
+			if err := tx.Bucket(bucketNonces).Put([]byte(nonce.Address+"/"+nonce.Nonce), nil); err != nil {
+				return err
+			}
+		}
+		for _, apiKey := range b.APIKeys {
+			v, err := json.Marshal(apiKey)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketAPIKeys).Put([]byte(apiKey.Key), v); err != nil {
+				return err
+			}
+		}
+		for _, balance := range b.Balances {
+			v, err := json.Marshal(balance)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketBalances).Put(append(key(uint64(balance.UserID)), balance.Asset...), v); err != nil {
+				return err
+			}
+		}
+		deposits := tx.Bucket(bucketDeposits)
+		for _, deposit := range b.Deposits {
+			if deposit.ID == 0 {
+				id, err := deposits.NextSequence()
+				if err != nil {
+					return err
+				}
+				deposit.ID = id
+			}
+			if err := put(deposits, deposit.ID, deposit); err != nil {
+				return err
+			}
+		}
+		for _, withdrawal := range b.Withdrawals {
+			if err := put(tx.Bucket(bucketWithdrawals), uint64(withdrawal.ID), withdrawal); err != nil {
+				return err
+			}
+		}
+		fills := tx.Bucket(bucketEscrowFills)
+		for _, fill := range b.EscrowFills {
+			if fill.ID == 0 {
+				id, err := fills.NextSequence()
+				if err != nil {
+					return err
+				}
+				fill.ID = id
+			}
+			if err := put(fills, fill.ID, fill); err != nil {
+				return err
+			}
+		}
+		for _, id := range b.SettledFills {
+			if err := fills.Delete(key(id)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *Bolt) Users() ([]*User, error) {
+	var users []*User
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUsers).ForEach(func(k, v []byte) error {
+			var user User
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			users = append(users, &user)
+			return nil
+		})
+	})
+	return users, err
+}
+
+func (s *Bolt) Order(id int64) (*Order, error) {
+	var order Order
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return get(tx.Bucket(bucketOrders), uint64(id), &order)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func (s *Bolt) LastOrderID() (int64, error) {
+	var id int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket(bucketOrders).Cursor().Last(); k != nil {
+			id = int64(binary.BigEndian.Uint64(k))
+		}
+		return nil
+	})
+	return id, err
+}
+
+func (s *Bolt) UserOrders(q OrderQuery) ([]*Order, error) {
+	orders := []*Order{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(bucketUserOrders).Bucket(key(uint64(q.UserID)))
+		if index == nil {
+			return nil
+		}
+
+		c := index.Cursor()
+		for k, _ := c.Seek(key(uint64(q.AfterID) + 1)); k != nil && (q.Limit == 0 || len(orders) < q.Limit); k, _ = c.Next() {
+			var order Order
+			if err := get(tx.Bucket(bucketOrders), binary.BigEndian.Uint64(k), &order); err != nil {
+				return err
+			}
+			if q.match(&order) {
+				orders = append(orders, &order)
+			}
+		}
+		return nil
+	})
+	return orders, err
+}
+
+func (s *Bolt) Trades(market string, limit int) ([]*Trade, error) {
+	trades := []*Trade{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketTrades).Bucket([]byte(market))
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil && len(trades) < limit; k, v = c.Prev() {
+			var trade Trade
+			if err := json.Unmarshal(v, &trade); err != nil {
+				return err
+			}
+			trades = append(trades, &trade)
+		}
+		return nil
+	})
+
+	// The cursor walked from the last trade back.
+	for i, k := 0, len(trades)-1; i < k; i, k = i+1, k-1 {
+		trades[i], trades[k] = trades[k], trades[i]
+	}
+	return trades, err
+}
+
+func (s *Bolt) QueryTrades(q TradeQuery) ([]*Trade, error) {
+	trades := []*Trade{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketTrades).Bucket([]byte(q.Market))
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Seek(key(q.AfterID + 1)); k != nil && (q.Limit == 0 || len(trades) < q.Limit); k, v = c.Next() {
+			var trade Trade
+			if err := json.Unmarshal(v, &trade); err != nil {
+				return err
+			}
+
+			ok, more := match(&trade, q.From, q.To)
+			if !more {
+				break
+			}
+			if ok {
+				trades = append(trades, &trade)
+			}
+		}
+		return nil
+	})
+	return trades, err
+}
+
+func (s *Bolt) UserTrades(q UserTradeQuery) ([]*UserTrade, error) {
+	trades := []*UserTrade{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(bucketUserTrades).Bucket(key(uint64(q.UserID)))
+		if index == nil {
+			return nil
+		}
+
+		c := index.Cursor()
+		for k, v := c.Seek(key(q.AfterSeq + 1)); k != nil && (q.Limit == 0 || len(trades) < q.Limit); k, v = c.Next() {
+			var ref TradeRef
+			if err := json.Unmarshal(v, &ref); err != nil {
+				return err
+			}
+			if q.Market != "" && ref.Market != q.Market {
+				continue
+			}
+
+			var trade Trade
+			if err := get(tx.Bucket(bucketTrades).Bucket([]byte(ref.Market)), ref.ID, &trade); err != nil {
+				return err
+			}
+
+			ok, more := match(&trade, q.From, q.To)
+			if !more {
+				break
+			}
+			if ok {
+				trades = append(trades, &UserTrade{Seq: binary.BigEndian.Uint64(k), Trade: &trade})
+			}
+		}
+		return nil
+	})
+	return trades, err
+}
+
+func (s *Bolt) Settlement(id uint64) (*Settlement, error) {
+	var settlement Settlement
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return get(tx.Bucket(bucketSettlements), id, &settlement)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &settlement, nil
+}
+
+func (s *Bolt) Cursor(name string) (uint64, error) {
+	var pos uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketCursors).Get([]byte(name)); v != nil {
+			pos = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return pos, err
+}
+
+func (s *Bolt) Nonces() ([]*Nonce, error) {
+	var nonces []*Nonce
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketNonces).ForEach(func(k, _ []byte) error {
+			address, nonce, ok := strings.Cut(string(k), "/")
+			if !ok {
+				return fmt.Errorf("invalid nonce key %q", k)
+			}
+			nonces = append(nonces, &Nonce{Address: address, Nonce: nonce})
+			return nil
+		})
+	})
+	return nonces, err
+}
+
+func (s *Bolt) APIKeys() ([]*APIKey, error) {
+	var keys []*APIKey
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAPIKeys).ForEach(func(k, v []byte) error {
+			var apiKey APIKey
+			if err := json.Unmarshal(v, &apiKey); err != nil {
+				return err
+			}
+			keys = append(keys, &apiKey)
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (s *Bolt) Balances() ([]*Balance, error) {
+	var balances []*Balance
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBalances).ForEach(func(k, v []byte) error {
+			var balance Balance
+			if err := json.Unmarshal(v, &balance); err != nil {
+				return err
+			}
+			balances = append(balances, &balance)
+			return nil
+		})
+	})
+	return balances, err
+}
+
+func (s *Bolt) Deposits() ([]*Deposit, error) {
+	var deposits []*Deposit
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDeposits).ForEach(func(k, v []byte) error {
+			var deposit Deposit
+			if err := json.Unmarshal(v, &deposit); err != nil {
+				return err
+			}
+			deposits = append(deposits, &deposit)
+			return nil
+		})
+	})
+	return deposits, err
+}
+
+func (s *Bolt) Withdrawals() ([]*Withdrawal, error) {
+	var withdrawals []*Withdrawal
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketWithdrawals).ForEach(func(k, v []byte) error {
+			var withdrawal Withdrawal
+			if err := json.Unmarshal(v, &withdrawal); err != nil {
+				return err
+			}
+			withdrawals = append(withdrawals, &withdrawal)
+			return nil
+		})
+	})
+	return withdrawals, err
+}
+
+func (s *Bolt) EscrowFills() ([]*EscrowFill, error) {
+	var fills []*EscrowFill
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketEscrowFills).ForEach(func(k, v []byte) error {
+			var fill EscrowFill
+			if err := json.Unmarshal(v, &fill); err != nil {
+				return err
+			}
+			fills = append(fills, &fill)
+			return nil
+		})
+	})
+	return fills, err
+}
+
+func (s *Bolt) Close() error {
+	return s.db.Close()
+}
+
+func put(bucket *bolt.Bucket, id uint64, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key(id), b)
+}
+
+func get(bucket *bolt.Bucket, id uint64, v any) error {
+	b := bucket.Get(key(id))
+	if b == nil {
+		return fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+	return json.Unmarshal(b, v)
+}
+
+func key(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
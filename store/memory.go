@@ -0,0 +1,366 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Memory is a Store in memory, for tests and development. It keeps every
+// record until the process exits.
+type Memory struct {
+	mu             sync.RWMutex
+	users          map[int64]User
+	orders         map[int64]Order
+	userOrders     map[int64][]int64
+	trades         map[string][]Trade
+	userTrades     map[int64][]TradeRef
+	settlements    map[uint64]Settlement
+	lastSettlement uint64
+	cursors        map[string]uint64
+	nonces         map[Nonce]bool
+	apiKeys        map[string]APIKey
+	balances       map[balanceKey]Balance
+	deposits       map[uint64]Deposit
+	lastDeposit    uint64
+	withdrawals    map[int64]Withdrawal
+	escrowFills    map[uint64]EscrowFill
+	lastFill       uint64
+}
+
+type balanceKey struct {
+	userID int64
+	asset  string
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:       make(map[int64]User),
+		orders:      make(map[int64]Order),
+		userOrders:  make(map[int64][]int64),
+		trades:      make(map[string][]Trade),
+		userTrades:  make(map[int64][]TradeRef),
+		settlements: make(map[uint64]Settlement),
+		cursors:     make(map[string]uint64),
+		nonces:      make(map[Nonce]bool),
+		apiKeys:     make(map[string]APIKey),
+		balances:    make(map[balanceKey]Balance),
+		deposits:    make(map[uint64]Deposit),
+		withdrawals: make(map[int64]Withdrawal),
+		escrowFills: make(map[uint64]EscrowFill),
+	}
+}
+
+func (s *Memory) Write(b *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range b.Users {
+		s.users[user.ID] = *user
+	}
+	for _, order := range b.Orders {
+		if _, ok := s.orders[order.ID]; !ok {
+			// Orders are usually written by ID, but not always.
+			ids := s.userOrders[order.UserID]
+			i := sort.Search(len(ids), func(i int) bool { return ids[i] > order.ID })
+			s.userOrders[order.UserID] = append(ids[:i:i], append([]int64{order.ID}, ids[i:]...)...)
+		}
+		s.orders[order.ID] = *order
+	}
+	for _, trade := range b.Trades {
+		trade.ID = uint64(len(s.trades[trade.Market]) + 1)
+		s.trades[trade.Market] = append(s.trades[trade.Market], *trade)
+		for _, userID := range tradeUsers(trade) {
+			s.userTrades[userID] = append(s.userTrades[userID], TradeRef{Market: trade.Market, ID: trade.ID})
+		}
+	}
+	for _, settlement := range b.Settlements {
+		if settlement.ID == 0 {
+			s.lastSettlement++
+			settlement.ID = s.lastSettlement
+		}
+		s.settlements[settlement.ID] = *settlement
+
+		if settlement.TxHash == "" {
+			continue
+		}
+		for _, ref := range settlement.Trades {
+			if trade := s.trade(ref); trade != nil {
+				addTx(trade, settlement.TxHash)
+			}
+		}
+	}
+	for name, pos := range b.Cursors {
+		s.cursors[name] = pos
+	}
+	for _, nonce := range b.Nonces {
+		s.nonces[*nonce] = true
+	}
+	for _, apiKey := range b.APIKeys {
+		apiKey := *apiKey
+		apiKey.Scopes = append([]string(nil), apiKey.Scopes...)
+		s.apiKeys[apiKey.Key] = apiKey
+	}
+	for _, balance := range b.Balances {
+		s.balances[balanceKey{userID: balance.UserID, asset: balance.Asset}] = *balance
+	}
+	for _, deposit := range b.Deposits {
+		if deposit.ID == 0 {
+			s.lastDeposit++
+			deposit.ID = s.lastDeposit
+		}
+		s.deposits[deposit.ID] = *deposit
+	}
+	for _, withdrawal := range b.Withdrawals {
+		s.withdrawals[withdrawal.ID] = *withdrawal
+	}
+	for _, fill := range b.EscrowFills {
+		if fill.ID == 0 {
+			s.lastFill++
+			fill.ID = s.lastFill
+		}
+		s.escrowFills[fill.ID] = *fill
+	}
+	for _, id := range b.SettledFills {
+		delete(s.escrowFills, id)
+	}
+
+	return nil
+}
+
+func (s *Memory) Users() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]*User, 0, len(s.users))
+	for _, user := range s.users {
+		user := user
+		users = append(users, &user)
+	}
+	sort.Slice(users, func(i, k int) bool { return users[i].ID < users[k].ID })
+	return users, nil
+}
+
+func (s *Memory) Order(id int64) (*Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	order, ok := s.orders[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+	return &order, nil
+}
+
+func (s *Memory) LastOrderID() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var last int64
+	for id := range s.orders {
+		if id > last {
+			last = id
+		}
+	}
+	return last, nil
+}
+
+func (s *Memory) UserOrders(q OrderQuery) ([]*Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := []*Order{}
+	ids := s.userOrders[q.UserID]
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] > q.AfterID })
+	for ; i < len(ids) && (q.Limit == 0 || len(orders) < q.Limit); i++ {
+		order := s.orders[ids[i]]
+		if q.match(&order) {
+			orders = append(orders, &order)
+		}
+	}
+	return orders, nil
+}
+
+func (s *Memory) Trades(market string, limit int) ([]*Trade, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := s.trades[market]
+	if limit > len(all) {
+		limit = len(all)
+	}
+
+	trades := make([]*Trade, 0, limit)
+	for i := len(all) - limit; i < len(all); i++ {
+		trades = append(trades, copyTrade(&all[i]))
+	}
+	return trades, nil
+}
+
+func (s *Memory) QueryTrades(q TradeQuery) ([]*Trade, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	trades := []*Trade{}
+	all := s.trades[q.Market]
+	for i := q.AfterID; i < uint64(len(all)) && (q.Limit == 0 || len(trades) < q.Limit); i++ {
+		ok, more := match(&all[i], q.From, q.To)
+		if !more {
+			break
+		}
+		if ok {
+			trades = append(trades, copyTrade(&all[i]))
+		}
+	}
+	return trades, nil
+}
+
+func (s *Memory) UserTrades(q UserTradeQuery) ([]*UserTrade, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	trades := []*UserTrade{}
+	refs := s.userTrades[q.UserID]
+	for i := q.AfterSeq; i < uint64(len(refs)) && (q.Limit == 0 || len(trades) < q.Limit); i++ {
+		if q.Market != "" && refs[i].Market != q.Market {
+			continue
+		}
+
+		trade := s.trade(refs[i])
+		ok, more := match(trade, q.From, q.To)
+		if !more {
+			break
+		}
+		if ok {
+			trades = append(trades, &UserTrade{Seq: i + 1, Trade: copyTrade(trade)})
+		}
+	}
+	return trades, nil
+}
+
+// trade returns the stored trade of a reference. It must be called with
+// the lock held.
+func (s *Memory) trade(ref TradeRef) *Trade {
+	trades := s.trades[ref.Market]
+	if ref.ID == 0 || ref.ID > uint64(len(trades)) {
+		return nil
+	}
+	return &trades[ref.ID-1]
+}
+
+func copyTrade(trade *Trade) *Trade {
+	t := *trade
+	t.SettlementTxs = append([]string(nil), trade.SettlementTxs...)
+	return &t
+}
+
+func (s *Memory) Settlement(id uint64) (*Settlement, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	settlement, ok := s.settlements[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+	return &settlement, nil
+}
+
+func (s *Memory) Cursor(name string) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.cursors[name], nil
+}
+
+func (s *Memory) Nonces() ([]*Nonce, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nonces := make([]*Nonce, 0, len(s.nonces))
+	for nonce := range s.nonces {
+		nonce := nonce
+		nonces = append(nonces, &nonce)
+	}
+	sort.Slice(nonces, func(i, k int) bool {
+		if nonces[i].Address != nonces[k].Address {
+			return nonces[i].Address < nonces[k].Address
+		}
+		return nonces[i].Nonce < nonces[k].Nonce
+	})
+	return nonces, nil
+}
+
+func (s *Memory) APIKeys() ([]*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]*APIKey, 0, len(s.apiKeys))
+	for _, apiKey := range s.apiKeys {
+		apiKey := apiKey
+		apiKey.Scopes = append([]string(nil), apiKey.Scopes...)
+		keys = append(keys, &apiKey)
+	}
+	sort.Slice(keys, func(i, k int) bool { return keys[i].Key < keys[k].Key })
+	return keys, nil
+}
+
+func (s *Memory) Balances() ([]*Balance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	balances := make([]*Balance, 0, len(s.balances))
+	for _, balance := range s.balances {
+		balance := balance
+		balances = append(balances, &balance)
+	}
+	sort.Slice(balances, func(i, k int) bool {
+		if balances[i].UserID != balances[k].UserID {
+			return balances[i].UserID < balances[k].UserID
+		}
+		return balances[i].Asset < balances[k].Asset
+	})
+	return balances, nil
+}
+
+func (s *Memory) Deposits() ([]*Deposit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deposits := make([]*Deposit, 0, len(s.deposits))
+	for _, deposit := range s.deposits {
+		deposit := deposit
+		deposits = append(deposits, &deposit)
+	}
+	sort.Slice(deposits, func(i, k int) bool { return deposits[i].ID < deposits[k].ID })
+	return deposits, nil
+}
+
+func (s *Memory) Withdrawals() ([]*Withdrawal, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	withdrawals := make([]*Withdrawal, 0, len(s.withdrawals))
+	for _, withdrawal := range s.withdrawals {
+		withdrawal := withdrawal
+		withdrawals = append(withdrawals, &withdrawal)
+	}
+	sort.Slice(withdrawals, func(i, k int) bool { return withdrawals[i].ID < withdrawals[k].ID })
+	return withdrawals, nil
+}
+
+func (s *Memory) EscrowFills() ([]*EscrowFill, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fills := make([]*EscrowFill, 0, len(s.escrowFills))
+	for _, fill := range s.escrowFills {
+		fill := fill
+		fills = append(fills, &fill)
+	}
+	sort.Slice(fills, func(i, k int) bool { return fills[i].ID < fills[k].ID })
+	return fills, nil
+}
+
+func (s *Memory) Close() error {
+	return nil
+}
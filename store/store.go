@@ -0,0 +1,343 @@
+// Package store keeps the history of the exchange: its users, every order
+// with its final status, trades and settlements. Open orders and the books
+// live in memory and in the journal; the store holds what the exchange no
+// longer needs to match, so memory stays bounded while the history
+// survives restarts.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+const (
+	// SettlementSent is the status of a settlement transaction that was
+	// sent and is not mined yet.
+	SettlementSent SettlementStatus = "SENT"
+	// SettlementConfirmed and SettlementReverted are the statuses of a
+	// mined settlement transaction.
+	SettlementConfirmed SettlementStatus = "CONFIRMED"
+	SettlementReverted  SettlementStatus = "REVERTED"
+	// SettlementFailed is the status of a settlement that could not be
+	// sent.
+	SettlementFailed SettlementStatus = "FAILED"
+)
+
+type SettlementStatus string
+
+var ErrNotFound = errors.New("not found")
+
+// Store is a durable store of the records of the exchange. It is safe for
+// concurrent use.
+type Store interface {
+	// Write stores the records of a batch in one transaction, replacing
+	// the records with the same ID. Trades get the next ID of their
+	// market, and settlements, deposits and escrow fills without an ID
+	// the next ID of their kind. SettledFills are deleted last.
+	Write(b *Batch) error
+	// Users returns every user, ordered by ID.
+	Users() ([]*User, error)
+	// Order returns the order with the ID, or ErrNotFound.
+	Order(id int64) (*Order, error)
+	// LastOrderID is the largest ID of the stored orders.
+	LastOrderID() (int64, error)
+	// UserOrders returns a page of the orders of a user, by ID.
+	UserOrders(q OrderQuery) ([]*Order, error)
+	// Trades returns at most limit of the last trades of a market, oldest
+	// first.
+	Trades(market string, limit int) ([]*Trade, error)
+	// QueryTrades returns a page of the trades of a market, oldest first.
+	QueryTrades(q TradeQuery) ([]*Trade, error)
+	// UserTrades returns a page of the trades of a user, in the order they
+	// happened.
+	UserTrades(q UserTradeQuery) ([]*UserTrade, error)
+	// Settlement returns the settlement with the ID, or ErrNotFound.
+	Settlement(id uint64) (*Settlement, error)
+	// Cursor returns the position saved under name, or zero.
+	Cursor(name string) (uint64, error)
+	// Nonces returns the used nonces of signed orders.
+	Nonces() ([]*Nonce, error)
+	// APIKeys returns every API key, revoked or not, ordered by key.
+	APIKeys() ([]*APIKey, error)
+	// Balances returns the ledger balances, ordered by user and asset.
+	Balances() ([]*Balance, error)
+	// Deposits returns the credited deposits, ordered by ID.
+	Deposits() ([]*Deposit, error)
+	// Withdrawals returns every withdrawal, ordered by ID.
+	Withdrawals() ([]*Withdrawal, error)
+	// EscrowFills returns the escrow fills not settled yet, ordered by ID.
+	EscrowFills() ([]*EscrowFill, error)
+	Close() error
+}
+
+// Batch is a set of records written together.
+type Batch struct {
+	Users       []*User
+	Orders      []*Order
+	Trades      []*Trade
+	Settlements []*Settlement
+	// Cursors are positions saved by name, like the next block to scan
+	// for deposits.
+	Cursors     map[string]uint64
+	Nonces      []*Nonce
+	APIKeys     []*APIKey
+	Balances    []*Balance
+	Deposits    []*Deposit
+	Withdrawals []*Withdrawal
+	EscrowFills []*EscrowFill
+	// SettledFills are the IDs of the escrow fills to delete, once they
+	// are settled or dropped.
+	SettledFills []uint64
+}
+
+func (b *Batch) Empty() bool {
+	return len(b.Users) == 0 && len(b.Orders) == 0 && len(b.Trades) == 0 && len(b.Settlements) == 0 && len(b.Cursors) == 0 && len(b.Nonces) == 0 &&
+		len(b.APIKeys) == 0 && len(b.Balances) == 0 && len(b.Deposits) == 0 && len(b.Withdrawals) == 0 &&
+		len(b.EscrowFills) == 0 && len(b.SettledFills) == 0
+}
+
+// Nonce is a nonce an address signed an order with, which can not be used
+// again.
+type Nonce struct {
+	Address string
+	Nonce   string
+}
+
+// User is a registered user. EncryptedKey is the hex encoded key of users
+// whose transfers the exchange signs, encrypted by the exchange, and empty
+// for users who keep custody of their key. PrivateKey is the plain key of
+// records written before keys were encrypted, and is only read.
+type User struct {
+	ID             int64
+	Address        string
+	DepositAddress string
+	EncryptedKey   string `json:",omitempty"`
+	PrivateKey     string `json:",omitempty"`
+}
+
+// APIKey is an API key of a user. EncryptedSecret is the hex encoded
+// secret of the key, encrypted by the exchange. Revoked keys are kept with
+// the time they were revoked, in Unix nanoseconds.
+type APIKey struct {
+	Key             string
+	UserID          int64
+	EncryptedSecret string
+	Scopes          []string
+	CreatedAt       int64
+	RevokedAt       int64 `json:",omitempty"`
+}
+
+// Balance is the ledger balance of a user in an asset, in base units. It
+// is negative while the user owes fees.
+type Balance struct {
+	UserID int64
+	Asset  string
+	Value  string
+}
+
+// Deposit is a deposit credited to a user. Value is in base units of the
+// asset, and SweepTx the hash of the transaction that moved it from the
+// deposit Address to the exchange, once it was swept.
+type Deposit struct {
+	ID          uint64
+	UserID      int64
+	Asset       string
+	Value       string
+	Address     string
+	TxHash      string
+	LogIndex    uint
+	BlockNumber uint64
+	BlockHash   string
+	SweepTx     string `json:",omitempty"`
+	Timestamp   int64
+}
+
+// Withdrawal is a withdrawal of a user and its status. Value is the amount
+// in base units of the asset, and Nonce the nonce of the transaction once
+// it was sent. Times are in Unix nanoseconds.
+type Withdrawal struct {
+	ID        int64
+	UserID    int64
+	Asset     string
+	Amount    float64
+	Value     string
+	To        string
+	Status    string
+	TxHash    string `json:",omitempty"`
+	Nonce     uint64 `json:",omitempty"`
+	Reason    string `json:",omitempty"`
+	CreatedAt int64
+	UpdatedAt int64
+}
+
+// EscrowFill is a fill of two signed orders that is not settled on the
+// escrow contract yet. Maker and Taker are the signed orders and Size is in
+// base units. SettlementID and Nonce are the settlement sending the fill
+// and the nonce of its transaction, once it was sent.
+type EscrowFill struct {
+	ID           uint64
+	Maker        json.RawMessage
+	Taker        json.RawMessage
+	Size         string
+	Trade        TradeRef
+	SettlementID uint64 `json:",omitempty"`
+	Nonce        uint64 `json:",omitempty"`
+}
+
+// Order is an order and what became of it. Size is the size of the order
+// including what was filled, OriginalSize the size it was placed with, and
+// Price the limit price, zero for market orders. AvgPrice is the average
+// price of the fills. Times are in Unix nanoseconds.
+type Order struct {
+	ID            int64
+	UserID        int64
+	Market        string
+	Type          string
+	Bid           bool
+	Price         float64
+	ClientOrderID string `json:",omitempty"`
+	OriginalSize  float64
+	Size          float64
+	Filled        float64
+	AvgPrice      float64
+	Status        string
+	CreatedAt     int64
+	UpdatedAt     int64
+}
+
+// OrderQuery selects the orders of a user with an ID above AfterID, in a
+// market and with one of the statuses when they are not empty. At most
+// Limit orders are returned, all when it is zero.
+type OrderQuery struct {
+	UserID   int64
+	Market   string
+	Statuses []string
+	AfterID  int64
+	Limit    int
+}
+
+// match reports whether an order is selected by the query, other than by
+// its user and ID.
+func (q *OrderQuery) match(order *Order) bool {
+	if q.Market != "" && order.Market != q.Market {
+		return false
+	}
+	if len(q.Statuses) == 0 {
+		return true
+	}
+	for _, status := range q.Statuses {
+		if order.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Trade is a match between a taker and a maker order. Bid is the side of
+// the taker. IDs count up from 1 per market. MakerFee and TakerFee are in
+// FeeAsset, and SettlementTxs are the hashes of the transactions that
+// settled the trade.
+type Trade struct {
+	ID            uint64
+	Market        string
+	Price         float64
+	Size          float64
+	Bid           bool
+	TakerOrderID  int64
+	TakerUserID   int64
+	MakerOrderID  int64
+	MakerUserID   int64
+	MakerFee      float64  `json:",omitempty"`
+	TakerFee      float64  `json:",omitempty"`
+	FeeAsset      string   `json:",omitempty"`
+	SettlementTxs []string `json:",omitempty"`
+	Timestamp     int64
+}
+
+// TradeRef identifies a trade.
+type TradeRef struct {
+	Market string
+	ID     uint64
+}
+
+// TradeQuery selects the trades of a market with an ID above AfterID, and
+// a time from From up to To, when they are not zero. At most Limit trades
+// are returned, all when it is zero. Trades are in time order, so the
+// query stops at the first trade at or after To.
+type TradeQuery struct {
+	Market  string
+	AfterID uint64
+	From    int64
+	To      int64
+	Limit   int
+}
+
+// UserTradeQuery selects the trades of a user like TradeQuery, with Seq
+// above AfterSeq, of any market when Market is empty.
+type UserTradeQuery struct {
+	UserID   int64
+	Market   string
+	AfterSeq uint64
+	From     int64
+	To       int64
+	Limit    int
+}
+
+// UserTrade is a trade of a user, who is its maker, its taker or both.
+// Seq counts the trades of the user up from 1.
+type UserTrade struct {
+	Seq   uint64
+	Trade *Trade
+}
+
+// match reports whether a trade is in the time range of a query, and
+// whether the trades after it can be.
+func match(trade *Trade, from, to int64) (ok, more bool) {
+	if to != 0 && trade.Timestamp >= to {
+		return false, false
+	}
+	return trade.Timestamp >= from, true
+}
+
+// addTx adds the hash of a settlement transaction to a trade.
+func addTx(trade *Trade, hash string) {
+	for _, tx := range trade.SettlementTxs {
+		if tx == hash {
+			return
+		}
+	}
+	trade.SettlementTxs = append(trade.SettlementTxs[:len(trade.SettlementTxs):len(trade.SettlementTxs)], hash)
+}
+
+// tradeUsers returns the users of a trade, once for a user trading with
+// himself.
+func tradeUsers(trade *Trade) []int64 {
+	if trade.MakerUserID == trade.TakerUserID {
+		return []int64{trade.TakerUserID}
+	}
+	return []int64{trade.TakerUserID, trade.MakerUserID}
+}
+
+// Settlement is a transaction moving the funds of trades: a transfer
+// between two users in direct settlement, or a batch of fills settled on
+// the escrow contract. Writing a settlement with a TxHash adds the hash to
+// the SettlementTxs of its Trades.
+type Settlement struct {
+	ID     uint64
+	Mode   string
+	Market string     `json:",omitempty"`
+	Asset  string     `json:",omitempty"`
+	Trades []TradeRef `json:",omitempty"`
+	// FromUserID, ToUserID and Amount are the parties and amount of a
+	// transfer.
+	FromUserID int64   `json:",omitempty"`
+	ToUserID   int64   `json:",omitempty"`
+	Amount     float64 `json:",omitempty"`
+	// Fills is the number of fills of an escrow batch.
+	Fills     int `json:",omitempty"`
+	TxHash    string
+	Status    SettlementStatus
+	Error     string `json:",omitempty"`
+	CreatedAt int64
+	UpdatedAt int64
+}
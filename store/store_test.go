@@ -0,0 +1,253 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func testStore(t *testing.T, s Store) {
+	users, err := s.Users()
+	assert(t, err, nil)
+	assert(t, len(users), 0)
+	_, err = s.Order(1)
+	assert(t, errors.Is(err, ErrNotFound), true)
+
+	order := &Order{ID: 7, UserID: 1, Market: "ETH", Type: "LIMIT", Bid: true, Price: 100, Size: 2, Status: "ACCEPTED"}
+	settlement := &Settlement{Mode: "DIRECT", Asset: "ETH", FromUserID: 2, ToUserID: 1, Amount: 1, Status: SettlementSent}
+	err = s.Write(&Batch{
+		Users: []*User{
+			{ID: 2, Address: "0x02"},
+			{ID: 1, Address: "0x01", EncryptedKey: "aa"},
+		},
+		Orders: []*Order{order, {ID: 3, UserID: 2, Market: "ETH", Type: "MARKET", Size: 1, Filled: 1, Status: "FILLED"}},
+		Trades: []*Trade{
+			{Market: "ETH", Price: 100, Size: 1, TakerOrderID: 3, TakerUserID: 2, MakerOrderID: 7, MakerUserID: 1, Timestamp: 10},
+			{Market: "BTC", Price: 10, Size: 1, TakerUserID: 1, MakerUserID: 1, Timestamp: 11},
+		},
+		Settlements: []*Settlement{settlement},
+	})
+	assert(t, err, nil)
+	assert(t, settlement.ID, uint64(1))
+
+	// Orders are replaced by later writes.
+	order.Filled = 1
+	order.Status = "PARTIALLY_FILLED"
+	assert(t, s.Write(&Batch{
+		Orders: []*Order{order},
+		Trades: []*Trade{
+			{Market: "ETH", Price: 101, Size: 0.5, TakerUserID: 2, MakerUserID: 3, Timestamp: 20},
+			{Market: "ETH", Price: 102, Size: 0.5, TakerUserID: 3, MakerUserID: 2, Timestamp: 30},
+		},
+	}), nil)
+
+	users, err = s.Users()
+	assert(t, err, nil)
+	assert(t, users, []*User{{ID: 1, Address: "0x01", EncryptedKey: "aa"}, {ID: 2, Address: "0x02"}})
+
+	got, err := s.Order(7)
+	assert(t, err, nil)
+	assert(t, got, order)
+	last, err := s.LastOrderID()
+	assert(t, err, nil)
+	assert(t, last, int64(7))
+
+	// Orders of a user, by ID.
+	assert(t, s.Write(&Batch{Orders: []*Order{{ID: 5, UserID: 1, Market: "BTC", Status: "CANCELLED"}}}), nil)
+	orders, err := s.UserOrders(OrderQuery{UserID: 1})
+	assert(t, err, nil)
+	assert(t, len(orders), 2)
+	assert(t, orders[0].ID, int64(5))
+	assert(t, orders[1], order)
+	orders, err = s.UserOrders(OrderQuery{UserID: 1, Statuses: []string{"PARTIALLY_FILLED", "FILLED"}})
+	assert(t, err, nil)
+	assert(t, orders, []*Order{order})
+	orders, err = s.UserOrders(OrderQuery{UserID: 1, AfterID: 5, Market: "BTC"})
+	assert(t, err, nil)
+	assert(t, len(orders), 0)
+	orders, err = s.UserOrders(OrderQuery{UserID: 2, Limit: 1})
+	assert(t, err, nil)
+	assert(t, len(orders), 1)
+	assert(t, orders[0].ID, int64(3))
+
+	trades, err := s.Trades("ETH", 2)
+	assert(t, err, nil)
+	assert(t, trades, []*Trade{
+		{ID: 2, Market: "ETH", Price: 101, Size: 0.5, TakerUserID: 2, MakerUserID: 3, Timestamp: 20},
+		{ID: 3, Market: "ETH", Price: 102, Size: 0.5, TakerUserID: 3, MakerUserID: 2, Timestamp: 30},
+	})
+	trades, err = s.Trades("BTC", 10)
+	assert(t, err, nil)
+	assert(t, len(trades), 1)
+	trades, err = s.Trades("XRP", 10)
+	assert(t, err, nil)
+	assert(t, len(trades), 0)
+
+	settlement.Status = SettlementConfirmed
+	assert(t, s.Write(&Batch{Settlements: []*Settlement{settlement}}), nil)
+	gotSettlement, err := s.Settlement(1)
+	assert(t, err, nil)
+	assert(t, gotSettlement, settlement)
+
+	// Pages of trades, by cursor and time.
+	trades, err = s.QueryTrades(TradeQuery{Market: "ETH", Limit: 2})
+	assert(t, err, nil)
+	assert(t, tradeIDs(trades), []uint64{1, 2})
+	trades, err = s.QueryTrades(TradeQuery{Market: "ETH", AfterID: 2, Limit: 2})
+	assert(t, err, nil)
+	assert(t, tradeIDs(trades), []uint64{3})
+	trades, err = s.QueryTrades(TradeQuery{Market: "ETH", From: 11, To: 30})
+	assert(t, err, nil)
+	assert(t, tradeIDs(trades), []uint64{2})
+
+	userTrades, err := s.UserTrades(UserTradeQuery{UserID: 1})
+	assert(t, err, nil)
+	assert(t, len(userTrades), 2)
+	assert(t, userTrades[1].Seq, uint64(2))
+	assert(t, userTrades[1].Trade.Market, "BTC")
+	userTrades, err = s.UserTrades(UserTradeQuery{UserID: 2, Market: "ETH", AfterSeq: 1, Limit: 1})
+	assert(t, err, nil)
+	assert(t, len(userTrades), 1)
+	assert(t, userTrades[0].Seq, uint64(2))
+	assert(t, userTrades[0].Trade.ID, uint64(2))
+
+	// Settlements add their transaction to their trades.
+	assert(t, s.Write(&Batch{Settlements: []*Settlement{{Mode: "ESCROW", TxHash: "0xaa", Trades: []TradeRef{{Market: "ETH", ID: 1}, {Market: "BTC", ID: 1}}}}}), nil)
+	assert(t, s.Write(&Batch{Settlements: []*Settlement{{Mode: "ESCROW", TxHash: "0xbb", Trades: []TradeRef{{Market: "ETH", ID: 1}}}}}), nil)
+	trades, err = s.QueryTrades(TradeQuery{Market: "ETH", Limit: 1})
+	assert(t, err, nil)
+	assert(t, trades[0].SettlementTxs, []string{"0xaa", "0xbb"})
+	userTrades, err = s.UserTrades(UserTradeQuery{UserID: 1, Market: "BTC"})
+	assert(t, err, nil)
+	assert(t, userTrades[0].Trade.SettlementTxs, []string{"0xaa"})
+
+	pos, err := s.Cursor("deposits")
+	assert(t, err, nil)
+	assert(t, pos, uint64(0))
+	assert(t, s.Write(&Batch{Cursors: map[string]uint64{"deposits": 42}}), nil)
+	pos, err = s.Cursor("deposits")
+	assert(t, err, nil)
+	assert(t, pos, uint64(42))
+
+	assert(t, s.Write(&Batch{Nonces: []*Nonce{{Address: "0x01", Nonce: "7"}, {Address: "0x01", Nonce: "8"}}}), nil)
+	assert(t, s.Write(&Batch{Nonces: []*Nonce{{Address: "0x01", Nonce: "7"}}}), nil)
+	nonces, err := s.Nonces()
+	assert(t, err, nil)
+	assert(t, nonces, []*Nonce{{Address: "0x01", Nonce: "7"}, {Address: "0x01", Nonce: "8"}})
+
+	apiKey := &APIKey{Key: "bb", UserID: 1, EncryptedSecret: "cc", Scopes: []string{"READ"}, CreatedAt: 5}
+	assert(t, s.Write(&Batch{APIKeys: []*APIKey{apiKey, {Key: "aa", UserID: 2, EncryptedSecret: "dd", Scopes: []string{"READ", "TRADE"}, CreatedAt: 6}}}), nil)
+	apiKey.RevokedAt = 7
+	assert(t, s.Write(&Batch{APIKeys: []*APIKey{apiKey}}), nil)
+	apiKeys, err := s.APIKeys()
+	assert(t, err, nil)
+	assert(t, len(apiKeys), 2)
+	assert(t, apiKeys[0].Key, "aa")
+	assert(t, apiKeys[1], apiKey)
+
+	deposit := &Deposit{UserID: 1, Asset: "ETH", Value: "1000", Address: "0xde", TxHash: "0xaa", BlockNumber: 3, Timestamp: 8}
+	assert(t, s.Write(&Batch{
+		Balances: []*Balance{{UserID: 2, Asset: "ETH", Value: "5"}, {UserID: 1, Asset: "USDC", Value: "-1"}, {UserID: 1, Asset: "ETH", Value: "1000"}},
+		Deposits: []*Deposit{deposit},
+	}), nil)
+	assert(t, deposit.ID, uint64(1))
+	deposit.SweepTx = "0xbb"
+	assert(t, s.Write(&Batch{
+		Balances: []*Balance{{UserID: 2, Asset: "ETH", Value: "0"}},
+		Deposits: []*Deposit{deposit, {UserID: 2, Asset: "ETH", Value: "7", TxHash: "0xcc"}},
+	}), nil)
+	balances, err := s.Balances()
+	assert(t, err, nil)
+	assert(t, balances, []*Balance{{UserID: 1, Asset: "ETH", Value: "1000"}, {UserID: 1, Asset: "USDC", Value: "-1"}, {UserID: 2, Asset: "ETH", Value: "0"}})
+	deposits, err := s.Deposits()
+	assert(t, err, nil)
+	assert(t, len(deposits), 2)
+	assert(t, deposits[0], deposit)
+	assert(t, deposits[1].ID, uint64(2))
+
+	withdrawal := &Withdrawal{ID: 2, UserID: 1, Asset: "ETH", Amount: 0.5, Value: "500", To: "0xee", Status: "QUEUED", CreatedAt: 9, UpdatedAt: 9}
+	assert(t, s.Write(&Batch{Withdrawals: []*Withdrawal{withdrawal, {ID: 1, UserID: 2, Asset: "ETH", Value: "1", Status: "CONFIRMED"}}}), nil)
+	withdrawal.Status, withdrawal.TxHash, withdrawal.Nonce = "SENT", "0xdd", 3
+	assert(t, s.Write(&Batch{Withdrawals: []*Withdrawal{withdrawal}}), nil)
+	withdrawals, err := s.Withdrawals()
+	assert(t, err, nil)
+	assert(t, len(withdrawals), 2)
+	assert(t, withdrawals[0].ID, int64(1))
+	assert(t, withdrawals[1], withdrawal)
+
+	fill := &EscrowFill{Maker: json.RawMessage(`{"Nonce":1}`), Taker: json.RawMessage(`{"Nonce":2}`), Size: "5", Trade: TradeRef{Market: "ETH", ID: 1}}
+	assert(t, s.Write(&Batch{EscrowFills: []*EscrowFill{fill, {Maker: json.RawMessage(`{}`), Taker: json.RawMessage(`{}`), Size: "1"}}}), nil)
+	assert(t, fill.ID, uint64(1))
+	fill.SettlementID, fill.Nonce = 4, 9
+	assert(t, s.Write(&Batch{EscrowFills: []*EscrowFill{fill}, SettledFills: []uint64{2}}), nil)
+	fills, err := s.EscrowFills()
+	assert(t, err, nil)
+	assert(t, fills, []*EscrowFill{fill})
+}
+
+func tradeIDs(trades []*Trade) []uint64 {
+	ids := []uint64{}
+	for _, trade := range trades {
+		ids = append(ids, trade.ID)
+	}
+	return ids
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestBolt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exchange.db")
+	s, err := OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+	assert(t, s.Close(), nil)
+
+	// The records survive reopening the database.
+	s, err = OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	order, err := s.Order(7)
+	assert(t, err, nil)
+	assert(t, order.Status, "PARTIALLY_FILLED")
+	trades, err := s.Trades("ETH", 10)
+	assert(t, err, nil)
+	assert(t, len(trades), 3)
+	pos, err := s.Cursor("deposits")
+	assert(t, err, nil)
+	assert(t, pos, uint64(42))
+	nonces, err := s.Nonces()
+	assert(t, err, nil)
+	assert(t, len(nonces), 2)
+	apiKeys, err := s.APIKeys()
+	assert(t, err, nil)
+	assert(t, len(apiKeys), 2)
+	balances, err := s.Balances()
+	assert(t, err, nil)
+	assert(t, len(balances), 3)
+	deposits, err := s.Deposits()
+	assert(t, err, nil)
+	assert(t, len(deposits), 2)
+	withdrawals, err := s.Withdrawals()
+	assert(t, err, nil)
+	assert(t, len(withdrawals), 2)
+	fills, err := s.EscrowFills()
+	assert(t, err, nil)
+	assert(t, len(fills), 1)
+}